@@ -0,0 +1,61 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"crypto/tls"
+	"strings"
+)
+
+// ConfigureTLS prepares config to advertise the enabled SPDY
+// versions, followed by any other non-HTTP protocols already
+// present, and finally HTTP/1.1. The same list is used for both
+// ALPN and NPN, so servers and clients using either extension
+// will negotiate SPDY where possible.
+func ConfigureTLS(config *tls.Config) {
+	if config == nil {
+		return
+	}
+
+	npnStrings := npn()
+	if config.NextProtos == nil {
+		config.NextProtos = npnStrings
+		return
+	}
+
+	// Collect compatible alternative protocols.
+	others := make([]string, 0, len(config.NextProtos))
+	for _, other := range config.NextProtos {
+		if !strings.Contains(other, "spdy/") && !strings.Contains(other, "http/") {
+			others = append(others, other)
+		}
+	}
+
+	// Start with spdy.
+	protos := make([]string, 0, len(others)+len(npnStrings))
+	protos = append(protos, npnStrings[:len(npnStrings)-1]...)
+
+	// Add the others.
+	protos = append(protos, others...)
+	config.NextProtos = append(protos, "http/1.1")
+}
+
+// negotiatedProtocol returns the application protocol agreed
+// in the TLS handshake, or the empty string if none was agreed.
+//
+// ALPN is preferred, since the server makes the final choice
+// and the result is always mutual. If the peer only supports
+// NPN, the result is used only if the protocol was chosen from
+// the list advertised by the server, rather than the client's
+// fallback when there was no overlap.
+func negotiatedProtocol(state *tls.ConnectionState) string {
+	if state == nil || state.NegotiatedProtocol == "" {
+		return ""
+	}
+	if !state.NegotiatedProtocolIsMutual {
+		return ""
+	}
+	return state.NegotiatedProtocol
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package attach_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/attach"
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+func TestGroup(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := stream.Client(c)
+	server := stream.Server(s)
+	defer client.Close()
+
+	// Upper-case stdin to stdout, then exit with an error.
+	go func() {
+		listener := attach.NewListener(server)
+		g, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		in, err := ioutil.ReadAll(g.Channel(attach.Stdin))
+		if err != nil {
+			g.Exit(err)
+			return
+		}
+		g.Channel(attach.Stdout).Write(bytes.ToUpper(in))
+		io.WriteString(g.Channel(attach.Stderr), g.Header().Get("Command"))
+		g.Exit(errors.New("exit status 1"))
+	}()
+
+	header := http.Header{"Command": {"upper"}}
+	g, err := attach.Open(client, header, attach.Stdin, attach.Stdout, attach.Stderr, attach.Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	io.WriteString(g.Channel(attach.Stdin), "hello")
+	g.Channel(attach.Stdin).CloseWrite()
+
+	out, err := ioutil.ReadAll(g.Channel(attach.Stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "HELLO" {
+		t.Errorf("Expected stdout %q, got %q", "HELLO", out)
+	}
+	out, err = ioutil.ReadAll(g.Channel(attach.Stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "upper" {
+		t.Errorf("Expected stderr %q, got %q", "upper", out)
+	}
+
+	err = g.Wait()
+	if rerr, ok := err.(*attach.RemoteError); !ok || rerr.Message != "exit status 1" {
+		t.Errorf("Expected remote error %q, got %v", "exit status 1", err)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package attach groups related streams of a stream.Session into a
+// single channel, such as the standard input, output, error and exit
+// status of a remote command, so that remote execution and attach tools
+// can be built on this package.
+//
+// Each stream in a group carries the group's ID, its own channel name,
+// and the names of all the group's channels in its metadata, so the
+// server side can wait for the whole group to arrive. The Stdout, Stderr
+// and Error channels carry data only from the server, and Stdin only
+// from the client. Other channels carry data in both directions.
+//
+// A simple example is:
+//
+//	// Server.
+//	l := attach.NewListener(stream.Server(conn))
+//	for {
+//		g, err := l.Accept()
+//		if err != nil {
+//			break
+//		}
+//		go func() {
+//			cmd := exec.Command(g.Header().Get("Command"))
+//			cmd.Stdout, cmd.Stderr = g.Channel(attach.Stdout), g.Channel(attach.Stderr)
+//			g.Exit(cmd.Run())
+//		}()
+//	}
+//
+//	// Client.
+//	header := http.Header{"Command": {"date"}}
+//	g, err := attach.Open(stream.Client(conn), header, attach.Stdout, attach.Stderr, attach.Error)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer g.Close()
+//	go io.Copy(os.Stderr, g.Channel(attach.Stderr))
+//	io.Copy(os.Stdout, g.Channel(attach.Stdout))
+//	if err := g.Wait(); err != nil {
+//		log.Fatal(err)
+//	}
+package attach
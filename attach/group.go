@@ -0,0 +1,169 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package attach
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+// The stream metadata used to group streams.
+const (
+	GroupHeader    = "Attach-Group"    // ID shared by the streams in a group.
+	ChannelHeader  = "Attach-Channel"  // name of the stream's channel.
+	ChannelsHeader = "Attach-Channels" // names of all channels in the group.
+)
+
+// The standard channel names.
+const (
+	Stdin  = "stdin"
+	Stdout = "stdout"
+	Stderr = "stderr"
+	Error  = "error" // carries the reason the group ended, if any.
+)
+
+// RemoteError is returned by Wait with the error reported
+// by the server's Exit.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+var errNoErrorChannel = errors.New("Error: Group has no error channel.")
+
+// nextGroupID is used to give each group opened a unique ID.
+var nextGroupID uint64
+
+// Group is a set of related streams, one for each channel.
+type Group struct {
+	id        string
+	header    http.Header
+	channels  []string
+	streams   map[string]*stream.Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newGroup(id string, header http.Header, channels []string) *Group {
+	out := new(Group)
+	out.id = id
+	out.header = header
+	out.channels = channels
+	out.streams = make(map[string]*stream.Stream, len(channels))
+	out.done = make(chan struct{})
+	return out
+}
+
+// Open opens a group on session, with a stream for each of the
+// given channels, sending header as metadata on each stream.
+func Open(session *stream.Session, header http.Header, channels ...string) (*Group, error) {
+	id := strconv.FormatUint(atomic.AddUint64(&nextGroupID, 1), 10)
+	g := newGroup(id, header, channels)
+	for _, name := range channels {
+		h := make(http.Header, len(header)+3)
+		for key, values := range header {
+			h[key] = values
+		}
+		h.Set(GroupHeader, id)
+		h.Set(ChannelHeader, name)
+		h.Set(ChannelsHeader, strings.Join(channels, ","))
+
+		s, err := session.Open(h)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.streams[name] = s
+
+		// The client never writes to the server's channels.
+		if name == Stdout || name == Stderr || name == Error {
+			s.CloseWrite()
+		}
+	}
+
+	return g, nil
+}
+
+// ID returns the group's ID.
+func (g *Group) ID() string {
+	return g.id
+}
+
+// Header returns the metadata sent when the group was
+// opened.
+func (g *Group) Header() http.Header {
+	return g.header
+}
+
+// Channels returns the names of the group's channels.
+func (g *Group) Channels() []string {
+	return append([]string(nil), g.channels...)
+}
+
+// Channel returns the stream for the named channel, or
+// nil if the group has no such channel.
+func (g *Group) Channel(name string) *stream.Stream {
+	return g.streams[name]
+}
+
+// Done returns a channel which is closed when the group
+// is closed.
+func (g *Group) Done() <-chan struct{} {
+	return g.done
+}
+
+// Close closes every stream in the group.
+func (g *Group) Close() error {
+	g.closeOnce.Do(func() {
+		for _, s := range g.streams {
+			s.Close()
+		}
+		close(g.done)
+	})
+	return nil
+}
+
+// Exit ends the group from the server side, sending err, if
+// any, on the Error channel, before closing every stream.
+// Data written already is delivered before each stream is
+// half-closed.
+func (g *Group) Exit(err error) error {
+	if s := g.Channel(Error); s != nil && err != nil {
+		if _, werr := s.Write([]byte(err.Error())); werr != nil {
+			g.Close()
+			return werr
+		}
+	}
+	return g.Close()
+}
+
+// Wait waits for the server to end the group, and returns
+// the error it reported, as a *RemoteError, if any. Wait
+// does not close the group, so any output still unread can
+// be read afterwards. The group must have an Error channel.
+func (g *Group) Wait() error {
+	s := g.Channel(Error)
+	if s == nil {
+		return errNoErrorChannel
+	}
+	msg, err := ioutil.ReadAll(s)
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return &RemoteError{Message: string(msg)}
+	}
+	return nil
+}
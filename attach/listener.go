@@ -0,0 +1,131 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package attach
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+// DefaultGroupTimeout is the longest that a Listener waits
+// for all of a group's streams to arrive, by default.
+const DefaultGroupTimeout = 30 * time.Second
+
+// Listener accepts groups opened on the server side of a
+// session.
+type Listener struct {
+	session *stream.Session
+
+	// GroupTimeout is the longest that the Listener waits
+	// for all of a group's streams to arrive, after which
+	// those which have arrived are closed. It is initialised
+	// to DefaultGroupTimeout.
+	GroupTimeout time.Duration
+
+	lock    sync.Mutex
+	pending map[string]*Group // groups with streams still to arrive.
+}
+
+// NewListener returns a Listener accepting groups on
+// session.
+func NewListener(session *stream.Session) *Listener {
+	out := new(Listener)
+	out.session = session
+	out.GroupTimeout = DefaultGroupTimeout
+	out.pending = make(map[string]*Group)
+	return out
+}
+
+// Accept waits for and returns the next group whose streams
+// have all arrived. Streams which are not part of a group are
+// closed.
+func (l *Listener) Accept() (*Group, error) {
+	for {
+		s, err := l.session.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if g := l.add(s); g != nil {
+			return g, nil
+		}
+	}
+}
+
+// add adds a stream to its group, returning the group
+// once it is complete.
+func (l *Listener) add(s *stream.Stream) *Group {
+	header := s.Header()
+	id := header.Get(GroupHeader)
+	name := header.Get(ChannelHeader)
+	channels := strings.Split(header.Get(ChannelsHeader), ",")
+	if id == "" || name == "" || !contains(channels, name) {
+		s.Close()
+		return nil
+	}
+
+	// The server never writes to the client's channel.
+	if name == Stdin {
+		s.CloseWrite()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	g := l.pending[id]
+	if g == nil {
+		metadata := make(http.Header, len(header))
+		for key, values := range header {
+			metadata[key] = values
+		}
+		metadata.Del(GroupHeader)
+		metadata.Del(ChannelHeader)
+		metadata.Del(ChannelsHeader)
+		g = newGroup(id, metadata, channels)
+		l.pending[id] = g
+		time.AfterFunc(l.GroupTimeout, func() {
+			l.expire(id, g)
+		})
+	}
+
+	if g.streams[name] != nil {
+		s.Close()
+		return nil
+	}
+	g.streams[name] = s
+	if len(g.streams) < len(g.channels) {
+		return nil
+	}
+
+	delete(l.pending, id)
+	return g
+}
+
+// expire closes a group whose streams have not all
+// arrived in time.
+func (l *Listener) expire(id string, g *Group) {
+	l.lock.Lock()
+	if l.pending[id] != g {
+		l.lock.Unlock()
+		return
+	}
+	delete(l.pending, id)
+	l.lock.Unlock()
+
+	g.Close()
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
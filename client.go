@@ -48,3 +48,24 @@ func NewClientConn(conn net.Conn, push common.Receiver, version, subversion int)
 func NewClient(insecureSkipVerify bool) *http.Client {
 	return &http.Client{Transport: NewTransport(insecureSkipVerify)}
 }
+
+// Dial connects to the address on the named network, such as
+// "tcp" or "unix", and starts a SPDY/3.1 client connection over
+// it, without TLS. This is intended for internal deployments and
+// local IPC where both endpoints are known to speak SPDY/3.1. To
+// use an existing net.Conn, see NewClientConn.
+func Dial(network, addr string) (common.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClientConn(conn, nil, 3, 1)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go client.Run()
+	return client, nil
+}
@@ -5,18 +5,36 @@
 package spdy_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	spdy2frames "github.com/SlyMarbo/spdy/spdy2/frames"
+	"github.com/SlyMarbo/spdy/spdy3"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
 )
 
 func init() {
@@ -54,6 +72,14 @@ func TestClientHead(t *testing.T) {
 	if _, ok := r.Header["Last-Modified"]; !ok {
 		t.Error("Last-Modified header not found.")
 	}
+	if r.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", r.StatusCode)
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(name, ":") {
+			t.Errorf("Response has pseudo-header %s", name)
+		}
+	}
 }
 
 func TestClientInGoroutines(t *testing.T) {
@@ -90,219 +116,2510 @@ func TestClientInGoroutines(t *testing.T) {
 	wg.Wait()
 }
 
-// FIXME: Fails
-// func TestClientRedirects(t *testing.T) {
-// 	defer afterTest(t)
-// 	var ts *httptest.Server
-// 	ts = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		n, _ := strconv.Atoi(r.FormValue("n"))
-// 		// Test Referer header. (7 is arbitrary position to test at)
-// 		if n == 7 {
-// 			if g, e := r.Referer(), ts.URL+"/?n=6"; e != g {
-// 				t.Errorf("on request ?n=7, expected referer of %q; got %q", e, g)
-// 			}
-// 		}
-// 		if n < 15 {
-// 			http.Redirect(w, r, fmt.Sprintf("/?n=%d", n+1), http.StatusFound)
-// 			return
-// 		}
-// 		fmt.Fprintf(w, "n=%d", n)
-// 	}))
-// 	defer ts.Close()
-
-// 	c := newClient()
-// 	_, err := c.Get(ts.URL)
-// 	if e, g := "Get /?n=10: stopped after 10 redirects", fmt.Sprintf("%v", err); e != g {
-// 		t.Errorf("with default client Get, expected error %q, got %q", e, g)
-// 	}
+func TestCloseIdleConnections(t *testing.T) {
+	ts := newServer(robotsTxtHandler)
+	defer ts.Close()
 
-// 	// HEAD request should also have the ability to follow redirects.
-// 	_, err = c.Head(ts.URL)
-// 	if e, g := "Head /?n=10: stopped after 10 redirects", fmt.Sprintf("%v", err); e != g {
-// 		t.Errorf("with default client Head, expected error %q, got %q", e, g)
-// 	}
+	tr := newClient().Transport.(*spdy.Transport)
+	client := &http.Client{Transport: tr}
 
-// 	// Do should also follow redirects.
-// 	greq, _ := http.NewRequest("GET", ts.URL, nil)
-// 	_, err = c.Do(greq)
-// 	if e, g := "Get /?n=10: stopped after 10 redirects", fmt.Sprintf("%v", err); e != g {
-// 		t.Errorf("with default client Do, expected error %q, got %q", e, g)
-// 	}
+	for i := 0; i < 2; i++ {
+		r, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pedanticReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
 
-// 	var checkErr error
-// 	var lastVia []*http.Request
-// 	c = newClient()
-// 	c.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
-// 		lastVia = via
-// 		return checkErr
-// 	}
-// 	res, err := c.Get(ts.URL)
-// 	if err != nil {
-// 		t.Fatalf("Get error: %v", err)
-// 	}
-// 	res.Body.Close()
-// 	finalUrl := res.Request.URL.String()
-// 	if e, g := "<nil>", fmt.Sprintf("%v", err); e != g {
-// 		t.Errorf("with custom client, expected error %q, got %q", e, g)
-// 	}
-// 	if !strings.HasSuffix(finalUrl, "/?n=15") {
-// 		t.Errorf("expected final url to end in /?n=15; got url %q", finalUrl)
-// 	}
-// 	if e, g := 15, len(lastVia); e != g {
-// 		t.Errorf("expected lastVia to have contained %d elements; got %d", e, g)
-// 	}
+		if n := len(tr.IdleSessions()); n != 1 {
+			t.Fatalf("Expected 1 idle session, got %d", n)
+		}
 
-// 	checkErr = errors.New("no redirects allowed")
-// 	res, err = c.Get(ts.URL)
-// 	if urlError, ok := err.(*url.Error); !ok || urlError.Err != checkErr {
-// 		t.Errorf("with redirects forbidden, expected a *url.Error with our 'no redirects allowed' error inside; got %#v (%q)", err, err)
-// 	}
-// 	if res == nil {
-// 		t.Fatalf("Expected a non-nil Response on CheckRedirect failure (http://golang.org/issue/3795)")
-// 	}
-// 	res.Body.Close()
-// 	if res.Header.Get("Location") == "" {
-// 		t.Errorf("no Location header in Response")
-// 	}
-// }
+		tr.CloseIdleConnections()
+		if n := len(tr.IdleSessions()); n != 0 {
+			t.Fatalf("Expected no idle sessions after closing, got %d", n)
+		}
+	}
+}
 
-// FIXME: Deadlocks
-// func TestPostRedirects(t *testing.T) {
-//	defer afterTest(t)
-// 	var log struct {
-// 		sync.Mutex
-// 		bytes.Buffer
-// 	}
-// 	var ts *httptest.Server
-// 	ts = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		log.Lock()
-// 		fmt.Fprintf(&log.Buffer, "%s %s ", r.Method, r.RequestURI)
-// 		log.Unlock()
-// 		if v := r.URL.Query().Get("code"); v != "" {
-// 			code, _ := strconv.Atoi(v)
-// 			if code/100 == 3 {
-// 				w.Header().Set("Location", ts.URL)
-// 			}
-// 			w.WriteHeader(code)
-// 		}
-// 	}))
-// 	defer ts.Close()
-// 	tests := []struct {
-// 		suffix string
-// 		want   int // response code
-// 	}{
-// 		{"/", 200},
-// 		{"/?code=301", 301},
-// 		{"/?code=302", 200},
-// 		{"/?code=303", 200},
-// 		{"/?code=404", 404},
-// 	}
-// 	client := newClient()
-// 	for _, tt := range tests {
-// 		res, err := client.Post(ts.URL+tt.suffix, "text/plain", strings.NewReader("Some content"))
-// 		if err != nil {
-// 			t.Fatal(err)
-// 		}
-// 		if res.StatusCode != tt.want {
-// 			t.Errorf("POST %s: status code = %d; want %d", tt.suffix, res.StatusCode, tt.want)
-// 		}
-// 	}
-// 	log.Lock()
-// 	got := log.String()
-// 	log.Unlock()
-// 	want := "POST / POST /?code=301 POST /?code=302 GET / POST /?code=303 GET / POST /?code=404 "
-// 	if got != want {
-// 		t.Errorf("Log differs.\n Got: %q\nWant: %q", got, want)
-// 	}
-// }
+func TestPlaintext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
 
-// FIXME: Fails (not a Flusher)
-// func TestStreamingGet(t *testing.T) {
-// 	defer afterTest(t)
-// 	say := make(chan string)
-// 	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		w.(http.Flusher).Flush()
-// 		for str := range say {
-// 			w.Write([]byte(str))
-// 			w.(http.Flusher).Flush()
-// 		}
-// 	}))
-// 	defer ts.Close()
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
 
-// 	c := newClient()
-// 	res, err := c.Get(ts.URL + "/")
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	var buf [10]byte
-// 	for _, str := range []string{"i", "am", "also", "known", "as", "comet"} {
-// 		say <- str
-// 		n, err := io.ReadFull(res.Body, buf[0:len(str)])
-// 		if err != nil {
-// 			t.Fatalf("ReadFull on %q: %v", str, err)
-// 		}
-// 		if n != len(str) {
-// 			t.Fatalf("Receiving %q, only read %d bytes", str, n)
-// 		}
-// 		got := string(buf[0:n])
-// 		if got != str {
-// 			t.Fatalf("Expected %q, got %q", str, got)
-// 		}
-// 	}
-// 	close(say)
-// 	_, err = io.ReadFull(res.Body, buf[0:1])
-// 	if err != io.EOF {
-// 		t.Fatalf("at end expected EOF, got %v", err)
-// 	}
-// }
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-//
-// HELPERS
-//
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if s := string(b); !strings.HasPrefix(s, "User-agent:") {
+		t.Errorf("Incorrect page body (did not begin with User-agent): %q", s)
+	}
+}
 
-var robotsTxtHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Last-Modified", "sometime")
-	fmt.Fprintf(w, "User-agent: go\nDisallow: /something/")
-})
+type pushCounter chan string
 
-// pedanticReadAll works like ioutil.ReadAll but additionally
-// verifies that r obeys the documented io.Reader contract.
-func pedanticReadAll(r io.Reader) (b []byte, err error) {
-	var bufa [64]byte
-	buf := bufa[:]
-	for {
-		n, err := r.Read(buf)
-		if n == 0 && err == nil {
-			return nil, fmt.Errorf("Read: n=0 with err=nil")
-		}
-		b = append(b, buf[:n]...)
-		if err == io.EOF {
-			n, err := r.Read(buf)
-			if n != 0 || err != io.EOF {
-				return nil, fmt.Errorf("Read: n=%d err=%#v after EOF", n, err)
-			}
-			return b, nil
-		}
-		if err != nil {
-			return b, err
-		}
+func (p pushCounter) ReceiveData(req *http.Request, data []byte, final bool) {
+	if final {
+		p <- req.URL.Path
 	}
 }
 
-func newServer(handler http.Handler) *httptest.Server {
-	ts := httptest.NewUnstartedServer(handler)
-	spdy.AddSPDY(ts.Config)
+func (p pushCounter) ReceiveHeader(req *http.Request, header http.Header) {}
+
+func (p pushCounter) ReceiveRequest(req *http.Request) bool { return true }
+
+func TestPushPolicy(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	policy := common.NewPushPolicy()
+	policy.Add("/", "/app.js", "/style.css")
+	spdy.SetPushPolicy(ts.Config, policy)
 	ts.TLS = ts.Config.TLSConfig
 	ts.StartTLS()
-	return ts
+	defer ts.Close()
+
+	pushes := make(pushCounter, 4)
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushReceiver = pushes
+
+	r, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pedanticReadAll(r.Body); err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-pushes:
+			got[path] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for pushes; got %v", got)
+		}
+	}
+	if !got["/app.js"] || !got["/style.css"] {
+		t.Errorf("Expected pushes of /app.js and /style.css, got %v", got)
+	}
 }
 
-func newClient() *http.Client {
-	tr := spdy.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			NextProtos:         []string{"spdy/3.1"},
-		},
+func TestPushPolicyLearning(t *testing.T) {
+	// The zero value is ready to use.
+	policy := &common.PushPolicy{Learn: true}
+
+	page, _ := http.NewRequest("GET", "https://example.com/", nil)
+	script, _ := http.NewRequest("GET", "https://example.com/app.js", nil)
+	script.Header.Set("Referer", "https://example.com/")
+
+	policy.Observe(script)
+	if res := policy.Resources(page); len(res) != 0 {
+		t.Errorf("Learned resources too soon: %v", res)
+	}
+	policy.Observe(script)
+	if res := policy.Resources(page); len(res) != 1 || res[0] != "/app.js" {
+		t.Errorf("Expected to learn /app.js, got %v", res)
+	}
+
+	policy.Add("/", "/style.css")
+	if res := policy.Resources(page); len(res) != 2 || res[0] != "/style.css" || res[1] != "/app.js" {
+		t.Errorf("Expected /style.css and /app.js, got %v", res)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	spdy.SetFairScheduling(10 * time.Millisecond)
+	defer spdy.SetFairScheduling(0)
+
+	body := strings.Repeat("0123456789abcdef", 1<<14)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer ts.Close()
+
+	client := newClient()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := client.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, err := pedanticReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				t.Error(err)
+			} else if string(b) != body {
+				t.Errorf("Received corrupt body of length %d", len(b))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRoundRobin(t *testing.T) {
+	spdy.SetRoundRobin(3000)
+	defer spdy.SetRoundRobin(0)
+
+	// Responses of different lengths, with DATA frames
+	// larger and smaller than the quantum.
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		for i := 0; i < n; i++ {
+			w.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 1000*(i%8+1)))
+		}
+	}))
+	defer ts.Close()
+
+	client := newClient()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			r, err := client.Get(ts.URL + "?n=" + strconv.Itoa(50*n))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, err := pedanticReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < 50*n; i++ {
+				size := 1000 * (i%8 + 1)
+				if len(b) < size || !bytes.Equal(b[:size], bytes.Repeat([]byte{byte('a' + i%26)}, size)) {
+					t.Errorf("Received corrupt body at write %d", i)
+					return
+				}
+				b = b[size:]
+			}
+			if len(b) != 0 {
+				t.Errorf("Received %d extra bytes", len(b))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSetPriority(t *testing.T) {
+	spdy.SetFairScheduling(10 * time.Millisecond)
+	defer spdy.SetFairScheduling(0)
+
+	// Each response changes priority part way through, which
+	// must not reorder its data.
+	half := strings.Repeat("0123456789abcdef", 1<<13)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, half)
+		if err := spdy.SetPriority(w, 8); err == nil {
+			t.Error("Expected an error setting an invalid priority.")
+		}
+		if err := spdy.SetPriority(w, 1); err != nil {
+			t.Error(err)
+		}
+		if p, _ := spdy.GetPriority(w); p != 1 {
+			t.Errorf("Expected priority 1, got %d", p)
+		}
+		io.WriteString(w, half)
+	}))
+	defer ts.Close()
+
+	client := newClient()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := client.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, err := pedanticReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				t.Error(err)
+			} else if string(b) != half+half {
+				t.Errorf("Received corrupt body of length %d", len(b))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBodyDrain(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.com/pushed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPush := func(length string) (*common.PushedResponse, chan struct{}) {
+		cancelled := make(chan struct{}, 1)
+		push := common.NewPushedResponse(req, 2, func() {
+			cancelled <- struct{}{}
+		})
+		push.SetDrainLimit(10)
+		header := make(http.Header)
+		header.Set(":status", "200")
+		if length != "" {
+			header.Set("Content-Length", length)
+		}
+		push.ReceiveHeader(header)
+		push.ReceiveData([]byte("hello "), false)
+
+		res := push.Response()
+		if _, err := res.Body.Read(make([]byte, 2)); err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if _, err := res.Body.Read(make([]byte, 2)); err != http.ErrBodyReadAfterClose {
+			t.Errorf("Expected %v after closing, got %v", http.ErrBodyReadAfterClose, err)
+		}
+		return push, cancelled
+	}
+	expectDone := func(push *common.PushedResponse) {
+		select {
+		case <-push.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Push did not end")
+		}
+	}
+
+	// The rest of a short body is drained.
+	push, cancelled := newPush("12")
+	push.ReceiveData([]byte("world!"), true)
+	expectDone(push)
+	select {
+	case <-cancelled:
+		t.Error("Short push was cancelled")
+	default:
+	}
+
+	// A long body is cancelled at once.
+	push, cancelled = newPush("100")
+	expectDone(push)
+	select {
+	case <-cancelled:
+	default:
+		t.Error("Long push was not cancelled")
+	}
+
+	// A body of unknown length is cancelled
+	// once the drain limit is exceeded.
+	push, cancelled = newPush("")
+	push.ReceiveData([]byte("more than ten bytes"), false)
+	expectDone(push)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Push of unknown length was not cancelled")
+	}
+}
+
+func TestPushedStreams(t *testing.T) {
+	errs := make(chan error, 1)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			return
+		}
+		push, err := spdy.Push(w, "https://"+r.Host+"/pushed")
+		if err != nil {
+			errs <- err
+			return
+		}
+		if ids, _ := spdy.PushedStreams(w); len(ids) != 1 || ids[0] != push.StreamID() {
+			errs <- fmt.Errorf("Expected pushed stream %d, got %v", push.StreamID(), ids)
+			return
+		}
+		push.Write([]byte("pushed"))
+		push.Finish()
+		if ids, _ := spdy.PushedStreams(w); len(ids) != 0 {
+			errs <- fmt.Errorf("Expected no pushed streams after finishing, got %v", ids)
+			return
+		}
+		errs <- nil
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushReceiver = make(pushCounter, 1)
+
+	r, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPushHandler(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range []string{"/accepted", "/refused"} {
+			push, err := spdy.Push(w, "https://"+r.Host+path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			push.Header().Set(":status", "200")
+			push.Write([]byte("pushed " + path))
+			push.Finish()
+		}
+		io.WriteString(w, "main")
+	}))
+	defer ts.Close()
+
+	pushes := make(chan *common.PushedResponse, 2)
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushHandler = common.PushHandlerFunc(func(push *common.PushedResponse) bool {
+		if push.Request.URL.Path == "/refused" {
+			return false
+		}
+		pushes <- push
+		return true
+	})
+
+	r, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	select {
+	case push := <-pushes:
+		res := push.Response()
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 || string(b) != "pushed /accepted" {
+			t.Errorf("Unexpected push: status %d, body %q", res.StatusCode, b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for push.")
+	}
+}
+
+func TestPushBufferLimit(t *testing.T) {
+	spdy.SetPushBufferLimit(16)
+	defer spdy.SetPushBufferLimit(1 << 20)
+
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := spdy.Push(w, "https://"+r.Host+"/large")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		push.Header().Set(":status", "200")
+		push.Write(make([]byte, 64))
+		push.Finish()
+		io.WriteString(w, "main")
+	}))
+	defer ts.Close()
+
+	pushes := make(chan *common.PushedResponse, 1)
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushHandler = common.PushHandlerFunc(func(push *common.PushedResponse) bool {
+		pushes <- push
+		return true
+	})
+
+	r, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	select {
+	case push := <-pushes:
+		// The push is not read until it has ended.
+		<-push.Done()
+		res := push.Response()
+		_, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != common.ErrPushBufferFull {
+			t.Errorf("Expected common.ErrPushBufferFull, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for push.")
+	}
+}
+
+func TestPushContent(t *testing.T) {
+	const asset = "body { color: red; }"
+	modtime := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	results := make(chan error, 1)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results <- spdy.PushContent(w, "https://"+r.Host+"/style.css", r.Header, "style.css", modtime, `"v1"`, strings.NewReader(asset))
+		io.WriteString(w, "main")
+	}))
+	defer ts.Close()
+
+	pushes := make(chan *common.PushedResponse, 1)
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushHandler = common.PushHandlerFunc(func(push *common.PushedResponse) bool {
+		pushes <- push
+		return true
+	})
+
+	tests := []struct {
+		header map[string]string
+		status int
+		body   string
+	}{
+		{nil, http.StatusOK, asset},
+		{map[string]string{"Range": "bytes=0-3"}, http.StatusPartialContent, asset[:4]},
+		{map[string]string{"Range": "bytes=0-3", "If-Range": `"v1"`}, http.StatusPartialContent, asset[:4]},
+		{map[string]string{"Range": "bytes=0-3", "If-Range": `"v0"`}, http.StatusOK, asset},
+		{map[string]string{"If-None-Match": `"v0"`}, http.StatusOK, asset},
+		{map[string]string{"If-None-Match": `"v0", W/"v1"`}, 0, ""},
+		{map[string]string{"If-Modified-Since": modtime.Format(http.TimeFormat)}, 0, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		r, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		err = <-results
+		if test.status == 0 {
+			if err != common.ErrPushCached {
+				t.Errorf("%v: expected common.ErrPushCached, got %v", test.header, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.header, err)
+		}
+
+		select {
+		case push := <-pushes:
+			res := push.Response()
+			b, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.status || string(b) != test.body {
+				t.Errorf("%v: expected status %d, body %q, got %d, %q", test.header, test.status, test.body, res.StatusCode, b)
+			}
+			if etag := res.Header.Get("Etag"); etag != `"v1"` {
+				t.Errorf("%v: expected ETag \"v1\", got %q", test.header, etag)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: timed out waiting for push.", test.header)
+		}
+	}
+}
+
+func TestPushCacheDigest(t *testing.T) {
+	spdy.SetPushCacheDigest(&common.CacheDigest{Header: "Cache-Digest", Cookie: "digest"})
+	defer spdy.SetPushCacheDigest(nil)
+
+	type result struct {
+		path    string
+		err     error
+		outcome common.PushOutcome
+	}
+	results := make(chan result, 4)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range []string{"/app.js", "/style.css", "/refused.js"} {
+			push, err := spdy.Push(w, "https://"+r.Host+path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			push.Header().Set("Etag", `"v2"`)
+			push.WriteHeader(http.StatusOK)
+			_, err = push.Write([]byte("pushed " + path))
+			if path == "/refused.js" && err == nil {
+				// Wait for the client to refuse the push.
+				select {
+				case <-push.(spdy.PushWatcher).Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			push.Finish()
+			outcome, _ := spdy.PushResult(push)
+			results <- result{path, err, outcome}
+		}
+		io.WriteString(w, "main")
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushHandler = common.PushHandlerFunc(func(push *common.PushedResponse) bool {
+		return push.Request.URL.Path != "/refused.js"
+	})
+
+	tests := []struct {
+		header   string
+		cookie   string
+		outcomes map[string]common.PushOutcome
+	}{
+		{
+			header: `/app.js, /style.css "v1"`,
+			outcomes: map[string]common.PushOutcome{
+				"/app.js":     common.PushCancelled,
+				"/style.css":  common.PushAccepted,
+				"/refused.js": common.PushReset,
+			},
+		},
+		{
+			cookie: url.QueryEscape(`/style.css "v2", /refused.js 0`),
+			outcomes: map[string]common.PushOutcome{
+				"/app.js":     common.PushAccepted,
+				"/style.css":  common.PushCancelled,
+				"/refused.js": common.PushReset,
+			},
+		},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+		if test.header != "" {
+			req.Header.Set("Cache-Digest", test.header)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "digest", Value: test.cookie})
+		}
+		r, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		for range test.outcomes {
+			res := <-results
+			want := test.outcomes[res.path]
+			if res.outcome != want {
+				t.Errorf("%s: expected outcome %s, got %s", res.path, want, res.outcome)
+			}
+			if want == common.PushCancelled && res.err != common.ErrPushCached {
+				t.Errorf("%s: expected common.ErrPushCached, got %v", res.path, res.err)
+			}
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stats := conn.(spdy.StatsReporter)
+
+	get := func() {
+		req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+
+	get()
+	first := stats.StatsDelta()
+	if first.StreamsOpened != 1 || first.FramesSent == 0 || first.DataBytesReceived == 0 {
+		t.Errorf("Unexpected stats after first request: %+v", first)
+	}
+
+	get()
+	second := stats.StatsDelta()
+	if second.StreamsOpened != 1 {
+		t.Errorf("Expected 1 stream in second interval, got %d", second.StreamsOpened)
+	}
+
+	total := stats.ResetStats()
+	if total.StreamsOpened != 2 || total.BytesReceived < first.BytesReceived+second.BytesReceived {
+		t.Errorf("Unexpected total stats: %+v", total)
+	}
+	if after := stats.Stats(); after.StreamsOpened != 0 || after.FramesSent != 0 {
+		t.Errorf("Stats were not reset: %+v", after)
+	}
+}
+
+func TestConnState(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	state := conn.(spdy.StateReporter).State()
+	if state.Version != "spdy/3.1" || state.Server || state.Closed {
+		t.Errorf("Unexpected connection details: %+v", state)
+	}
+	if state.LastOwnStreamID != 1 || state.LastPeerStreamID != 0 {
+		t.Errorf("Expected last stream IDs 1 and 0, got %d and %d", state.LastOwnStreamID, state.LastPeerStreamID)
+	}
+	if state.SentSettings[common.SETTINGS_MAX_CONCURRENT_STREAMS] == nil {
+		t.Errorf("Missing sent settings: %v", state.SentSettings)
+	}
+	if state.ReceivedSettings[common.SETTINGS_MAX_CONCURRENT_STREAMS] == nil {
+		t.Errorf("Missing received settings: %v", state.ReceivedSettings)
+	}
+	if state.SendWindow <= 0 || state.ReceiveWindow <= 0 || state.InitialReceiveWindow == 0 {
+		t.Errorf("Unexpected windows: %+v", state)
+	}
+	if state.BytesSent == 0 || state.BytesReceived == 0 || state.GoawaySent || state.GoawayReceived {
+		t.Errorf("Unexpected activity: %+v", state)
+	}
+	for _, headers := range []common.CompressionStats{state.HeadersSent, state.HeadersReceived} {
+		if headers.Blocks != 1 || headers.Compressed == 0 || headers.Ratio() <= 1 {
+			t.Errorf("Unexpected header compression: %+v", headers)
+		}
+	}
+}
+
+func TestPushCache(t *testing.T) {
+	var direct int
+	var lock sync.Mutex
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/style.css" {
+			lock.Lock()
+			direct++
+			lock.Unlock()
+			io.WriteString(w, "direct")
+			return
+		}
+		push, err := spdy.Push(w, "https://"+r.Host+"/style.css")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		push.Header().Set(":status", "200")
+		push.Header().Set("Cache-Control", "max-age=60")
+		push.Write([]byte("pushed"))
+		push.Finish()
+		io.WriteString(w, "main")
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	tr := client.Transport.(*spdy.Transport)
+	tr.PushCache = spdy.NewPushCache()
+
+	r, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	r, err = client.Get(ts.URL + "/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "pushed" {
+		t.Errorf("Expected pushed body, got %q", b)
+	}
+	if r.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Pushed headers were not cached: %v", r.Header)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if direct != 0 {
+		t.Errorf("Expected no direct requests, got %d", direct)
+	}
+}
+
+func TestCrossOriginPush(t *testing.T) {
+	outcomes := make(chan common.PushOutcome, 1)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := "https://other.example/style.css"
+		if r.URL.Path == "/scheme" {
+			u = "http://" + r.Host + "/style.css"
+		}
+		push, err := spdy.Push(w, u)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		push.Header().Set(":status", "200")
+		push.Header().Set("Cache-Control", "max-age=60")
+		push.Write([]byte("poisoned"))
+		// Wait for the client to reset the push.
+		select {
+		case <-push.(spdy.PushWatcher).Done():
+		case <-time.After(5 * time.Second):
+		}
+		push.Finish()
+		outcome, _ := spdy.PushResult(push)
+		outcomes <- outcome
+		io.WriteString(w, "main")
+	}))
+	defer ts.Close()
+
+	// Pushes for another host or scheme are reset with
+	// PROTOCOL_ERROR, which also closes the connection, so
+	// the responses themselves may not arrive.
+	for _, path := range []string{"/host", "/scheme"} {
+		client := newClient()
+		tr := client.Transport.(*spdy.Transport)
+		tr.PushCache = spdy.NewPushCache()
+
+		if r, err := client.Get(ts.URL + path); err == nil {
+			r.Body.Close()
+		}
+		if outcome := <-outcomes; outcome != common.PushReset {
+			t.Errorf("%s: expected outcome %s, got %s", path, common.PushReset, outcome)
+		}
+		if n := tr.PushCache.Len(); n != 0 {
+			t.Errorf("%s: expected no cached pushes, got %d", path, n)
+		}
+	}
+}
+
+func TestDataChecksums(t *testing.T) {
+	spdy.SetDataChecksums(true)
+	defer spdy.SetDataChecksums(false)
+
+	body := strings.Repeat("0123456789abcdef", 16*1024)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})})
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(b) != body {
+			t.Fatalf("Request %d: body corrupted (got %d bytes, want %d)", i, len(b), len(body))
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer which is safe for
+// concurrent use.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestFrameCapture(t *testing.T) {
+	out := new(syncBuffer)
+	capture, err := common.NewCapture(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spdy.SetFrameCapture(capture)
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	sc, err := spdy.NewServerConn(server, &http.Server{Handler: robotsTxtHandler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := spdy3.NewConn(client, nil, 1)
+	spdy.SetFrameCapture(nil)
+	go sc.Run()
+	go conn.Run()
+
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pedanticReadAll(res.Body); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	client.Close()
+	<-sc.CloseNotify()
+	<-conn.CloseNotify()
+
+	if err := capture.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reassemble the TCP streams from the pcap file.
+	data := out.Bytes()
+	if len(data) < 24 || !bytes.Equal(data[:4], []byte{0xd4, 0xc3, 0xb2, 0xa1}) || data[20] != 101 {
+		t.Fatalf("Bad pcap header: % x", data[:24])
+	}
+	type flow struct {
+		next uint32
+		data bytes.Buffer
+	}
+	flows := make(map[[2]uint16]*flow)
+	for data = data[24:]; len(data) > 0; {
+		size := int(data[8]) | int(data[9])<<8 | int(data[10])<<16
+		ip := data[16 : 16+size]
+		data = data[16+size:]
+
+		tcp := ip[int(ip[0]&0xf)*4:]
+		ports := [2]uint16{uint16(tcp[0])<<8 | uint16(tcp[1]), uint16(tcp[2])<<8 | uint16(tcp[3])}
+		seq := uint32(tcp[4])<<24 | uint32(tcp[5])<<16 | uint32(tcp[6])<<8 | uint32(tcp[7])
+		f := flows[ports]
+		if f == nil {
+			f = &flow{next: 1}
+			flows[ports] = f
+		}
+		if seq != f.next {
+			t.Fatalf("Flow %v: expected sequence number %d, got %d", ports, f.next, seq)
+		}
+		payload := tcp[int(tcp[12]>>4)*4:]
+		f.next += uint32(len(payload))
+		f.data.Write(payload)
+	}
+
+	// Both connections' streams in each direction
+	// are recorded, and hold whole frames.
+	if len(flows) != 4 {
+		t.Fatalf("Expected 4 TCP streams, got %d", len(flows))
+	}
+	counts := make(map[string]int)
+	for ports, f := range flows {
+		r := bufio.NewReader(&f.data)
+		for {
+			frame, err := frames.ReadFrame(r, 1)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Flow %v: %v", ports, err)
+			}
+			counts[frame.Name()]++
+		}
+	}
+	if counts["SYN_STREAM"] != 2 || counts["SYN_REPLY"] != 2 {
+		t.Errorf("Expected the request and response to be captured twice, got %v", counts)
+	}
+}
+
+func TestBodySpill(t *testing.T) {
+	dir := t.TempDir()
+	spdy.SetBufferRequestBodies(true)
+	defer spdy.SetBufferRequestBodies(false)
+	spdy.SetBodySpillThreshold(1024, dir)
+	defer spdy.SetBodySpillThreshold(0, "")
+
+	body := strings.Repeat("0123456789abcdef", 16*1024)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil || len(files) != 1 {
+			t.Errorf("Expected one spill file, got %d (%v)", len(files), err)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		} else if string(b) != body {
+			t.Errorf("Body corrupted (got %d bytes, want %d)", len(b), len(body))
+		}
+	}))
+	defer ts.Close()
+
+	res, err := newClient().Post(ts.URL, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// The file is removed once the stream has closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if files, _ := ioutil.ReadDir(dir); len(files) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Spill file was not removed.")
+}
+
+func TestStreamStats(t *testing.T) {
+	chunk := []byte(strings.Repeat("x", 1000))
+	writers := make(chan http.ResponseWriter, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		for i := 0; i < 3; i++ {
+			w.Write(chunk)
+		}
+		writers <- w
+	})})
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("POST", "http://"+l.Addr().String()+"/", strings.NewReader(strings.Repeat("y", 3000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pedanticReadAll(r.Body); err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	s, err := spdy.GetStreamStats(<-writers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.DataBytesReceived != 3000 || s.DataFramesReceived == 0 {
+		t.Errorf("Expected 3000 bytes received in DATA frames, got %d bytes in %d frames", s.DataBytesReceived, s.DataFramesReceived)
+	}
+	if s.DataBytesSent != 3000 || s.DataFramesSent != 3 {
+		t.Errorf("Expected 3000 bytes sent in 3 DATA frames, got %d bytes in %d frames", s.DataBytesSent, s.DataFramesSent)
+	}
+	if s.HeaderBytesReceived == 0 || s.HeaderBytesSent == 0 {
+		t.Errorf("Expected headers sent and received, got %d and %d bytes", s.HeaderBytesSent, s.HeaderBytesReceived)
+	}
+	if s.MaxQueueDelay > s.QueueDelay {
+		t.Errorf("Maximum queueing delay %v exceeds total %v", s.MaxQueueDelay, s.QueueDelay)
+	}
+	if s.Opened.IsZero() || s.FirstByteSent.Before(s.Opened) || s.LastByteSent.Before(s.FirstByteSent) {
+		t.Errorf("Unexpected send times: opened %v, first byte %v, last byte %v", s.Opened, s.FirstByteSent, s.LastByteSent)
+	}
+	if s.FirstByteReceived.IsZero() || s.LastByteReceived.Before(s.FirstByteReceived) {
+		t.Errorf("Unexpected receive times: first byte %v, last byte %v", s.FirstByteReceived, s.LastByteReceived)
+	}
+	if s.Duration() < s.TimeToFirstByte() {
+		t.Errorf("Duration %v is less than time to first byte %v", s.Duration(), s.TimeToFirstByte())
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	const rate = 64 * 1024
+	spdy.SetRateLimits(0, rate)
+	defer spdy.SetRateLimits(0, 0)
+
+	chunk := []byte(strings.Repeat("x", 16*1024))
+	stats := make(chan common.StreamStats, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			w.Write(chunk)
+		}
+		s, err := spdy.GetStreamStats(w)
+		if err != nil {
+			t.Error(err)
+		}
+		stats <- s
+	})})
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	r, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first second's worth is sent immediately, and
+	// the rest takes another second.
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Expected rate limiting, but response took only %v", elapsed)
+	}
+	if len(b) != 8*len(chunk) {
+		t.Errorf("Expected %d bytes, got %d", 8*len(chunk), len(b))
+	}
+
+	s := <-stats
+	if s.DataBytesSent != uint64(8*len(chunk)) {
+		t.Errorf("Expected %d bytes sent, got %d", 8*len(chunk), s.DataBytesSent)
+	}
+	if s.Throughput <= 0 {
+		t.Errorf("Expected positive throughput, got %f", s.Throughput)
+	}
+}
+
+func TestTransportObservers(t *testing.T) {
+	conns := make(chan common.Conn, 1)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stream, ok := w.(spdy.Stream); ok {
+			conns <- stream.Conn()
+		}
+	}))
+	defer ts.Close()
+
+	origin := ts.Listener.Addr().String()
+	settings := make(chan common.Settings, 1)
+	goaways := make(chan common.GoawayStatus, 1)
+	client := newClient()
+	tr := client.Transport.(*spdy.Transport)
+	tr.OnSettings = func(o string, s common.Settings) {
+		if o != origin {
+			t.Errorf("Expected origin %q, got %q", origin, o)
+		}
+		settings <- s
+	}
+	tr.OnGoaway = func(o string, lastGoodStreamID common.StreamID, status common.GoawayStatus) {
+		if o != origin {
+			t.Errorf("Expected origin %q, got %q", origin, o)
+		}
+		goaways <- status
+	}
+
+	r, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	select {
+	case s := <-settings:
+		if s[common.SETTINGS_MAX_CONCURRENT_STREAMS] == nil {
+			t.Errorf("Expected SETTINGS_MAX_CONCURRENT_STREAMS, got %v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for SETTINGS")
+	}
+
+	// Close the server's session, which sends a GOAWAY.
+	(<-conns).Close()
+	select {
+	case status := <-goaways:
+		if status != common.GOAWAY_OK {
+			t.Errorf("Expected GOAWAY_OK, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for GOAWAY")
+	}
+}
+
+// FIXME: Fails
+// func TestClientRedirects(t *testing.T) {
+// 	defer afterTest(t)
+// 	var ts *httptest.Server
+// 	ts = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// 		n, _ := strconv.Atoi(r.FormValue("n"))
+// 		// Test Referer header. (7 is arbitrary position to test at)
+// 		if n == 7 {
+// 			if g, e := r.Referer(), ts.URL+"/?n=6"; e != g {
+// 				t.Errorf("on request ?n=7, expected referer of %q; got %q", e, g)
+// 			}
+// 		}
+// 		if n < 15 {
+// 			http.Redirect(w, r, fmt.Sprintf("/?n=%d", n+1), http.StatusFound)
+// 			return
+// 		}
+// 		fmt.Fprintf(w, "n=%d", n)
+// 	}))
+// 	defer ts.Close()
+
+// 	c := newClient()
+// 	_, err := c.Get(ts.URL)
+// 	if e, g := "Get /?n=10: stopped after 10 redirects", fmt.Sprintf("%v", err); e != g {
+// 		t.Errorf("with default client Get, expected error %q, got %q", e, g)
+// 	}
+
+// 	// HEAD request should also have the ability to follow redirects.
+// 	_, err = c.Head(ts.URL)
+// 	if e, g := "Head /?n=10: stopped after 10 redirects", fmt.Sprintf("%v", err); e != g {
+// 		t.Errorf("with default client Head, expected error %q, got %q", e, g)
+// 	}
+
+// 	// Do should also follow redirects.
+// 	greq, _ := http.NewRequest("GET", ts.URL, nil)
+// 	_, err = c.Do(greq)
+// 	if e, g := "Get /?n=10: stopped after 10 redirects", fmt.Sprintf("%v", err); e != g {
+// 		t.Errorf("with default client Do, expected error %q, got %q", e, g)
+// 	}
+
+// 	var checkErr error
+// 	var lastVia []*http.Request
+// 	c = newClient()
+// 	c.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
+// 		lastVia = via
+// 		return checkErr
+// 	}
+// 	res, err := c.Get(ts.URL)
+// 	if err != nil {
+// 		t.Fatalf("Get error: %v", err)
+// 	}
+// 	res.Body.Close()
+// 	finalUrl := res.Request.URL.String()
+// 	if e, g := "<nil>", fmt.Sprintf("%v", err); e != g {
+// 		t.Errorf("with custom client, expected error %q, got %q", e, g)
+// 	}
+// 	if !strings.HasSuffix(finalUrl, "/?n=15") {
+// 		t.Errorf("expected final url to end in /?n=15; got url %q", finalUrl)
+// 	}
+// 	if e, g := 15, len(lastVia); e != g {
+// 		t.Errorf("expected lastVia to have contained %d elements; got %d", e, g)
+// 	}
+
+// 	checkErr = errors.New("no redirects allowed")
+// 	res, err = c.Get(ts.URL)
+// 	if urlError, ok := err.(*url.Error); !ok || urlError.Err != checkErr {
+// 		t.Errorf("with redirects forbidden, expected a *url.Error with our 'no redirects allowed' error inside; got %#v (%q)", err, err)
+// 	}
+// 	if res == nil {
+// 		t.Fatalf("Expected a non-nil Response on CheckRedirect failure (http://golang.org/issue/3795)")
+// 	}
+// 	res.Body.Close()
+// 	if res.Header.Get("Location") == "" {
+// 		t.Errorf("no Location header in Response")
+// 	}
+// }
+
+// FIXME: Deadlocks
+// func TestPostRedirects(t *testing.T) {
+//	defer afterTest(t)
+// 	var log struct {
+// 		sync.Mutex
+// 		bytes.Buffer
+// 	}
+// 	var ts *httptest.Server
+// 	ts = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// 		log.Lock()
+// 		fmt.Fprintf(&log.Buffer, "%s %s ", r.Method, r.RequestURI)
+// 		log.Unlock()
+// 		if v := r.URL.Query().Get("code"); v != "" {
+// 			code, _ := strconv.Atoi(v)
+// 			if code/100 == 3 {
+// 				w.Header().Set("Location", ts.URL)
+// 			}
+// 			w.WriteHeader(code)
+// 		}
+// 	}))
+// 	defer ts.Close()
+// 	tests := []struct {
+// 		suffix string
+// 		want   int // response code
+// 	}{
+// 		{"/", 200},
+// 		{"/?code=301", 301},
+// 		{"/?code=302", 200},
+// 		{"/?code=303", 200},
+// 		{"/?code=404", 404},
+// 	}
+// 	client := newClient()
+// 	for _, tt := range tests {
+// 		res, err := client.Post(ts.URL+tt.suffix, "text/plain", strings.NewReader("Some content"))
+// 		if err != nil {
+// 			t.Fatal(err)
+// 		}
+// 		if res.StatusCode != tt.want {
+// 			t.Errorf("POST %s: status code = %d; want %d", tt.suffix, res.StatusCode, tt.want)
+// 		}
+// 	}
+// 	log.Lock()
+// 	got := log.String()
+// 	log.Unlock()
+// 	want := "POST / POST /?code=301 POST /?code=302 GET / POST /?code=303 GET / POST /?code=404 "
+// 	if got != want {
+// 		t.Errorf("Log differs.\n Got: %q\nWant: %q", got, want)
+// 	}
+// }
+
+// FIXME: Fails (not a Flusher)
+// func TestStreamingGet(t *testing.T) {
+// 	defer afterTest(t)
+// 	say := make(chan string)
+// 	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// 		w.(http.Flusher).Flush()
+// 		for str := range say {
+// 			w.Write([]byte(str))
+// 			w.(http.Flusher).Flush()
+// 		}
+// 	}))
+// 	defer ts.Close()
+
+// 	c := newClient()
+// 	res, err := c.Get(ts.URL + "/")
+// 	if err != nil {
+// 		t.Fatal(err)
+// 	}
+// 	var buf [10]byte
+// 	for _, str := range []string{"i", "am", "also", "known", "as", "comet"} {
+// 		say <- str
+// 		n, err := io.ReadFull(res.Body, buf[0:len(str)])
+// 		if err != nil {
+// 			t.Fatalf("ReadFull on %q: %v", str, err)
+// 		}
+// 		if n != len(str) {
+// 			t.Fatalf("Receiving %q, only read %d bytes", str, n)
+// 		}
+// 		got := string(buf[0:n])
+// 		if got != str {
+// 			t.Fatalf("Expected %q, got %q", str, got)
+// 		}
+// 	}
+// 	close(say)
+// 	_, err = io.ReadFull(res.Body, buf[0:1])
+// 	if err != io.EOF {
+// 		t.Fatalf("at end expected EOF, got %v", err)
+// 	}
+// }
+
+//
+// HELPERS
+//
+
+var robotsTxtHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Last-Modified", "sometime")
+	fmt.Fprintf(w, "User-agent: go\nDisallow: /something/")
+})
+
+// pedanticReadAll works like ioutil.ReadAll but additionally
+// verifies that r obeys the documented io.Reader contract.
+func pedanticReadAll(r io.Reader) (b []byte, err error) {
+	var bufa [64]byte
+	buf := bufa[:]
+	for {
+		n, err := r.Read(buf)
+		if n == 0 && err == nil {
+			return nil, fmt.Errorf("Read: n=0 with err=nil")
+		}
+		b = append(b, buf[:n]...)
+		if err == io.EOF {
+			n, err := r.Read(buf)
+			if n != 0 || err != io.EOF {
+				return nil, fmt.Errorf("Read: n=%d err=%#v after EOF", n, err)
+			}
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	ts := newServer(robotsTxtHandler)
+	defer ts.Close()
+
+	var lock sync.Mutex
+	var dialled []string
+	tr := &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			lock.Lock()
+			dialled = append(dialled, addr)
+			lock.Unlock()
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}
+	defer tr.CloseAll()
+
+	for i := 0; i < 2; i++ {
+		r, err := (&http.Client{Transport: tr}).Get(ts.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+	lock.Lock()
+	if len(dialled) != 1 || dialled[0] != ts.Listener.Addr().String() {
+		t.Errorf("Expected one dial to %s, got %v", ts.Listener.Addr(), dialled)
+	}
+	lock.Unlock()
+
+	// DialTimeout covers both the dial and the TLS
+	// handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	hang := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	for _, test := range []struct {
+		url  string
+		dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	}{
+		{ts.URL + "/", hang},
+		{"https://" + silent.Addr().String() + "/", nil},
+	} {
+		tr := &spdy.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialContext:     test.dial,
+			DialTimeout:     100 * time.Millisecond,
+		}
+		start := time.Now()
+		_, err := (&http.Client{Transport: tr}).Get(test.url)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected %v, got %v", test.url, context.DeadlineExceeded, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: dial took %v", test.url, elapsed)
+		}
+	}
+}
+
+// serveProxy runs a proxy on l, calling tunnel to
+// read each client's request and connect to the target.
+func serveProxy(l net.Listener, tunnel func(net.Conn) (net.Conn, error)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, err := tunnel(conn)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spdy.UsingSPDY(w) {
+			io.WriteString(w, "SPDY")
+		}
+	}))
+	defer ts.Close()
+
+	var lock sync.Mutex
+	used := make(map[string]int)
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+
+	connect, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connect.Close()
+	go serveProxy(connect, func(conn net.Conn) (net.Conn, error) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return nil, err
+		}
+		if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return nil, errors.New("unauthorised")
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		used["http"]++
+		lock.Unlock()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return target, nil
+	})
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	go serveProxy(socks, func(conn net.Conn) (net.Conn, error) {
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(conn, buf[:3]); err != nil || buf[2] != 2 {
+			return nil, errors.New("bad greeting")
+		}
+		conn.Write([]byte{5, 2})
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[2:2+buf[1]])
+		user := string(buf[2 : 2+buf[1]])
+		io.ReadFull(conn, buf[:1])
+		io.ReadFull(conn, buf[1:1+buf[0]])
+		if user != "user" || string(buf[1:1+buf[0]]) != "pass" {
+			conn.Write([]byte{1, 1})
+			return nil, errors.New("unauthorised")
+		}
+		conn.Write([]byte{1, 0})
+
+		io.ReadFull(conn, buf[:4])
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(conn, buf[:1])
+			io.ReadFull(conn, buf[1:1+buf[0]])
+			host = string(buf[1 : 1+buf[0]])
+		}
+		io.ReadFull(conn, buf[:2])
+		port := int(buf[0])<<8 | int(buf[1])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return nil, err
+		}
+		lock.Lock()
+		used["socks5"]++
+		lock.Unlock()
+		conn.Write([]byte{5, 0, 0, 3, 4, 'h', 'o', 's', 't', 0, 0})
+		return target, nil
+	})
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	for _, test := range []struct {
+		target string
+		proxy  string
+		via    string
+		ok     bool
+	}{
+		{ts.URL, "http://user:pass@" + connect.Addr().String(), "http", true},
+		{ts.URL, "http://user:wrong@" + connect.Addr().String(), "", false},
+		{ts.URL, "socks5://user:pass@" + socks.Addr().String(), "socks5", true},
+		{"https://localhost:" + port, "socks5h://user:pass@" + socks.Addr().String(), "socks5", true},
+		{ts.URL, "socks5://user:wrong@" + socks.Addr().String(), "", false},
+	} {
+		proxy, err := url.Parse(test.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &spdy.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"spdy/3.1"},
+			},
+			Proxy: http.ProxyURL(proxy),
+		}
+
+		lock.Lock()
+		before := used[test.via]
+		lock.Unlock()
+		r, err := (&http.Client{Transport: tr}).Get(test.target + "/")
+		if !test.ok {
+			if err == nil {
+				r.Body.Close()
+				t.Errorf("%s: expected an error", test.proxy)
+			}
+			tr.CloseAll()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.proxy, err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		tr.CloseAll()
+		if err != nil || string(body) != "SPDY" {
+			t.Errorf("%s: expected a SPDY response, got %q (%v)", test.proxy, body, err)
+		}
+		lock.Lock()
+		if used[test.via] != before+1 {
+			t.Errorf("%s: expected the request to use the proxy", test.proxy)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestDialViaProxy(t *testing.T) {
+	// The target echoes until the tunnel is half-closed.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		spdy.ServeConnect(w, nil)
+	}))
+	defer ts.Close()
+
+	proxy, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+	}
+	defer tr.CloseAll()
+
+	conn, err := tr.DialViaProxy(proxy, target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	data := bytes.Repeat([]byte("tunnel"), 30000)
+	go func() {
+		conn.Write(data)
+		conn.(interface {
+			CloseWrite() error
+		}).CloseWrite()
+	}()
+	echo, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatalf("Expected %d bytes echoed, got %d", len(data), len(echo))
+	}
+
+	// Unreachable targets are refused.
+	target.Close()
+	if _, err := tr.DialViaProxy(proxy, target.Addr().String()); err == nil {
+		t.Fatal("Expected an error dialling a closed target.")
+	}
+}
+
+func TestInformationalResponses(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("X-Final", "yes")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "done")
+	}))
+	defer ts.Close()
+
+	client := newClient()
+
+	var codes []int
+	var links []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			codes = append(codes, code)
+			links = append(links, header.Get("Link"))
+			return nil
+		},
+	}
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != 1 || codes[0] != http.StatusEarlyHints || links[0] != "</style.css>; rel=preload" {
+		t.Errorf("Expected one 103 response with a Link header, got %v %q", codes, links)
+	}
+	if res.StatusCode != http.StatusOK || string(body) != "done" {
+		t.Errorf("Expected final response 200 %q, got %d %q", "done", res.StatusCode, body)
+	}
+	if res.Header.Get("X-Final") != "yes" || res.Header.Get("Link") == "" {
+		t.Errorf("Final response is missing headers: %v", res.Header)
+	}
+
+	// An error from Got1xxResponse ends the request.
+	errStop := errors.New("stop")
+	trace.Got1xxResponse = func(int, textproto.MIMEHeader) error {
+		return errStop
+	}
+	req, err = http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	if res, err = client.Do(req); !errors.Is(err, errStop) {
+		if err == nil {
+			res.Body.Close()
+		}
+		t.Errorf("Expected error %v, got %v", errStop, err)
+	}
+}
+
+func TestGoawayRetry(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	spdy.AddSPDY(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+
+	// The first two sessions refuse the first request
+	// with a GOAWAY, without processing it.
+	done := make(chan struct{})
+	var m sync.Mutex
+	sessions := 0
+	ts.Config.TLSNextProto["spdy/3.1"] = func(s *http.Server, conn *tls.Conn, handler http.Handler) {
+		m.Lock()
+		sessions++
+		n := sessions
+		m.Unlock()
+		if n > 2 {
+			spdy3.NextProto1(s, conn, handler)
+			return
+		}
+
+		buf := bufio.NewReader(conn)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				return
+			}
+			if _, ok := frame.(*frames.SYN_STREAM); ok {
+				break
+			}
+		}
+		goaway := new(frames.GOAWAY)
+		goaway.Status = common.GOAWAY_OK
+		if _, err := goaway.WriteTo(conn); err != nil {
+			return
+		}
+		<-done
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	defer close(done)
+
+	client := newClient()
+	tr := client.Transport.(*spdy.Transport)
+
+	// POST is not idempotent, so is not retried by default.
+	_, err := client.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	if !errors.Is(err, common.ErrUnprocessed) {
+		t.Fatalf("Expected error %v, got %v", common.ErrUnprocessed, err)
+	}
+
+	tr.RetryUnprocessed = true
+	res, err := client.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("Expected body %q, got %q", "hello", body)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if sessions != 3 {
+		t.Errorf("Expected 3 sessions, got %d", sessions)
+	}
+}
+
+func TestRefusedStreamRetry(t *testing.T) {
+	ts := httptest.NewUnstartedServer(robotsTxtHandler)
+	spdy.AddSPDY(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+
+	// The server refuses the first, second, fourth
+	// and fifth requests with REFUSED_STREAM, and
+	// replies to the rest with an empty response.
+	var m sync.Mutex
+	requests := 0
+	ts.Config.TLSNextProto["spdy/3.1"] = func(s *http.Server, conn *tls.Conn, handler http.Handler) {
+		buf := bufio.NewReader(conn)
+		compressor := common.NewCompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				return
+			}
+			syn, ok := frame.(*frames.SYN_STREAM)
+			if !ok {
+				continue
+			}
+			m.Lock()
+			requests++
+			n := requests
+			m.Unlock()
+
+			if n <= 2 || n == 4 || n == 5 {
+				rst := new(frames.RST_STREAM)
+				rst.StreamID = syn.StreamID
+				rst.Status = common.RST_STREAM_REFUSED_STREAM
+				if _, err := rst.WriteTo(conn); err != nil {
+					return
+				}
+				continue
+			}
+
+			reply := new(frames.SYN_REPLY)
+			reply.StreamID = syn.StreamID
+			reply.Flags = common.FLAG_FIN
+			reply.Header = make(http.Header)
+			reply.Header.Set(":status", "204")
+			reply.Header.Set(":version", "HTTP/1.1")
+			if err := reply.Compress(compressor); err != nil {
+				return
+			}
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := newClient()
+	tr := client.Transport.(*spdy.Transport)
+	tr.RefusedRetryBackoff = time.Millisecond
+
+	// Refused requests are retried, even with a
+	// method which is not idempotent.
+	res, err := client.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+	m.Lock()
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+	m.Unlock()
+
+	// Retries can be disabled.
+	tr.RefusedRetries = -1
+	_, err = client.Get(ts.URL)
+	var reset *common.StreamResetError
+	if !errors.As(err, &reset) || !reset.Retryable() {
+		t.Fatalf("Expected REFUSED_STREAM reset, got %v", err)
+	}
+
+	// Requests whose body cannot be rewound
+	// are not retried.
+	tr.RefusedRetries = 0
+	_, err = client.Post(ts.URL, "text/plain", io.MultiReader(strings.NewReader("hello")))
+	if !errors.As(err, &reset) || !reset.Retryable() {
+		t.Fatalf("Expected REFUSED_STREAM reset, got %v", err)
+	}
+	m.Lock()
+	if requests != 5 {
+		t.Errorf("Expected 5 requests, got %d", requests)
+	}
+	m.Unlock()
+}
+
+func TestHandoff(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		io.WriteString(w, "done")
+	}))
+	defer ts.Close()
+	client := newClient()
+
+	result := make(chan string, 1)
+	go func() {
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		result <- string(body)
+	}()
+	<-started
+
+	handoffs := make(chan []common.ConnHandoff, 1)
+	go func() {
+		handoffs <- spdy.Handoff(5 * time.Second)
+	}()
+
+	// The active request is finished once the
+	// connections are going away.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		going := 0
+		conns := common.Conns()
+		for _, r := range conns {
+			if g, ok := r.Conn.(spdy.GoawayReporter); !ok || g.GoingAway() {
+				going++
+			}
+		}
+		if going == len(conns) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(finish)
+
+	if body := <-result; body != "done" {
+		t.Errorf("Expected body %q, got %q", "done", body)
+	}
+
+	var server, other *common.ConnHandoff
+	exported := <-handoffs
+	addr := ts.Listener.Addr().String()
+	for i := range exported {
+		switch {
+		case exported[i].LocalAddr == addr:
+			server = &exported[i]
+		case exported[i].RemoteAddr == addr:
+			other = &exported[i]
+		}
+	}
+	if server == nil || other == nil {
+		t.Fatalf("Expected server and client handoffs, got %+v", exported)
+	}
+	if !server.State.GoawaySent {
+		t.Error("Expected GOAWAY to have been sent.")
+	}
+	if len(server.Streams) != 1 || server.Streams[0].ID != 1 {
+		t.Errorf("Expected stream 1 to be handed off, got %+v", server.Streams)
+	}
+
+	// Connections leave the registry as Run returns.
+	deadline = time.Now().Add(5 * time.Second)
+	for len(common.Conns()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(common.Conns()); n != 0 {
+		t.Errorf("Expected all connections to close, got %d", n)
+	}
+
+	// The state can be imported by a new client, which
+	// persists the settings the server flagged to be
+	// persisted.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := spdy3.NewConn(c1, nil, 1)
+	if err := conn.Import(*other); err != nil {
+		t.Error(err)
+	}
+	if err := conn.Import(*server); err == nil {
+		t.Error("Expected an error importing a server's state into a client.")
+	}
+	for id, setting := range other.State.ReceivedSettings {
+		persisted := conn.PersistedSettings[id]
+		switch {
+		case !setting.Flags.PERSIST_VALUE():
+			if persisted != nil {
+				t.Errorf("Imported setting %s, which was not flagged to be persisted", id)
+			}
+		case persisted == nil || persisted.Value != setting.Value:
+			t.Errorf("Expected setting %s to be persisted as %d, got %v", id, setting.Value, persisted)
+		}
+	}
+
+	// Settings which were not flagged to be persisted,
+	// such as the initial window, are not imported.
+	handoff := *other
+	handoff.State.ReceivedSettings = common.Settings{
+		common.SETTINGS_INITIAL_WINDOW_SIZE:    &common.Setting{ID: common.SETTINGS_INITIAL_WINDOW_SIZE, Value: 1 << 20},
+		common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{Flags: common.FLAG_SETTINGS_PERSIST_VALUE, ID: common.SETTINGS_MAX_CONCURRENT_STREAMS, Value: 7},
+	}
+	conn = spdy3.NewConn(c1, nil, 1)
+	window := conn.State().InitialSendWindow
+	if err := conn.Import(handoff); err != nil {
+		t.Error(err)
+	}
+	if w := conn.State().InitialSendWindow; w != window {
+		t.Errorf("Expected initial send window %d, got %d", window, w)
+	}
+	if len(conn.PersistedSettings) != 1 {
+		t.Errorf("Expected 1 persisted setting, got %v", conn.PersistedSettings)
+	}
+	if s := conn.PersistedSettings[common.SETTINGS_MAX_CONCURRENT_STREAMS]; s == nil || s.Value != 7 {
+		t.Errorf("Expected MAX_CONCURRENT_STREAMS to be persisted as 7, got %v", s)
+	}
+}
+
+func TestHeaderDictionary(t *testing.T) {
+	dict := []byte("x-custom-headerhttps:status200:version:methodGET:path/:host")
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	sc, err := spdy.NewServerConn(server, &http.Server{Handler: robotsTxtHandler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.(*spdy3.Conn).SetHeaderDictionary(dict)
+	go sc.Run()
+
+	conn := spdy3.NewConn(client, nil, 1)
+	conn.SetHeaderDictionary(dict)
+	go conn.Run()
+
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Custom-Header", "1")
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := pedanticReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(body), "User-agent:") {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	// The blocks cannot be read with the default dictionary.
+	block, err := common.NewCompressorDict(3, dict).Compress(req.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.NewDecompressor(3).Decompress(block); err == nil {
+		t.Error("Decompressed a custom dictionary's block with the default dictionary")
+	}
+	if _, err := common.NewDecompressorDict(3, dict).Decompress(block); err != nil {
+		t.Error(err)
+	}
+
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestCompressionLevel(t *testing.T) {
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	sc, err := spdy.NewServerConn(server, &http.Server{Handler: robotsTxtHandler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.(*spdy3.Conn).SetCompressionLevel(zlib.NoCompression); err != nil {
+		t.Fatal(err)
+	}
+	go sc.Run()
+
+	conn := spdy3.NewConn(client, nil, 1)
+	if err := conn.SetCompressionLevel(100); err != common.ErrCompressionLevel {
+		t.Errorf("Expected common.ErrCompressionLevel, got %v", err)
+	}
+	if err := conn.SetCompressionLevel(zlib.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// The server's headers were stored, not compressed.
+	sent, received := conn.HeaderCompression()
+	if sent.Blocks != 1 || sent.Compressed == 0 {
+		t.Errorf("Unexpected compression of sent headers: %+v", sent)
+	}
+	if received.Blocks != 1 || received.Compressed < received.Raw {
+		t.Errorf("Unexpected compression of received headers: %+v", received)
+	}
+
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestResponseContentLength(t *testing.T) {
+	server, client := net.Pipe()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn := spdy3.NewConn(client, nil, 1)
+	go conn.Run()
+	defer conn.Close()
+
+	// The server answers each request with a body
+	// shorter or longer than its Content-Length.
+	bodies := []string{"abc", "abcdefghijklm", "abcdefghij"}
+	go func() {
+		buf := bufio.NewReader(server)
+		compressor := common.NewCompressor(3)
+		decompressor := common.NewDecompressor(3)
+		for i := 0; ; {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				return
+			}
+			syn, ok := frame.(*frames.SYN_STREAM)
+			if !ok {
+				continue
+			}
+			if err = syn.Decompress(decompressor); err != nil {
+				t.Error(err)
+				return
+			}
+
+			reply := new(frames.SYN_REPLY)
+			reply.StreamID = syn.StreamID
+			reply.Header = make(http.Header)
+			reply.Header.Set(":status", "200")
+			reply.Header.Set(":version", "HTTP/1.1")
+			reply.Header.Set("Content-Length", "10")
+			data := new(frames.DATA)
+			data.StreamID = syn.StreamID
+			data.Flags = common.FLAG_FIN
+			data.Data = []byte(bodies[i])
+			i++
+			if err = reply.Compress(compressor); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err = reply.WriteTo(server); err != nil {
+				return
+			}
+			if _, err = data.WriteTo(server); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, body := range bodies {
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err == nil {
+			var got []byte
+			got, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err == nil && string(got) != body {
+				t.Errorf("Expected %q, got %q", body, got)
+			}
+		}
+		if len(body) == 10 && err != nil {
+			t.Errorf("Expected %q, got error %v", body, err)
+		} else if len(body) != 10 && err != common.ErrContentLength {
+			t.Errorf("Expected ErrContentLength for %q, got %v", body, err)
+		}
+	}
+
+	// Requests must match their own Content-Length.
+	req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = 5
+	if _, err = conn.RequestResponse(req, nil, 0); err != common.ErrContentLength {
+		t.Errorf("Expected ErrContentLength sending a short body, got %v", err)
+	}
+}
+
+func TestHints(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "hints.json")
+	store, err := spdy.NewFileHintStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newClient()
+	client.Transport.(*spdy.Transport).Hints = store
+
+	r, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	// The hints survive a restart.
+	store, err = spdy.NewFileHintStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hints, ok := store.Load(ts.Listener.Addr().String())
+	if !ok {
+		t.Fatal("Expected hints to be saved.")
+	}
+	if hints.Protocol != "spdy/3.1" {
+		t.Errorf("Expected protocol %q, got %q", "spdy/3.1", hints.Protocol)
+	}
+	setting := hints.Settings[common.SETTINGS_MAX_CONCURRENT_STREAMS]
+	if setting == nil || setting.Value != common.DEFAULT_STREAM_LIMIT {
+		t.Errorf("Expected SETTINGS_MAX_CONCURRENT_STREAMS to be persisted, got %v", hints.Settings)
+	}
+}
+
+func TestPersistedSettings(t *testing.T) {
+	server, client := net.Pipe()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn := spdy3.NewConn(client, nil, 1)
+	conn.PersistedSettings = common.Settings{
+		common.SETTINGS_ROUND_TRIP_TIME: &common.Setting{ID: common.SETTINGS_ROUND_TRIP_TIME, Value: 50},
+	}
+	persisted := make(chan bool, 1)
+	conn.PersistSettings = func(clear bool, persist common.Settings) {
+		if len(persist) != 0 {
+			t.Errorf("Expected no settings to persist, got %v", persist)
+		}
+		persisted <- clear
+	}
+	go conn.Run()
+
+	// The persisted settings follow the client's own.
+	buf := bufio.NewReader(server)
+	for i := 0; i < 2; i++ {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, ok := frame.(*frames.SETTINGS)
+		if !ok {
+			t.Fatalf("Expected SETTINGS, got %v", frame)
+		}
+		setting := settings.Settings[common.SETTINGS_ROUND_TRIP_TIME]
+		if i == 0 && setting != nil {
+			t.Errorf("Persisted settings sent with the client's own: %v", settings)
+		}
+		if i == 1 && (setting == nil || setting.Value != 50 || !setting.Flags.PERSISTED()) {
+			t.Errorf("Expected persisted SETTINGS_ROUND_TRIP_TIME, got %v", settings)
+		}
+	}
+
+	// The server can clear them.
+	settings := new(frames.SETTINGS)
+	settings.Flags = common.FLAG_SETTINGS_CLEAR_SETTINGS
+	settings.Settings = make(common.Settings)
+	if _, err := settings.WriteTo(server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cleared := <-persisted:
+		if !cleared {
+			t.Error("Expected the persisted settings to be cleared.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the settings to be cleared.")
+	}
+
+	server.Close()
+	<-conn.CloseNotify()
+}
+
+func TestPersistedSettingsSPDY2(t *testing.T) {
+	server, client := net.Pipe()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn := spdy2.NewConn(client, nil)
+	conn.PersistedSettings = common.Settings{
+		common.SETTINGS_ROUND_TRIP_TIME: &common.Setting{ID: common.SETTINGS_ROUND_TRIP_TIME, Value: 50},
+	}
+	persisted := make(chan common.Settings, 1)
+	conn.PersistSettings = func(clear bool, persist common.Settings) {
+		persisted <- persist
+	}
+	go conn.Run()
+
+	// The persisted settings follow the client's own.
+	buf := bufio.NewReader(server)
+	for i := 0; i < 2; i++ {
+		frame, err := spdy2frames.ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, ok := frame.(*spdy2frames.SETTINGS)
+		if !ok {
+			t.Fatalf("Expected SETTINGS, got %v", frame)
+		}
+		setting := settings.Settings[common.SETTINGS_ROUND_TRIP_TIME]
+		if i == 1 && (setting == nil || setting.Value != 50 || !setting.Flags.PERSISTED()) {
+			t.Errorf("Expected persisted SETTINGS_ROUND_TRIP_TIME, got %v", settings)
+		}
+	}
+
+	// Values the server flags are persisted.
+	settings := new(spdy2frames.SETTINGS)
+	settings.Settings = make(common.Settings)
+	settings.Add(common.FLAG_SETTINGS_PERSIST_VALUE, common.SETTINGS_MAX_CONCURRENT_STREAMS, 10)
+	if _, err := settings.WriteTo(server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case persist := <-persisted:
+		setting := persist[common.SETTINGS_MAX_CONCURRENT_STREAMS]
+		if setting == nil || setting.Value != 10 {
+			t.Errorf("Expected SETTINGS_MAX_CONCURRENT_STREAMS to be persisted, got %v", persist)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the settings to be persisted.")
+	}
+
+	server.Close()
+	<-conn.CloseNotify()
+}
+
+func newServer(handler http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(handler)
+	spdy.AddSPDY(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	return ts
+}
+
+func newClient() *http.Client {
+	tr := spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+	}
+	return &http.Client{Transport: &tr}
+}
+
+func TestStreamResetError(t *testing.T) {
+	for _, status := range []common.StatusCode{
+		common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_CANCEL,
+		common.RST_STREAM_INTERNAL_ERROR,
+	} {
+		server, client := net.Pipe()
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := spdy3.NewConn(client, nil, 1)
+		go conn.Run()
+
+		// The server resets the request, then
+		// discards anything else it is sent.
+		go func() {
+			buf := bufio.NewReader(server)
+			for {
+				frame, err := frames.ReadFrame(buf, 1)
+				if err != nil {
+					return
+				}
+				if syn, ok := frame.(*frames.SYN_STREAM); ok {
+					rst := new(frames.RST_STREAM)
+					rst.StreamID = syn.StreamID
+					rst.Status = status
+					if _, err := rst.WriteTo(server); err != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		req, err := http.NewRequest("GET", "https://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.RequestResponse(req, nil, 0)
+		var reset *common.StreamResetError
+		if !errors.As(err, &reset) {
+			t.Errorf("%s: expected a *common.StreamResetError, got %v", status, err)
+		} else if reset.Status != status || reset.StreamID != 1 {
+			t.Errorf("%s: unexpected error %v", status, reset)
+		} else if reset.Retryable() != (status == common.RST_STREAM_REFUSED_STREAM) {
+			t.Errorf("%s: unexpected Retryable() %v", status, reset.Retryable())
+		}
+
+		server.Close()
+		<-conn.CloseNotify()
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	cancelled := make(chan struct{}, 2)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up.
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	expectCancelled := func() {
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Handler did not see the stream cancelled")
+		}
+	}
+
+	// The request's context is honoured.
+	client := newClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	expectCancelled()
+
+	// As is the Transport's Timeout.
+	client.Transport.(*spdy.Transport).Timeout = 50 * time.Millisecond
+	if _, err := client.Get(ts.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	expectCancelled()
+
+	// A request whose context has already
+	// ended is not sent.
+	req, err = http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
 	}
-	return &http.Client{Transport: &tr}
 }
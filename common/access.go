@@ -0,0 +1,40 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+)
+
+// AccessControl, if set, is called by new connections for each
+// request they receive, before it is given to the handler, with
+// the client's verified certificate, or nil if the client did not
+// present one, as given by ClientCertificate. If it returns an
+// error, the stream is denied, with a 403 response if
+// RejectionResponses is set, or a RST_STREAM with CANCEL
+// otherwise, and the error's text is logged. REFUSED_STREAM is
+// not used, as it tells clients the request is safe to retry.
+//
+// The server must ask for client certificates for there to be
+// an identity to check, by setting ClientAuth in its TLS config.
+// AccessControl is called from the connection's read loop, so it
+// must not block.
+//
+// By default, AccessControl is nil, and every request is handled.
+var AccessControl func(identity *x509.Certificate, request *http.Request) error
+
+// ClientCertificate returns the client's leaf certificate from
+// state, if the client presented one and it was verified, or
+// nil otherwise. Certificates which were not verified, such as
+// those accepted with tls.RequestClientCert, are not trusted as
+// an identity.
+func ClientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheDigest describes how clients list the resources they have
+// cached, so that servers can cancel pushes of those resources with
+// RST_STREAM CANCEL, rather than sending them in full.
+//
+// The list is taken from the request header named by Header, or, if
+// that is absent, the cookie named by Cookie. It is a comma-separated
+// list of entries, each the path of a resource, such as "/style.css",
+// optionally followed by a space and a validator for the cached copy.
+// This is either its ETag, in quotes, or its Last-Modified time, in
+// seconds since the Unix epoch. An entry with a validator only
+// matches a pushed response with the same ETag, or which was last
+// modified no later than the given time. In a cookie, the list is
+// URL-encoded. For example:
+//
+//	Cache-Digest: /app.js, /style.css "v2", /logo.png 1388534400
+type CacheDigest struct {
+	// Header is the name of the request header
+	// listing the cached resources, if any.
+	Header string
+
+	// Cookie is the name of the cookie listing
+	// the cached resources, if any.
+	Cookie string
+}
+
+// PushCacheDigest is used by new connections to cancel pushes
+// of resources which the client has cached.
+//
+// By default, PushCacheDigest is nil, and pushes are never
+// cancelled.
+var PushCacheDigest *CacheDigest
+
+// Cached returns true iff the request lists the resource with
+// the given path as cached, with a validator, if any, which
+// matches the pushed response's header.
+func (d *CacheDigest) Cached(request *http.Request, path string, response http.Header) bool {
+	if d == nil || request == nil {
+		return false
+	}
+
+	list := ""
+	if d.Header != "" {
+		list = strings.Join(request.Header.Values(d.Header), ",")
+	}
+	if list == "" && d.Cookie != "" {
+		cookie, err := request.Cookie(d.Cookie)
+		if err != nil {
+			return false
+		}
+		list, err = url.QueryUnescape(cookie.Value)
+		if err != nil {
+			return false
+		}
+	}
+
+	for _, entry := range strings.Split(list, ",") {
+		name, validator, _ := strings.Cut(strings.TrimSpace(entry), " ")
+		if name != path {
+			continue
+		}
+		if validatorMatches(strings.TrimSpace(validator), response) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatorMatches returns true iff a cached copy with the
+// given validator matches the response's header. An empty
+// validator matches any response.
+func validatorMatches(validator string, response http.Header) bool {
+	if validator == "" {
+		return true
+	}
+
+	if strings.HasPrefix(validator, `"`) || strings.HasPrefix(validator, "W/") {
+		etag := strings.TrimPrefix(response.Get("Etag"), "W/")
+		return etag != "" && etag == strings.TrimPrefix(validator, "W/")
+	}
+
+	cached, err := strconv.ParseInt(validator, 10, 64)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(response.Get("Last-Modified"))
+	return err == nil && !modified.After(time.Unix(cached, 0))
+}
+
+// PushOutcome describes what became of a server push.
+type PushOutcome int
+
+const (
+	// PushPending indicates that the push
+	// is still being sent.
+	PushPending PushOutcome = iota
+
+	// PushAccepted indicates that the push was
+	// sent in full without being reset.
+	PushAccepted
+
+	// PushCancelled indicates that the server cancelled
+	// the push, as the client has the resource cached.
+	PushCancelled
+
+	// PushReset indicates that the client
+	// reset the push with a RST_STREAM.
+	PushReset
+
+	// PushAborted indicates that the push ended early
+	// for another reason, such as its connection or its
+	// associated stream closing.
+	PushAborted
+)
+
+func (o PushOutcome) String() string {
+	switch o {
+	case PushPending:
+		return "pending"
+	case PushAccepted:
+		return "accepted"
+	case PushCancelled:
+		return "cancelled"
+	case PushReset:
+		return "reset"
+	case PushAborted:
+		return "aborted"
+	}
+	return fmt.Sprintf("PushOutcome(%d)", int(o))
+}
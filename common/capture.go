@@ -0,0 +1,307 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// FrameCapture, if non-nil, records the bytes sent and received
+// by each new connection, for inspection in Wireshark.
+//
+// By default, FrameCapture is nil, disabling capture.
+var FrameCapture *Capture
+
+// captureSegment is the largest TCP payload written in a
+// single packet, which keeps each packet within the 64 KiB
+// limit of an IP datagram.
+const captureSegment = 65000
+
+// linkTypeRaw is the pcap link type for packets which begin
+// with an IPv4 or IPv6 header.
+const linkTypeRaw = 101
+
+// Capture writes the traffic of SPDY connections to a pcap
+// file, which can be opened in Wireshark. Each connection is
+// recorded as a TCP stream between its local and remote
+// addresses, carrying the plaintext sent and received, so
+// connections over TLS can be inspected without their keys.
+// Connections which do not have TCP addresses, such as pipes,
+// are given synthetic addresses on the loopback network.
+//
+// Wireshark only recognises SPDY on port 443 once the TLS has
+// been removed, so the streams may need to be marked as SPDY
+// with Decode As.
+//
+// A Capture is safe for concurrent use. After the first error
+// writing to the underlying writer, nothing more is written,
+// and the error is returned by Err.
+type Capture struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+	port uint16 // last synthetic port used.
+	buf  []byte
+}
+
+// NewCapture returns a Capture which writes to w, once the pcap
+// file header has been written.
+func NewCapture(w io.Writer) (*Capture, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4) // Magic number.
+	binary.LittleEndian.PutUint16(header[4:], 2)          // Major version.
+	binary.LittleEndian.PutUint16(header[6:], 4)          // Minor version.
+	binary.LittleEndian.PutUint32(header[16:], 0xffff)    // Snapshot length.
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	out := new(Capture)
+	out.w = w
+	out.port = 49151
+	return out, nil
+}
+
+// Err returns the first error encountered writing the capture,
+// if any.
+func (c *Capture) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Conn returns the recorder for a connection with the given
+// addresses. A nil *Capture returns a nil *CaptureConn, which
+// records nothing.
+func (c *Capture) Conn(local, remote net.Addr) *CaptureConn {
+	if c == nil {
+		return nil
+	}
+
+	out := new(CaptureConn)
+	out.capture = c
+	out.local, out.localPort = tcpEndpoint(local)
+	out.remote, out.remotePort = tcpEndpoint(remote)
+	out.seq = [2]uint32{1, 1}
+
+	c.lock.Lock()
+	if out.localPort == 0 {
+		c.port++
+		out.local, out.localPort = net.IPv4(127, 0, 0, 1), c.port
+	}
+	if out.remotePort == 0 {
+		c.port++
+		out.remote, out.remotePort = net.IPv4(127, 0, 0, 2), c.port
+	}
+	c.lock.Unlock()
+
+	// If either endpoint uses IPv6, both are given
+	// IPv6 addresses.
+	out.v6 = out.local.To4() == nil || out.remote.To4() == nil
+
+	return out
+}
+
+// tcpEndpoint gives the IP address and port of addr, or a zero
+// port if addr is not a TCP address.
+func tcpEndpoint(addr net.Addr) (net.IP, uint16) {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP != nil {
+		return tcp.IP, uint16(tcp.Port)
+	}
+	return nil, 0
+}
+
+// CaptureConn records the traffic of a single connection in
+// a Capture. A nil *CaptureConn records nothing.
+type CaptureConn struct {
+	capture    *Capture
+	local      net.IP
+	remote     net.IP
+	localPort  uint16
+	remotePort uint16
+	seq        [2]uint32 // next sequence number sent and received.
+	v6         bool      // whether packets are IPv6.
+}
+
+// Sent records data written to the connection.
+func (c *CaptureConn) Sent(data []byte) {
+	c.record(data, true)
+}
+
+// Received records data read from the connection.
+func (c *CaptureConn) Received(data []byte) {
+	c.record(data, false)
+}
+
+// Reader returns a reader which records the data read from r
+// as having been received.
+func (c *CaptureConn) Reader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return captureReader{r, c}
+}
+
+// Writer returns a writer which records the data written to w
+// as having been sent.
+func (c *CaptureConn) Writer(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return captureWriter{w, c}
+}
+
+func (c *CaptureConn) record(data []byte, sent bool) {
+	if c == nil || len(data) == 0 {
+		return
+	}
+
+	now := time.Now()
+	capture := c.capture
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	for len(data) > 0 && capture.err == nil {
+		segment := data
+		if len(segment) > captureSegment {
+			segment = segment[:captureSegment]
+		}
+		data = data[len(segment):]
+		capture.err = capture.writePacket(now, c.packet(segment, sent))
+	}
+}
+
+// packet builds the IP packet carrying data, updating the
+// sequence numbers. The packet is built in the Capture's
+// buffer, so its lock must be held.
+func (c *CaptureConn) packet(data []byte, sent bool) []byte {
+	src, dst := c.local, c.remote
+	srcPort, dstPort := c.localPort, c.remotePort
+	seq, ack := &c.seq[0], c.seq[1]
+	if !sent {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &c.seq[1], c.seq[0]
+	}
+
+	ipLen := 20
+	if c.v6 {
+		ipLen = 40
+	}
+	size := ipLen + 20 + len(data)
+	buf := c.capture.buf[:0]
+	if cap(buf) < size {
+		buf = make([]byte, 0, size)
+		c.capture.buf = buf
+	}
+	buf = buf[:size]
+	for i := range buf[:ipLen+20] {
+		buf[i] = 0
+	}
+
+	// IP header, with the addresses needed for
+	// the TCP checksum's pseudo-header.
+	var pseudo uint32
+	if ipLen == 20 {
+		buf[0] = 0x45
+		binary.BigEndian.PutUint16(buf[2:], uint16(size))
+		buf[6] = 0x40 // Don't fragment.
+		buf[8] = 64   // TTL.
+		buf[9] = 6    // TCP.
+		copy(buf[12:], src.To4())
+		copy(buf[16:], dst.To4())
+		binary.BigEndian.PutUint16(buf[10:], checksum(buf[:20], 0))
+		pseudo = sum(buf[12:20], 0)
+	} else {
+		buf[0] = 0x60
+		binary.BigEndian.PutUint16(buf[4:], uint16(size-40))
+		buf[6] = 6  // TCP.
+		buf[7] = 64 // Hop limit.
+		copy(buf[8:], src.To16())
+		copy(buf[24:], dst.To16())
+		pseudo = sum(buf[8:40], 0)
+	}
+	pseudo += 6 + uint32(size-ipLen)
+
+	// TCP header.
+	tcp := buf[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK.
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(tcp[20:], data)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	*seq += uint32(len(data))
+	return buf
+}
+
+// writePacket writes a pcap record holding packet. The
+// Capture's lock must be held.
+func (c *Capture) writePacket(t time.Time, packet []byte) error {
+	var header [16]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(packet)
+	return err
+}
+
+// sum adds data to the one's complement sum s, as used
+// in the IP and TCP checksums.
+func sum(data []byte, s uint32) uint32 {
+	for len(data) > 1 {
+		s += uint32(data[0])<<8 | uint32(data[1])
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		s += uint32(data[0]) << 8
+	}
+	return s
+}
+
+// checksum gives the Internet checksum of data, starting
+// from the partial sum s.
+func checksum(data []byte, s uint32) uint16 {
+	s = sum(data, s)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+type captureReader struct {
+	r io.Reader
+	c *CaptureConn
+}
+
+func (r captureReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.c.Received(b[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	w io.Writer
+	c *CaptureConn
+}
+
+func (w captureWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.c.Sent(b[:n])
+	return n, err
+}
@@ -0,0 +1,30 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import "fmt"
+
+// DataChecksums, if true, causes new SPDY/3 connections to
+// offer the DATA checksum extension in their initial SETTINGS.
+// If both endpoints offer it, each DATA frame carries a CRC32
+// of its payload, which is verified on receipt. This detects
+// corruption introduced by broken middleboxes, at the cost of
+// four bytes per frame.
+//
+// By default, DataChecksums is false.
+var DataChecksums = false
+
+// ChecksumError indicates that a DATA frame failed the
+// checksum verification of the DATA checksum extension.
+type ChecksumError struct {
+	StreamID StreamID
+	Expected uint32 // checksum sent by the peer.
+	Actual   uint32 // checksum of the payload received.
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Error: DATA checksum mismatch on stream %d (expected %08x, got %08x).",
+		e.StreamID, e.Expected, e.Actual)
+}
@@ -9,23 +9,45 @@ import (
 	"compress/zlib"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"sync"
 )
 
 // CompressionLevel can be used to customise the level of
-// compression used when sending headers.
+// compression used when sending headers. It is read when
+// each compressor is created.
 var CompressionLevel = zlib.BestCompression
 
 var versionError = errors.New("Version not supported.")
 
-var zlibV2Writers chan *zlib.Writer
-var zlibV3Writers chan *zlib.Writer
+// ErrCompressionLevel indicates an invalid zlib
+// compression level.
+var ErrCompressionLevel = errors.New("Error: Invalid compression level.")
 
-func init() {
-	zlibV2Writers = make(chan *zlib.Writer, 5)
-	zlibV3Writers = make(chan *zlib.Writer, 5)
+// zlibWriters holds the zlib writers of closed compressors
+// for reuse, by SPDY version and compression level.
+var (
+	zlibWritersLock sync.Mutex
+	zlibWriters     = make(map[zlibWriterKey]chan *zlib.Writer)
+)
+
+type zlibWriterKey struct {
+	version uint16
+	level   int
+}
+
+func zlibWriterPool(version uint16, level int) chan *zlib.Writer {
+	key := zlibWriterKey{version, level}
+	zlibWritersLock.Lock()
+	defer zlibWritersLock.Unlock()
+	pool, ok := zlibWriters[key]
+	if !ok {
+		pool = make(chan *zlib.Writer, 5)
+		zlibWriters[key] = pool
+	}
+	return pool
 }
 
 // Decompressor is used to decompress name/value header blocks.
@@ -36,6 +58,8 @@ type decompressor struct {
 	in      *bytes.Buffer
 	out     io.ReadCloser
 	version uint16
+	dict    []byte // nil for the version's dictionary.
+	stats   CompressionStats
 }
 
 // NewDecompressor is used to create a new decompressor.
@@ -46,6 +70,31 @@ func NewDecompressor(version uint16) Decompressor {
 	return out
 }
 
+// NewDecompressorDict returns a decompressor for the given
+// SPDY version which uses dict in place of the version's
+// dictionary. The sender must use the same dictionary. If
+// dict is nil, the version's dictionary is used.
+func NewDecompressorDict(version uint16, dict []byte) Decompressor {
+	out := new(decompressor)
+	out.version = version
+	out.dict = dict
+	return out
+}
+
+// HeaderDictionary returns the compression dictionary
+// defined for the given SPDY version, or nil if the
+// version is not supported.
+func HeaderDictionary(version uint16) []byte {
+	switch version {
+	case 2:
+		return HeaderDictionaryV2
+	case 3:
+		return HeaderDictionaryV3
+	default:
+		return nil
+	}
+}
+
 // Decompress uses zlib decompression to decompress the provided
 // data, according to the SPDY specification of the given version.
 func (d *decompressor) Decompress(data []byte) (headers http.Header, err error) {
@@ -63,15 +112,15 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 	// Initialise the decompressor with the appropriate
 	// dictionary, depending on SPDY version.
 	if d.out == nil {
-		switch d.version {
-		case 2:
-			d.out, err = zlib.NewReaderDict(d.in, HeaderDictionaryV2)
-		case 3:
-			d.out, err = zlib.NewReaderDict(d.in, HeaderDictionaryV3)
-		default:
-			err = versionError
+		dict := d.dict
+		if dict == nil {
+			dict = HeaderDictionary(d.version)
+		}
+		if dict == nil {
+			return nil, versionError
 		}
 
+		d.out, err = zlib.NewReaderDict(d.in, dict)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +154,13 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 
 	headers = make(http.Header)
 	bounds := MAX_FRAME_SIZE - 12 // Maximum frame size minus maximum non-headers data (SYN_STREAM)
+
+	// Once the header block exceeds MaxHeaderBlockSize, the
+	// rest is read and discarded, so that the decompression
+	// state remains in step with the sender's.
+	total := size
+	tooLarge := false
+	malformed := false
 	for i := 0; i < numNameValuePairs; i++ {
 		var nameLength, valueLength int
 
@@ -121,9 +177,18 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 			return nil, errors.New("Error: Incorrect header name length.")
 		}
 		bounds -= nameLength
+		total += size + nameLength
+		if MaxHeaderBlockSize > 0 && total > MaxHeaderBlockSize {
+			tooLarge = true
+		}
 
 		// Get the name.
-		name, err := ReadExactly(d.out, nameLength)
+		var name []byte
+		if tooLarge {
+			err = discard(d.out, nameLength)
+		} else {
+			name, err = ReadExactly(d.out, nameLength)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -141,6 +206,17 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 			return nil, errors.New("Error: Incorrect header values length.")
 		}
 		bounds -= valueLength
+		total += size + valueLength
+		if MaxHeaderBlockSize > 0 && total > MaxHeaderBlockSize {
+			tooLarge = true
+		}
+
+		if tooLarge {
+			if err = discard(d.out, valueLength); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		// Get the values.
 		values, err := ReadExactly(d.out, valueLength)
@@ -148,15 +224,95 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 			return nil, err
 		}
 
-		// Split the value on null boundaries.
+		// Split the value on null boundaries. A name may have a
+		// single empty value, but each of several values must be
+		// non-empty. Malformed values are reported once the rest
+		// of the block has been read, as for oversized blocks.
+		if len(values) == 0 {
+			headers.Add(string(name), "")
+			continue
+		}
 		for _, value := range bytes.Split(values, []byte{'\x00'}) {
+			if len(value) == 0 {
+				malformed = true
+				break
+			}
 			headers.Add(string(name), string(value))
 		}
 	}
 
+	d.stats.Blocks++
+	d.stats.Raw += uint64(total)
+	d.stats.Compressed += uint64(len(data))
+
+	if tooLarge {
+		debug.Printf("Error: Maximum header block size is %d. Received %d.\n", MaxHeaderBlockSize, total)
+		return nil, ErrHeaderBlockTooLarge
+	}
+	if malformed {
+		debug.Println("Error: Received header value with an empty NUL-separated value.")
+		return nil, ErrMalformedHeader
+	}
+
+	// Rejoin any cookie crumbs into a single header.
+	if cookies := headers["Cookie"]; len(cookies) > 1 {
+		headers["Cookie"] = []string{strings.Join(cookies, "; ")}
+	}
+
 	return headers, nil
 }
 
+// headerValues returns the values which can be sent for a
+// name. Since values are separated by null bytes, any which
+// contain one are dropped, as are empty values, unless there
+// are no others.
+func headerValues(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" && strings.IndexByte(value, 0) < 0 {
+			out = append(out, value)
+		} else if value != "" {
+			debug.Printf("Warning: Dropping header value %q containing a null byte.\n", value)
+		}
+	}
+	return out
+}
+
+// crumbleCookies splits Cookie header values into
+// their individual cookies, dropping any empty ones.
+func crumbleCookies(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, crumb := range strings.Split(value, ";") {
+			if crumb = strings.TrimSpace(crumb); crumb != "" {
+				out = append(out, crumb)
+			}
+		}
+	}
+	return out
+}
+
+// Stats returns the totals for the header
+// blocks decompressed.
+func (d *decompressor) Stats() CompressionStats {
+	d.Lock()
+	defer d.Unlock()
+	return d.stats
+}
+
+// discard reads and discards n bytes from r,
+// without buffering them.
+func discard(r io.Reader, n int) error {
+	copied, err := io.Copy(ioutil.Discard, io.LimitReader(r, int64(n)))
+	if err != nil {
+		return err
+	}
+	if copied != int64(n) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
 // Compressor is used to compress name/value header blocks.
 // Compressors retain their state, so a single Compressor
 // should be used for each direction of a particular
@@ -166,6 +322,9 @@ type compressor struct {
 	buf     *bytes.Buffer
 	w       *zlib.Writer
 	version uint16
+	level   int
+	dict    []byte // nil for the version's dictionary.
+	stats   CompressionStats
 }
 
 // NewCompressor is used to create a new compressor.
@@ -173,6 +332,38 @@ type compressor struct {
 func NewCompressor(version uint16) Compressor {
 	out := new(compressor)
 	out.version = version
+	out.level = CompressionLevel
+	return out
+}
+
+// NewCompressorLevel returns a compressor for the given SPDY
+// version which uses the given zlib compression level, such
+// as zlib.BestSpeed, and dict in place of the version's
+// dictionary, unless dict is nil. The zlib state is only
+// allocated once the first header block is compressed, so
+// idle connections hold little memory.
+func NewCompressorLevel(version uint16, level int, dict []byte) (Compressor, error) {
+	if level < zlib.HuffmanOnly || level > zlib.BestCompression {
+		return nil, ErrCompressionLevel
+	}
+	out := new(compressor)
+	out.version = version
+	out.level = level
+	out.dict = dict
+	return out, nil
+}
+
+// NewCompressorDict returns a compressor for the given SPDY
+// version which uses dict in place of the version's dictionary.
+// The receiver must use the same dictionary, so this is only
+// useful with peers configured to match, such as when tuning
+// a dictionary. If dict is nil, the version's dictionary is
+// used.
+func NewCompressorDict(version uint16, dict []byte) Compressor {
+	out := new(compressor)
+	out.version = version
+	out.level = CompressionLevel
+	out.dict = dict
 	return out
 }
 
@@ -189,26 +380,25 @@ func (c *compressor) Compress(h http.Header) ([]byte, error) {
 		c.buf.Reset()
 	}
 
-	// Same for the compressor.
+	// Same for the compressor. Writers using a custom
+	// dictionary cannot be shared, so are not pooled.
 	if c.w == nil {
-		var err error
-		switch c.version {
-		case 2:
-			select {
-			case c.w = <-zlibV2Writers:
-				c.w.Reset(c.buf)
-			default:
-				c.w, err = zlib.NewWriterLevelDict(c.buf, CompressionLevel, HeaderDictionaryV2)
-			}
-		case 3:
-			select {
-			case c.w = <-zlibV3Writers:
-				c.w.Reset(c.buf)
-			default:
-				c.w, err = zlib.NewWriterLevelDict(c.buf, CompressionLevel, HeaderDictionaryV3)
+		dict := c.dict
+		var pool chan *zlib.Writer // nil if not pooled.
+		if dict == nil {
+			dict = HeaderDictionary(c.version)
+			if dict == nil {
+				return nil, versionError
 			}
+			pool = zlibWriterPool(c.version, c.level)
+		}
+
+		var err error
+		select {
+		case c.w = <-pool:
+			c.w.Reset(c.buf)
 		default:
-			err = versionError
+			c.w, err = zlib.NewWriterLevelDict(c.buf, c.level, dict)
 		}
 		if err != nil {
 			return nil, err
@@ -242,8 +432,14 @@ func (c *compressor) Compress(h http.Header) ([]byte, error) {
 			continue
 		}
 
+		// Cookies are sent as separate crumbs, so that
+		// unchanged cookies compress well.
+		if http.CanonicalHeaderKey(name) == "Cookie" {
+			values = crumbleCookies(values)
+		}
+
 		// Multiple values are separated by a single null byte.
-		pairs[name] = strings.Join(values, "\x00")
+		pairs[name] = strings.Join(headerValues(values), "\x00")
 
 		// +size for len(name), +size for len(values).
 		length += len(name) + size + len(pairs[name]) + size
@@ -319,24 +515,51 @@ func (c *compressor) Compress(h http.Header) ([]byte, error) {
 	}
 
 	c.w.Flush()
+	c.stats.Blocks++
+	c.stats.Raw += uint64(len(out))
+	c.stats.Compressed += uint64(c.buf.Len())
 	return c.buf.Bytes(), nil
 }
 
+// Stats returns the totals for the header
+// blocks compressed.
+func (c *compressor) Stats() CompressionStats {
+	c.Lock()
+	defer c.Unlock()
+	return c.stats
+}
+
+// CompressionStats describes the header blocks
+// handled by a Compressor or Decompressor.
+type CompressionStats struct {
+	Blocks     uint64 // Header blocks processed.
+	Raw        uint64 // Bytes before compression.
+	Compressed uint64 // Bytes after compression.
+}
+
+// Ratio returns the ratio of raw to compressed
+// bytes, or 0 if no headers have been processed.
+func (s CompressionStats) Ratio() float64 {
+	if s.Compressed == 0 {
+		return 0
+	}
+	return float64(s.Raw) / float64(s.Compressed)
+}
+
 func (c *compressor) Close() error {
 	if c.w == nil {
 		return nil
 	}
-	var channel chan *zlib.Writer
-	switch c.version {
-	case 2:
-		channel = zlibV2Writers
-	case 3:
-		channel = zlibV3Writers
-	default:
+	if c.dict != nil {
+		err := c.w.Close()
+		c.w = nil
+		return err
+	}
+	if HeaderDictionary(c.version) == nil {
 		return ErrInvalidVersion
 	}
 	select {
-	case channel <- c.w:
+	case zlibWriterPool(c.version, c.level) <- c.w:
 	default:
 		err := c.w.Close()
 		if err != nil {
@@ -50,42 +50,52 @@ const (
 
 // RST_STREAM status codes
 const (
-	RST_STREAM_PROTOCOL_ERROR        = 1
-	RST_STREAM_INVALID_STREAM        = 2
-	RST_STREAM_REFUSED_STREAM        = 3
-	RST_STREAM_UNSUPPORTED_VERSION   = 4
-	RST_STREAM_CANCEL                = 5
-	RST_STREAM_INTERNAL_ERROR        = 6
-	RST_STREAM_FLOW_CONTROL_ERROR    = 7
-	RST_STREAM_STREAM_IN_USE         = 8
-	RST_STREAM_STREAM_ALREADY_CLOSED = 9
-	RST_STREAM_INVALID_CREDENTIALS   = 10
-	RST_STREAM_FRAME_TOO_LARGE       = 11
+	RST_STREAM_PROTOCOL_ERROR        StatusCode = 1
+	RST_STREAM_INVALID_STREAM        StatusCode = 2
+	RST_STREAM_REFUSED_STREAM        StatusCode = 3
+	RST_STREAM_UNSUPPORTED_VERSION   StatusCode = 4
+	RST_STREAM_CANCEL                StatusCode = 5
+	RST_STREAM_INTERNAL_ERROR        StatusCode = 6
+	RST_STREAM_FLOW_CONTROL_ERROR    StatusCode = 7
+	RST_STREAM_STREAM_IN_USE         StatusCode = 8
+	RST_STREAM_STREAM_ALREADY_CLOSED StatusCode = 9
+	RST_STREAM_INVALID_CREDENTIALS   StatusCode = 10
+	RST_STREAM_FRAME_TOO_LARGE       StatusCode = 11
 )
 
 // GOAWAY status codes
 const (
-	GOAWAY_OK                 = 0
-	GOAWAY_PROTOCOL_ERROR     = 1
-	GOAWAY_INTERNAL_ERROR     = 2
-	GOAWAY_FLOW_CONTROL_ERROR = 3
+	GOAWAY_OK                 GoawayStatus = 0
+	GOAWAY_PROTOCOL_ERROR     GoawayStatus = 1
+	GOAWAY_INTERNAL_ERROR     GoawayStatus = 2
+	GOAWAY_FLOW_CONTROL_ERROR GoawayStatus = 3
 )
 
 // Settings IDs
 const (
-	SETTINGS_UPLOAD_BANDWIDTH               = 1
-	SETTINGS_DOWNLOAD_BANDWIDTH             = 2
-	SETTINGS_ROUND_TRIP_TIME                = 3
-	SETTINGS_MAX_CONCURRENT_STREAMS         = 4
-	SETTINGS_CURRENT_CWND                   = 5
-	SETTINGS_DOWNLOAD_RETRANS_RATE          = 6
-	SETTINGS_INITIAL_WINDOW_SIZE            = 7
-	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE = 8
+	SETTINGS_UPLOAD_BANDWIDTH               SettingID = 1
+	SETTINGS_DOWNLOAD_BANDWIDTH             SettingID = 2
+	SETTINGS_ROUND_TRIP_TIME                SettingID = 3
+	SETTINGS_MAX_CONCURRENT_STREAMS         SettingID = 4
+	SETTINGS_CURRENT_CWND                   SettingID = 5
+	SETTINGS_DOWNLOAD_RETRANS_RATE          SettingID = 6
+	SETTINGS_INITIAL_WINDOW_SIZE            SettingID = 7
+	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE SettingID = 8
+)
+
+// Extensions. These are not part of the SPDY specification,
+// and are only used once both endpoints have advertised them.
+const (
+	FLAG_DATA_CHECKSUM               = 0x80   // DATA payload ends with a CRC32.
+	SETTINGS_DATA_CHECKSUM SettingID = 0xc5c0 // DATA checksums are supported.
 )
 
 // Maximum frame size (2 ** 24 -1).
 const MAX_FRAME_SIZE = 0xffffff
 
+// Minimum frame size every implementation must accept.
+const MIN_FRAME_SIZE = 8192
+
 const MAX_DATA_SIZE = 0xffffff
 
 // Maximum stream ID (2 ** 31 -1).
@@ -123,7 +133,14 @@ var statusCodeText = map[StatusCode]string{
 	RST_STREAM_FRAME_TOO_LARGE:       "FRAME_TOO_LARGE",
 }
 
-var settingText = map[uint32]string{
+var goawayStatusText = map[GoawayStatus]string{
+	GOAWAY_OK:                 "OK",
+	GOAWAY_PROTOCOL_ERROR:     "PROTOCOL_ERROR",
+	GOAWAY_INTERNAL_ERROR:     "INTERNAL_ERROR",
+	GOAWAY_FLOW_CONTROL_ERROR: "FLOW_CONTROL_ERROR",
+}
+
+var settingText = map[SettingID]string{
 	SETTINGS_UPLOAD_BANDWIDTH:               "UPLOAD_BANDWIDTH",
 	SETTINGS_DOWNLOAD_BANDWIDTH:             "DOWNLOAD_BANDWIDTH",
 	SETTINGS_ROUND_TRIP_TIME:                "ROUND_TRIP_TIME",
@@ -132,6 +149,7 @@ var settingText = map[uint32]string{
 	SETTINGS_DOWNLOAD_RETRANS_RATE:          "DOWNLOAD_RETRANS_RATE",
 	SETTINGS_INITIAL_WINDOW_SIZE:            "INITIAL_WINDOW_SIZE",
 	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE: "CLIENT_CERTIFICATE_VECTOR_SIZE",
+	SETTINGS_DATA_CHECKSUM:                  "DATA_CHECKSUM",
 }
 
 // DefaultPriority returns the default request
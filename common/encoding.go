@@ -0,0 +1,119 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"compress/flate"
+	"strconv"
+	"strings"
+)
+
+// CompressResponses, if true, causes new connections to compress
+// response bodies with gzip or deflate, as allowed by the request's
+// Accept-Encoding header. Responses which set their own
+// Content-Encoding, have no body, are partial, or whose content type
+// is already compressed, as reported by Compressible, are sent as
+// written. The Content-Type of a response is sniffed from its first
+// write if the handler has not set it.
+//
+// By default, CompressResponses is false.
+var CompressResponses = false
+
+// ResponseCompressionLevel is the flate compression level used
+// for response bodies when CompressResponses is set.
+//
+// By default, ResponseCompressionLevel is flate.DefaultCompression.
+var ResponseCompressionLevel = flate.DefaultCompression
+
+// ResponseEncoding returns the content coding with which to compress
+// a response to a request with the given Accept-Encoding header,
+// which is "gzip" or "deflate", or "" if the client accepts neither.
+// Where both are acceptable, the one with the higher quality value
+// is chosen, preferring gzip.
+func ResponseEncoding(acceptEncoding string) string {
+	var gzip, deflate, any float64 = -1, -1, -1
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+
+		switch coding {
+		case "gzip", "x-gzip":
+			gzip = q
+		case "deflate":
+			deflate = q
+		case "*":
+			any = q
+		}
+	}
+
+	// A wildcard covers the codings not named.
+	if gzip < 0 {
+		gzip = any
+	}
+	if deflate < 0 {
+		deflate = any
+	}
+
+	switch {
+	case gzip > 0 && gzip >= deflate:
+		return "gzip"
+	case deflate > 0:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressedTypes lists the media types, other than those of
+// images, audio and video, whose content is already compressed.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/octet-stream":     true,
+	"application/pdf":              true,
+	"application/vnd.rar":          true,
+	"application/wasm":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-bzip2":          true,
+	"application/x-gzip":           true,
+	"application/x-rar-compressed": true,
+	"application/x-xz":             true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// Compressible returns true iff a body of the given content type
+// is worth compressing. Images, other than SVG, audio, video and
+// archives are already compressed, so are not. An empty content
+// type is not compressible, as nothing is known of the content.
+func Compressible(contentType string) bool {
+	media, _, _ := strings.Cut(contentType, ";")
+	media = strings.ToLower(strings.TrimSpace(media))
+	if media == "" || compressedTypes[media] {
+		return false
+	}
+
+	kind, _, _ := strings.Cut(media, "/")
+	switch kind {
+	case "image":
+		return media == "image/svg+xml"
+	case "audio", "video":
+		return false
+	}
+	return true
+}
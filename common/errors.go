@@ -25,6 +25,8 @@ var (
 	ErrConnNil        = errors.New("Error: Connection is nil.")
 	ErrConnClosed     = errors.New("Error: Connection is closed.")
 	ErrGoaway         = errors.New("Error: GOAWAY received.")
+	ErrUnprocessed    = errors.New("Error: Request refused by GOAWAY before being processed.")
+	ErrStreamClosed   = errors.New("Error: Stream closed.")
 	ErrNoFlowControl  = errors.New("Error: This connection does not use flow control.")
 	ErrConnectFail    = errors.New("Error: Failed to connect.")
 	ErrInvalidVersion = errors.New("Error: Invalid SPDY version.")
@@ -36,8 +38,97 @@ var (
 	// ErrNotConnected indicates that a SPDY-specific feature was
 	// attempted with a Client not connected to the given server.
 	ErrNotConnected = errors.New("Error: Not connected to given server.")
+
+	// ErrNotWebSocket indicates that a WebSocket was accepted
+	// for a request which did not open one.
+	ErrNotWebSocket = errors.New("Error: Not a WebSocket request.")
+
+	// Header validation errors. See ValidateHeader.
+	ErrTooManyHeaders      = errors.New("Error: Too many headers.")
+	ErrHeaderBlockTooLarge = errors.New("Error: Header block too large.")
+	ErrHeaderValueTooLarge = errors.New("Error: Header value too large.")
+	ErrMalformedHeader     = errors.New("Error: Malformed header.")
+
+	// Request header errors. See RequestFromHeader.
+	ErrMissingPseudoHeader  = errors.New("Error: Missing pseudo-header.")
+	ErrConnectionHeader     = errors.New("Error: Connection-specific header.")
+	ErrInvalidHTTPVersion   = errors.New("Error: Invalid HTTP version.")
+	ErrInvalidRequestURL    = errors.New("Error: Invalid request URL.")
+	ErrInvalidContentLength = errors.New("Error: Invalid Content-Length.")
+
+	// ErrContentLength indicates that the DATA sent or received
+	// on a stream did not match its Content-Length header.
+	ErrContentLength = errors.New("Error: Body length does not match Content-Length.")
+
+	// ErrPushCached indicates that a resource was not pushed,
+	// as the client has shown that it has the resource cached.
+	ErrPushCached = errors.New("Error: Pushed resource is cached by the client.")
+
+	// ErrWindowUpdateThreshold indicates a WindowUpdateThreshold
+	// outside the range 0 to 1.
+	ErrWindowUpdateThreshold = errors.New("Error: Window update threshold must be between 0 and 1.")
 )
 
+// StreamResetError is the cause given when a stream is
+// ended abruptly with a RST_STREAM, such as when a client
+// resets a stream whose server handler is still running.
+type StreamResetError struct {
+	StreamID StreamID
+	Status   StatusCode
+}
+
+func (e *StreamResetError) Error() string {
+	return fmt.Sprintf("Error: Stream %d reset with %s.", e.StreamID, e.Status)
+}
+
+// Retryable indicates whether the request can safely be
+// sent again. A stream reset with REFUSED_STREAM was not
+// processed by the peer, whereas one reset with CANCEL or
+// INTERNAL_ERROR may have been partly processed.
+func (e *StreamResetError) Retryable() bool {
+	return e.Status == RST_STREAM_REFUSED_STREAM
+}
+
+// StreamContextError annotates an error raised deep in the
+// connection, such as in flow control or compression, with
+// the stream on which it occurred, so that a single log line
+// identifies the request involved.
+type StreamContextError struct {
+	Err      error
+	StreamID StreamID
+	Path     string // Request path, if known.
+	Peer     string // Remote address of the connection.
+}
+
+// WrapStreamError returns err annotated with the given
+// stream context. A nil error, or one which already has
+// stream context, is returned unchanged.
+func WrapStreamError(err error, streamID StreamID, path, peer string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*StreamContextError); ok {
+		return err
+	}
+	return &StreamContextError{
+		Err:      err,
+		StreamID: streamID,
+		Path:     path,
+		Peer:     peer,
+	}
+}
+
+func (e *StreamContextError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%v [stream %d, peer %s]", e.Err, e.StreamID, e.Peer)
+	}
+	return fmt.Sprintf("%v [stream %d, path %q, peer %s]", e.Err, e.StreamID, e.Path, e.Peer)
+}
+
+func (e *StreamContextError) Unwrap() error {
+	return e.Err
+}
+
 type incorrectDataLength struct {
 	got, expected int
 }
@@ -52,6 +143,27 @@ func (i *incorrectDataLength) Error() string {
 
 var FrameTooLarge = errors.New("Error: Frame too large.")
 
+// ErrMemoryBudget indicates that a stream was reset because
+// its connection had exceeded its memory budget.
+var ErrMemoryBudget = errors.New("Error: Connection memory budget exceeded.")
+
+var (
+	ErrBadFrameSize     = errors.New("Error: Maximum frame size must be between 8192 and 16777223 bytes.")
+	ErrBadDataChunkSize = errors.New("Error: DATA chunk size must be between 1 and 16777215 bytes.")
+)
+
+// CheckFrameSizes returns an error if the maximum
+// frame size or DATA chunk size is out of bounds.
+func CheckFrameSizes(maxFrame, dataChunk int) error {
+	if maxFrame < MIN_FRAME_SIZE || maxFrame > MAX_FRAME_SIZE+8 {
+		return ErrBadFrameSize
+	}
+	if dataChunk < 1 || dataChunk > MAX_DATA_SIZE {
+		return ErrBadDataChunkSize
+	}
+	return nil
+}
+
 type invalidField struct {
 	field         string
 	got, expected int
@@ -0,0 +1,82 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// EventHistory is the number of recent frames recorded by
+// each new SPDY/3 connection, for use in diagnosing wedged
+// connections. A value of 0 disables the record.
+var EventHistory = 64
+
+// Event records a frame sent or received on a connection.
+// Header blocks are not recorded, since they may contain
+// credentials.
+type Event struct {
+	Time     time.Time
+	Sent     bool     // whether the frame was sent, rather than received.
+	Frame    string   // frame type, such as "DATA".
+	StreamID StreamID `json:",omitempty"`
+	Detail   string   `json:",omitempty"` // such as the frame's length or status.
+}
+
+// EventLog holds the most recent events on a connection,
+// discarding the oldest once it is full. A nil *EventLog
+// records nothing.
+type EventLog struct {
+	lock   sync.Mutex
+	events []Event
+	next   int // index of the oldest event, once full.
+}
+
+// NewEventLog returns a log of the given size, or nil
+// if size is not positive.
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		return nil
+	}
+	out := new(EventLog)
+	out.events = make([]Event, 0, size)
+	return out
+}
+
+// Add records an event.
+func (l *EventLog) Add(event Event) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	if len(l.events) < cap(l.events) {
+		l.events = append(l.events, event)
+	} else {
+		l.events[l.next] = event
+		l.next = (l.next + 1) % len(l.events)
+	}
+	l.lock.Unlock()
+}
+
+// Events returns the events recorded, oldest first.
+func (l *EventLog) Events() []Event {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	out := make([]Event, 0, len(l.events))
+	out = append(out, l.events[l.next:]...)
+	out = append(out, l.events[:l.next]...)
+	return out
+}
+
+// SchedulerState summarises the frames and data waiting
+// to be sent on a connection, by priority.
+type SchedulerState struct {
+	Streams  [8]int // active streams sending at each priority.
+	Buffered [8]int // bytes of DATA held for the streams' send windows.
+	FairHeld [8]int // frames held back by fair scheduling.
+}
@@ -0,0 +1,21 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+// ConnHandoff describes a connection being handed off
+// during a restart, so that the old and new processes can
+// coordinate. It can be encoded as JSON.
+//
+// Compression contexts cannot migrate between processes,
+// so a connection cannot be resumed by the new process.
+// Instead, the old process finishes the streams listed,
+// and the other endpoint opens a new connection for any
+// further streams.
+type ConnHandoff struct {
+	LocalAddr  string
+	RemoteAddr string
+	State      ConnState
+	Streams    []StreamInfo // streams left to the old process.
+}
@@ -5,6 +5,7 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -57,13 +58,20 @@ type PriorityStream interface {
 }
 
 // Frame represents a single SPDY frame.
+//
+// String gives a detailed, multi-line description of the
+// frame, for debugging. Summary gives a single line, which
+// is better suited to high-volume logs, and MarshalJSON
+// gives a machine-readable form for structured logging.
 type Frame interface {
 	fmt.Stringer
 	io.ReaderFrom
 	io.WriterTo
+	json.Marshaler
 	Compress(Compressor) error
 	Decompress(Decompressor) error
 	Name() string
+	Summary() string
 }
 
 // Compressor is used to compress the text header of a SPDY frame.
@@ -124,6 +132,26 @@ type Receiver interface {
 	ReceiveRequest(request *http.Request) bool
 }
 
+// Objects implementing the PushHandler interface can be
+// registered on a client to receive server pushes.
+//
+// HandlePush is called when the server begins a push, and
+// must return quickly. If it returns false, the push is
+// refused with a RST_STREAM CANCEL. Otherwise, the pushed
+// response can be read from the PushedResponse, typically
+// in a new goroutine.
+type PushHandler interface {
+	HandlePush(push *PushedResponse) bool
+}
+
+// PushHandlerFunc is an adapter to allow the use of
+// ordinary functions as PushHandlers.
+type PushHandlerFunc func(push *PushedResponse) bool
+
+func (f PushHandlerFunc) HandlePush(push *PushedResponse) bool {
+	return f(push)
+}
+
 // Objects conforming to the FlowControl interface can be
 // used to provide the flow control mechanism for a
 // connection using SPDY version 3 and above.
@@ -5,9 +5,236 @@
 package common
 
 import (
+	"net/http"
 	"sync"
+	"time"
 )
 
+// FairnessWindow is the window over which new SPDY/3 connections
+// share bandwidth fairly between the streams in each priority
+// class. Without fair scheduling, a newly opened bulk stream can
+// briefly starve an interactive stream of the same priority.
+//
+// By default, FairnessWindow is 0, disabling fair scheduling.
+var FairnessWindow time.Duration
+
+// RoundRobinQuantum is the number of bytes of DATA that each
+// stream in a priority class on new SPDY/3 connections may
+// send in its turn, as the streams with data waiting take
+// turns. This takes precedence over FairnessWindow.
+//
+// By default, RoundRobinQuantum is 0, disabling round robin
+// scheduling.
+var RoundRobinQuantum int
+
+// StarvationBound is the longest that a priority class on new
+// SPDY/3 connections may make no progress while higher-priority
+// frames are sent. Once the bound is exceeded, the class's next
+// frame is sent ahead of them. Without this, a busy stream can
+// starve all streams of lower priority indefinitely.
+//
+// By default, StarvationBound is 0, disabling the watchdog.
+var StarvationBound time.Duration
+
+// FlowStallThreshold is the time for which a stream on new SPDY/3
+// connections may be blocked by flow control, with DATA held for
+// want of a WINDOW_UPDATE from its peer, before the stall is logged
+// and counted in the connection's FlowStalls stat.
+//
+// By default, FlowStallThreshold is 0, and stalls are not reported.
+var FlowStallThreshold time.Duration
+
+// FlowStallTimeout is the time for which a stream on new SPDY/3
+// connections may be blocked by flow control before it is reset
+// with RST_STREAM CANCEL and counted in the connection's
+// FlowStallResets stat, so that a peer which stops sending
+// WINDOW_UPDATEs cannot hold the stream and its buffered DATA
+// forever.
+//
+// By default, FlowStallTimeout is 0, and stalled streams are
+// never reset.
+var FlowStallTimeout time.Duration
+
+// WindowUpdateThreshold is the fraction of a receive window's
+// initial size which new SPDY/3 connections let its growth reach
+// before sending it in a WINDOW_UPDATE, so that a peer sending
+// many small DATA frames is not sent an update for each. Growth is
+// sent sooner once it exceeds what is left of the window the peer
+// has been given. A threshold of 0 sends growth as soon as the flow
+// control module grants it. It must be between 0 and 1.
+//
+// By default, WindowUpdateThreshold is 0.5, half the window.
+var WindowUpdateThreshold = 0.5
+
+// MaxFrameSize is the default size of the largest frame, including
+// its 8-byte header, which new SPDY/3 connections accept. Larger
+// DATA frames are discarded, and their streams are reset with
+// FRAME_TOO_LARGE. Larger control frames end the connection, since
+// a header block cannot be skipped without losing the compression
+// state. It must be between MIN_FRAME_SIZE and MAX_FRAME_SIZE + 8.
+// By default, MaxFrameSize is MAX_FRAME_SIZE + 8, so that every
+// legal frame is accepted.
+var MaxFrameSize = MAX_FRAME_SIZE + 8
+
+// DataChunkSize is the default size of the largest DATA frame
+// payload sent by new SPDY/3 connections. Writes are split into
+// frames of at most this size. Smaller chunks reduce the latency
+// of other streams' frames, at the cost of more frames, and so
+// more system calls. It must be between 1 and MAX_DATA_SIZE.
+var DataChunkSize = MAX_DATA_SIZE
+
+// WriteBatchSize is the largest batch of frames which new SPDY/3
+// connections hold before writing them to the network. Frames
+// are batched while more are waiting to be sent, so that several
+// can be written with each system call, and the batch is written
+// as soon as no more are waiting. A size of 0 disables batching,
+// so that each frame is written as it is sent.
+var WriteBatchSize = 64 << 10
+
+// ExpectContinueTimeout is the default time for which new
+// SPDY/3 connections hold the body of a request sent with
+// Expect: 100-continue, waiting for the server's interim
+// 100 Continue response, before sending it anyway.
+var ExpectContinueTimeout = time.Second
+
+// RefusedStreamRetries is the default number of times a
+// Transport retries a request which the server refuses with
+// REFUSED_STREAM. RefusedStreamBackoff is the delay before the
+// first retry, which doubles with each further retry.
+var (
+	RefusedStreamRetries = 3
+	RefusedStreamBackoff = 10 * time.Millisecond
+)
+
+// BodyDrainLimit is the default number of bytes which new SPDY/3
+// connections read and discard from a pushed response whose body
+// is closed before it has been read fully, so that the push can
+// finish normally rather than being cancelled with RST_STREAM.
+// This mirrors net/http, which drains small bodies so that the
+// connection can be reused. If more than BodyDrainLimit bytes
+// remain, as far as is known, the push is cancelled at once.
+//
+// By default, BodyDrainLimit is 0, cancelling every push
+// whose body is closed early.
+var BodyDrainLimit int64
+
+// PushBufferLimit is the default number of bytes which new
+// SPDY/3 connections buffer from a pushed response before it
+// is read. Pushes do not have their receive windows regrown,
+// so the server can send up to the initial window unasked. A
+// push which exceeds the limit is cancelled with RST_STREAM,
+// and reads of its body fail with ErrPushBufferFull. A limit
+// of 0 disables the check.
+//
+// By default, PushBufferLimit is 1 MiB.
+var PushBufferLimit int64 = 1 << 20
+
+// BufferRequestBodies determines whether new SPDY/3 connections
+// buffer request bodies of known length in full before calling
+// their handlers, rather than streaming them to the handlers as
+// they are received.
+//
+// By default, BufferRequestBodies is false, so that handlers
+// are called as soon as the request headers arrive.
+var BufferRequestBodies bool
+
+// HandleEarly, if set, decides for each request with a body
+// received by new SPDY/3 connections whether its handler is
+// called as soon as the request headers arrive, or once the
+// request is complete, in place of BufferRequestBodies.
+var HandleEarly func(request *http.Request) bool
+
+// BodySpillThreshold is the default size beyond which new
+// SPDY/3 connections spill the request bodies they buffer
+// for handlers to temporary files in BodySpillDir, or
+// os.TempDir if it is empty. This bounds the memory used by
+// large uploads to handlers which do not stream them.
+//
+// By default, BodySpillThreshold is 0, holding request
+// bodies in memory.
+var (
+	BodySpillThreshold int64
+	BodySpillDir       string
+)
+
+// MaxRequestBodyBytes is the default limit on the size of each
+// request body received by new SPDY/3 connections. A request
+// which declares a longer Content-Length, or sends more DATA,
+// is answered with 413 Request Entity Too Large if its handler
+// has not yet responded, and its stream is reset with CANCEL,
+// so that the client stops sending. Handlers reading the body
+// are given an *http.MaxBytesError. The receive window is not
+// grown beyond the limit, so well-behaved clients stop sending
+// there.
+//
+// By default, MaxRequestBodyBytes is 0, so request bodies are
+// not limited.
+var MaxRequestBodyBytes int64
+
+// Limits on received header blocks, enforced by ValidateHeader.
+// A limit of 0 disables that check.
+var (
+	// MaxHeaderCount is the maximum number of header values.
+	MaxHeaderCount = 256
+
+	// MaxHeaderBlockSize is the maximum size, in bytes, of a
+	// decompressed header block. This is also enforced during
+	// decompression, so that a small compressed block cannot
+	// expand to fill memory.
+	MaxHeaderBlockSize = 256 * 1024
+
+	// MaxHeaderValueLength is the maximum size, in bytes, of
+	// any one header value.
+	MaxHeaderValueLength = 64 * 1024
+)
+
+// PanicHandler, if set, is called by new SPDY/3 connections
+// when a handler panics, with the request, the value passed
+// to panic, and the goroutine's stack trace, so that the panic
+// can be reported to an error tracker. The stream is ended
+// with a 500 response if the handler had not yet sent its
+// headers, or a RST_STREAM with INTERNAL_ERROR otherwise.
+//
+// By default, PanicHandler is nil, and panics are logged.
+var PanicHandler func(request *http.Request, v interface{}, stack []byte)
+
+// Validation determines how new SPDY/3 connections respond
+// to violations of the specification which they could
+// tolerate. See ValidationMode.
+//
+// By default, Validation is ValidationLenient.
+var Validation = ValidationLenient
+
+// ClosedStreamGrace is how long new SPDY/3 connections
+// remember streams which have closed or been reset. Frames
+// received for such a stream within this period were in
+// flight when it closed, so are ignored, whereas later
+// frames are answered with a RST_STREAM with the status
+// STREAM_ALREADY_CLOSED.
+//
+// By default, ClosedStreamGrace is 10 seconds.
+var ClosedStreamGrace = 10 * time.Second
+
+// ErrorHandler, if set, is called by new SPDY/3 connections
+// when the peer violates the protocol, such as by sending a
+// malformed frame, an invalid stream ID or a header block
+// which cannot be decompressed, just before the connection
+// is ended. It is given the error and the offending frame,
+// which may be nil or incomplete if it could not be parsed,
+// and returns how the connection should be ended.
+//
+// By default, ErrorHandler is nil, and protocol errors are
+// only logged.
+var ErrorHandler func(err error, frame Frame) ErrorAction
+
+// LogHeaderBlockSize, if positive, causes SPDY/3 and SPDY/3.1
+// connections to log each header block sent or received whose
+// names and values exceed this many bytes, with its stream ID,
+// to help diagnose header bloat.
+//
+// By default, LogHeaderBlockSize is 0, logging no header blocks.
+var LogHeaderBlockSize = 0
+
 // StreamLimit is used to add and enforce
 // a limit on the number of concurrently
 // active streams.
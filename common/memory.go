@@ -0,0 +1,134 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"sync"
+)
+
+// MemoryBudget is the default limit, in bytes, on the memory
+// used by each new SPDY/3 connection to buffer data: request
+// bodies held in memory until handlers read them, DATA held
+// until the other endpoint's window grows, and the header
+// blocks of active requests. Once the budget is exceeded, the
+// connection stops growing its receive windows, so that the
+// other endpoint must stop sending, and grows them again once
+// the buffered data has been consumed. A stream which receives
+// DATA while the connection is using more than twice its
+// budget, as can happen with very many streams, is reset. The
+// budget should be well above the initial receive window, as
+// the other endpoint may fill its windows before it learns
+// that they will not grow.
+//
+// By default, MemoryBudget is 0, disabling the budget.
+var MemoryBudget int64
+
+// MemoryAccount tracks the memory used against a budget. A nil
+// MemoryAccount imposes no budget. It is safe for concurrent
+// use.
+type MemoryAccount struct {
+	lock   sync.Mutex
+	limit  int64
+	used   int64
+	peak   int64
+	resume func() // called once the account is back within budget.
+}
+
+// NewMemoryAccount returns a MemoryAccount with the given budget.
+// If resume is non-nil, it is called in a new goroutine whenever
+// the memory used falls back within the budget after exceeding
+// it. If limit is not positive, NewMemoryAccount returns nil.
+func NewMemoryAccount(limit int64, resume func()) *MemoryAccount {
+	if limit <= 0 {
+		return nil
+	}
+
+	out := new(MemoryAccount)
+	out.limit = limit
+	out.resume = resume
+	return out
+}
+
+// Limit returns the budget, or 0 if there is none.
+func (m *MemoryAccount) Limit() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.limit
+}
+
+// Used returns the memory in use, and the most that has
+// been in use at once.
+func (m *MemoryAccount) Used() (used, peak int64) {
+	if m == nil {
+		return 0, 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used, m.peak
+}
+
+// Exceeded reports whether the memory in use exceeds the
+// budget.
+func (m *MemoryAccount) Exceeded() bool {
+	return m.Exceeds(1)
+}
+
+// Exceeds reports whether the memory in use exceeds the
+// given multiple of the budget.
+func (m *MemoryAccount) Exceeds(multiple int64) bool {
+	if m == nil {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used > m.limit*multiple
+}
+
+// Add charges n bytes to the account.
+func (m *MemoryAccount) Add(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.lock.Lock()
+	m.used += n
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+	m.lock.Unlock()
+}
+
+// Release returns n bytes to the account.
+func (m *MemoryAccount) Release(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.lock.Lock()
+	over := m.used > m.limit
+	m.used -= n
+	if m.used < 0 {
+		m.used = 0
+	}
+	resumed := over && m.used <= m.limit
+	m.lock.Unlock()
+
+	if resumed && m.resume != nil {
+		go m.resume()
+	}
+}
+
+// HeaderSize returns the size of header's names and
+// values, which approximates the memory it uses.
+func HeaderSize(header http.Header) int64 {
+	size := 0
+	for name, values := range header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
@@ -0,0 +1,135 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// requestPseudoHeaders are the pseudo-headers which
+// every SPDY/3 request must carry.
+var requestPseudoHeaders = []string{":method", ":path", ":version", ":host", ":scheme"}
+
+// pseudoHeaders are the pseudo-headers which are translated
+// into fields of http.Request and http.Response, and so are
+// hidden from their Header. Others, such as ":protocol", are
+// left in place.
+var pseudoHeaders = append([]string{":status"}, requestPseudoHeaders...)
+
+// connectionHeaders are specific to a single HTTP/1.1
+// connection, and must not be sent over SPDY.
+var connectionHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"}
+
+// StripPseudoHeaders removes the pseudo-headers which have
+// equivalent http.Request or http.Response fields from
+// header, returning their values.
+func StripPseudoHeaders(header http.Header) map[string]string {
+	out := make(map[string]string)
+	for _, name := range pseudoHeaders {
+		if values, ok := header[name]; ok {
+			if len(values) > 0 {
+				out[name] = values[0]
+			}
+			delete(header, name)
+		}
+	}
+	return out
+}
+
+// CheckConnectionHeaders returns ErrConnectionHeader if
+// header contains any connection-specific header.
+func CheckConnectionHeaders(header http.Header) error {
+	for _, name := range connectionHeaders {
+		if _, ok := header[name]; ok {
+			return ErrConnectionHeader
+		}
+	}
+	return nil
+}
+
+// RequestFromHeader builds the request described by a SPDY/3
+// SYN_STREAM's header block. The pseudo-headers are moved from
+// header into the request's fields, and header becomes its
+// Header. The caller must set any connection details, such as
+// RemoteAddr and TLS.
+//
+// RequestFromHeader returns ErrMissingPseudoHeader if any of
+// :method, :path, :version, :host and :scheme is missing,
+// ErrConnectionHeader if the block contains connection-specific
+// headers, ErrInvalidHTTPVersion if :version cannot be parsed,
+// ErrInvalidRequestURL if the URL cannot be parsed, and
+// ErrInvalidContentLength if the Content-Length is invalid. The
+// request's ContentLength is -1 if no length was given.
+func RequestFromHeader(header http.Header) (*http.Request, error) {
+	if err := CheckConnectionHeaders(header); err != nil {
+		return nil, err
+	}
+	for _, name := range requestPseudoHeaders {
+		if header.Get(name) == "" {
+			return nil, ErrMissingPseudoHeader
+		}
+	}
+
+	pseudo := StripPseudoHeaders(header)
+	u, err := url.Parse(pseudo[":scheme"] + "://" + pseudo[":host"] + pseudo[":path"])
+	if err != nil {
+		return nil, ErrInvalidRequestURL
+	}
+
+	vers := pseudo[":version"]
+	major, minor, ok := http.ParseHTTPVersion(vers)
+	if !ok {
+		return nil, ErrInvalidHTTPVersion
+	}
+
+	length, err := ContentLength(header)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &http.Request{
+		Method:        pseudo[":method"],
+		URL:           u,
+		Proto:         vers,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Host:          u.Host,
+		RequestURI:    u.RequestURI(),
+		ContentLength: length,
+	}
+	return request, nil
+}
+
+// ContentLength returns the length declared by the Content-Length
+// header in header, or -1 if there is none. It returns
+// ErrInvalidContentLength if the header is not a non-negative integer,
+// or is repeated with different values, since the lengths could
+// be read differently by another server handling the request.
+func ContentLength(header http.Header) (int64, error) {
+	values := header["Content-Length"]
+	if len(values) == 0 {
+		return -1, nil
+	}
+
+	var length int64 = -1
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" || strings.TrimLeft(field, "0123456789") != "" {
+				return -1, ErrInvalidContentLength
+			}
+			n, err := strconv.ParseInt(field, 10, 64)
+			if err != nil || (length >= 0 && n != length) {
+				return -1, ErrInvalidContentLength
+			}
+			length = n
+		}
+	}
+	return length, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// DefaultLearnThreshold is the number of times a resource
+// must be requested from a page before a learning PushPolicy
+// pushes it with that page.
+const DefaultLearnThreshold = 2
+
+// MaxLearnedResources is the maximum number of resources a
+// PushPolicy will learn for any one page.
+const MaxLearnedResources = 16
+
+// PushPolicy determines which resources a server pushes
+// automatically with each request. Resources are given as
+// paths on the same host as the request.
+//
+// Rules can be added explicitly with Add. If Learn is set,
+// the policy also learns rules from the Referer headers of
+// subsequent requests, so a resource which is repeatedly
+// requested from a page will be pushed with that page.
+//
+// The zero value is an empty policy ready to use.
+type PushPolicy struct {
+	// Learn enables learning from Referer headers.
+	Learn bool
+
+	// LearnThreshold is the number of times a resource must
+	// be seen with a given referer before it is pushed. If
+	// zero, DefaultLearnThreshold is used.
+	LearnThreshold int
+
+	lock    sync.Mutex
+	rules   map[string][]string
+	learned map[string]map[string]int
+}
+
+// NewPushPolicy returns an empty PushPolicy, which
+// does not learn. Rules are added with Add, and
+// learning is enabled by setting Learn.
+func NewPushPolicy() *PushPolicy {
+	return new(PushPolicy)
+}
+
+// Add registers a rule, so that the given resources are
+// pushed whenever path is requested.
+func (p *PushPolicy) Add(path string, resources ...string) {
+	p.lock.Lock()
+	if p.rules == nil {
+		p.rules = make(map[string][]string)
+	}
+	p.rules[path] = append(p.rules[path], resources...)
+	p.lock.Unlock()
+}
+
+// Resources returns the paths of the resources to be pushed
+// in response to r. Each resource is only listed once.
+func (p *PushPolicy) Resources(r *http.Request) []string {
+	if r == nil || r.URL == nil {
+		return nil
+	}
+
+	path := r.URL.Path
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	seen := map[string]struct{}{path: struct{}{}}
+	out := make([]string, 0, len(p.rules[path]))
+	for _, resource := range p.rules[path] {
+		if _, ok := seen[resource]; !ok {
+			seen[resource] = struct{}{}
+			out = append(out, resource)
+		}
+	}
+
+	threshold := p.LearnThreshold
+	if threshold <= 0 {
+		threshold = DefaultLearnThreshold
+	}
+
+	learned := make([]string, 0, len(p.learned[path]))
+	for resource, n := range p.learned[path] {
+		if _, ok := seen[resource]; !ok && n >= threshold {
+			learned = append(learned, resource)
+		}
+	}
+	sort.Strings(learned)
+
+	return append(out, learned...)
+}
+
+// Observe records r for learning, if Learn is set. Only
+// GET requests with a Referer on the same host are used.
+func (p *PushPolicy) Observe(r *http.Request) {
+	if !p.Learn || r == nil || r.URL == nil || r.Method != "GET" {
+		return
+	}
+
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host || referer.Path == r.URL.Path {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.learned == nil {
+		p.learned = make(map[string]map[string]int)
+	}
+	counts := p.learned[referer.Path]
+	if counts == nil {
+		counts = make(map[string]int)
+		p.learned[referer.Path] = counts
+	}
+	if _, ok := counts[r.URL.Path]; !ok && len(counts) >= MaxLearnedResources {
+		return
+	}
+	counts[r.URL.Path]++
+}
@@ -0,0 +1,317 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrPushCancelled is returned when reading the body of a
+// push which has been cancelled, by either endpoint.
+var ErrPushCancelled = errors.New("Error: Push cancelled.")
+
+// ErrPushBufferFull is returned when reading the body of a
+// push which was cancelled because more of its data arrived
+// unread than its buffer limit allows.
+var ErrPushBufferFull = errors.New("Error: Push buffer limit exceeded.")
+
+// PushedResponse is a server push received by a client. It
+// is given to a PushHandler when the push begins, and its
+// response can then be read as the push's headers and data
+// arrive.
+type PushedResponse struct {
+	// Request is the request sent by the server in the push.
+	Request *http.Request
+
+	StreamID StreamID
+
+	headerM    sync.Mutex
+	header     http.Header
+	statusCode int
+	ready      chan struct{} // closed once the response begins.
+	readyOnce  sync.Once
+
+	body        *pushBody
+	cancel      func()
+	drainLimit  int64 // bytes drained if the body is closed early.
+	bufferLimit int64 // bytes buffered unread before the push is cancelled.
+}
+
+// NewPushedResponse is used by connections to create a
+// PushedResponse. The given cancel function should send a
+// RST_STREAM with CANCEL for the push.
+func NewPushedResponse(request *http.Request, streamID StreamID, cancel func()) *PushedResponse {
+	out := new(PushedResponse)
+	out.Request = request
+	out.StreamID = streamID
+	out.header = make(http.Header)
+	out.ready = make(chan struct{})
+	out.body = newPushBody(out)
+	out.cancel = cancel
+	return out
+}
+
+// Response waits for the push's response headers, then
+// returns the response. Its Body is read as the push's data
+// arrives. Closing the Body before it has been read fully
+// cancels the push.
+func (p *PushedResponse) Response() *http.Response {
+	<-p.ready
+
+	out := new(http.Response)
+
+	p.headerM.Lock()
+	out.StatusCode = p.statusCode
+	out.Header = CloneHeader(p.header)
+	p.headerM.Unlock()
+
+	out.Status = fmt.Sprintf("%d %s", out.StatusCode, http.StatusText(out.StatusCode))
+	out.Proto = "HTTP/1.1"
+	out.ProtoMajor = 1
+	out.ProtoMinor = 1
+	out.ContentLength = -1
+	if length, err := strconv.ParseInt(out.Header.Get("Content-Length"), 10, 64); err == nil {
+		out.ContentLength = length
+	}
+	out.Body = p.body
+	out.Trailer = make(http.Header)
+	out.Request = p.Request
+	return out
+}
+
+// SetDrainLimit sets the number of bytes read and discarded
+// if the Body is closed before it has been read fully, rather
+// than cancelling the push. If more than limit bytes remain, as
+// far as is known, the push is still cancelled. A limit of 0,
+// the default, cancels the push at once.
+func (p *PushedResponse) SetDrainLimit(limit int64) {
+	p.headerM.Lock()
+	p.drainLimit = limit
+	p.headerM.Unlock()
+}
+
+// SetBufferLimit sets the number of bytes of data buffered
+// before the Body is read. If more arrives unread, the push
+// is cancelled, and reads of the Body fail with
+// ErrPushBufferFull. A limit of 0, the default, disables the
+// check.
+func (p *PushedResponse) SetBufferLimit(limit int64) {
+	p.headerM.Lock()
+	p.bufferLimit = limit
+	p.headerM.Unlock()
+}
+
+// remaining returns the number of bytes of the body yet to be
+// received, given those received already, or -1 if the length
+// is not known.
+func (p *PushedResponse) remaining(received int64) int64 {
+	p.headerM.Lock()
+	defer p.headerM.Unlock()
+	length, err := strconv.ParseInt(p.header.Get("Content-Length"), 10, 64)
+	if err != nil || length < received {
+		return -1
+	}
+	return length - received
+}
+
+// Cancel refuses the push, or stops it if it has already
+// begun, sending a RST_STREAM with CANCEL.
+func (p *PushedResponse) Cancel() {
+	if p.body.closeWithError(ErrPushCancelled) {
+		p.begin()
+		if p.cancel != nil {
+			p.cancel()
+		}
+	}
+}
+
+// ReceiveHeader is used by the connection to pass on the
+// push's response headers.
+func (p *PushedResponse) ReceiveHeader(header http.Header) {
+	p.headerM.Lock()
+	UpdateHeader(p.header, header)
+	status := strings.TrimSpace(p.header.Get(":status"))
+	if i := strings.Index(status, " "); i >= 0 {
+		status = status[:i]
+	}
+	if s, err := strconv.Atoi(status); err == nil {
+		p.statusCode = s
+	}
+	p.headerM.Unlock()
+
+	if status != "" {
+		p.begin()
+	}
+}
+
+// ReceiveData is used by the connection to pass on the
+// push's data. The final bool indicates the end of the push.
+func (p *PushedResponse) ReceiveData(data []byte, final bool) {
+	p.begin()
+
+	p.headerM.Lock()
+	limit := p.bufferLimit
+	p.headerM.Unlock()
+	if !p.body.write(data, limit) {
+		if p.body.closeWithError(ErrPushBufferFull) && p.cancel != nil {
+			p.cancel()
+		}
+		return
+	}
+	if final {
+		p.body.closeWithError(io.EOF)
+	}
+}
+
+// Reset is used by the connection when the push is reset
+// by the server, or the connection closes.
+func (p *PushedResponse) Reset(err error) {
+	p.body.closeWithError(err)
+	p.begin()
+}
+
+// Done returns a channel which is closed when the push has
+// ended, successfully or otherwise.
+func (p *PushedResponse) Done() <-chan struct{} {
+	return p.body.done
+}
+
+func (p *PushedResponse) begin() {
+	p.readyOnce.Do(func() {
+		p.headerM.Lock()
+		if p.statusCode == 0 {
+			p.statusCode = http.StatusOK
+		}
+		p.headerM.Unlock()
+		close(p.ready)
+	})
+}
+
+// pushBody buffers a push's data until it is read, so that
+// the connection is never blocked by a slow reader.
+type pushBody struct {
+	push     *PushedResponse
+	lock     sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	received int64         // bytes of data received.
+	closed   bool          // set once Close has been called.
+	err      error         // set once the push ends.
+	done     chan struct{} // closed once the push ends.
+}
+
+func newPushBody(push *PushedResponse) *pushBody {
+	out := new(pushBody)
+	out.push = push
+	out.cond = sync.NewCond(&out.lock)
+	out.done = make(chan struct{})
+	return out
+}
+
+func (b *pushBody) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// Close cancels the push if it has not yet finished,
+// unless the rest of it can be drained within the push's
+// drain limit.
+func (b *pushBody) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	finished := b.err != nil
+	received := b.received
+	b.buf.Reset()
+	b.lock.Unlock()
+	if finished {
+		return nil
+	}
+
+	b.push.headerM.Lock()
+	limit := b.push.drainLimit
+	b.push.headerM.Unlock()
+	remaining := b.push.remaining(received)
+	if limit <= 0 || remaining > limit {
+		b.push.Cancel()
+		return nil
+	}
+
+	go b.drain(received + limit)
+	return nil
+}
+
+// drain discards the push's data as it arrives, cancelling
+// the push if it has not ended once more than limit bytes
+// have been received.
+func (b *pushBody) drain(limit int64) {
+	b.lock.Lock()
+	for b.err == nil && b.received <= limit {
+		b.cond.Wait()
+	}
+	finished := b.err != nil
+	b.lock.Unlock()
+
+	if !finished {
+		b.push.Cancel()
+	}
+}
+
+// write buffers data until it is read, returning false
+// if this would buffer more than limit bytes, if limit is
+// positive.
+func (b *pushBody) write(data []byte, limit int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return true
+	}
+	if !b.closed && limit > 0 && int64(b.buf.Len()+len(data)) > limit {
+		return false
+	}
+	b.received += int64(len(data))
+	if !b.closed {
+		b.buf.Write(data)
+	}
+	b.cond.Broadcast()
+	return true
+}
+
+// closeWithError ends the body, returning false if it had
+// already ended.
+func (b *pushBody) closeWithError(err error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return false
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	b.err = err
+	close(b.done)
+	b.cond.Broadcast()
+	return true
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionRateLimit and StreamRateLimit are the default
+// limits, in bytes per second, on the DATA sent by each new
+// SPDY/3 connection and by each of its streams, respectively.
+// This stops one greedy stream or client from starving the
+// others.
+//
+// By default, both are 0, disabling rate limiting.
+var (
+	ConnectionRateLimit int64
+	StreamRateLimit     int64
+)
+
+// ThroughputWindow is the period over which throughput
+// is measured.
+const ThroughputWindow = time.Second
+
+// RateLimiter is a token bucket, used to limit the rate
+// at which data is sent. Each token represents one byte.
+// A nil RateLimiter imposes no limit.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // tokens added per second.
+	burst  float64 // maximum tokens held.
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate bytes
+// per second, in bursts of up to burst bytes. If burst is
+// not positive, it is set to rate. If rate is not positive,
+// NewRateLimiter returns nil.
+func NewRateLimiter(rate, burst int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+
+	out := new(RateLimiter)
+	out.rate = float64(rate)
+	out.burst = float64(burst)
+	out.tokens = out.burst
+	out.last = time.Now()
+	return out
+}
+
+// Rate returns the limit in bytes per second.
+func (r *RateLimiter) Rate() int64 {
+	if r == nil {
+		return 0
+	}
+	return int64(r.rate)
+}
+
+// reserve takes n tokens from the bucket, returning how
+// long the caller must wait before they are available.
+// The bucket may go into debt, so writes larger than the
+// burst size are still permitted.
+func (r *RateLimiter) reserve(n int) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes may be sent. If cancel is
+// closed first, Wait returns false.
+func (r *RateLimiter) Wait(n int, cancel <-chan bool) bool {
+	if r == nil || n <= 0 {
+		return true
+	}
+
+	d := r.reserve(n)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// ThroughputMeter measures the rate at which data is
+// transferred over the last ThroughputWindow. The zero
+// value is ready to use.
+type ThroughputMeter struct {
+	lock     sync.Mutex
+	start    time.Time // start of the current period.
+	current  int64     // bytes in the current period.
+	previous int64     // bytes in the previous period.
+}
+
+// rotate moves the meter on to the period containing now.
+func (m *ThroughputMeter) rotate(now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+		return
+	}
+
+	periods := now.Sub(m.start) / ThroughputWindow
+	switch {
+	case periods == 0:
+		return
+	case periods == 1:
+		m.previous = m.current
+	default:
+		m.previous = 0
+	}
+	m.current = 0
+	m.start = m.start.Add(periods * ThroughputWindow)
+}
+
+// Add records n bytes as transferred.
+func (m *ThroughputMeter) Add(n int) {
+	m.lock.Lock()
+	m.rotate(time.Now())
+	m.current += int64(n)
+	m.lock.Unlock()
+}
+
+// Rate returns the current throughput, in bytes per second.
+func (m *ThroughputMeter) Rate() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.rotate(now)
+
+	// Weight the previous period by how much of it
+	// still falls within the window.
+	elapsed := float64(now.Sub(m.start)) / float64(ThroughputWindow)
+	total := float64(m.previous)*(1-elapsed) + float64(m.current)
+	return total / ThroughputWindow.Seconds()
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RegisteredConn describes a connection in the registry
+// of running connections.
+type RegisteredConn struct {
+	ID    uint64 // unique for the life of the process.
+	Conn  Conn
+	Since time.Time // when the connection started running.
+}
+
+// registry holds the connections which are running, for
+// use by debugging tools.
+var registry struct {
+	sync.Mutex
+	nextID uint64
+	conns  map[Conn]RegisteredConn
+}
+
+// RegisterConn adds a connection to the registry. It is
+// called as the connection starts running.
+func RegisterConn(conn Conn) {
+	registry.Lock()
+	if registry.conns == nil {
+		registry.conns = make(map[Conn]RegisteredConn)
+	}
+	registry.nextID++
+	registry.conns[conn] = RegisteredConn{ID: registry.nextID, Conn: conn, Since: time.Now()}
+	registry.Unlock()
+}
+
+// UnregisterConn removes a connection from the registry.
+// It is called once the connection has ended.
+func UnregisterConn(conn Conn) {
+	registry.Lock()
+	delete(registry.conns, conn)
+	registry.Unlock()
+}
+
+// Conns returns the running connections, in the order
+// in which they started.
+func Conns() []RegisteredConn {
+	registry.Lock()
+	out := make([]RegisteredConn, 0, len(registry.conns))
+	for _, conn := range registry.conns {
+		out = append(out, conn)
+	}
+	registry.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
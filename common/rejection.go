@@ -0,0 +1,67 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// RejectionResponses, if true, causes servers to refuse
+// streams which cannot be handled, such as those with bad
+// headers or which exceed the stream limit, with a minimal
+// response rather than a bare RST_STREAM. This lets browsers
+// show a useful error to the user.
+//
+// By default, RejectionResponses is false.
+var RejectionResponses = false
+
+// RejectUnidirectional, if true, causes servers to refuse
+// client streams sent with FLAG_UNIDIRECTIONAL with a
+// PROTOCOL_ERROR, as no response can be sent on them.
+//
+// By default, RejectUnidirectional is false, and such
+// streams are served as usual, with any response
+// discarded.
+var RejectUnidirectional = false
+
+// RejectionTemplate is used to produce the body of rejection
+// responses. It is executed with a Rejection.
+var RejectionTemplate = template.Must(template.New("rejection").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Reason}}</p>
+</body>
+</html>
+`))
+
+// Rejection describes a stream refused by the server.
+type Rejection struct {
+	Status     int    // HTTP status code.
+	StatusText string // Text for the status code.
+	Reason     string // Short description of why the stream was refused.
+}
+
+// NewRejection returns a Rejection with the given
+// status and reason.
+func NewRejection(status int, reason string) *Rejection {
+	return &Rejection{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+	}
+}
+
+// Body renders the rejection using RejectionTemplate.
+func (r *Rejection) Body() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := RejectionTemplate.Execute(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -66,7 +66,11 @@ func (r *Response) ReceiveHeader(req *http.Request, header http.Header) {
 		r.Header = make(http.Header)
 	}
 	UpdateHeader(r.Header, header)
-	if status := r.Header.Get(":status"); status != "" {
+
+	// The pseudo-headers are not shown in the response's
+	// Header, as they are given by its fields.
+	pseudo := StripPseudoHeaders(r.Header)
+	if status := pseudo[":status"]; status != "" {
 		status = strings.TrimSpace(status)
 		if i := strings.Index(status, " "); i >= 0 {
 			status = status[:i]
@@ -0,0 +1,78 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerTimingMode determines how servers report the
+// timing of each stream, as given by ServerTimingValue.
+type ServerTimingMode int
+
+const (
+	// ServerTimingOff disables timing reports.
+	ServerTimingOff ServerTimingMode = iota
+
+	// ServerTimingHeader adds a Server-Timing header to
+	// each response, sent with its final frame, so that
+	// clients can see where the time was spent.
+	ServerTimingHeader
+
+	// ServerTimingLog logs the timing of each response.
+	ServerTimingLog
+)
+
+func (m ServerTimingMode) String() string {
+	switch m {
+	case ServerTimingOff:
+		return "off"
+	case ServerTimingHeader:
+		return "header"
+	case ServerTimingLog:
+		return "log"
+	}
+	return fmt.Sprintf("ServerTimingMode(%d)", int(m))
+}
+
+// ServerTiming determines how new connections report the
+// timing of each response they send.
+//
+// By default, ServerTiming is ServerTimingOff.
+var ServerTiming = ServerTimingOff
+
+// ServerTimingValue returns the stream's timings as the value of a
+// Server-Timing header, with each duration in milliseconds:
+//
+//	queue   the time from the stream opening to its handler being
+//	        called, waiting for a worker and the request body.
+//	handler the time for which the handler ran.
+//	flush   the time from the handler returning to all of its
+//	        DATA having been released by flow control.
+//	stall   the total time for which flow control held DATA,
+//	        waiting for the transfer window to grow.
+//
+// Timings which have not been recorded are left out.
+func (s *StreamStats) ServerTimingValue() string {
+	var parts []string
+	add := func(name string, d time.Duration) {
+		ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+		parts = append(parts, name+";dur="+ms)
+	}
+	if !s.Opened.IsZero() && !s.HandlerStarted.IsZero() {
+		add("queue", s.HandlerStarted.Sub(s.Opened))
+	}
+	if !s.HandlerStarted.IsZero() && !s.HandlerFinished.IsZero() {
+		add("handler", s.HandlerFinished.Sub(s.HandlerStarted))
+	}
+	if !s.HandlerFinished.IsZero() && !s.Flushed.IsZero() {
+		add("flush", s.Flushed.Sub(s.HandlerFinished))
+	}
+	add("stall", s.FlowControlStall)
+	return strings.Join(parts, ", ")
+}
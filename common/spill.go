@@ -0,0 +1,141 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SpillBuffer is a FIFO buffer which holds up to a threshold
+// of data in memory, and spills the rest to a temporary file,
+// so that large bodies can be buffered with bounded memory.
+// Data is read in the order in which it was written, and it
+// is safe to read and write concurrently.
+type SpillBuffer struct {
+	lock      sync.Mutex
+	threshold int64 // 0 disables spilling.
+	dir       string
+	mem       bytes.Buffer
+	file      *os.File // nil until the threshold is reached.
+	readPos   int64    // offset of the next read from file.
+	writePos  int64    // offset of the next write to file.
+	err       error    // error writing to file, if any.
+
+	// Account, if non-nil, is charged for the data
+	// held in memory.
+	Account *MemoryAccount
+}
+
+// NewSpillBuffer returns a buffer which spills data beyond
+// threshold bytes to a temporary file in dir. If dir is empty,
+// os.TempDir is used. A threshold of 0 holds all data in
+// memory.
+func NewSpillBuffer(threshold int64, dir string) *SpillBuffer {
+	out := new(SpillBuffer)
+	out.threshold = threshold
+	out.dir = dir
+	return out
+}
+
+// Write adds data to the buffer. If the data cannot be
+// spilled to disk, the error is returned, and is also
+// returned by Read once the data before it has been read.
+func (b *SpillBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil && (b.threshold <= 0 || int64(b.mem.Len()+len(data)) <= b.threshold) {
+		b.Account.Add(int64(len(data)))
+		return b.mem.Write(data)
+	}
+
+	if b.file == nil {
+		b.file, b.err = ioutil.TempFile(b.dir, "spdy-body-")
+		if b.err != nil {
+			return 0, b.err
+		}
+		debug.Printf("Spilling buffered body to %s.\n", b.file.Name())
+	}
+	n, err := b.file.WriteAt(data, b.writePos)
+	b.writePos += int64(n)
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// Read reads the next data from the buffer, returning
+// io.EOF if there is none.
+func (b *SpillBuffer) Read(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.mem.Len() > 0 || len(data) == 0 {
+		n, err := b.mem.Read(data)
+		b.Account.Release(int64(n))
+		return n, err
+	}
+	if b.file != nil && b.readPos < b.writePos {
+		if max := b.writePos - b.readPos; int64(len(data)) > max {
+			data = data[:max]
+		}
+		n, err := b.file.ReadAt(data, b.readPos)
+		b.readPos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return 0, io.EOF
+}
+
+// Len returns the number of bytes unread.
+func (b *SpillBuffer) Len() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return int64(b.mem.Len()) + b.writePos - b.readPos
+}
+
+// Spilled reports whether any data has been
+// spilled to disk.
+func (b *SpillBuffer) Spilled() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.file != nil
+}
+
+// Reset discards the buffer's contents, removing
+// any temporary file.
+func (b *SpillBuffer) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.Account.Release(int64(b.mem.Len()))
+	b.mem.Reset()
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+	b.readPos = 0
+	b.writePos = 0
+	b.err = nil
+}
+
+// Close discards the buffer's contents, as Reset.
+func (b *SpillBuffer) Close() error {
+	b.Reset()
+	return nil
+}
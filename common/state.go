@@ -0,0 +1,81 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+)
+
+// ConnState is a snapshot of a connection's state, for
+// use in health checks and debugging.
+type ConnState struct {
+	Version string // negotiated protocol, such as "spdy/3.1".
+	Server  bool   // whether this is the server endpoint.
+	Closed  bool
+
+	// Streams holds the IDs of the active streams, in
+	// ascending order.
+	Streams []StreamID
+
+	LastPeerStreamID StreamID // last stream opened by the other endpoint.
+	LastOwnStreamID  StreamID // last stream opened by this endpoint.
+
+	// The connection's transfer windows, which are only
+	// used by SPDY/3.1, and the initial window of each new
+	// stream, in each direction.
+	SendWindow           int64
+	ReceiveWindow        int64
+	InitialSendWindow    uint32
+	InitialReceiveWindow uint32
+
+	// HeldFrames is the number of frames held back until
+	// the connection's send window grows.
+	HeldFrames int
+
+	SentSettings     Settings // the latest value of each setting sent.
+	ReceivedSettings Settings // the latest value of each setting received.
+
+	// The bytes written to and read from the network,
+	// since the connection's statistics were last reset.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// The totals for the header blocks sent and received,
+	// before and after compression.
+	HeadersSent     CompressionStats
+	HeadersReceived CompressionStats
+
+	// MemoryUsed is the memory used to buffer data, which
+	// is only counted if the connection has a memory budget.
+	MemoryUsed int64
+
+	GoawaySent     bool
+	GoawayReceived bool
+}
+
+// StreamInfo is a snapshot of a stream's state, for use
+// in debugging.
+type StreamInfo struct {
+	ID       StreamID
+	Kind     string // "request", "response" or "push".
+	Priority Priority
+	State    string // as given by StreamState.String.
+
+	// The stream's transfer windows, and the bytes of
+	// DATA held back until the send window grows.
+	SendWindow    int64
+	ReceiveWindow int64
+	Buffered      int
+
+	Stats StreamStats
+}
+
+// StateGoAway is the http.ConnState reported to a ConnState
+// hook once a SPDY connection has sent or received a GOAWAY,
+// so that no new streams will be started on it. It may be
+// followed by StateActive or StateIdle as the remaining
+// streams finish, and finally by StateClosed. Its String
+// method returns the empty string.
+const StateGoAway = http.ConnState(100)
@@ -0,0 +1,358 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats contains counters describing the activity on a
+// connection, either in total or over an interval.
+type Stats struct {
+	FramesSent        uint64
+	FramesReceived    uint64
+	BytesSent         uint64 // Bytes written to the network.
+	BytesReceived     uint64 // Bytes read from the network.
+	DataBytesSent     uint64 // DATA payload bytes sent.
+	DataBytesReceived uint64 // DATA payload bytes received.
+	StreamsOpened     uint64 // Streams opened by either endpoint.
+	ResetsSent        uint64 // RST_STREAMs sent.
+	ResetsReceived    uint64 // RST_STREAMs received.
+	StarvedFrames     uint64 // Frames sent early by the starvation watchdog.
+	StaleFrames       uint64 // Frames dropped for streams not opened on the connection.
+	UnknownFrames     uint64 // Control frames of unknown types received and ignored.
+	FlowStalls        uint64 // Streams blocked by flow control beyond FlowStallThreshold.
+	FlowStallResets   uint64 // Streams reset after being blocked beyond FlowStallTimeout.
+
+	// Interval is the period over which the counters were
+	// collected.
+	Interval time.Duration
+}
+
+// add adds the counters in other to s.
+func (s *Stats) add(other *Stats) {
+	s.FramesSent += other.FramesSent
+	s.FramesReceived += other.FramesReceived
+	s.BytesSent += other.BytesSent
+	s.BytesReceived += other.BytesReceived
+	s.DataBytesSent += other.DataBytesSent
+	s.DataBytesReceived += other.DataBytesReceived
+	s.StreamsOpened += other.StreamsOpened
+	s.ResetsSent += other.ResetsSent
+	s.ResetsReceived += other.ResetsReceived
+	s.StarvedFrames += other.StarvedFrames
+	s.StaleFrames += other.StaleFrames
+	s.UnknownFrames += other.UnknownFrames
+	s.FlowStalls += other.FlowStalls
+	s.FlowStallResets += other.FlowStallResets
+}
+
+// sub returns the counters in s less those in other.
+func (s Stats) sub(other *Stats) Stats {
+	s.FramesSent -= other.FramesSent
+	s.FramesReceived -= other.FramesReceived
+	s.BytesSent -= other.BytesSent
+	s.BytesReceived -= other.BytesReceived
+	s.DataBytesSent -= other.DataBytesSent
+	s.DataBytesReceived -= other.DataBytesReceived
+	s.StreamsOpened -= other.StreamsOpened
+	s.ResetsSent -= other.ResetsSent
+	s.ResetsReceived -= other.ResetsReceived
+	s.StarvedFrames -= other.StarvedFrames
+	s.StaleFrames -= other.StaleFrames
+	s.UnknownFrames -= other.UnknownFrames
+	s.FlowStalls -= other.FlowStalls
+	s.FlowStallResets -= other.FlowStallResets
+	return s
+}
+
+// StatsCounter accumulates a connection's Stats. All of its
+// methods are atomic with respect to each other, so no
+// events are lost or counted twice between calls.
+type StatsCounter struct {
+	lock     sync.Mutex
+	total    Stats
+	start    time.Time // start of total.
+	mark     Stats     // total at the last call to Delta.
+	markTime time.Time
+}
+
+func NewStatsCounter() *StatsCounter {
+	out := new(StatsCounter)
+	out.start = time.Now()
+	out.markTime = out.start
+	return out
+}
+
+// Add adds the given counters to the totals.
+func (c *StatsCounter) Add(delta Stats) {
+	c.lock.Lock()
+	c.total.add(&delta)
+	c.lock.Unlock()
+}
+
+// Snapshot returns the totals since the counter was
+// created or last reset.
+func (c *StatsCounter) Snapshot() Stats {
+	c.lock.Lock()
+	out := c.total
+	out.Interval = time.Since(c.start)
+	c.lock.Unlock()
+	return out
+}
+
+// Reset returns the totals, as Snapshot, and sets them to
+// zero. The interval used by Delta is also restarted.
+func (c *StatsCounter) Reset() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	out := c.total
+	out.Interval = now.Sub(c.start)
+	c.total = Stats{}
+	c.mark = Stats{}
+	c.start = now
+	c.markTime = now
+	return out
+}
+
+// Delta returns the change in the totals since the last
+// call to Delta or Reset, or since the counter was created.
+// Interval is set to the time elapsed, so that rates can be
+// computed.
+func (c *StatsCounter) Delta() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	out := c.total.sub(&c.mark)
+	out.Interval = now.Sub(c.markTime)
+	c.mark = c.total
+	c.markTime = now
+	return out
+}
+
+// StreamStats contains counters describing the activity
+// on a single stream. DATA is counted as sent once flow
+// control releases it to the connection, while the times
+// at which frames were sent are those at which they were
+// written to the network.
+type StreamStats struct {
+	DataBytesSent       uint64 // DATA payload bytes sent.
+	DataBytesReceived   uint64 // DATA payload bytes received.
+	DataFramesSent      uint64 // DATA frames sent.
+	DataFramesReceived  uint64 // DATA frames received.
+	HeaderBytesSent     uint64 // Uncompressed header bytes sent, as HeaderSize.
+	HeaderBytesReceived uint64 // Uncompressed header bytes received, as HeaderSize.
+
+	// QueueDelay is the total time for which DATA frames
+	// waited on the connection, between being released by
+	// flow control and being written to the network, and
+	// MaxQueueDelay is the longest any one frame waited.
+	QueueDelay    time.Duration
+	MaxQueueDelay time.Duration
+
+	// FlowControlStall is the total time for which the
+	// stream was constrained by flow control, with DATA
+	// held until the transfer window grew, including any
+	// current stall. FlowControlStalls is the number of
+	// times it became constrained, and MaxFlowControlStall
+	// is the longest any one stall lasted.
+	FlowControlStall    time.Duration
+	FlowControlStalls   uint64
+	MaxFlowControlStall time.Duration
+
+	Opened            time.Time // When the stream was opened.
+	FirstByteSent     time.Time // When the stream's first frame was written.
+	LastByteSent      time.Time // When the stream's last frame so far was written.
+	FirstByteReceived time.Time // When the stream's first frame was read.
+	LastByteReceived  time.Time // When the stream's last frame so far was read.
+	HandlerStarted    time.Time // When the handler was called.
+	HandlerFinished   time.Time // When the handler returned.
+	Flushed           time.Time // When flow control released the handler's last DATA.
+
+	// Throughput is the rate at which DATA has been sent
+	// over the last ThroughputWindow, in bytes per second.
+	Throughput float64
+}
+
+// TimeToFirstByte returns the time from the stream being
+// opened to its first frame being sent, or zero if none
+// has been sent.
+func (s *StreamStats) TimeToFirstByte() time.Duration {
+	if s.FirstByteSent.IsZero() || s.Opened.IsZero() {
+		return 0
+	}
+	return s.FirstByteSent.Sub(s.Opened)
+}
+
+// Duration returns the time from the stream being opened
+// to its last frame so far being sent, or zero if none
+// has been sent.
+func (s *StreamStats) Duration() time.Duration {
+	if s.LastByteSent.IsZero() || s.Opened.IsZero() {
+		return 0
+	}
+	return s.LastByteSent.Sub(s.Opened)
+}
+
+// StreamCounter accumulates the StreamStats which are
+// recorded as a stream's frames are written to and read
+// from the network. Its methods are safe for concurrent
+// use. The zero value is ready to use.
+type StreamCounter struct {
+	lock    sync.Mutex
+	stats   StreamStats
+	queued  map[Frame]time.Time // DATA frames waiting to be written.
+	stalled time.Time           // When flow control last constrained the stream.
+}
+
+// Open records that the stream has been opened.
+func (c *StreamCounter) Open() {
+	c.lock.Lock()
+	c.stats.Opened = time.Now()
+	c.lock.Unlock()
+}
+
+// HandlerStarted records that the handler has been called.
+func (c *StreamCounter) HandlerStarted() {
+	c.lock.Lock()
+	c.stats.HandlerStarted = time.Now()
+	c.lock.Unlock()
+}
+
+// HandlerFinished records that the handler has returned.
+func (c *StreamCounter) HandlerFinished() {
+	c.lock.Lock()
+	c.stats.HandlerFinished = time.Now()
+	c.lock.Unlock()
+}
+
+// Flushed records that flow control has released
+// all of the handler's DATA.
+func (c *StreamCounter) Flushed() {
+	c.lock.Lock()
+	c.stats.Flushed = time.Now()
+	c.lock.Unlock()
+}
+
+// Stalled records whether flow control is
+// holding the stream's DATA.
+func (c *StreamCounter) Stalled(stalled bool) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch {
+	case stalled && c.stalled.IsZero():
+		c.stalled = now
+		c.stats.FlowControlStalls++
+	case !stalled && !c.stalled.IsZero():
+		stall := now.Sub(c.stalled)
+		c.stats.FlowControlStall += stall
+		if stall > c.stats.MaxFlowControlStall {
+			c.stats.MaxFlowControlStall = stall
+		}
+		c.stalled = time.Time{}
+	}
+}
+
+// Queued records that a DATA frame has been released
+// by flow control, to be written to the network.
+func (c *StreamCounter) Queued(frame Frame) {
+	c.lock.Lock()
+	if c.queued == nil {
+		c.queued = make(map[Frame]time.Time)
+	}
+	c.queued[frame] = time.Now()
+	c.lock.Unlock()
+}
+
+// Sent records that a frame of the stream has been
+// written to the network, carrying the given bytes of
+// headers, if any.
+func (c *StreamCounter) Sent(frame Frame, headerBytes int) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if queued, ok := c.queued[frame]; ok {
+		delete(c.queued, frame)
+		delay := now.Sub(queued)
+		c.stats.QueueDelay += delay
+		if delay > c.stats.MaxQueueDelay {
+			c.stats.MaxQueueDelay = delay
+		}
+	}
+	c.stats.HeaderBytesSent += uint64(headerBytes)
+	if c.stats.FirstByteSent.IsZero() {
+		c.stats.FirstByteSent = now
+	}
+	c.stats.LastByteSent = now
+}
+
+// Received records that a frame of the stream has been
+// read from the network, carrying the given bytes of
+// DATA payload or headers.
+func (c *StreamCounter) Received(data bool, dataBytes, headerBytes int) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if data {
+		c.stats.DataFramesReceived++
+		c.stats.DataBytesReceived += uint64(dataBytes)
+	}
+	c.stats.HeaderBytesReceived += uint64(headerBytes)
+	if c.stats.FirstByteReceived.IsZero() {
+		c.stats.FirstByteReceived = now
+	}
+	c.stats.LastByteReceived = now
+}
+
+// Snapshot returns the statistics recorded so far.
+func (c *StreamCounter) Snapshot() StreamStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	out := c.stats
+	if !c.stalled.IsZero() {
+		stall := time.Since(c.stalled)
+		out.FlowControlStall += stall
+		if stall > out.MaxFlowControlStall {
+			out.MaxFlowControlStall = stall
+		}
+	}
+	return out
+}
+
+// HandshakeStats describes the TLS handshakes completed
+// by a server.
+type HandshakeStats struct {
+	Handshakes    uint64            // Handshakes completed.
+	Resumed       uint64            // Handshakes which resumed a session.
+	TotalDuration time.Duration     // Sum of the handshake durations.
+	MaxDuration   time.Duration     // Longest handshake.
+	Protocols     map[string]uint64 // Handshakes by negotiated protocol.
+	CipherSuites  map[uint16]uint64 // Handshakes by cipher suite.
+}
+
+// MeanDuration returns the mean handshake duration.
+func (s *HandshakeStats) MeanDuration() time.Duration {
+	if s.Handshakes == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(s.Handshakes)
+}
+
+// ResumptionRate returns the proportion of handshakes
+// which resumed a previous session.
+func (s *HandshakeStats) ResumptionRate() float64 {
+	if s.Handshakes == 0 {
+		return 0
+	}
+	return float64(s.Resumed) / float64(s.Handshakes)
+}
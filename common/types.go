@@ -65,6 +65,12 @@ func (f Flags) CLEAR_SETTINGS() bool {
 	return f&FLAG_SETTINGS_CLEAR_SETTINGS != 0
 }
 
+// DATA_CHECKSUM indicates whether the DATA_CHECKSUM
+// extension flag is set.
+func (f Flags) DATA_CHECKSUM() bool {
+	return f&FLAG_DATA_CHECKSUM != 0
+}
+
 // FIN indicates whether the FIN flag is set.
 func (f Flags) FIN() bool {
 	return f&FLAG_FIN != 0
@@ -126,8 +132,7 @@ func (p Priority) Valid(version uint16) bool {
  **************/
 
 // StatusCode represents a status code sent in
-// certain SPDY frames, such as RST_STREAM and
-// GOAWAY.
+// a SPDY RST_STREAM frame.
 type StatusCode uint32
 
 func (r StatusCode) B1() byte {
@@ -153,8 +158,6 @@ func (r StatusCode) IsFatal() bool {
 	switch r {
 	case RST_STREAM_PROTOCOL_ERROR:
 		return true
-	case RST_STREAM_INTERNAL_ERROR:
-		return true
 	case RST_STREAM_FRAME_TOO_LARGE:
 		return true
 	case RST_STREAM_UNSUPPORTED_VERSION:
@@ -167,24 +170,72 @@ func (r StatusCode) IsFatal() bool {
 
 // String gives the StatusCode in text form.
 func (r StatusCode) String() string {
-	return statusCodeText[r]
+	if text, ok := statusCodeText[r]; ok {
+		return text
+	}
+	return fmt.Sprintf("StatusCode(%d)", uint32(r))
+}
+
+/****************
+ * GoawayStatus *
+ ****************/
+
+// GoawayStatus represents the status code sent
+// in a SPDY GOAWAY frame. GOAWAY uses its own
+// set of codes, distinct from RST_STREAM's.
+type GoawayStatus uint32
+
+func (g GoawayStatus) B1() byte {
+	return byte(g >> 24)
+}
+
+func (g GoawayStatus) B2() byte {
+	return byte(g >> 16)
+}
+
+func (g GoawayStatus) B3() byte {
+	return byte(g >> 8)
+}
+
+func (g GoawayStatus) B4() byte {
+	return byte(g)
+}
+
+// String gives the GoawayStatus in text form.
+func (g GoawayStatus) String() string {
+	if text, ok := goawayStatusText[g]; ok {
+		return text
+	}
+	return fmt.Sprintf("GoawayStatus(%d)", uint32(g))
 }
 
 /************
  * Settings *
  ************/
 
+// SettingID identifies a setting in a SPDY
+// SETTINGS frame.
+type SettingID uint32
+
+// String gives the SettingID in text form.
+func (id SettingID) String() string {
+	if text, ok := settingText[id]; ok {
+		return text
+	}
+	return fmt.Sprintf("SettingID(%d)", uint32(id))
+}
+
 // Setting represents a single setting as sent
 // in a SPDY SETTINGS frame.
 type Setting struct {
 	Flags Flags
-	ID    uint32
+	ID    SettingID
 	Value uint32
 }
 
 // String gives the textual representation of a Setting.
 func (s *Setting) String() string {
-	id := settingText[s.ID] + ":"
+	id := s.ID.String() + ":"
 	Flags := ""
 	if s.Flags.PERSIST_VALUE() {
 		Flags += " FLAG_SETTINGS_PERSIST_VALUE"
@@ -204,7 +255,17 @@ func (s *Setting) String() string {
 // Settings represents a series of settings, stored in a map
 // by setting ID. This ensures that duplicate settings are
 // not sent, since the new value will replace the old.
-type Settings map[uint32]*Setting
+type Settings map[SettingID]*Setting
+
+// Clone returns a copy of s.
+func (s Settings) Clone() Settings {
+	out := make(Settings, len(s))
+	for id, setting := range s {
+		copied := *setting
+		out[id] = &copied
+	}
+	return out
+}
 
 // Settings returns a slice of Setting, sorted into order by
 // ID, as in the SPDY specification.
@@ -223,8 +284,67 @@ func (s Settings) Settings() []*Setting {
 	out := make([]*Setting, len(s))
 
 	for i, id := range ids {
-		out[i] = s[uint32(id)]
+		out[i] = s[SettingID(id)]
 	}
 
 	return out
 }
+
+/***************
+ * ErrorAction *
+ ***************/
+
+// ErrorAction determines how a connection is ended after
+// a protocol error, as chosen by an error handler.
+type ErrorAction int
+
+const (
+	// ErrorActionDefault ends the connection as it would
+	// be without an error handler.
+	ErrorActionDefault ErrorAction = iota
+
+	// ErrorActionGoaway sends a GOAWAY with PROTOCOL_ERROR,
+	// then closes the connection.
+	ErrorActionGoaway
+
+	// ErrorActionClose closes the network connection
+	// without sending anything more.
+	ErrorActionClose
+)
+
+/******************
+ * ValidationMode *
+ ******************/
+
+// ValidationMode determines how a connection responds to
+// violations of the specification which it could tolerate,
+// such as a stream ID of the wrong parity or lower than one
+// already seen, or a frame for a stream which is not open.
+type ValidationMode int
+
+const (
+	// ValidationLenient logs violations and ignores
+	// the offending frames, for interoperability with
+	// clients which do not follow the specification.
+	// A SYN_STREAM which misuses its stream ID is still
+	// refused with a PROTOCOL_ERROR RST_STREAM, so that
+	// its sender does not wait for a reply.
+	ValidationLenient ValidationMode = iota
+
+	// ValidationStrict responds to violations as the
+	// specification requires, resetting streams whose
+	// IDs are misused and ending the connection when
+	// stream IDs decrease. Streams which are not open
+	// are reset when they receive frames.
+	ValidationStrict
+)
+
+func (v ValidationMode) String() string {
+	switch v {
+	case ValidationLenient:
+		return "lenient"
+	case ValidationStrict:
+		return "strict"
+	}
+	return fmt.Sprintf("ValidationMode(%d)", int(v))
+}
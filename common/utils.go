@@ -20,6 +20,52 @@ func CloneHeader(h http.Header) http.Header {
 	return h2
 }
 
+// HeaderSnapshot records the headers which have been
+// sent on a stream. Each flush takes an immutable
+// snapshot of the headers which have changed since the
+// last, without modifying the stream's Header, so a
+// handler which keeps using its Header cannot corrupt
+// or lose headers being sent. The zero value is ready
+// to use.
+type HeaderSnapshot struct {
+	sent http.Header
+}
+
+// Changes returns a copy of the name/value pairs in h
+// which differ from those already sent, and records
+// them as sent. The returned Header is not shared.
+func (s *HeaderSnapshot) Changes(h http.Header) http.Header {
+	if s.sent == nil {
+		s.sent = make(http.Header, len(h))
+	}
+
+	out := make(http.Header)
+	for name, values := range h {
+		if equalValues(values, s.sent[name]) {
+			continue
+		}
+
+		sent := make([]string, len(values))
+		copy(sent, values)
+		s.sent[name] = sent
+		out[name] = append([]string(nil), values...)
+	}
+
+	return out
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // UpdateHeader adds and new name/value pairs and replaces
 // those already existing in the older header.
 func UpdateHeader(older, newer http.Header) {
@@ -52,8 +98,20 @@ func BytesToUint32(b []byte) uint32 {
 
 // ReadExactly is used to ensure that the given number of bytes
 // are read if possible, even if multiple calls to Read
-// are required.
+// are required. If r is a SliceReader, or a ReadCounter
+// wrapping one, the bytes are not copied.
 func ReadExactly(r io.Reader, i int) ([]byte, error) {
+	switch r := r.(type) {
+	case *SliceReader:
+		return r.next(i)
+	case *ReadCounter:
+		if s, ok := r.R.(*SliceReader); ok {
+			out, err := s.next(i)
+			r.N += int64(len(out))
+			return out, err
+		}
+	}
+
 	out := make([]byte, i)
 	in := out[:]
 	for i > 0 {
@@ -70,6 +128,48 @@ func ReadExactly(r io.Reader, i int) ([]byte, error) {
 	return out, nil
 }
 
+// SliceReader is an io.Reader over a byte slice, from
+// which ReadExactly returns subslices rather than copies.
+// This allows frames held in memory to be decoded without
+// copying their payloads.
+type SliceReader struct {
+	data []byte
+}
+
+func NewSliceReader(data []byte) *SliceReader {
+	return &SliceReader{data: data}
+}
+
+func (s *SliceReader) Read(b []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// Len returns the number of bytes not yet read.
+func (s *SliceReader) Len() int {
+	return len(s.data)
+}
+
+// next returns the next i bytes, with their capacity
+// limited so that appending to them cannot overwrite
+// the bytes which follow.
+func (s *SliceReader) next(i int) ([]byte, error) {
+	if len(s.data) < i {
+		if len(s.data) == 0 {
+			return nil, io.EOF
+		}
+		s.data = nil
+		return nil, io.ErrUnexpectedEOF
+	}
+	out := s.data[:i:i]
+	s.data = s.data[i:]
+	return out, nil
+}
+
 // WriteExactly is used to ensure that the given data is written
 // if possible, even if multiple calls to Write are
 // required.
@@ -0,0 +1,62 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ValidateHeader checks a received header block against
+// MaxHeaderCount, MaxHeaderBlockSize and MaxHeaderValueLength,
+// and ensures that each name is a valid token, optionally
+// prefixed with a colon, and that no value contains a line
+// break.
+func ValidateHeader(header http.Header) error {
+	count, size := 0, 0
+	for name, values := range header {
+		if !validHeaderName(name) {
+			return ErrMalformedHeader
+		}
+
+		size += len(name)
+		for _, value := range values {
+			count++
+			size += len(value)
+			if MaxHeaderValueLength > 0 && len(value) > MaxHeaderValueLength {
+				return ErrHeaderValueTooLarge
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return ErrMalformedHeader
+			}
+		}
+
+		if MaxHeaderCount > 0 && count > MaxHeaderCount {
+			return ErrTooManyHeaders
+		}
+		if MaxHeaderBlockSize > 0 && size > MaxHeaderBlockSize {
+			return ErrHeaderBlockTooLarge
+		}
+	}
+
+	return nil
+}
+
+// validHeaderName indicates whether name is a valid
+// header name, as defined in RFC 2616, section 4.2,
+// or a SPDY pseudo-header.
+func validHeaderName(name string) bool {
+	name = strings.TrimPrefix(name, ":")
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("()<>@,;:\\\"/[]?={}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
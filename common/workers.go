@@ -0,0 +1,128 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+)
+
+// Workers is the pool shared by new SPDY/3 connections to run
+// their streams' handlers, and ConnWorkers is the default limit
+// on the handlers each of them runs at once. Streams waiting
+// for a worker are queued, rather than each being given its
+// own goroutine, so a server with very many connections can
+// bound its goroutines.
+//
+// By default, Workers is nil and ConnWorkers is 0, so that
+// each stream's handler runs in its own goroutine.
+var (
+	Workers     *WorkerPool
+	ConnWorkers int
+)
+
+// WorkerPool runs functions with bounded concurrency. Functions
+// submitted while the pool is at its limit are queued, and run
+// in order as others finish. A pool with a parent runs its
+// functions in the parent, so that both limits apply. A nil
+// WorkerPool imposes no limit, running each function in its
+// own goroutine.
+type WorkerPool struct {
+	lock    sync.Mutex
+	limit   int
+	parent  *WorkerPool
+	running int
+	queue   []func()
+}
+
+// NewWorkerPool returns a WorkerPool running at most limit
+// functions at once, in the given parent, which may be nil.
+// If limit is not positive, NewWorkerPool returns parent.
+func NewWorkerPool(limit int, parent *WorkerPool) *WorkerPool {
+	if limit <= 0 {
+		return parent
+	}
+
+	out := new(WorkerPool)
+	out.limit = limit
+	out.parent = parent
+	return out
+}
+
+// Limit returns the number of functions which may run at
+// once, or 0 if there is no limit.
+func (p *WorkerPool) Limit() int {
+	if p == nil {
+		return 0
+	}
+	return p.limit
+}
+
+// Running returns the number of functions running, and the
+// number queued.
+func (p *WorkerPool) Running() (running, queued int) {
+	if p == nil {
+		return 0, 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running, len(p.queue)
+}
+
+// Go runs f in the pool, queueing it if the pool is at its
+// limit. Go does not block.
+func (p *WorkerPool) Go(f func()) {
+	if p == nil {
+		go f()
+		return
+	}
+
+	p.lock.Lock()
+	if p.running >= p.limit {
+		p.queue = append(p.queue, f)
+		p.lock.Unlock()
+		return
+	}
+	p.running++
+	p.lock.Unlock()
+	p.start(f)
+}
+
+// start runs f, and then each queued function in turn.
+// The pool's running count must already include f.
+func (p *WorkerPool) start(f func()) {
+	if p.parent != nil {
+		// Each function rejoins the parent's queue, so
+		// that one busy child cannot hold its workers.
+		p.parent.Go(func() {
+			f()
+			if next := p.next(); next != nil {
+				p.start(next)
+			}
+		})
+		return
+	}
+
+	go func() {
+		for f != nil {
+			f()
+			f = p.next()
+		}
+	}()
+}
+
+// next returns the next queued function, or nil if there
+// is none, in which case the running count is reduced.
+func (p *WorkerPool) next() func() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.queue) == 0 {
+		p.running--
+		return nil
+	}
+	f := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return f
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/debug"
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+func TestHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := stream.Client(c)
+	server := stream.Server(s)
+	defer client.Close()
+	defer server.Close()
+
+	opened, err := client.Open(http.Header{"Service": {"echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	// Find the client's connection.
+	var id uint64
+	for _, conn := range debug.Snapshot() {
+		if conn.LocalAddr == c.LocalAddr().String() {
+			id = conn.ID
+		}
+	}
+	if id == 0 {
+		t.Fatal("Client connection not registered")
+	}
+
+	ts := httptest.NewServer(debug.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?format=json&conn=" + strconv.FormatUint(id, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []debug.Conn
+	err = json.NewDecoder(res.Body).Decode(&conns)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].ID != id {
+		t.Fatalf("Expected connection %d, got %+v", id, conns)
+	}
+	conn := conns[0]
+	if conn.State == nil || conn.State.Server {
+		t.Errorf("Expected client state, got %+v", conn.State)
+	}
+	if len(conn.Streams) != 1 || conn.Streams[0].Kind != "request" {
+		t.Errorf("Expected one request stream, got %+v", conn.Streams)
+	}
+	if conn.HeadersSent == nil || conn.HeadersSent.Blocks == 0 || conn.HeadersSent.Ratio <= 0 {
+		t.Errorf("Expected header compression, got %+v", conn.HeadersSent)
+	}
+	if conn.Scheduler == nil || conn.Scheduler.Streams[0] != 1 {
+		t.Errorf("Expected one stream at priority 0, got %+v", conn.Scheduler)
+	}
+	if len(conn.Events) == 0 || !conn.Events[0].Sent {
+		t.Errorf("Expected recent frames, got %+v", conn.Events)
+	}
+
+	// Dumps can be restored and browsed.
+	buf := new(bytes.Buffer)
+	if err := debug.WriteDump(buf); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := debug.ReadDump(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	dump.ServeHTTP(rec, httptest.NewRequest("GET", "/?conn="+strconv.FormatUint(id, 10), nil))
+	if !strings.Contains(rec.Body.String(), "SYN_STREAM") {
+		t.Errorf("Expected restored dump to show events, got:\n%s", rec.Body)
+	}
+
+	res, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "Connection "+strconv.FormatUint(id, 10)) {
+		t.Errorf("Unexpected HTML page:\n%s", body)
+	}
+
+	// Closed connections are removed.
+	client.Close()
+	<-client.Conn().CloseNotify()
+	res, err = http.Get(ts.URL + "?conn=" + strconv.FormatUint(id, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, res.StatusCode)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package debug serves the internal state of the running SPDY
+// connections, for use in production triage, in the manner of
+// net/http/pprof. Each connection is shown with its transfer
+// windows, settings, held frames, header compression ratios,
+// scheduler queues, recently sent and received frames and
+// active streams, and each stream with its priority, windows
+// and the data it has buffered.
+//
+// Importing the package registers its handler on the default
+// mux, under /debug/spdy/, and publishes the same data through
+// expvar, under "spdy":
+//
+//	import _ "github.com/SlyMarbo/spdy/debug"
+//
+// The handler can also be added to any other mux:
+//
+//	mux.Handle("/admin/spdy", debug.Handler())
+//
+// The state is rendered as HTML, or as JSON if the request has
+// format=json in its query or prefers application/json. A
+// single connection can be selected with conn=<id>.
+//
+// To analyse a wedged connection after the fact, a snapshot can
+// be saved with WriteDump, or written to a file whenever the
+// process receives a signal:
+//
+//	stop := debug.DumpOnSignal("/var/tmp", syscall.SIGUSR1)
+//	defer stop()
+//
+// and later restored with ReadDump and browsed through the
+// Dump's ServeHTTP method.
+package debug
@@ -0,0 +1,96 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// Dump is a snapshot of every running connection,
+// which can be saved for later analysis.
+type Dump struct {
+	Time  time.Time // when the snapshot was taken.
+	Conns []Conn
+}
+
+// NewDump returns a snapshot of the running connections.
+func NewDump() *Dump {
+	return &Dump{Time: time.Now(), Conns: Snapshot()}
+}
+
+// WriteDump writes a snapshot of the running connections
+// to w, as JSON.
+func WriteDump(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(NewDump())
+}
+
+// ReadDump restores a snapshot written by WriteDump.
+func ReadDump(r io.Reader) (*Dump, error) {
+	out := new(Dump)
+	if err := json.NewDecoder(r).Decode(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DumpOnSignal writes a snapshot of the running connections
+// to a new file in dir each time the process receives one of
+// the given signals, such as syscall.SIGUSR1. If dir is empty,
+// the temporary directory is used. The files are named by the
+// time of the snapshot. Calling the returned function stops
+// the dumps.
+func DumpOnSignal(dir string, sigs ...os.Signal) (stop func()) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+	go func() {
+		for {
+			select {
+			case <-c:
+				name, err := dumpFile(dir)
+				if err != nil {
+					common.GetLogger().Printf("Failed to write SPDY dump: %v\n", err)
+				} else {
+					common.GetLogger().Printf("Wrote SPDY dump to %s\n", name)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// dumpFile writes a snapshot to a new file in dir,
+// returning its name.
+func dumpFile(dir string) (string, error) {
+	name := filepath.Join(dir, "spdy-"+time.Now().Format("20060102-150405.000000000")+".json")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err = WriteDump(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	return name, f.Close()
+}
@@ -0,0 +1,259 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug
+
+import (
+	"encoding/json"
+	"expvar"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+func init() {
+	http.Handle("/debug/spdy/", Handler())
+	expvar.Publish("spdy", expvar.Func(func() interface{} {
+		return Snapshot()
+	}))
+}
+
+// Conn describes a running connection.
+type Conn struct {
+	ID         uint64
+	Since      time.Time // when the connection started running.
+	LocalAddr  string
+	RemoteAddr string
+
+	// The following are only given for connections
+	// which provide them.
+	State           *common.ConnState      `json:",omitempty"`
+	Stats           *common.Stats          `json:",omitempty"`
+	HeadersSent     *Compression           `json:",omitempty"`
+	HeadersReceived *Compression           `json:",omitempty"`
+	Streams         []common.StreamInfo    `json:",omitempty"`
+	Scheduler       *common.SchedulerState `json:",omitempty"`
+	Events          []common.Event         `json:",omitempty"` // recent frames, oldest first.
+}
+
+// Compression describes the header blocks sent or
+// received on a connection.
+type Compression struct {
+	common.CompressionStats
+	Ratio float64 // of raw to compressed bytes.
+}
+
+func newCompression(stats common.CompressionStats) *Compression {
+	return &Compression{CompressionStats: stats, Ratio: stats.Ratio()}
+}
+
+// The optional methods used to inspect a connection.
+type (
+	stater interface {
+		State() common.ConnState
+	}
+	statser interface {
+		Stats() common.Stats
+	}
+	streamer interface {
+		Streams() []common.StreamInfo
+	}
+	compression interface {
+		HeaderCompression() (sent, received common.CompressionStats)
+	}
+	scheduler interface {
+		SchedulerState() common.SchedulerState
+	}
+	eventer interface {
+		Events() []common.Event
+	}
+)
+
+// Snapshot returns the state of each running
+// connection, in the order in which they started.
+func Snapshot() []Conn {
+	registered := common.Conns()
+	out := make([]Conn, 0, len(registered))
+	for _, conn := range registered {
+		out = append(out, snapshot(conn))
+	}
+	return out
+}
+
+func snapshot(registered common.RegisteredConn) Conn {
+	out := Conn{ID: registered.ID, Since: registered.Since}
+	conn := registered.Conn
+	if nc := conn.Conn(); nc != nil {
+		out.LocalAddr = nc.LocalAddr().String()
+		out.RemoteAddr = nc.RemoteAddr().String()
+	}
+	if c, ok := conn.(stater); ok {
+		state := c.State()
+		out.State = &state
+	}
+	if c, ok := conn.(statser); ok {
+		stats := c.Stats()
+		out.Stats = &stats
+	}
+	if c, ok := conn.(compression); ok {
+		sent, received := c.HeaderCompression()
+		out.HeadersSent = newCompression(sent)
+		out.HeadersReceived = newCompression(received)
+	}
+	if c, ok := conn.(streamer); ok {
+		out.Streams = c.Streams()
+	}
+	if c, ok := conn.(scheduler); ok {
+		state := c.SchedulerState()
+		out.Scheduler = &state
+	}
+	if c, ok := conn.(eventer); ok {
+		out.Events = c.Events()
+	}
+	return out
+}
+
+// Handler returns a handler which serves the state of
+// the running connections, as described in the package
+// documentation.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewDump().ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP serves the connections in the dump, in the
+// same way as Handler. This can be used to browse a dump
+// restored with ReadDump.
+func (d *Dump) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conns := d.Conns
+	if id := r.URL.Query().Get("conn"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid connection ID.", http.StatusBadRequest)
+			return
+		}
+		var selected []Conn
+		for _, conn := range conns {
+			if conn.ID == n {
+				selected = append(selected, conn)
+			}
+		}
+		if len(selected) == 0 {
+			http.Error(w, "Connection not found.", http.StatusNotFound)
+			return
+		}
+		conns = selected
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(conns)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.Execute(w, &Dump{Time: d.Time, Conns: conns})
+}
+
+// wantsJSON reports whether the response should be
+// JSON, rather than HTML.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	accept := strings.SplitN(r.Header.Get("Accept"), ",", 2)[0]
+	mediaType, _, _ := mime.ParseMediaType(accept)
+	return mediaType == "application/json"
+}
+
+var page = template.Must(template.New("spdy").Funcs(template.FuncMap{
+	"age": func(now, since time.Time) time.Duration {
+		return now.Sub(since).Truncate(time.Second)
+	},
+	"ratio": func(c *Compression) string {
+		if c == nil || c.Blocks == 0 {
+			return "-"
+		}
+		return strconv.FormatFloat(c.Ratio, 'f', 2, 64)
+	},
+	"direction": func(sent bool) string {
+		if sent {
+			return "sent"
+		}
+		return "received"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>SPDY connections</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: right; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>SPDY connections</h1>
+<p>{{len .Conns}} running. <a href="?format=json">JSON</a></p>
+{{$now := .Time}}
+{{range .Conns}}
+<h2><a href="?conn={{.ID}}">Connection {{.ID}}</a>: {{.LocalAddr}} &harr; {{.RemoteAddr}}</h2>
+<table>
+<tr><th>Age</th><td>{{age $now .Since}}</td></tr>
+{{with .State}}
+<tr><th>Protocol</th><td>{{.Version}}{{if .Server}} (server){{else}} (client){{end}}{{if .Closed}} closed{{end}}</td></tr>
+<tr><th>Last stream (peer / own)</th><td>{{.LastPeerStreamID}} / {{.LastOwnStreamID}}</td></tr>
+<tr><th>Window (send / receive)</th><td>{{.SendWindow}} / {{.ReceiveWindow}}</td></tr>
+<tr><th>Initial stream window (send / receive)</th><td>{{.InitialSendWindow}} / {{.InitialReceiveWindow}}</td></tr>
+<tr><th>Held frames</th><td>{{.HeldFrames}}</td></tr>
+<tr><th>Memory used</th><td>{{.MemoryUsed}}</td></tr>
+<tr><th>GOAWAY (sent / received)</th><td>{{.GoawaySent}} / {{.GoawayReceived}}</td></tr>
+{{end}}
+{{with .Stats}}
+<tr><th>Frames (sent / received)</th><td>{{.FramesSent}} / {{.FramesReceived}}</td></tr>
+<tr><th>Bytes (sent / received)</th><td>{{.BytesSent}} / {{.BytesReceived}}</td></tr>
+<tr><th>Resets (sent / received)</th><td>{{.ResetsSent}} / {{.ResetsReceived}}</td></tr>
+<tr><th>Starved / stale / unknown frames</th><td>{{.StarvedFrames}} / {{.StaleFrames}} / {{.UnknownFrames}}</td></tr>
+<tr><th>Flow control stalls (reported / reset)</th><td>{{.FlowStalls}} / {{.FlowStallResets}}</td></tr>
+{{end}}
+<tr><th>Header compression (sent / received)</th><td>{{ratio .HeadersSent}} / {{ratio .HeadersReceived}}</td></tr>
+</table>
+{{if .Streams}}
+<table>
+<tr><th>Stream</th><th>Kind</th><th>Priority</th><th>State</th><th>Send window</th><th>Receive window</th><th>Buffered</th><th>Sent</th><th>Throughput (B/s)</th></tr>
+{{range .Streams}}
+<tr><td>{{.ID}}</td><td>{{.Kind}}</td><td>{{.Priority}}</td><td>{{.State}}</td><td>{{.SendWindow}}</td><td>{{.ReceiveWindow}}</td><td>{{.Buffered}}</td><td>{{.Stats.DataBytesSent}}</td><td>{{printf "%.0f" .Stats.Throughput}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{with $s := .Scheduler}}
+<table>
+<tr><th>Priority</th><th>Streams</th><th>Buffered</th><th>Held frames</th></tr>
+{{range $i, $n := .Streams}}
+<tr><td>{{$i}}</td><td>{{$n}}</td><td>{{index $s.Buffered $i}}</td><td>{{index $s.FairHeld $i}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{if .Events}}
+<table>
+<tr><th>Time</th><th>Direction</th><th>Frame</th><th>Stream</th><th>Detail</th></tr>
+{{range .Events}}
+<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{direction .Sent}}</td><td>{{.Frame}}</td><td>{{.StreamID}}</td><td>{{.Detail}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
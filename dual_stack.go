@@ -0,0 +1,246 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	"github.com/SlyMarbo/spdy/spdy3"
+)
+
+// DualStack serves SPDY and HTTP/2 on the same listener, with the
+// same handlers, to ease the migration of services which must support
+// both protocols for a time. HTTP/2 is provided by net/http. HTTP/2 is
+// preferred over SPDY, which is preferred over HTTP/1.1, so each client
+// uses the newest protocol it supports.
+//
+// Shutdown ends all three protocols gracefully. This is needed because
+// http.Server.Shutdown does not track SPDY connections, which are taken
+// over from the server once the TLS handshake completes.
+//
+// A simple example is:
+//
+//	srv := &http.Server{Addr: ":https", Handler: handler}
+//	ds := spdy.NewDualStack(srv)
+//	go func() {
+//		err := ds.ListenAndServeTLS("cert.pem", "key.pem")
+//		if err != nil && err != http.ErrServerClosed {
+//			log.Fatal(err)
+//		}
+//	}()
+//
+//	// Later...
+//	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	ds.Shutdown(ctx)
+type DualStack struct {
+	Server *http.Server
+
+	conns connSet
+}
+
+// NewDualStack adds SPDY and HTTP/2 support to srv, and must
+// be called before srv begins serving. SPDY connections are
+// tracked by the returned DualStack, so any TLSNextProto
+// entries for SPDY set previously are replaced.
+func NewDualStack(srv *http.Server) *DualStack {
+	d := new(DualStack)
+	d.Server = srv
+
+	AddSPDY(srv)
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = new(tls.Config)
+	}
+	if srv.TLSNextProto == nil {
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	// Advertise HTTP/2 first.
+	protos := []string{"h2"}
+	for _, proto := range srv.TLSConfig.NextProtos {
+		if proto != "h2" {
+			protos = append(protos, proto)
+		}
+	}
+	if len(protos) == 1 {
+		protos = append(protos, "http/1.1")
+	}
+	srv.TLSConfig.NextProtos = protos
+
+	if srv.Protocols == nil {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+	}
+	srv.Protocols.SetHTTP2(true)
+	d.conns.track(srv)
+
+	return d
+}
+
+// ListenAndServeTLS listens on the server's address and serves
+// SPDY, HTTP/2 and HTTPS, as http.Server.ListenAndServeTLS.
+func (d *DualStack) ListenAndServeTLS(certFile, keyFile string) error {
+	return d.Server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ServeTLS serves SPDY, HTTP/2 and HTTPS on l, as
+// http.Server.ServeTLS.
+func (d *DualStack) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	return d.Server.ServeTLS(l, certFile, keyFile)
+}
+
+// Shutdown gracefully shuts down the server. SPDY connections
+// are sent a GOAWAY, or closed once idle if they cannot be
+// drained, and HTTP/2 and HTTPS connections are shut down as
+// by http.Server.Shutdown. Shutdown then waits for all the
+// connections to finish their active streams and close. If
+// ctx expires first, the remaining SPDY connections are
+// closed and the context's error is returned.
+func (d *DualStack) Shutdown(ctx context.Context) error {
+	d.conns.drain()
+	err := d.Server.Shutdown(ctx)
+	if werr := d.conns.wait(ctx); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// connSet tracks the SPDY connections taken over from an
+// http.Server, so that they can be shut down with it.
+type connSet struct {
+	lock      sync.Mutex
+	conns     map[common.Conn]struct{}
+	closing   bool
+	wg        sync.WaitGroup
+	configure func(common.Conn) // optionally called before each conn runs.
+}
+
+// track replaces srv's TLSNextProto entries for SPDY,
+// so that their connections are run by the set.
+func (s *connSet) track(srv *http.Server) {
+	for proto := range srv.TLSNextProto {
+		switch proto {
+		case "spdy/2":
+			srv.TLSNextProto[proto] = func(hs *http.Server, tlsConn *tls.Conn, _ http.Handler) {
+				s.serve(spdy2.NewConn(tlsConn, hs))
+			}
+		case "spdy/3":
+			srv.TLSNextProto[proto] = func(hs *http.Server, tlsConn *tls.Conn, _ http.Handler) {
+				s.serve(spdy3.NewConn(tlsConn, hs, 0))
+			}
+		case "spdy/3.1":
+			srv.TLSNextProto[proto] = func(hs *http.Server, tlsConn *tls.Conn, _ http.Handler) {
+				s.serve(spdy3.NewConn(tlsConn, hs, 1))
+			}
+		}
+	}
+}
+
+// serve runs conn until it ends, unless the set
+// is shutting down.
+func (s *connSet) serve(conn common.Conn) {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	if s.conns == nil {
+		s.conns = make(map[common.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+
+	if s.configure != nil {
+		s.configure(conn)
+	}
+	conn.Run()
+}
+
+// snapshot returns the running connections, and stops
+// the set from accepting new ones.
+func (s *connSet) snapshot() []common.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closing = true
+	conns := make([]common.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// drain sends each connection a GOAWAY, or closes it once
+// idle if it cannot be drained.
+func (s *connSet) drain() {
+	for _, conn := range s.snapshot() {
+		if drainer, ok := conn.(Drainer); ok {
+			drainer.Drain()
+		} else {
+			go closeWhenIdle(conn)
+		}
+	}
+}
+
+// close closes each connection immediately.
+func (s *connSet) close() {
+	for _, conn := range s.snapshot() {
+		conn.Close()
+	}
+}
+
+// wait waits for the connections to close. If ctx expires
+// first, the remaining connections are closed and the
+// context's error is returned.
+func (s *connSet) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.close()
+		return ctx.Err()
+	}
+}
+
+// closeWhenIdle closes conn once it has no active streams.
+func closeWhenIdle(conn common.Conn) {
+	idler, ok := conn.(Idler)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !idler.Idle() {
+		select {
+		case <-ticker.C:
+		case <-conn.CloseNotify():
+			return
+		}
+	}
+	conn.Close()
+}
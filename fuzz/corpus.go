@@ -0,0 +1,140 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/SlyMarbo/spdy/common"
+	frames2 "github.com/SlyMarbo/spdy/spdy2/frames"
+	frames3 "github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// requestHeader returns the header of a simple GET
+// request in the given version of SPDY.
+func requestHeader(version uint16) http.Header {
+	h := make(http.Header)
+	if version == 2 {
+		h.Set("method", "GET")
+		h.Set("url", "/")
+		h.Set("version", "HTTP/1.1")
+		h.Set("host", "example.com")
+		h.Set("scheme", "https")
+		return h
+	}
+	h.Set(":method", "GET")
+	h.Set(":path", "/")
+	h.Set(":version", "HTTP/1.1")
+	h.Set(":host", "example.com")
+	h.Set(":scheme", "https")
+	return h
+}
+
+// responseHeader returns the header of a simple
+// response in the given version of SPDY.
+func responseHeader(version uint16) http.Header {
+	h := make(http.Header)
+	if version == 2 {
+		h.Set("status", "200")
+		h.Set("version", "HTTP/1.1")
+	} else {
+		h.Set(":status", "200")
+		h.Set(":version", "HTTP/1.1")
+	}
+	h.Set("Content-Type", "text/plain")
+	return h
+}
+
+// sampleFrames returns a valid example of every frame type.
+func sampleFrames() []versionedFrame {
+	settings := common.Settings{
+		common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{
+			ID:    common.SETTINGS_INITIAL_WINDOW_SIZE,
+			Value: common.DEFAULT_INITIAL_WINDOW_SIZE,
+		},
+		common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
+			ID:    common.SETTINGS_MAX_CONCURRENT_STREAMS,
+			Value: common.DEFAULT_STREAM_LIMIT,
+		},
+	}
+
+	return []versionedFrame{
+		{&frames2.SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Header: requestHeader(2)}, 2},
+		{&frames2.SYN_REPLY{StreamID: 1, Header: responseHeader(2)}, 2},
+		{&frames2.RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL}, 2},
+		{&frames2.SETTINGS{Settings: settings}, 2},
+		{new(frames2.NOOP), 2},
+		{&frames2.PING{PingID: 1}, 2},
+		{&frames2.GOAWAY{LastGoodStreamID: 1}, 2},
+		{&frames2.HEADERS{StreamID: 1, Header: responseHeader(2)}, 2},
+		{&frames2.WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1024}, 2},
+		{&frames2.DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("Hello")}, 2},
+		{&frames3.SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Header: requestHeader(3)}, 3},
+		{&frames3.SYN_REPLY{StreamID: 1, Header: responseHeader(3)}, 3},
+		{&frames3.RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL}, 3},
+		{&frames3.SETTINGS{Settings: settings}, 3},
+		{&frames3.PING{PingID: 1}, 3},
+		{&frames3.GOAWAY{LastGoodStreamID: 1, Status: common.GOAWAY_OK}, 3},
+		{&frames3.HEADERS{StreamID: 1, Header: responseHeader(3)}, 3},
+		{&frames3.WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1024}, 3},
+		{&frames3.CREDENTIAL{Slot: 1, Proof: []byte("proof")}, 3},
+		{&frames3.DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("Hello")}, 3},
+		{&frames3.DATA{StreamID: 1, Flags: common.FLAG_DATA_CHECKSUM, Data: []byte("Hello")}, 3},
+	}
+}
+
+// Seeds returns the encoding of a valid example of every
+// frame type, produced with WriteTo, for use as a corpus.
+func Seeds() [][]byte {
+	samples := sampleFrames()
+	out := make([][]byte, 0, len(samples))
+	for _, f := range samples {
+		buf := new(bytes.Buffer)
+		if err := f.frame.Compress(common.NewCompressor(f.version)); err != nil {
+			continue
+		}
+		if _, err := f.frame.WriteTo(buf); err != nil {
+			continue
+		}
+		out = append(out, buf.Bytes())
+	}
+	return out
+}
+
+// Session returns the encoding of a short SPDY/3.1 client
+// session, for use as a corpus entry for Conns. Since the
+// header blocks share a compression context, they must be
+// read in order.
+func Session() []byte {
+	comp := common.NewCompressor(3)
+	post := requestHeader(3)
+	post.Set(":method", "POST")
+	session := []common.Frame{
+		&frames3.SETTINGS{Settings: common.Settings{
+			common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{
+				ID:    common.SETTINGS_INITIAL_WINDOW_SIZE,
+				Value: common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE,
+			},
+		}},
+		&frames3.SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Header: requestHeader(3)},
+		&frames3.PING{PingID: 1},
+		&frames3.SYN_STREAM{StreamID: 3, Header: post},
+		&frames3.DATA{StreamID: 3, Data: []byte("Hello")},
+		&frames3.WINDOW_UPDATE{StreamID: 0, DeltaWindowSize: 1024},
+		&frames3.DATA{StreamID: 3, Flags: common.FLAG_FIN, Data: []byte(", world")},
+		&frames3.RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL},
+		&frames3.GOAWAY{LastGoodStreamID: 0, Status: common.GOAWAY_OK},
+	}
+
+	buf := new(bytes.Buffer)
+	for _, frame := range session {
+		if err := frame.Compress(comp); err != nil {
+			continue
+		}
+		frame.WriteTo(buf)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,15 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fuzz contains fuzzing entry points for the SPDY frame
+// parsers and connection read loops.
+//
+// Each entry point has the signature expected by go-fuzz, and is
+// also run as a native Go fuzz target by the package's tests:
+//
+//	go test -fuzz=FuzzFrames github.com/SlyMarbo/spdy/fuzz
+//
+// Seed inputs are produced by Seeds, which writes a valid example
+// of each frame type with WriteTo.
+package fuzz
@@ -0,0 +1,171 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	frames2 "github.com/SlyMarbo/spdy/spdy2/frames"
+	"github.com/SlyMarbo/spdy/spdy3"
+	frames3 "github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// ConnTimeout is the time a connection is given to shut
+// down once its input has been exhausted. A connection
+// which takes longer is treated as hung, and Conns panics.
+var ConnTimeout = 5 * time.Second
+
+func init() {
+	// Malformed input produces a lot of log output.
+	common.SetLogOutput(ioutil.Discard)
+}
+
+// versionedFrame pairs a frame with its SPDY version.
+type versionedFrame struct {
+	frame   common.Frame
+	version uint16
+}
+
+// emptyFrames returns an empty frame of every type.
+func emptyFrames() []versionedFrame {
+	return []versionedFrame{
+		{new(frames2.SYN_STREAM), 2},
+		{new(frames2.SYN_REPLY), 2},
+		{new(frames2.RST_STREAM), 2},
+		{new(frames2.SETTINGS), 2},
+		{new(frames2.NOOP), 2},
+		{new(frames2.PING), 2},
+		{new(frames2.GOAWAY), 2},
+		{new(frames2.HEADERS), 2},
+		{new(frames2.WINDOW_UPDATE), 2},
+		{new(frames2.DATA), 2},
+		{new(frames3.SYN_STREAM), 3},
+		{new(frames3.SYN_REPLY), 3},
+		{new(frames3.RST_STREAM), 3},
+		{new(frames3.SETTINGS), 3},
+		{new(frames3.PING), 3},
+		{new(frames3.GOAWAY), 3},
+		{new(frames3.HEADERS), 3},
+		{new(frames3.WINDOW_UPDATE), 3},
+		{new(frames3.CREDENTIAL), 3},
+		{new(frames3.DATA), 3},
+	}
+}
+
+// Frames feeds data to the ReadFrom method of every frame
+// type, and to the ReadFrame function of each version. Any
+// frame parsed successfully is then decompressed, printed,
+// and written out again. Frames returns 1 if any frame was
+// parsed, and 0 otherwise.
+func Frames(data []byte) int {
+	parsed := make([]versionedFrame, 0, 4)
+	for _, f := range emptyFrames() {
+		if _, err := f.frame.ReadFrom(bytes.NewReader(data)); err == nil {
+			parsed = append(parsed, f)
+		}
+	}
+
+	for subversion := 0; subversion <= 1; subversion++ {
+		frame, err := frames3.ReadFrame(bufio.NewReader(bytes.NewReader(data)), subversion)
+		if err == nil {
+			parsed = append(parsed, versionedFrame{frame, 3})
+		}
+	}
+
+	if frame, err := frames2.ReadFrame(bufio.NewReader(bytes.NewReader(data))); err == nil {
+		parsed = append(parsed, versionedFrame{frame, 2})
+	}
+
+	for _, f := range parsed {
+		roundTrip(f)
+	}
+
+	if len(parsed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// roundTrip decompresses, prints and then re-encodes
+// a parsed frame.
+func roundTrip(f versionedFrame) {
+	if err := f.frame.Decompress(common.NewDecompressor(f.version)); err != nil {
+		return
+	}
+
+	_ = f.frame.String()
+
+	if err := f.frame.Compress(common.NewCompressor(f.version)); err != nil {
+		return
+	}
+	f.frame.WriteTo(ioutil.Discard)
+}
+
+// Conns feeds data to the read loop of a server connection
+// for each version of SPDY, and to a SPDY/3.1 client
+// connection. Conns returns 1 if every connection processed
+// its input, and 0 otherwise.
+func Conns(data []byte) int {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, fuzzer!"))
+	})
+
+	conns := []common.Conn{
+		spdy2.NewConn(newConn(data), &http.Server{Handler: handler}),
+		spdy3.NewConn(newConn(data), &http.Server{Handler: handler}, 0),
+		spdy3.NewConn(newConn(data), &http.Server{Handler: handler}, 1),
+		spdy3.NewConn(newConn(data), nil, 1),
+	}
+
+	out := 1
+	for _, conn := range conns {
+		done := make(chan error, 1)
+		go func(conn common.Conn) {
+			done <- conn.Run()
+		}(conn)
+
+		select {
+		case err := <-done:
+			if err != nil {
+				out = 0
+			}
+		case <-time.After(ConnTimeout):
+			panic("fuzz: connection failed to close")
+		}
+	}
+
+	return out
+}
+
+// conn is a synthetic net.Conn, which reads the
+// given data and discards anything written.
+type conn struct {
+	r *bytes.Reader
+}
+
+func newConn(data []byte) net.Conn {
+	return &conn{r: bytes.NewReader(data)}
+}
+
+func (c *conn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c *conn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *conn) Close() error                     { return nil }
+func (c *conn) LocalAddr() net.Addr              { return addr{} }
+func (c *conn) RemoteAddr() net.Addr             { return addr{} }
+func (c *conn) SetDeadline(time.Time) error      { return nil }
+func (c *conn) SetReadDeadline(time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(time.Time) error { return nil }
+
+type addr struct{}
+
+func (addr) Network() string { return "fuzz" }
+func (addr) String() string  { return "fuzz" }
@@ -0,0 +1,26 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz
+
+import "testing"
+
+func FuzzFrames(f *testing.F) {
+	for _, seed := range Seeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Frames(data)
+	})
+}
+
+func FuzzConns(f *testing.F) {
+	for _, seed := range Seeds() {
+		f.Add(seed)
+	}
+	f.Add(Session())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Conns(data)
+	})
+}
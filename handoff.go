@@ -0,0 +1,164 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// ListenersEnv is the environment variable used to tell a
+// new process how many listeners it has inherited. The
+// listeners are passed as the files following stderr, as
+// by exec.Cmd.ExtraFiles.
+const ListenersEnv = "SPDY_LISTENERS"
+
+// ListenerFiles returns a copy of each listener's file, so
+// that the listeners can be passed to a new process during a
+// restart. The files should be given to the new process as
+// its ExtraFiles, in order, with the environment variable
+// given by ListenersEnvVar.
+//
+// A zero-downtime restart is then:
+//
+//	files, err := spdy.ListenerFiles(l)
+//	// handle error
+//	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+//	cmd.Env = append(os.Environ(), spdy.ListenersEnvVar(len(files)))
+//	cmd.ExtraFiles = files
+//	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+//	err = cmd.Start()
+//	// handle error
+//
+//	// Stop accepting, and lame-duck the existing connections.
+//	l.Close()
+//	handoffs := spdy.Handoff(30 * time.Second)
+//
+// and the new process serves on the listeners returned by
+// InheritListeners.
+func ListenerFiles(listeners ...net.Listener) ([]*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	for _, l := range listeners {
+		f, ok := l.(filer)
+		if !ok {
+			return nil, errors.New("Error: Listener for " + l.Addr().String() + " cannot be passed to another process.")
+		}
+		file, err := f.File()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// ListenersEnvVar returns the environment variable, in the
+// form "key=value", which tells a new process that it has
+// inherited n listeners.
+func ListenersEnvVar(n int) string {
+	return ListenersEnv + "=" + strconv.Itoa(n)
+}
+
+// InheritListeners returns the listeners passed to the process
+// by its predecessor, in the order given to ListenerFiles, or
+// nil if there are none. The environment variable is cleared,
+// so that the listeners are not inherited twice.
+func InheritListeners() ([]net.Listener, error) {
+	value := os.Getenv(ListenersEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ListenersEnv)
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, errors.New("Error: Invalid " + ListenersEnv + " value " + strconv.Quote(value) + ".")
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		file := os.NewFile(uintptr(3+i), "listener "+strconv.Itoa(i))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Handoff lame-ducks every running SPDY connection during a
+// restart. Connections which support it are exported, sending
+// a GOAWAY so that new streams are opened on a connection to
+// the new process, and the rest are closed once idle. Handoff
+// then waits for the connections to finish their active
+// streams and close. Any still running once timeout has passed
+// are closed.
+//
+// The exported state of each connection is returned, and can
+// be passed to the new process, such as encoded as JSON, to be
+// given to Import on new connections to the same endpoints.
+func Handoff(timeout time.Duration) []common.ConnHandoff {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Exporting a connection can block until its send
+	// loop is free, so the exports are made concurrently
+	// and bounded by the timeout.
+	registered := common.Conns()
+	exported := make(chan common.ConnHandoff, len(registered))
+	exporting := 0
+	for _, r := range registered {
+		if handoffer, ok := r.Conn.(Handoffer); ok {
+			exporting++
+			go func(h Handoffer) {
+				exported <- h.Export()
+			}(handoffer)
+		} else {
+			go closeWhenIdle(r.Conn)
+		}
+	}
+
+	handoffs := make([]common.ConnHandoff, 0, exporting)
+	for i := 0; i < exporting; i++ {
+		select {
+		case handoff := <-exported:
+			handoffs = append(handoffs, handoff)
+		case <-timer.C:
+			for _, r := range registered {
+				r.Conn.Close()
+			}
+			return handoffs
+		}
+	}
+
+	for _, r := range registered {
+		select {
+		case <-r.Conn.CloseNotify():
+		case <-timer.C:
+			for _, r := range registered {
+				r.Conn.Close()
+			}
+			return handoffs
+		}
+	}
+	return handoffs
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// HandshakeMetrics records the duration, negotiated protocol,
+// cipher suite and resumption of each TLS handshake on the
+// listeners it creates. This shows how many clients are using
+// SPDY, which can inform protocol rollout decisions.
+//
+// A simple example is:
+//
+//	metrics := spdy.NewHandshakeMetrics()
+//	l, err := net.Listen("tcp", ":https")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	spdy.AddSPDY(srv)
+//	go srv.Serve(metrics.Listener(l, srv.TLSConfig))
+//
+//	// Later...
+//	stats := metrics.Stats()
+//	log.Printf("%d SPDY/3.1 handshakes", stats.Protocols["spdy/3.1"])
+type HandshakeMetrics struct {
+	lock  sync.Mutex
+	stats common.HandshakeStats
+}
+
+func NewHandshakeMetrics() *HandshakeMetrics {
+	out := new(HandshakeMetrics)
+	out.stats.Protocols = make(map[string]uint64)
+	out.stats.CipherSuites = make(map[uint16]uint64)
+	return out
+}
+
+// Listener returns a TLS listener which accepts connections
+// from inner, using config, and records each handshake. The
+// accepted connections are *tls.Conn, so the listener can be
+// used with http.Server.Serve and TLSNextProto as normal. Any
+// VerifyConnection callback in config is still called.
+//
+// Handshakes which use http/1.1, or which negotiate no
+// protocol, are recorded under "http/1.1".
+func (m *HandshakeMetrics) Listener(inner net.Listener, config *tls.Config) net.Listener {
+	return &metricsListener{Listener: inner, config: config, metrics: m}
+}
+
+// Stats returns a copy of the statistics so far.
+func (m *HandshakeMetrics) Stats() common.HandshakeStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	out := m.stats
+	out.Protocols = make(map[string]uint64, len(m.stats.Protocols))
+	for proto, n := range m.stats.Protocols {
+		out.Protocols[proto] = n
+	}
+	out.CipherSuites = make(map[uint16]uint64, len(m.stats.CipherSuites))
+	for suite, n := range m.stats.CipherSuites {
+		out.CipherSuites[suite] = n
+	}
+	return out
+}
+
+// record adds a completed handshake.
+func (m *HandshakeMetrics) record(state *tls.ConnectionState, d time.Duration) {
+	proto := state.NegotiatedProtocol
+	if proto == "" {
+		proto = "http/1.1"
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stats.Handshakes++
+	if state.DidResume {
+		m.stats.Resumed++
+	}
+	m.stats.TotalDuration += d
+	if d > m.stats.MaxDuration {
+		m.stats.MaxDuration = d
+	}
+	m.stats.Protocols[proto]++
+	m.stats.CipherSuites[state.CipherSuite]++
+}
+
+// metricsListener is used by HandshakeMetrics.Listener.
+type metricsListener struct {
+	net.Listener
+	config  *tls.Config
+	metrics *HandshakeMetrics
+}
+
+func (l *metricsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is timed from when the connection is
+	// accepted until it has been verified.
+	start := time.Now()
+	config := l.config.Clone()
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		l.metrics.record(&state, time.Since(start))
+		return nil
+	}
+
+	return tls.Server(conn, config), nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// OriginHints is what a Transport remembers about an origin
+// between connections. It can be encoded as JSON.
+type OriginHints struct {
+	// Protocol is the protocol last negotiated with the
+	// origin, such as "spdy/3.1" or "http/1.1".
+	Protocol string
+
+	// Settings holds the SPDY settings which the server
+	// asked to be persisted with FLAG_SETTINGS_PERSIST_VALUE.
+	Settings common.Settings `json:",omitempty"`
+}
+
+// HintStore stores OriginHints by origin, given as host:port.
+// Implementations must be safe for concurrent use. Save is
+// called from the read loops of SPDY sessions, so it should
+// not block for long.
+type HintStore interface {
+	Load(origin string) (OriginHints, bool)
+	Save(origin string, hints OriginHints) error
+}
+
+// MemoryHintStore is a HintStore held in memory, which lasts
+// for the life of the process.
+type MemoryHintStore struct {
+	lock  sync.Mutex
+	hints map[string]OriginHints
+}
+
+// NewMemoryHintStore returns an empty MemoryHintStore.
+func NewMemoryHintStore() *MemoryHintStore {
+	return &MemoryHintStore{hints: make(map[string]OriginHints)}
+}
+
+func (s *MemoryHintStore) Load(origin string) (OriginHints, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hints, ok := s.hints[origin]
+	hints.Settings = hints.Settings.Clone()
+	return hints, ok
+}
+
+func (s *MemoryHintStore) Save(origin string, hints OriginHints) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hints.Settings = hints.Settings.Clone()
+	s.hints[origin] = hints
+	return nil
+}
+
+// FileHintStore is a HintStore kept in a JSON file, so that
+// the hints survive process restarts. The file is rewritten
+// on each Save.
+type FileHintStore struct {
+	path   string
+	memory *MemoryHintStore
+	lock   sync.Mutex // serialises writes to the file.
+}
+
+// NewFileHintStore returns a FileHintStore kept at path,
+// loading any hints already saved there.
+func NewFileHintStore(path string) (*FileHintStore, error) {
+	s := &FileHintStore{path: path, memory: NewMemoryHintStore()}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.memory.hints); err != nil {
+		return nil, err
+	}
+	if s.memory.hints == nil {
+		s.memory.hints = make(map[string]OriginHints)
+	}
+	return s, nil
+}
+
+func (s *FileHintStore) Load(origin string) (OriginHints, bool) {
+	return s.memory.Load(origin)
+}
+
+func (s *FileHintStore) Save(origin string, hints OriginHints) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.memory.Save(origin, hints)
+	s.memory.lock.Lock()
+	data, err := json.Marshal(s.memory.hints)
+	s.memory.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Replace the file atomically, so that a crash
+	// cannot leave it truncated.
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,248 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	logging "log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3"
+)
+
+// Server is a drop-in replacement for http.Server, which serves
+// SPDY and HTTPS on the same port, choosing for each connection
+// the protocol negotiated with ALPN or NPN. Its fields have the
+// same meaning as in http.Server, so migrating an existing
+// program is typically a matter of changing the server's type:
+//
+//	srv := &spdy.Server{
+//		Addr:         ":https",
+//		Handler:      handler,
+//		ReadTimeout:  10 * time.Second,
+//		WriteTimeout: 10 * time.Second,
+//	}
+//	log.Fatal(srv.ListenAndServeTLS("cert.pem", "key.pem"))
+//
+// The fields must not be changed once the server begins serving.
+type Server struct {
+	Addr      string       // TCP address to listen on, ":https" if empty.
+	Handler   http.Handler // handler to invoke, http.DefaultServeMux if nil.
+	TLSConfig *tls.Config  // optional TLS config, which is cloned.
+
+	// KeyLogWriter, if set, is given the TLS session keys of
+	// each connection in the NSS key log format, so that
+	// captures of the traffic can be decrypted for debugging.
+	// It is used unless TLSConfig has a KeyLogWriter of its
+	// own. KeyLogFromEnv gives a writer to the file named by
+	// SSLKEYLOGFILE.
+	KeyLogWriter io.Writer
+
+	// ReadTimeout and WriteTimeout apply to each SPDY
+	// connection as a whole, rather than to each request,
+	// and are refreshed as frames are read and written.
+	// ReadHeaderTimeout, IdleTimeout and MaxHeaderBytes
+	// apply only to HTTPS connections. The limits on SPDY
+	// header blocks are set with SetHeaderLimits.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// MaxRequestBodyBytes, if positive, limits the size of each
+	// request body received over SPDY/3 and SPDY/3.1, in place
+	// of the limit set with SetMaxRequestBodyBytes. Requests
+	// which exceed it are answered with 413 Request Entity Too
+	// Large. HTTPS request bodies can be limited by wrapping the
+	// Handler with http.MaxBytesHandler.
+	MaxRequestBodyBytes int64
+
+	// CompressResponses, if true, compresses the bodies of
+	// responses sent over SPDY/3 and SPDY/3.1 where the client
+	// accepts it, as described for SetResponseCompression, even
+	// if it has not been enabled for every connection.
+	CompressResponses bool
+
+	// ServerTiming, if not ServerTimingOff, determines how the
+	// timing of each response sent over SPDY/3 and SPDY/3.1 is
+	// reported, as described for SetServerTiming, in place of
+	// the mode set for every connection.
+	ServerTiming common.ServerTimingMode
+
+	// ConnState specifies an optional callback, called
+	// when a client connection changes state, as in
+	// http.Server. SPDY/3 and SPDY/3.1 connections also
+	// report StateGoAway.
+	ConnState func(net.Conn, http.ConnState)
+
+	// ErrorLog specifies an optional logger for errors
+	// accepting connections and serving HTTPS. If nil,
+	// logging goes to os.Stderr. Errors on SPDY connections
+	// are logged by the package's logger, which is set with
+	// SetLogger.
+	ErrorLog *logging.Logger
+
+	once  sync.Once
+	srv   *http.Server
+	conns connSet
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{} // plaintext listeners.
+	closed    bool
+}
+
+// server returns the underlying http.Server, creating
+// it from the fields on first use.
+func (s *Server) server() *http.Server {
+	s.once.Do(func() {
+		s.srv = &http.Server{
+			Addr:              s.Addr,
+			Handler:           s.Handler,
+			TLSConfig:         s.TLSConfig.Clone(),
+			ReadTimeout:       s.ReadTimeout,
+			ReadHeaderTimeout: s.ReadHeaderTimeout,
+			WriteTimeout:      s.WriteTimeout,
+			IdleTimeout:       s.IdleTimeout,
+			MaxHeaderBytes:    s.MaxHeaderBytes,
+			ConnState:         s.ConnState,
+			ErrorLog:          s.ErrorLog,
+		}
+		AddSPDY(s.srv)
+		if s.KeyLogWriter != nil {
+			if s.srv.TLSConfig == nil {
+				s.srv.TLSConfig = new(tls.Config)
+			}
+			if s.srv.TLSConfig.KeyLogWriter == nil {
+				s.srv.TLSConfig.KeyLogWriter = s.KeyLogWriter
+			}
+		}
+		s.conns.configure = s.configureConn
+		s.conns.track(s.srv)
+	})
+	return s.srv
+}
+
+// configureConn applies the server's SPDY settings to conn.
+func (s *Server) configureConn(conn common.Conn) {
+	c, ok := conn.(*spdy3.Conn)
+	if !ok {
+		return
+	}
+	if s.MaxRequestBodyBytes > 0 {
+		c.MaxRequestBodyBytes = s.MaxRequestBodyBytes
+	}
+	if s.CompressResponses {
+		c.CompressResponses = true
+	}
+	if s.ServerTiming != common.ServerTimingOff {
+		c.ServerTiming = s.ServerTiming
+	}
+}
+
+// ListenAndServeTLS listens on the server's address and serves
+// SPDY and HTTPS, as http.Server.ListenAndServeTLS. Files
+// containing a certificate and matching private key must be
+// provided, unless the TLSConfig already has certificates.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	return s.server().ListenAndServeTLS(certFile, keyFile)
+}
+
+// ServeTLS serves SPDY and HTTPS on l, as http.Server.ServeTLS.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	return s.server().ServeTLS(l, certFile, keyFile)
+}
+
+// ListenAndServe listens on the server's address and serves
+// plain HTTP, as http.Server.ListenAndServe. SPDY is only
+// served over TLS, as the protocol must be negotiated, or
+// by ServePlaintext.
+func (s *Server) ListenAndServe() error {
+	return s.server().ListenAndServe()
+}
+
+// Serve serves plain HTTP on l, as http.Server.Serve.
+func (s *Server) Serve(l net.Listener) error {
+	return s.server().Serve(l)
+}
+
+// ServePlaintext accepts connections on l and serves SPDY/3.1
+// on each, without TLS, as spdy.ServePlaintext. Any net.Listener
+// may be used, such as a Unix domain socket for a sidecar or other
+// local IPC, alongside ServeTLS on another listener. Since there
+// is no protocol negotiation, every client must speak SPDY/3.1.
+// The connections are drained by Shutdown, and l is closed by
+// Shutdown and Close, after which http.ErrServerClosed is returned.
+func (s *Server) ServePlaintext(l net.Listener) error {
+	srv := s.server()
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return http.ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+	}()
+
+	err := acceptLoop(l, func(rw net.Conn) {
+		serveSPDYPlaintext(rw, srv, s.conns.serve)
+	})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// closeListeners closes the plaintext listeners, and stops
+// ServePlaintext from accepting new ones.
+func (s *Server) closeListeners() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+// Shutdown gracefully shuts down the server, as DualStack.Shutdown.
+// SPDY connections are sent a GOAWAY, or closed once idle if they
+// cannot be drained, and HTTPS connections are shut down as by
+// http.Server.Shutdown. If ctx expires before the connections have
+// closed, the rest are closed and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+	s.conns.drain()
+	err := s.server().Shutdown(ctx)
+	if werr := s.conns.wait(ctx); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// Close immediately closes the server's listeners and
+// all of its connections, as http.Server.Close.
+func (s *Server) Close() error {
+	s.closeListeners()
+	s.conns.close()
+	return s.server().Close()
+}
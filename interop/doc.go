@@ -0,0 +1,26 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package interop contains tests which check this package's SPDY
+// framing against the specifications and other implementations.
+// They are kept apart from the ordinary tests by the interop
+// build tag:
+//
+//	go test -tags interop github.com/SlyMarbo/spdy/interop
+//
+// Each frame type is checked byte for byte against golden
+// encodings taken from the SPDY/2 and SPDY/3 specifications,
+// covering details such as the width of the priority field and
+// the byte order of SPDY/2 setting IDs. Malformed frames, such
+// as those with incorrect lengths, must be rejected.
+//
+// Recorded sessions replay a client's bytes to a server. Their
+// header blocks were compressed with C zlib and the SPDY
+// dictionaries, as spdylay does, rather than with compress/zlib,
+// so they also check that the two implementations agree.
+//
+// Set SPDY_INTEROP_URL to the https URL of an external SPDY
+// server, such as spdylay's spdyd, to fetch it with a Transport
+// which only offers SPDY. The test is skipped otherwise.
+package interop
@@ -0,0 +1,266 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build interop
+
+package interop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+	frames2 "github.com/SlyMarbo/spdy/spdy2/frames"
+	frames3 "github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// A golden frame is the encoding of a frame given by the
+// specification. If frame is nil, only the decoding is
+// checked, along with check, if set.
+type golden struct {
+	name  string
+	frame common.Frame
+	hex   string
+	check func(common.Frame) bool
+}
+
+// syn3 is a SPDY/3 SYN_STREAM for GET https://example.com/,
+// with priority 3, as spdylay sends it. Its header block was
+// compressed with C zlib, using Python's zlib module, rather
+// than with compress/zlib.
+const syn3 = "800300010100005e0000000100000000600078f9e3c6a7c202a5235076b28216" +
+	"08dca91589a080d54b069713ec5688d4ecee1a02565990082eb318f5c1f2c5c0" +
+	"1232175c8c669494148052398715f6c48d9aa9788b0b522a73122b8192267a06" +
+	"00000000ffff"
+
+// syn2 is the equivalent SPDY/2 SYN_STREAM, with priority 1.
+const syn2 = "80020001010000650000000100000000400078f9dfa251b26260636001e51206" +
+	"eed48ac4dc829c54bde4fc5c06b65c60d6cc4f616076770d61602b06c6666e2a" +
+	"036b46494941310333481ba33e031722ad33f01617a454e6245602ad30d13360" +
+	"60875ac0c001b317000000ffff"
+
+var goldenSPDY3 = []golden{
+	{
+		name: "SYN_STREAM",
+		hex:  syn3,
+		check: func(f common.Frame) bool {
+			syn, ok := f.(*frames3.SYN_STREAM)
+			if !ok || syn.StreamID != 1 || syn.Priority != 3 || !syn.Flags.FIN() {
+				return false
+			}
+			if syn.Decompress(common.NewDecompressor(3)) != nil {
+				return false
+			}
+			return syn.Header.Get(":path") == "/" && syn.Header.Get("User-Agent") == "spdylay/1.4.0"
+		},
+	},
+	{
+		name:  "RST_STREAM",
+		frame: &frames3.RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL},
+		hex:   "80030003" + "00000008" + "00000001" + "00000005",
+	},
+	{
+		name: "SETTINGS",
+		frame: &frames3.SETTINGS{Settings: common.Settings{
+			common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
+				Flags: common.FLAG_SETTINGS_PERSIST_VALUE,
+				ID:    common.SETTINGS_MAX_CONCURRENT_STREAMS,
+				Value: 100,
+			},
+		}},
+		// Each entry's flags precede its 24-bit ID.
+		hex: "80030004" + "0000000c" + "00000001" + "01000004" + "00000064",
+	},
+	{
+		name:  "PING",
+		frame: &frames3.PING{PingID: 1},
+		hex:   "80030006" + "00000004" + "00000001",
+	},
+	{
+		name:  "GOAWAY",
+		frame: &frames3.GOAWAY{LastGoodStreamID: 1, Status: common.GOAWAY_PROTOCOL_ERROR},
+		hex:   "80030007" + "00000008" + "00000001" + "00000001",
+	},
+	{
+		name:  "WINDOW_UPDATE",
+		frame: &frames3.WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 0x10000},
+		hex:   "80030009" + "00000008" + "00000001" + "00010000",
+	},
+	{
+		name:  "DATA",
+		frame: &frames3.DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("hello")},
+		hex:   "00000001" + "01000005" + "68656c6c6f",
+	},
+	{
+		// NOOP was removed in SPDY/3, so is unknown.
+		name:  "NOOP",
+		frame: &frames3.UNKNOWN{Type: 5},
+		hex:   "80030005" + "00000000",
+	},
+	{
+		name:  "UNKNOWN",
+		frame: &frames3.UNKNOWN{Type: 0xff, Flags: 1, Data: []byte("hello")},
+		hex:   "800300ff" + "01000005" + "68656c6c6f",
+	},
+}
+
+var goldenSPDY2 = []golden{
+	{
+		name: "SYN_STREAM",
+		hex:  syn2,
+		check: func(f common.Frame) bool {
+			// SPDY/2 priorities have only two bits.
+			syn, ok := f.(*frames2.SYN_STREAM)
+			if !ok || syn.StreamID != 1 || syn.Priority != 1 || !syn.Flags.FIN() {
+				return false
+			}
+			if syn.Decompress(common.NewDecompressor(2)) != nil {
+				return false
+			}
+			return syn.Header.Get("Url") == "/" && syn.Header.Get("User-Agent") == "spdylay/1.4.0"
+		},
+	},
+	{
+		name:  "RST_STREAM",
+		frame: &frames2.RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL},
+		hex:   "80020003" + "00000008" + "00000001" + "00000005",
+	},
+	{
+		name: "SETTINGS",
+		frame: &frames2.SETTINGS{Settings: common.Settings{
+			common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
+				Flags: common.FLAG_SETTINGS_PERSIST_VALUE,
+				ID:    common.SETTINGS_MAX_CONCURRENT_STREAMS,
+				Value: 100,
+			},
+		}},
+		// SPDY/2 setting IDs are little-endian, as sent
+		// by Chrome, and followed by their flags.
+		hex: "80020004" + "0000000c" + "00000001" + "04000001" + "00000064",
+	},
+	{
+		name:  "NOOP",
+		frame: &frames2.NOOP{},
+		hex:   "80020005" + "00000000",
+	},
+	{
+		name:  "PING",
+		frame: &frames2.PING{PingID: 1},
+		hex:   "80020006" + "00000004" + "00000001",
+	},
+	{
+		// SPDY/2 GOAWAY frames have no status.
+		name:  "GOAWAY",
+		frame: &frames2.GOAWAY{LastGoodStreamID: 1},
+		hex:   "80020007" + "00000004" + "00000001",
+	},
+	{
+		name:  "DATA",
+		frame: &frames2.DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("hello")},
+		hex:   "00000001" + "01000005" + "68656c6c6f",
+	},
+	{
+		name:  "UNKNOWN",
+		frame: &frames2.UNKNOWN{Type: 0xff, Flags: 1, Data: []byte("hello")},
+		hex:   "800200ff" + "01000005" + "68656c6c6f",
+	},
+}
+
+func TestGoldenFramesSPDY3(t *testing.T) {
+	testGolden(t, goldenSPDY3, func(r *bufio.Reader) (common.Frame, error) {
+		return frames3.ReadFrame(r, 0)
+	})
+}
+
+func TestGoldenFramesSPDY2(t *testing.T) {
+	testGolden(t, goldenSPDY2, frames2.ReadFrame)
+}
+
+func testGolden(t *testing.T, tests []golden, read func(*bufio.Reader) (common.Frame, error)) {
+	for _, test := range tests {
+		want := decodeHex(t, test.hex)
+
+		if test.frame != nil {
+			got := new(bytes.Buffer)
+			if _, err := test.frame.WriteTo(got); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s: encoded as\n\t%x\nexpected\n\t%x", test.name, got.Bytes(), want)
+			}
+		}
+
+		// The frame must decode, and encode back
+		// to the same bytes.
+		r := bufio.NewReader(bytes.NewReader(want))
+		frame, err := read(r)
+		if err != nil {
+			t.Errorf("%s: failed to decode: %v", test.name, err)
+			continue
+		}
+		if _, err := r.Peek(1); err != io.EOF {
+			t.Errorf("%s: frame not fully consumed", test.name)
+		}
+		got := new(bytes.Buffer)
+		if _, err := frame.WriteTo(got); err != nil {
+			t.Errorf("%s: failed to re-encode: %v", test.name, err)
+		} else if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s: re-encoded as\n\t%x\nexpected\n\t%x", test.name, got.Bytes(), want)
+		}
+
+		// The check may decompress the header
+		// block, so it comes last.
+		if test.check != nil && !test.check(frame) {
+			t.Errorf("%s: decoded incorrectly as %v", test.name, frame)
+		}
+	}
+}
+
+func TestMalformedFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		hex     string
+	}{
+		{"SPDY/3 SYN_STREAM too short", 3, "80030001" + "00000008" + "00000001" + "00000000"},
+		{"SPDY/3 RST_STREAM too short", 3, "80030003" + "00000004" + "00000001"},
+		{"SPDY/3 SETTINGS wrong count", 3, "80030004" + "0000000c" + "00000002" + "00000004" + "00000064"},
+		{"SPDY/3 PING too long", 3, "80030006" + "00000008" + "00000001" + "00000000"},
+		{"SPDY/3 GOAWAY too short", 3, "80030007" + "00000004" + "00000001"},
+		{"SPDY/3 WINDOW_UPDATE stream 0", 3, "80030009" + "00000008" + "00000000" + "00010000"},
+		{"SPDY/3 WINDOW_UPDATE too large", 3, "80030009" + "00000008" + "00000001" + "80000000"},
+		{"SPDY/3 unknown flags", 3, "80030006" + "ff000004" + "00000001"},
+		{"SPDY/2 RST_STREAM too short", 2, "80020003" + "00000004" + "00000001"},
+		{"SPDY/2 SETTINGS wrong count", 2, "80020004" + "0000000c" + "00000002" + "04000000" + "00000064"},
+		{"SPDY/2 PING too long", 2, "80020006" + "00000008" + "00000001" + "00000000"},
+		{"SPDY/2 GOAWAY too long", 2, "80020007" + "00000008" + "00000001" + "00000000"},
+	}
+
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(decodeHex(t, test.hex)))
+		var frame common.Frame
+		var err error
+		if test.version == 2 {
+			frame, err = frames2.ReadFrame(r)
+		} else {
+			frame, err = frames3.ReadFrame(r, 0)
+		}
+		if err == nil {
+			t.Errorf("%s: accepted as %v", test.name, frame)
+		}
+	}
+}
+
+// decodeHex decodes a golden encoding, which
+// may contain whitespace for readability.
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
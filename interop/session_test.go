@@ -0,0 +1,227 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build interop
+
+package interop
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3"
+	frames3 "github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// clientSession is the start of a SPDY/3 session as
+// spdylay's spdycat opens it: SETTINGS, with a stream
+// limit of 100, then a GET request for /.
+const clientSession = "80030004" + "0000000c" + "00000001" + "00000004" + "00000064" + syn3
+
+// syncFlush ends each header block, which must
+// be flushed with Z_SYNC_FLUSH.
+var syncFlush = []byte{0, 0, 0xff, 0xff}
+
+func TestRecordedSession(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || r.Header.Get("User-Agent") != "spdylay/1.4.0" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	go conn.Run()
+
+	go client.Write(decodeHex(t, clientSession))
+
+	buf := bufio.NewReader(client)
+	decom := common.NewDecompressor(3)
+	var body []byte
+	for done := false; !done; {
+		raw, err := readRawFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw[0]&0x80 != 0 && (raw[0] != 0x80 || raw[1] != 3) {
+			t.Fatalf("Control frame has bad version: %x", raw[:4])
+		}
+
+		frame, err := frames3.ReadFrame(bufio.NewReader(bytes.NewReader(raw)), 0)
+		if err != nil {
+			t.Fatalf("Failed to decode %x: %v", raw, err)
+		}
+		switch frame := frame.(type) {
+		case *frames3.SYN_REPLY:
+			if !bytes.HasSuffix(raw, syncFlush) {
+				t.Errorf("SYN_REPLY header block was not sync flushed: %x", raw)
+			}
+			if err := frame.Decompress(decom); err != nil {
+				t.Fatal(err)
+			}
+			if frame.StreamID != 1 || frame.Header.Get(":status") != "200" {
+				t.Fatalf("Unexpected reply: %v", frame)
+			}
+		case *frames3.DATA:
+			if frame.StreamID != 1 {
+				t.Fatalf("Unexpected DATA: %v", frame)
+			}
+			body = append(body, frame.Data...)
+			done = frame.Flags.FIN()
+		case *frames3.RST_STREAM, *frames3.GOAWAY:
+			t.Fatalf("Session refused: %v", frame)
+		}
+	}
+
+	if string(body) != "hello" {
+		t.Errorf("Expected body %q, got %q", "hello", body)
+	}
+
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestClientFraming(t *testing.T) {
+	server, client := net.Pipe()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := spdy3.NewConn(client, nil, 0)
+	go conn.Run()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, err := http.NewRequest("GET", "https://example.com/", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.RequestResponse(req, nil, 5)
+	}()
+
+	buf := bufio.NewReader(server)
+	var raw []byte
+	for {
+		var err error
+		raw, err = readRawFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw[0] == 0x80 && raw[3] == 1 {
+			break
+		}
+	}
+
+	// The priority occupies the top three bits,
+	// followed by five unused bits and the slot.
+	if raw[16] != 5<<5 || raw[17] != 0 {
+		t.Errorf("Unexpected priority and slot bytes %x", raw[16:18])
+	}
+
+	// The header block must be readable by any
+	// zlib, so it is decoded here without the
+	// package's decompressor.
+	block := raw[18:]
+	if !bytes.HasSuffix(block, syncFlush) {
+		t.Errorf("Header block was not sync flushed: %x", block)
+	}
+	header, err := ioutil.ReadAll(zlibReader(t, block))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(header, []byte(":method")) || !bytes.Contains(header, []byte("example.com")) {
+		t.Errorf("Unexpected header block %q", header)
+	}
+
+	server.Close()
+	<-done
+	<-conn.CloseNotify()
+}
+
+func TestExternalServer(t *testing.T) {
+	target := os.Getenv("SPDY_INTEROP_URL")
+	if target == "" {
+		t.Skip("SPDY_INTEROP_URL is not set.")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := u.Host
+	if u.Port() == "" {
+		origin += ":443"
+	}
+
+	hints := spdy.NewMemoryHintStore()
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &spdy.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"spdy/3.1", "spdy/3", "spdy/2"},
+			},
+			Hints: hints,
+		},
+	}
+	res, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, _ := hints.Load(origin)
+	if !strings.HasPrefix(h.Protocol, "spdy/") {
+		t.Fatalf("Expected SPDY to be negotiated, got %q", h.Protocol)
+	}
+	t.Logf("Fetched %d bytes over %s with status %d.", len(body), h.Protocol, res.StatusCode)
+}
+
+// readRawFrame reads one frame, without decoding it.
+func readRawFrame(r *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	length := int(head[5])<<16 | int(head[6])<<8 | int(head[7])
+	frame := make([]byte, 8+length)
+	copy(frame, head)
+	if _, err := io.ReadFull(r, frame[8:]); err != nil {
+		return nil, fmt.Errorf("frame %x truncated: %v", head, err)
+	}
+	return frame, nil
+}
+
+// zlibReader returns a reader for the first header
+// block sent on a SPDY/3 connection.
+func zlibReader(t *testing.T, block []byte) io.Reader {
+	r, err := zlib.NewReaderDict(bytes.NewReader(block), common.HeaderDictionaryV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
@@ -0,0 +1,38 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"io"
+	"os"
+)
+
+// KeyLogFromEnv opens the file named by the SSLKEYLOGFILE
+// environment variable for appending, for use as the
+// KeyLogWriter of a Transport, Server or tls.Config. If the
+// variable is not set, KeyLogFromEnv returns nil. The writer
+// may be shared by clients and servers:
+//
+//	w, err := spdy.KeyLogFromEnv()
+//	...
+//	tr := &spdy.Transport{KeyLogWriter: w}
+//
+// The file is written in the NSS key log format, which lets
+// Wireshark decrypt captured TLS traffic. Anyone with the file
+// can decrypt the connections it records, so it should only be
+// used for debugging.
+func KeyLogFromEnv() (io.WriteCloser, error) {
+	name := os.Getenv("SSLKEYLOGFILE")
+	if name == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Warning: Logging TLS session keys to %s.\n", name)
+	return f, nil
+}
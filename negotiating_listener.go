@@ -0,0 +1,195 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	"github.com/SlyMarbo/spdy/spdy3"
+)
+
+// NegotiatingListener wraps a TCP listener, performing the TLS
+// handshake on each connection and dispatching it by the protocol
+// negotiated with ALPN or NPN. SPDY connections are served by this
+// package, while HTTP/2 and HTTP/1.1 connections are returned by
+// Accept, to be served by net/http. Every protocol uses the same
+// server's handler, timeouts and TLS config.
+//
+// A simple example is:
+//
+//	srv := &http.Server{Handler: handler, TLSConfig: config}
+//	nl := spdy.NewNegotiatingListener(l, srv)
+//	go func() {
+//		err := srv.Serve(nl)
+//		if err != nil && err != http.ErrServerClosed {
+//			log.Fatal(err)
+//		}
+//	}()
+//
+//	// Later...
+//	nl.Shutdown(ctx)
+//
+// The server's TLSConfig must provide the certificates.
+type NegotiatingListener struct {
+	net.Listener
+
+	server  *http.Server
+	config  *tls.Config
+	start   sync.Once
+	accepts chan acceptResult
+	done    chan struct{}
+	closed  sync.Once
+	conns   connSet
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewNegotiatingListener returns a listener serving SPDY on l
+// with srv, and must be called before srv begins serving. The
+// server's TLS config is prepared to advertise the SPDY versions,
+// HTTP/2 and HTTP/1.1, in that order, and HTTP/2 is enabled.
+func NewNegotiatingListener(l net.Listener, srv *http.Server) *NegotiatingListener {
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = new(tls.Config)
+	}
+	ConfigureTLS(srv.TLSConfig)
+	protos := make([]string, 0, len(srv.TLSConfig.NextProtos)+1)
+	for _, proto := range srv.TLSConfig.NextProtos {
+		if proto == "http/1.1" {
+			protos = append(protos, "h2")
+		}
+		if proto != "h2" {
+			protos = append(protos, proto)
+		}
+	}
+	srv.TLSConfig.NextProtos = protos
+
+	if srv.Protocols == nil {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+	}
+	srv.Protocols.SetHTTP2(true)
+
+	n := new(NegotiatingListener)
+	n.Listener = l
+	n.server = srv
+	n.config = srv.TLSConfig
+	n.accepts = make(chan acceptResult)
+	n.done = make(chan struct{})
+	return n
+}
+
+// Accept waits for and returns the next connection which
+// negotiated HTTP/2 or HTTP/1.1. The TLS handshake has been
+// completed.
+func (n *NegotiatingListener) Accept() (net.Conn, error) {
+	n.start.Do(func() {
+		go n.acceptLoop()
+	})
+
+	select {
+	case result := <-n.accepts:
+		return result.conn, result.err
+	case <-n.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener. Any connections
+// already accepted are not closed.
+func (n *NegotiatingListener) Close() error {
+	n.closed.Do(func() {
+		close(n.done)
+	})
+	return n.Listener.Close()
+}
+
+// Shutdown gracefully shuts down the server, as DualStack.Shutdown.
+// SPDY connections are sent a GOAWAY, or closed once idle if they
+// cannot be drained, and the rest are shut down by the server's
+// Shutdown, which also closes the listener.
+func (n *NegotiatingListener) Shutdown(ctx context.Context) error {
+	n.conns.drain()
+	err := n.server.Shutdown(ctx)
+	if werr := n.conns.wait(ctx); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// acceptLoop accepts connections from the underlying
+// listener, negotiating each in its own goroutine. Errors
+// are passed to Accept, and end the loop unless they are
+// temporary.
+func (n *NegotiatingListener) acceptLoop() {
+	for {
+		conn, err := n.Listener.Accept()
+		if err != nil {
+			select {
+			case n.accepts <- acceptResult{err: err}:
+			case <-n.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go n.negotiate(conn)
+	}
+}
+
+// negotiate performs the TLS handshake on conn, then serves it
+// with SPDY or passes it to Accept.
+func (n *NegotiatingListener) negotiate(conn net.Conn) {
+	defer common.Recover()
+
+	tlsConn := tls.Server(conn, n.config)
+	d := n.server.ReadHeaderTimeout
+	if d == 0 {
+		d = n.server.ReadTimeout
+	}
+	if d != 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	var spdyConn common.Conn
+	switch negotiatedProtocol(&state) {
+	case "spdy/2":
+		spdyConn = spdy2.NewConn(tlsConn, n.server)
+	case "spdy/3":
+		spdyConn = spdy3.NewConn(tlsConn, n.server, 0)
+	case "spdy/3.1":
+		spdyConn = spdy3.NewConn(tlsConn, n.server, 1)
+	default:
+		select {
+		case n.accepts <- acceptResult{conn: tlsConn}:
+		case <-n.done:
+			conn.Close()
+		}
+		return
+	}
+
+	setState(n.server, tlsConn, http.StateNew)
+	n.conns.serve(spdyConn)
+	conn.Close()
+	setState(n.server, tlsConn, http.StateClosed)
+}
@@ -0,0 +1,32 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package portforward carries TCP connections over the byte streams of
+// a stream.Session, in the manner of kubectl port-forward.
+//
+// A Forward accepts connections from a local listener, and carries each
+// to a target dialled by the other endpoint. A Reverse does the opposite,
+// carrying connections accepted by the other endpoint to a local target.
+// Both must use the client side of the session, as only clients open
+// streams. The server side of the session is handled by a Server.
+//
+// Each forward may limit the number of connections it carries at once,
+// and the rate at which it carries data, and reports statistics on the
+// connections it has carried.
+//
+// A simple example is:
+//
+//	// Server.
+//	server := new(portforward.Server)
+//	go server.Serve(stream.Server(conn))
+//
+//	// Client.
+//	session := stream.Client(conn)
+//	l, err := net.Listen("tcp", "127.0.0.1:5432")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	forward := &portforward.Forward{Session: session, Target: "db:5432"}
+//	log.Fatal(forward.Serve(l))
+package portforward
@@ -0,0 +1,146 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portforward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+// ErrRefused is returned when the other endpoint
+// refuses a forward.
+var ErrRefused = errors.New("Error: Forward refused by the other endpoint.")
+
+// Forward carries each connection accepted from a local
+// listener over a new stream, to a target dialled by the
+// other endpoint of the session.
+type Forward struct {
+	Session *stream.Session // client session used to open streams.
+	Target  string          // address dialled by the other endpoint.
+
+	// MaxConns, if positive, limits the number of connections
+	// carried at once. Further connections wait until one of
+	// those being carried has finished.
+	MaxConns int
+
+	// RateLimit, if positive, limits the bytes per second
+	// carried in each direction, shared by all connections.
+	RateLimit int64
+
+	link
+}
+
+// Serve accepts connections from l and carries each to the
+// target, until l or the session is closed.
+func (f *Forward) Serve(l net.Listener) error {
+	f.start(f.MaxConns, f.RateLimit)
+	cancel := f.Session.Conn().CloseNotify()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if !f.acquire(cancel) {
+			conn.Close()
+			return common.ErrConnClosed
+		}
+		go f.carry(conn, cancel)
+	}
+}
+
+func (f *Forward) carry(conn net.Conn, cancel <-chan bool) {
+	defer f.release()
+
+	remote, err := f.Session.Open(http.Header{TargetHeader: {f.Target}})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	f.join(conn, remote, cancel)
+}
+
+// Reverse carries each connection accepted by the other
+// endpoint of the session, on the address Listen, to a
+// target dialled locally.
+type Reverse struct {
+	Session *stream.Session // client session used to open streams.
+	Listen  string          // address listened on by the other endpoint.
+	Target  string          // address dialled locally.
+
+	// Dial is used to connect to the target. If nil,
+	// net.Dial is used.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// MaxConns, if positive, limits the number of connections
+	// carried at once. The other endpoint does not pass on
+	// further connections until one of those being carried
+	// has finished.
+	MaxConns int
+
+	// RateLimit, if positive, limits the bytes per second
+	// carried in each direction, shared by all connections.
+	RateLimit int64
+
+	link
+}
+
+// Run carries connections from the other endpoint until the
+// session is closed, or the other endpoint refuses the
+// forward.
+//
+// A stream is kept open for the next connection, and the
+// other endpoint signals when a connection has been accepted
+// with a single byte, after which the target is dialled.
+func (r *Reverse) Run() error {
+	r.start(r.MaxConns, r.RateLimit)
+	cancel := r.Session.Conn().CloseNotify()
+	for {
+		if !r.acquire(cancel) {
+			return common.ErrConnClosed
+		}
+
+		remote, err := r.Session.Open(http.Header{ListenHeader: {r.Listen}})
+		if err == common.ErrStreamClosed && !r.Session.Closed() {
+			err = ErrRefused
+		}
+		if err != nil {
+			r.release()
+			return err
+		}
+
+		// Wait for a connection.
+		var signal [1]byte
+		if _, err := io.ReadFull(remote, signal[:]); err != nil {
+			remote.Close()
+			r.release()
+			if r.Session.Closed() {
+				return common.ErrConnClosed
+			}
+			return ErrRefused
+		}
+
+		go r.carry(remote, cancel)
+	}
+}
+
+func (r *Reverse) carry(remote *stream.Stream, cancel <-chan bool) {
+	defer r.release()
+
+	dial := r.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", r.Target)
+	if err != nil {
+		remote.Close()
+		return
+	}
+	r.join(conn, remote, cancel)
+}
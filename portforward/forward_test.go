@@ -0,0 +1,151 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portforward_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy/portforward"
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+// echoServer returns a listener which echoes each
+// connection it accepts.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// sessions returns a connected pair of sessions.
+func sessions(t *testing.T) (client, server *stream.Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream.Client(c), stream.Server(s)
+}
+
+// echo checks that addr echoes a message.
+func echo(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const msg = "hello, world"
+	if _, err = io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("Expected %q, got %q", msg, buf)
+	}
+}
+
+func TestForward(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	client, server := sessions(t)
+	defer client.Close()
+	go new(portforward.Server).Serve(server)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	forward := &portforward.Forward{Session: client, Target: target.Addr().String(), MaxConns: 2}
+	go forward.Serve(l)
+
+	for i := 0; i < 3; i++ {
+		echo(t, l.Addr().String())
+	}
+
+	// The statistics are updated once each connection ends.
+	deadline := time.Now().Add(5 * time.Second)
+	for forward.Stats().Active > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := forward.Stats()
+	if stats.Active != 0 || stats.Total != 3 || stats.Sent != 36 || stats.Received != 36 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	client, server := sessions(t)
+	defer client.Close()
+
+	addrs := make(chan string, 1)
+	go (&portforward.Server{
+		Listen: func(network, addr string) (net.Listener, error) {
+			l, err := net.Listen(network, "127.0.0.1:0")
+			if err == nil {
+				addrs <- l.Addr().String()
+			}
+			return l, err
+		},
+	}).Serve(server)
+
+	reverse := &portforward.Reverse{Session: client, Listen: "remote", Target: target.Addr().String()}
+	go reverse.Run()
+
+	addr := <-addrs
+	for i := 0; i < 3; i++ {
+		echo(t, addr)
+	}
+
+	// Forwards which are not allowed are refused.
+	refused, server := sessions(t)
+	defer refused.Close()
+	go (&portforward.Server{
+		Allow: func(addr string, reverse bool) bool {
+			return !reverse
+		},
+	}).Serve(server)
+
+	reverse = &portforward.Reverse{Session: refused, Listen: "remote", Target: target.Addr().String()}
+	if err := reverse.Run(); err != portforward.ErrRefused {
+		t.Errorf("Expected %v, got %v", portforward.ErrRefused, err)
+	}
+}
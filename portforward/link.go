@@ -0,0 +1,151 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portforward
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+// The stream metadata used to describe each forward.
+const (
+	TargetHeader = "Portforward-Target" // address to dial for a Forward.
+	ListenHeader = "Portforward-Listen" // address to listen on for a Reverse.
+)
+
+// Stats describes the connections carried by a forward.
+type Stats struct {
+	Active   int64 // connections currently being carried.
+	Total    int64 // connections carried in total.
+	Sent     int64 // bytes sent to the other endpoint.
+	Received int64 // bytes received from the other endpoint.
+}
+
+// link holds the limits and statistics shared by the
+// connections carried by one forward.
+type link struct {
+	once      sync.Once
+	slots     chan struct{}       // nil if there is no connection limit.
+	sendLimit *common.RateLimiter // limit on data sent to the other endpoint.
+	recvLimit *common.RateLimiter // limit on data received from it.
+
+	active   int64
+	total    int64
+	sent     int64
+	received int64
+}
+
+// Stats returns the forward's statistics.
+func (l *link) Stats() Stats {
+	return Stats{
+		Active:   atomic.LoadInt64(&l.active),
+		Total:    atomic.LoadInt64(&l.total),
+		Sent:     atomic.LoadInt64(&l.sent),
+		Received: atomic.LoadInt64(&l.received),
+	}
+}
+
+// start applies the forward's limits. Only the first
+// call has any effect.
+func (l *link) start(maxConns int, rate int64) {
+	l.once.Do(func() {
+		if maxConns > 0 {
+			l.slots = make(chan struct{}, maxConns)
+		}
+		l.sendLimit = common.NewRateLimiter(rate, 0)
+		l.recvLimit = common.NewRateLimiter(rate, 0)
+	})
+}
+
+// acquire waits until another connection can be carried.
+// If cancel is closed first, acquire returns false.
+func (l *link) acquire(cancel <-chan bool) bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// release frees the slot taken by acquire.
+func (l *link) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// join carries data between a local connection and a
+// stream until both directions have finished, then closes
+// them both.
+func (l *link) join(local net.Conn, remote *stream.Stream, cancel <-chan bool) {
+	atomic.AddInt64(&l.active, 1)
+	atomic.AddInt64(&l.total, 1)
+	defer atomic.AddInt64(&l.active, -1)
+	defer local.Close()
+	defer remote.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if copyData(remote, local, l.sendLimit, &l.sent, cancel) == nil {
+			remote.CloseWrite()
+		} else {
+			remote.Close()
+		}
+	}()
+
+	if copyData(local, remote, l.recvLimit, &l.received, cancel) == nil {
+		closeWrite(local)
+	} else {
+		local.Close()
+	}
+	<-done
+}
+
+// copyData copies from src to dst until src ends, waiting
+// on limit before each write and adding the bytes written
+// to count.
+func copyData(dst io.Writer, src io.Reader, limit *common.RateLimiter, count *int64, cancel <-chan bool) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !limit.Wait(n, cancel) {
+				return common.ErrConnClosed
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			atomic.AddInt64(count, int64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeWrite half-closes conn if it supports that, or
+// closes it otherwise.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
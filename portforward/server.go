@@ -0,0 +1,170 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portforward
+
+import (
+	"net"
+
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+// Server handles the forwards opened by the client side
+// of a session, dialling the targets of each Forward, and
+// listening on the addresses of each Reverse.
+type Server struct {
+	// Dial is used to connect to the target of a Forward.
+	// If nil, net.Dial is used.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Listen is used to open the listener for a Reverse.
+	// If nil, net.Listen is used.
+	Listen func(network, addr string) (net.Listener, error)
+
+	// Allow, if set, is called with the address of each
+	// forward, and whether it is a Reverse. Forwards which
+	// it does not allow are refused.
+	Allow func(addr string, reverse bool) bool
+
+	// MaxConns, if positive, limits the number of connections
+	// carried at once. Further connections wait until one of
+	// those being carried has finished.
+	MaxConns int
+
+	// RateLimit, if positive, limits the bytes per second
+	// carried in each direction, shared by all connections.
+	RateLimit int64
+
+	link
+}
+
+// reverseListener passes each connection accepted on the
+// address of a Reverse to one of its waiting streams.
+type reverseListener struct {
+	net.Listener
+	streams chan *stream.Stream
+}
+
+// Serve handles the forwards opened on session, until it is
+// closed. Any listeners opened for Reverse forwards are closed
+// when Serve returns.
+func (s *Server) Serve(session *stream.Session) error {
+	s.start(s.MaxConns, s.RateLimit)
+	cancel := session.Conn().CloseNotify()
+
+	listeners := make(map[string]*reverseListener)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for {
+		remote, err := session.Accept()
+		if err != nil {
+			return err
+		}
+
+		if target := remote.Header().Get(TargetHeader); target != "" && s.allow(target, false) {
+			go s.forward(remote, target, cancel)
+			continue
+		}
+
+		addr := remote.Header().Get(ListenHeader)
+		if addr == "" || !s.allow(addr, true) {
+			remote.Close()
+			continue
+		}
+
+		l := listeners[addr]
+		if l == nil {
+			listen := s.Listen
+			if listen == nil {
+				listen = net.Listen
+			}
+			nl, err := listen("tcp", addr)
+			if err != nil {
+				remote.Close()
+				continue
+			}
+			l = &reverseListener{Listener: nl, streams: make(chan *stream.Stream)}
+			listeners[addr] = l
+			go s.reverse(l, cancel)
+		}
+
+		go func() {
+			select {
+			case l.streams <- remote:
+			case <-cancel:
+				remote.Close()
+			}
+		}()
+	}
+}
+
+func (s *Server) allow(addr string, reverse bool) bool {
+	return s.Allow == nil || s.Allow(addr, reverse)
+}
+
+// forward carries a stream to the target of a Forward.
+func (s *Server) forward(remote *stream.Stream, target string, cancel <-chan bool) {
+	if !s.acquire(cancel) {
+		remote.Close()
+		return
+	}
+	defer s.release()
+
+	dial := s.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", target)
+	if err != nil {
+		remote.Close()
+		return
+	}
+	s.join(conn, remote, cancel)
+}
+
+// reverse accepts connections for a Reverse, and signals
+// a waiting stream to carry each one.
+func (s *Server) reverse(l *reverseListener, cancel <-chan bool) {
+	for {
+		if !s.acquire(cancel) {
+			return
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			s.release()
+			return
+		}
+
+		if !s.signal(l, conn, cancel) {
+			conn.Close()
+			s.release()
+			return
+		}
+	}
+}
+
+// signal passes conn to the next waiting stream which
+// is still open.
+func (s *Server) signal(l *reverseListener, conn net.Conn, cancel <-chan bool) bool {
+	for {
+		select {
+		case remote := <-l.streams:
+			if _, err := remote.Write([]byte{1}); err != nil {
+				remote.Close()
+				continue
+			}
+			go func() {
+				defer s.release()
+				s.join(conn, remote, cancel)
+			}()
+			return true
+		case <-cancel:
+			return false
+		}
+	}
+}
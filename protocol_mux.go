@@ -0,0 +1,172 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	"github.com/SlyMarbo/spdy/spdy3"
+)
+
+// ProtocolMux wraps a cleartext listener, reading the first bytes
+// of each connection to tell SPDY from HTTP/1.1. Connections which
+// begin with a SPDY control frame are served by this package, while
+// the rest are returned by Accept, to be served by net/http. Both
+// protocols use the same server's handler and timeouts. SPDY/3
+// connections are served as SPDY/3.1, as the two cannot be told
+// apart by their first frame.
+//
+// A simple example is:
+//
+//	srv := &http.Server{Handler: handler}
+//	mux := spdy.NewProtocolMux(l, srv)
+//	go func() {
+//		err := srv.Serve(mux)
+//		if err != nil && err != http.ErrServerClosed {
+//			log.Fatal(err)
+//		}
+//	}()
+//
+//	// Later...
+//	mux.Shutdown(ctx)
+type ProtocolMux struct {
+	net.Listener
+
+	server  *http.Server
+	start   sync.Once
+	accepts chan acceptResult
+	done    chan struct{}
+	closed  sync.Once
+	conns   connSet
+}
+
+// NewProtocolMux returns a listener serving SPDY on l
+// with srv.
+func NewProtocolMux(l net.Listener, srv *http.Server) *ProtocolMux {
+	m := new(ProtocolMux)
+	m.Listener = l
+	m.server = srv
+	m.accepts = make(chan acceptResult)
+	m.done = make(chan struct{})
+	return m
+}
+
+// Accept waits for and returns the next connection which
+// is not using SPDY. The bytes read to identify it are
+// returned by its first reads.
+func (m *ProtocolMux) Accept() (net.Conn, error) {
+	m.start.Do(func() {
+		go m.acceptLoop()
+	})
+
+	select {
+	case result := <-m.accepts:
+		return result.conn, result.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener. Any connections
+// already accepted are not closed.
+func (m *ProtocolMux) Close() error {
+	m.closed.Do(func() {
+		close(m.done)
+	})
+	return m.Listener.Close()
+}
+
+// Shutdown gracefully shuts down the server, as
+// NegotiatingListener.Shutdown.
+func (m *ProtocolMux) Shutdown(ctx context.Context) error {
+	m.conns.drain()
+	err := m.server.Shutdown(ctx)
+	if werr := m.conns.wait(ctx); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// acceptLoop accepts connections from the underlying
+// listener, sniffing each in its own goroutine. Errors
+// are passed to Accept, and end the loop unless they are
+// temporary.
+func (m *ProtocolMux) acceptLoop() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			select {
+			case m.accepts <- acceptResult{err: err}:
+			case <-m.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go m.sniff(conn)
+	}
+}
+
+// sniff reads the start of conn, then serves it with
+// SPDY or passes it to Accept.
+func (m *ProtocolMux) sniff(conn net.Conn) {
+	defer common.Recover()
+
+	d := m.server.ReadHeaderTimeout
+	if d == 0 {
+		d = m.server.ReadTimeout
+	}
+	if d != 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+
+	// A SPDY control frame begins with the control bit
+	// and the version, which no HTTP/1.1 request can.
+	start := make([]byte, 2)
+	n, err := io.ReadFull(conn, start[:1])
+	if err == nil && start[0] == 0x80 {
+		n, err = io.ReadFull(conn, start[1:])
+		n++
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn = newPrefixedConn(conn, start[:n])
+	var spdyConn common.Conn
+	switch {
+	case n == 2 && start[1] == 2:
+		spdyConn = spdy2.NewConn(conn, m.server)
+	case n == 2 && start[1] == 3:
+		spdyConn = spdy3.NewConn(conn, m.server, 1)
+	case n == 2:
+		// Neither SPDY nor HTTP/1.1.
+		conn.Close()
+		return
+	default:
+		select {
+		case m.accepts <- acceptResult{conn: conn}:
+		case <-m.done:
+			conn.Close()
+		}
+		return
+	}
+
+	setState(m.server, conn, http.StateNew)
+	m.conns.serve(spdyConn)
+	conn.Close()
+	setState(m.server, conn, http.StateClosed)
+}
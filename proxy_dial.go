@@ -0,0 +1,270 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialTCP connects to addr, through the proxy for req
+// if there is one.
+func (t *Transport) dialTCP(ctx context.Context, req *http.Request, addr string) (net.Conn, error) {
+	if t.Proxy != nil {
+		proxy, err := t.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			return t.dialProxy(ctx, proxy, addr)
+		}
+	}
+
+	return t.dialContext()(ctx, "tcp", addr)
+}
+
+// dialProxy opens a tunnel to addr through the given proxy.
+func (t *Transport) dialProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	var port string
+	switch proxy.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	default:
+		return nil, errors.New(fmt.Sprintf("Error: Unsupported proxy scheme %q.", proxy.Scheme))
+	}
+	if proxy.Port() != "" {
+		port = proxy.Port()
+	}
+
+	raw, err := t.dialContext()(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake with the proxy is abandoned if
+	// the context expires.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			raw.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	conn := raw
+	switch proxy.Scheme {
+	case "https":
+		config := t.TLSClientConfig.Clone()
+		config.ServerName = proxy.Hostname()
+		config.NextProtos = nil
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.Handshake(); err == nil {
+			conn, err = t.proxyConnect(tlsConn, proxy, addr)
+		}
+	case "http":
+		conn, err = t.proxyConnect(conn, proxy, addr)
+	default:
+		err = socks5Connect(ctx, conn, proxy, addr)
+	}
+
+	close(done)
+	<-stopped
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// proxyConnect asks the HTTP proxy at the other end of conn
+// to open a tunnel to addr, with a CONNECT request.
+func (t *Transport) proxyConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for name, values := range t.ProxyConnectHeader {
+		req.Header[name] = values
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	// The response is read a byte at a time, so that
+	// none of the tunnel is consumed with it. Its body
+	// is the tunnel, so is not read.
+	res, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), req)
+	if err != nil {
+		return conn, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return conn, errors.New(fmt.Sprintf("Error: Proxy refused CONNECT with status %d.", res.StatusCode))
+	}
+
+	return conn, nil
+}
+
+// byteReader reads at most one byte at a time.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
+
+// socks5Replies gives the meaning of each SOCKS5 reply code.
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn
+// to open a tunnel to addr, as described in RFC 1928, with the
+// username and password authentication of RFC 1929 if the
+// proxy's URL has a username.
+func socks5Connect(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 0xffff {
+		return errors.New(fmt.Sprintf("Error: Invalid port in %q.", addr))
+	}
+
+	// Agree the authentication method.
+	method := byte(0) // No authentication.
+	if proxy.User != nil {
+		method = 2 // Username and password.
+	}
+	if _, err = conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("Error: SOCKS5 proxy refused authentication method.")
+	}
+
+	if method == 2 {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("Error: SOCKS5 username or password too long.")
+		}
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("Error: SOCKS5 proxy refused username and password.")
+		}
+	}
+
+	// Ask for the tunnel. With socks5h, or if the host
+	// cannot be resolved, the proxy resolves it.
+	request := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host); err == nil && len(addrs) > 0 {
+			ip = addrs[0].IP
+		}
+	}
+	switch {
+	case ip.To4() != nil:
+		request = append(request, 1)
+		request = append(request, ip.To4()...)
+	case ip != nil:
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	case len(host) <= 255:
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	default:
+		return errors.New(fmt.Sprintf("Error: Host name %q too long for SOCKS5.", host))
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	// Read the reply, discarding the bound address.
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 5 {
+		return errors.New("Error: Invalid SOCKS5 reply.")
+	}
+	if header[1] != 0 {
+		reason, ok := socks5Replies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply code %d", header[1])
+		}
+		return errors.New(fmt.Sprintf("Error: SOCKS5 proxy refused connection: %s.", reason))
+	}
+	var size int
+	switch header[3] {
+	case 1:
+		size = 4
+	case 4:
+		size = 16
+	case 3:
+		if _, err = io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		size = int(header[0])
+	default:
+		return errors.New("Error: Invalid SOCKS5 reply.")
+	}
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
@@ -0,0 +1,277 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// DefaultPushTTL is the time for which a pushed response
+// with no Cache-Control max-age is kept in a PushCache.
+const DefaultPushTTL = time.Minute
+
+// DefaultMaxPushCacheEntries is the default limit on the
+// number of responses stored in a PushCache.
+const DefaultMaxPushCacheEntries = 128
+
+// PushCache is an in-memory cache of pushed responses. When
+// set on a Transport, accepted pushes are stored by URL, and
+// later GET requests for the same URL are served from the
+// cache, without a round trip. A request made while the push
+// is still arriving waits for it to complete. Connections
+// reset pushes whose scheme or host differ from those of the
+// associated request, so one server cannot push responses
+// for another.
+//
+// Pushed responses with Cache-Control no-store or no-cache
+// are not stored. The max-age directive, if present, sets the
+// time for which a response is kept; otherwise TTL is used.
+type PushCache struct {
+	// TTL is the time for which responses without a max-age
+	// are kept. If zero, DefaultPushTTL is used.
+	TTL time.Duration
+
+	// MaxEntries limits the number of responses stored. If
+	// zero, DefaultMaxPushCacheEntries is used.
+	MaxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*pushCacheEntry
+}
+
+type pushCacheEntry struct {
+	ready      chan struct{} // closed once the push is complete.
+	statusCode int
+	header     http.Header
+	body       []byte
+	err        error
+	expires    time.Time // protected by the cache's lock.
+}
+
+func NewPushCache() *PushCache {
+	out := new(PushCache)
+	out.entries = make(map[string]*pushCacheEntry)
+	return out
+}
+
+// HandlePush accepts a push into the cache. This allows a
+// PushCache to be used as a common.PushHandler.
+func (c *PushCache) HandlePush(push *common.PushedResponse) bool {
+	if push.Request == nil || push.Request.URL == nil {
+		return false
+	}
+
+	key := pushCacheKey(push.Request.URL)
+	entry := &pushCacheEntry{
+		ready:   make(chan struct{}),
+		expires: time.Now().Add(c.ttl()),
+	}
+
+	c.lock.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*pushCacheEntry)
+	}
+	if _, ok := c.entries[key]; ok {
+		c.lock.Unlock()
+		return false // Already pushed.
+	}
+	c.evict()
+	c.entries[key] = entry
+	c.lock.Unlock()
+
+	go c.receive(key, entry, push)
+	return true
+}
+
+// receive reads the pushed response into the entry.
+func (c *PushCache) receive(key string, entry *pushCacheEntry, push *common.PushedResponse) {
+	defer close(entry.ready)
+
+	res := push.Response()
+	maxAge, cacheable := cacheLifetime(res.Header)
+	if res.StatusCode == http.StatusPartialContent {
+		// Only part of the resource was pushed.
+		cacheable = false
+	}
+	if !cacheable {
+		res.Body.Close()
+		entry.err = fmt.Errorf("Error: Pushed response for %q is not cacheable.", key)
+		c.remove(key, entry)
+		return
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		entry.err = err
+		c.remove(key, entry)
+		return
+	}
+
+	entry.statusCode = res.StatusCode
+	entry.header = cleanPushHeader(res.Header)
+	entry.body = body
+	if maxAge >= 0 {
+		c.lock.Lock()
+		entry.expires = time.Now().Add(maxAge)
+		c.lock.Unlock()
+	}
+}
+
+// Response returns a cached response for req, if one is
+// available. If the push is still arriving, Response waits
+// for it to complete, or for req's context to end.
+func (c *PushCache) Response(req *http.Request) (*http.Response, bool) {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return nil, false
+	}
+	if cc := req.Header.Get("Cache-Control"); strings.Contains(cc, "no-cache") {
+		return nil, false
+	}
+
+	key := pushCacheKey(req.URL)
+	c.lock.Lock()
+	entry := c.entries[key]
+	c.lock.Unlock()
+	if entry == nil {
+		return nil, false
+	}
+
+	select {
+	case <-entry.ready:
+	case <-req.Context().Done():
+		return nil, false
+	}
+
+	if entry.err != nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	expired := time.Now().After(entry.expires)
+	c.lock.Unlock()
+	if expired {
+		c.remove(key, entry)
+		return nil, false
+	}
+
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.statusCode, http.StatusText(entry.statusCode)),
+		StatusCode:    entry.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        common.CloneHeader(entry.header),
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Request:       req,
+	}
+	return res, true
+}
+
+// Len returns the number of responses in the cache,
+// including pushes which are still arriving.
+func (c *PushCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+func (c *PushCache) remove(key string, entry *pushCacheEntry) {
+	c.lock.Lock()
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	c.lock.Unlock()
+}
+
+// evict makes room for a new entry, removing expired
+// entries and then those closest to expiry. It must be
+// called with the lock held.
+func (c *PushCache) evict() {
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultMaxPushCacheEntries
+	}
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	for len(c.entries) >= max {
+		var oldest string
+		for key, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+func (c *PushCache) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return DefaultPushTTL
+}
+
+// pushCacheKey normalises u for use as a cache key,
+// removing any default port.
+func pushCacheKey(u *url.URL) string {
+	host := u.Host
+	switch {
+	case u.Scheme == "https" && strings.HasSuffix(host, ":443"):
+		host = strings.TrimSuffix(host, ":443")
+	case u.Scheme == "http" && strings.HasSuffix(host, ":80"):
+		host = strings.TrimSuffix(host, ":80")
+	}
+	return u.Scheme + "://" + host + u.RequestURI()
+}
+
+// cacheLifetime interprets the Cache-Control header of
+// a pushed response. The max-age is -1 if not given.
+func cacheLifetime(header http.Header) (maxAge time.Duration, cacheable bool) {
+	maxAge = -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.Atoi(directive[len("max-age="):])
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			maxAge = time.Duration(secs) * time.Second
+		}
+	}
+	return maxAge, true
+}
+
+// cleanPushHeader removes SPDY pseudo-headers from a
+// pushed response's headers.
+func cleanPushHeader(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for name, values := range header {
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// PushContent pushes the resource at the given URL on the stream
+// used by w, with content as its body, replying as http.ServeContent
+// replies to a GET request with the given header. A Range in the
+// header is pushed as a 206 Partial Content response, unless an
+// If-Range names another version of the resource, in which case the
+// whole resource is pushed. The name and modtime are used as by
+// http.ServeContent, and etag, if not empty, is sent as the ETag.
+// Typically, header is that of the request being served.
+//
+// Nothing is pushed if PushNeeded reports that the client already
+// has the resource cached, in which case PushContent returns the
+// ErrPushCached error. If the underlying connection is using HTTP,
+// and not SPDY, PushContent returns the ErrNotSPDY error.
+func PushContent(w http.ResponseWriter, resource string, header http.Header, name string, modtime time.Time, etag string, content io.ReadSeeker) error {
+	if !PushNeeded(header, etag, modtime) {
+		return common.ErrPushCached
+	}
+
+	u, err := url.Parse(resource)
+	if err != nil {
+		return err
+	}
+
+	push, err := Push(w, resource)
+	if err != nil {
+		return err
+	}
+	defer push.Finish()
+
+	// Only the range, if it still applies, is
+	// passed on to http.ServeContent.
+	pushHeader := make(http.Header)
+	if ranges := header.Get("Range"); ranges != "" && ifRangeMatches(header, etag, modtime) {
+		pushHeader.Set("Range", ranges)
+	}
+
+	request := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     pushHeader,
+		Host:       u.Host,
+		RequestURI: u.RequestURI(),
+	}
+	if etag != "" {
+		push.Header().Set("Etag", etag)
+	}
+	http.ServeContent(push, request, name, modtime, content)
+	return nil
+}
+
+// PushNeeded returns false if the given request header shows that
+// the client already has the version of a resource with the given
+// entity tag and modification time, so that pushing it would be
+// wasted. This is the case if its If-None-Match lists etag, or, if
+// it has no If-None-Match, its If-Modified-Since is no earlier than
+// modtime. Either etag or modtime may be zero, if unknown.
+func PushNeeded(header http.Header, etag string, modtime time.Time) bool {
+	if match := header.Get("If-None-Match"); match != "" {
+		return etag == "" || !etagListed(match, etag)
+	}
+
+	if since := header.Get("If-Modified-Since"); since != "" && !modtime.IsZero() {
+		t, err := http.ParseTime(since)
+		if err == nil && !modtime.Truncate(time.Second).After(t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ifRangeMatches returns true iff a Range in the given
+// header applies to the version of a resource with the
+// given entity tag and modification time, as there is no
+// If-Range, or the If-Range names that version.
+func ifRangeMatches(header http.Header, etag string, modtime time.Time) bool {
+	ifRange := strings.TrimSpace(header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	// An entity tag must match strongly.
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && ifRange == etag && !strings.HasPrefix(etag, "W/")
+	}
+
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !modtime.IsZero() && modtime.Truncate(time.Second).Equal(t)
+}
+
+// etagListed returns true iff the If-None-Match list
+// includes etag, using the weak comparison.
+func etagListed(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
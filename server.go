@@ -16,6 +16,11 @@ import (
 	"github.com/SlyMarbo/spdy/spdy3"
 )
 
+// StateGoAway is the state reported to an http.Server's
+// ConnState hook once a SPDY/3 or SPDY/3.1 connection has
+// sent or received a GOAWAY. See common.StateGoAway.
+const StateGoAway = common.StateGoAway
+
 // NewServerConn is used to create a SPDY connection, using the given
 // net.Conn for the underlying connection, and the given http.Server to
 // configure the request serving.
@@ -132,29 +137,9 @@ func ListenAndServeSpdyOnly(addr string, certFile string, keyFile string, handle
 	tlsListener := tls.NewListener(conn, server.TLSConfig)
 	defer tlsListener.Close()
 
-	// Main loop
-	var tempDelay time.Duration
-	for {
-		rw, e := tlsListener.Accept()
-		if e != nil {
-			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Printf("Accept error: %v; retrying in %v", e, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
-			return e
-		}
-		tempDelay = 0
-		go serveSPDY(rw, server)
-	}
+	return acceptLoop(tlsListener, func(rw net.Conn) {
+		serveSPDY(rw, server)
+	})
 }
 
 // ListenAndServeSPDYNoNPN creates a server that listens exclusively
@@ -189,10 +174,61 @@ func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handl
 	tlsListener := tls.NewListener(conn, server.TLSConfig)
 	defer tlsListener.Close()
 
-	// Main loop
+	return acceptLoop(tlsListener, func(rw net.Conn) {
+		serveSPDYNoNPN(rw, server, version, subversion)
+	})
+}
+
+// ListenAndServePlaintext listens on the TCP network address
+// addr and serves SPDY/3.1 on each incoming connection, without
+// TLS. Handler is typically nil, in which case the
+// DefaultServeMux is used.
+//
+// This is intended for internal deployments, such as behind a
+// load balancer which already terminates TLS. Since there is no
+// protocol negotiation, every client must speak SPDY/3.1.
+func ListenAndServePlaintext(addr string, handler http.Handler) error {
+	if addr == "" {
+		addr = ":http"
+	}
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	conn, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return ServePlaintext(conn, server)
+}
+
+// ServePlaintext accepts connections on l and serves SPDY/3.1
+// on each, without TLS, using srv to configure the request
+// serving. Any net.Listener may be used.
+func ServePlaintext(l net.Listener, srv *http.Server) error {
+	if srv == nil {
+		return errors.New("Error: Connection initialised with nil server.")
+	}
+	return acceptLoop(l, func(rw net.Conn) {
+		serveSPDYPlaintext(rw, srv, func(conn common.Conn) {
+			conn.Run()
+		})
+	})
+}
+
+// acceptLoop accepts connections from l, backing off on
+// temporary errors, and calls serve in a new goroutine
+// for each.
+func acceptLoop(l net.Listener, serve func(net.Conn)) error {
 	var tempDelay time.Duration
 	for {
-		rw, e := tlsListener.Accept()
+		rw, e := l.Accept()
 		if e != nil {
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -210,12 +246,25 @@ func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handl
 			return e
 		}
 		tempDelay = 0
-		go serveSPDYNoNPN(rw, server, version, subversion)
+		go serve(rw)
+	}
+}
+
+// setState calls srv's ConnState hook, if any. The
+// connections served by this package's own accept loops
+// are reported as new and closed here, as http.Server
+// does for those it accepts.
+func setState(srv *http.Server, conn net.Conn, state http.ConnState) {
+	if srv.ConnState != nil {
+		srv.ConnState(conn, state)
 	}
 }
 
 func serveSPDY(conn net.Conn, srv *http.Server) {
 	defer common.Recover()
+	setState(srv, conn, http.StateNew)
+	defer setState(srv, conn, http.StateClosed)
+	defer conn.Close()
 
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok { // Only allow TLS connections.
@@ -232,9 +281,8 @@ func serveSPDY(conn net.Conn, srv *http.Server) {
 		return
 	}
 
-	tlsState := new(tls.ConnectionState)
-	*tlsState = tlsConn.ConnectionState()
-	proto := tlsState.NegotiatedProtocol
+	tlsState := tlsConn.ConnectionState()
+	proto := negotiatedProtocol(&tlsState)
 	if fn := srv.TLSNextProto[proto]; fn != nil {
 		fn(srv, tlsConn, nil)
 	}
@@ -243,6 +291,9 @@ func serveSPDY(conn net.Conn, srv *http.Server) {
 
 func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version, subversion int) {
 	defer common.Recover()
+	setState(srv, conn, http.StateNew)
+	defer setState(srv, conn, http.StateClosed)
+	defer conn.Close()
 
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok { // Only allow TLS connections.
@@ -266,3 +317,26 @@ func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version, subversion int) {
 	}
 	serverConn.Run()
 }
+
+// serveSPDYPlaintext serves SPDY/3.1 on conn, calling run
+// to run the session.
+func serveSPDYPlaintext(conn net.Conn, srv *http.Server, run func(common.Conn)) {
+	defer common.Recover()
+	setState(srv, conn, http.StateNew)
+	defer setState(srv, conn, http.StateClosed)
+	defer conn.Close()
+
+	if d := srv.ReadTimeout; d != 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+	if d := srv.WriteTimeout; d != 0 {
+		conn.SetWriteDeadline(time.Now().Add(d))
+	}
+
+	serverConn, err := NewServerConn(conn, srv, 3, 1)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	run(serverConn)
+}
@@ -0,0 +1,4163 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+func TestRejectionResponses(t *testing.T) {
+	spdy.SetRejectionResponses(true)
+	defer spdy.SetRejectionResponses(false)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Send a request with no method.
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", l.Addr().String())
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err = syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syn.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	var reply *frames.SYN_REPLY
+	for reply == nil {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.SYN_REPLY:
+			reply = frame
+		case *frames.RST_STREAM:
+			t.Fatalf("Received %s instead of a rejection response.", frame.Status)
+		}
+	}
+
+	if status := reply.Header.Get(":status"); status != "400" {
+		t.Errorf("Expected status 400, got %q", status)
+	}
+
+	frame, err := frames.ReadFrame(buf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := frame.(*frames.DATA)
+	if !ok {
+		t.Fatalf("Expected DATA, got %T", frame)
+	}
+	if !data.Flags.FIN() || !strings.Contains(string(data.Data), "400 Bad Request") {
+		t.Errorf("Unexpected rejection body %q", data.Data)
+	}
+}
+
+func TestRejectionResponseWindow(t *testing.T) {
+	spdy.SetRejectionResponses(true)
+	defer spdy.SetRejectionResponses(false)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Leave no room for the rejection's body.
+	settings := new(frames.SETTINGS)
+	settings.Settings = common.Settings{
+		common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{ID: common.SETTINGS_INITIAL_WINDOW_SIZE, Value: 16},
+	}
+	if _, err = settings.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a request with no method.
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", l.Addr().String())
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err = syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syn.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.SYN_REPLY:
+			t.Fatal("Sent a rejection response larger than the transfer window.")
+		case *frames.DATA:
+			t.Fatalf("Sent %d bytes of DATA beyond the transfer window.", len(frame.Data))
+		case *frames.RST_STREAM:
+			if frame.StreamID != 1 {
+				t.Errorf("Expected RST_STREAM for stream 1, got %d", frame.StreamID)
+			}
+			return
+		}
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	com := common.NewCompressor(3)
+	request := func(sid common.StreamID, extra int, value string) {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = common.FLAG_FIN
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "GET")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", l.Addr().String())
+		syn.Header.Set(":path", "/")
+		syn.Header.Set(":version", "HTTP/1.1")
+		for i := 0; i < extra; i++ {
+			syn.Header.Set(fmt.Sprintf("x-extra-%d", i), value)
+		}
+		if err := syn.Compress(com); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syn.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Send a request with too many headers, one which
+	// decompresses to an excessive size, and then a
+	// normal request on the same connection.
+	request(1, common.MaxHeaderCount, "1")
+	request(3, 1, strings.Repeat("a", common.MaxHeaderBlockSize))
+	request(5, 0, "")
+
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	resets := 0
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.RST_STREAM:
+			if frame.StreamID != 1 && frame.StreamID != 3 || frame.Status != common.RST_STREAM_PROTOCOL_ERROR {
+				t.Fatalf("Unexpected %s on stream %d", frame.Status, frame.StreamID)
+			}
+			resets++
+		case *frames.SYN_REPLY:
+			if frame.StreamID != 5 {
+				t.Fatalf("Unexpected SYN_REPLY on stream %d", frame.StreamID)
+			}
+			if resets != 2 {
+				t.Fatalf("Expected 2 requests to be reset, got %d", resets)
+			}
+			return
+		}
+	}
+}
+
+func TestPseudoHeaders(t *testing.T) {
+	seen := make(chan *http.Request, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: handler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	framer, err := frames.NewFramer(1, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer framer.Close()
+	request := func(sid common.StreamID, name, value string) {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = common.FLAG_FIN
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "GET")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", "/robots.txt?q=1")
+		syn.Header.Set(":version", "HTTP/1.1")
+		if value == "" {
+			delete(syn.Header, name)
+		} else {
+			syn.Header[name] = []string{value}
+		}
+		if err := framer.WriteFrame(syn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Requests missing a pseudo-header, or carrying a
+	// connection-specific header, are refused. The package's
+	// compressor drops connection headers, so Keep-Alive is
+	// given in lower case to slip past it.
+	request(1, ":path", "")
+	request(3, ":host", "")
+	request(5, "keep-alive", "300")
+	request(7, "Accept", "*/*")
+
+	resets := 0
+	for done := false; !done; {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.RST_STREAM:
+			if frame.StreamID == 7 || frame.Status != common.RST_STREAM_PROTOCOL_ERROR {
+				t.Fatalf("Unexpected %s on stream %d", frame.Status, frame.StreamID)
+			}
+			resets++
+		case *frames.SYN_REPLY:
+			if frame.StreamID != 7 {
+				t.Fatalf("Unexpected SYN_REPLY on stream %d", frame.StreamID)
+			}
+			done = true
+		}
+	}
+	if resets != 3 {
+		t.Errorf("Expected 3 requests to be reset, got %d", resets)
+	}
+
+	r := <-seen
+	if r.Method != "GET" || r.Host != "example.com" || r.URL.Path != "/robots.txt" || r.RequestURI != "/robots.txt?q=1" ||
+		r.Proto != "HTTP/1.1" || r.Header.Get("Accept") != "*/*" {
+		t.Errorf("Unexpected request %v", r)
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(name, ":") {
+			t.Errorf("Handler saw pseudo-header %s", name)
+		}
+	}
+}
+
+func TestHandshakeMetrics(t *testing.T) {
+	ts := newServer(robotsTxtHandler)
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	metrics := spdy.NewHandshakeMetrics()
+	srv := &http.Server{Handler: robotsTxtHandler, TLSConfig: ts.TLS}
+	spdy.AddSPDY(srv)
+	go srv.Serve(metrics.Listener(l, srv.TLSConfig))
+
+	r, err := newClient().Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	stats := metrics.Stats()
+	if stats.Handshakes != 1 {
+		t.Fatalf("Expected 1 handshake, got %d", stats.Handshakes)
+	}
+	if n := stats.Protocols["spdy/3.1"]; n != 1 {
+		t.Errorf("Expected 1 SPDY/3.1 handshake, got %d (%v)", n, stats.Protocols)
+	}
+	if len(stats.CipherSuites) != 1 {
+		t.Errorf("Expected 1 cipher suite, got %v", stats.CipherSuites)
+	}
+	if stats.MeanDuration() <= 0 || stats.MeanDuration() > stats.MaxDuration {
+		t.Errorf("Unexpected handshake durations: mean %v, max %v", stats.MeanDuration(), stats.MaxDuration)
+	}
+}
+
+func TestRejectUnidirectional(t *testing.T) {
+	spdy.SetRejectUnidirectional(true)
+	defer spdy.SetRejectUnidirectional(false)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Send a unidirectional request, then an ordinary one.
+	com := common.NewCompressor(3)
+	for _, sid := range []common.StreamID{1, 3} {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = common.FLAG_FIN
+		if sid == 1 {
+			syn.Flags |= common.FLAG_UNIDIRECTIONAL
+		}
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "GET")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", l.Addr().String())
+		syn.Header.Set(":path", "/")
+		syn.Header.Set(":version", "HTTP/1.1")
+		if err = syn.Compress(com); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = syn.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first must be refused, and the second served.
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	refused := false
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.RST_STREAM:
+			if frame.StreamID != 1 || frame.Status != common.RST_STREAM_PROTOCOL_ERROR {
+				t.Fatalf("Unexpected %s", frame)
+			}
+			refused = true
+		case *frames.SYN_REPLY:
+			if frame.StreamID != 3 {
+				t.Fatalf("Unexpected %s", frame)
+			}
+			if !refused {
+				t.Error("Unidirectional stream was not refused.")
+			}
+			return
+		}
+	}
+}
+
+func TestFlushHeaders(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := spdy.FlushHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Stream", "yes")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: handler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Priority = 7
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", l.Addr().String())
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err = syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syn.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// The headers must arrive while the handler is
+	// still running.
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		if reply, ok := frame.(*frames.SYN_REPLY); ok {
+			if reply.Header.Get("X-Stream") != "yes" {
+				t.Errorf("Expected X-Stream header, got %v", reply.Header)
+			}
+			return
+		}
+	}
+}
+
+func TestFrameOrdering(t *testing.T) {
+	const size = 100 << 10 // Larger than the transfer window.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, size))
+		w.Header().Set("X-After", "yes")
+		w.(http.Flusher).Flush()
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: handler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", l.Addr().String())
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err = syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syn.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// The headers were set after the data was written,
+	// so must not overtake the data held by flow control.
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	received := 0
+	updated := false
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+
+		switch frame := frame.(type) {
+		case *frames.DATA:
+			received += len(frame.Data)
+			if frame.Flags.FIN() {
+				t.Fatal("Stream ended before the headers were received.")
+			}
+			if !updated && received >= common.DEFAULT_INITIAL_WINDOW_SIZE {
+				updated = true
+				for _, id := range []common.StreamID{0, 1} {
+					grow := new(frames.WINDOW_UPDATE)
+					grow.StreamID = id
+					grow.DeltaWindowSize = 1 << 20
+					if _, err = grow.WriteTo(conn); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+		case *frames.HEADERS:
+			if frame.Header.Get("X-After") != "yes" {
+				t.Errorf("Expected X-After header, got %v", frame.Header)
+			}
+			if received != size {
+				t.Fatalf("Headers received after %d bytes of data, expected %d.", received, size)
+			}
+			return
+		}
+	}
+}
+
+func TestHeaderSnapshots(t *testing.T) {
+	done := make(chan struct{})
+	unmodified := true
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		h := w.Header()
+		h.Set("X-First", "1")
+		w.WriteHeader(http.StatusOK)
+		unmodified = h.Get("X-First") == "1"
+		h.Set("X-Second", "2")
+		w.(http.Flusher).Flush()
+
+		// Keep changing the headers until the stream is
+		// reset, which races with the stream's shutdown.
+		for i := 0; r.Context().Err() == nil; i++ {
+			h.Set("X-Count", strconv.Itoa(i))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: handler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", l.Addr().String())
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err = syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syn.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each flush should send only the headers which
+	// have changed since the last.
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	var headers []http.Header
+	for len(headers) < 3 {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.SYN_REPLY:
+			headers = append(headers, frame.Header)
+		case *frames.HEADERS:
+			headers = append(headers, frame.Header)
+		}
+	}
+
+	if headers[0].Get("X-First") != "1" || headers[0].Get("X-Second") != "" {
+		t.Errorf("Unexpected SYN_REPLY headers: %v", headers[0])
+	}
+	if headers[1].Get("X-Second") != "2" || headers[1].Get("X-First") != "" {
+		t.Errorf("Unexpected first HEADERS: %v", headers[1])
+	}
+	if headers[2].Get("X-Count") == "" || headers[2].Get("X-Second") != "" {
+		t.Errorf("Unexpected second HEADERS: %v", headers[2])
+	}
+
+	rst := new(frames.RST_STREAM)
+	rst.StreamID = 1
+	rst.Status = common.RST_STREAM_CANCEL
+	if _, err = rst.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler did not see the stream reset.")
+	}
+	if !unmodified {
+		t.Error("WriteHeader modified the handler's header.")
+	}
+}
+
+// countingListener counts the bytes read from
+// its connections.
+type countingListener struct {
+	net.Listener
+	n *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, l.n}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestExpectContinue(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accept", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	})
+	mux.HandleFunc("/reject", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusExpectationFailed)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var received int64
+	go spdy.ServePlaintext(countingListener{l, &received}, &http.Server{Handler: mux})
+
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tcpConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(*spdy3.Conn).ExpectContinueTimeout = time.Minute
+	go conn.Run()
+	defer conn.Close()
+
+	const size = 256 << 10
+	request := func(path string) *http.Response {
+		req, err := http.NewRequest("POST", "http://"+l.Addr().String()+path, bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Expect", "100-continue")
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// The body is not sent if the handler
+	// replies without reading it.
+	res := request("/reject")
+	res.Body.Close()
+	if res.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("Expected status %d, got %d", http.StatusExpectationFailed, res.StatusCode)
+	}
+	if n := atomic.LoadInt64(&received); n >= size {
+		t.Errorf("Server received %d bytes, so the body was sent.", n)
+	}
+
+	// Otherwise, it is sent once the handler reads it.
+	res = request("/accept")
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if string(body) != fmt.Sprint(size) {
+		t.Errorf("Expected the handler to read %d bytes, got %q", size, body)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		if spdy.UsingSPDY(w) {
+			fmt.Fprint(w, "SPDY")
+		} else {
+			fmt.Fprint(w, r.Proto)
+		}
+	}))
+	ds := spdy.NewDualStack(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	h2 := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	sc := newClient()
+
+	for _, test := range []struct {
+		client *http.Client
+		want   string
+	}{
+		{sc, "SPDY"},
+		{h2, "HTTP/2.0"},
+	} {
+		r, err := test.client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.want {
+			t.Errorf("Expected %q, got %q", test.want, body)
+		}
+	}
+
+	// Shutdown must wait for the active SPDY stream.
+	slow := make(chan string, 1)
+	go func() {
+		r, err := sc.Get(ts.URL + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		slow <- string(body)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- ds.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned early: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if body := <-slow; body != "SPDY" {
+		t.Errorf("Expected %q, got %q", "SPDY", body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := spdy.NetConn(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		// Echo until the client half-closes.
+		if _, err := io.Copy(conn, conn); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprint(conn, "BYE")
+	}))
+	defer ts.Close()
+
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1"}}
+	tlsConn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	defer conn.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/tunnel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, res, err := conn.(spdy.StreamDialer).Dial(req, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	// Send more than the initial transfer window.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	go func() {
+		if _, err := stream.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatal("Echoed data does not match")
+	}
+
+	// Nothing more is sent until the client half-closes.
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := stream.Read(echo); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	if err := stream.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "BYE" {
+		t.Errorf("Expected %q, got %q", "BYE", rest)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	type report struct {
+		path  string
+		v     interface{}
+		stack []byte
+	}
+	reports := make(chan report, 2)
+	spdy.SetPanicHandler(func(r *http.Request, v interface{}, stack []byte) {
+		reports <- report{r.URL.Path, v, stack}
+	})
+	defer spdy.SetPanicHandler(nil)
+
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/after":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			panic("after")
+		case "/before":
+			panic("before")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1"}}
+	tlsConn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	defer conn.Close()
+
+	get := func(path string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.RequestResponse(req, nil, 0)
+	}
+
+	checkReport := func(path string) {
+		select {
+		case r := <-reports:
+			if r.path != path || r.v != path[1:] || len(r.stack) == 0 {
+				t.Fatalf("Unexpected panic report %q, %v, %d-byte stack.", r.path, r.v, len(r.stack))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Panic in %s was not reported.", path)
+		}
+	}
+
+	// A panic before the headers are sent gives a 500.
+	res, err := get("/before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d.", res.StatusCode)
+	}
+	checkReport("/before")
+
+	// A panic after the headers are sent resets the stream.
+	_, err = get("/after")
+	reset, ok := err.(*common.StreamResetError)
+	if !ok || reset.Status != common.RST_STREAM_INTERNAL_ERROR {
+		t.Fatalf("Expected INTERNAL_ERROR reset, got %v.", err)
+	}
+	checkReport("/after")
+
+	// The connection is still usable.
+	res, err = get("/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("Expected \"ok\", got %q, %v.", body, err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	uploads := make(chan string, 1)
+	proceed := make(chan struct{})
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/answer":
+			// Answer before the upload has finished.
+			fmt.Fprint(w, "early")
+			if err := spdy.CloseWrite(w); err != nil {
+				t.Error(err)
+			}
+			if _, err := w.Write([]byte("late")); err == nil {
+				t.Error("Write succeeded after CloseWrite")
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			uploads <- string(body)
+
+		case "/ignore":
+			// Ignore the upload, but still respond.
+			w.WriteHeader(http.StatusOK)
+			if err := spdy.CloseRead(w, false); err != nil {
+				t.Error(err)
+			}
+			<-proceed
+			if _, err := r.Body.Read(make([]byte, 1)); err == nil {
+				t.Error("Read succeeded after CloseRead")
+			}
+			fmt.Fprint(w, "ignored")
+		}
+	}))
+	defer ts.Close()
+
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1"}}
+	tlsConn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	defer conn.Close()
+
+	dial := func(path string) net.Conn {
+		req, err := http.NewRequest("POST", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, _, err := conn.(spdy.StreamDialer).Dial(req, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		return stream
+	}
+
+	// The response ends while the upload continues.
+	stream := dial("/answer")
+	res, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "early" {
+		t.Errorf("Expected %q, got %q", "early", res)
+	}
+	if _, err := stream.Write([]byte("upload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if upload := <-uploads; upload != "upload" {
+		t.Errorf("Expected upload %q, got %q", "upload", upload)
+	}
+	stream.Close()
+
+	// The upload is discarded while the response is sent.
+	stream = dial("/ignore")
+	if _, err := stream.Write([]byte("unwanted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once a PING has been answered, the server has seen
+	// the upload end, so the stream can end normally.
+	pong, err := conn.(spdy.Pinger).Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-pong
+	close(proceed)
+	res, err = ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "ignored" {
+		t.Errorf("Expected %q, got %q", "ignored", res)
+	}
+	stream.Close()
+}
+
+func TestStreamReset(t *testing.T) {
+	causes := make(chan error, 1)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := spdy.NetConn(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		if r.URL.Path == "/server-reset" {
+			// Reset once the client is ready.
+			io.ReadFull(conn, make([]byte, 1))
+			conn.(*spdy3.StreamConn).Reset(common.RST_STREAM_REFUSED_STREAM)
+			return
+		}
+
+		// Wait for the client to reset the stream.
+		<-r.Context().Done()
+		causes <- context.Cause(r.Context())
+	}))
+	defer ts.Close()
+
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1"}}
+	tlsConn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	defer conn.Close()
+
+	dial := func(path string) *spdy3.StreamConn {
+		req, err := http.NewRequest("POST", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, _, err := conn.(spdy.StreamDialer).Dial(req, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream.(*spdy3.StreamConn)
+	}
+
+	// Client reset.
+	stream := dial("/client-reset")
+	if err := stream.Reset(common.RST_STREAM_CANCEL); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cause := <-causes:
+		reset, ok := cause.(*common.StreamResetError)
+		if !ok || reset.Status != common.RST_STREAM_CANCEL || reset.StreamID != stream.StreamID() {
+			t.Fatalf("Expected CANCEL reset of stream %d, got %v", stream.StreamID(), cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler's context was not cancelled.")
+	}
+
+	// Server reset.
+	stream = dial("/server-reset")
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	stream.Write([]byte("x"))
+	_, err = ioutil.ReadAll(stream)
+	if reset, ok := err.(*common.StreamResetError); !ok || reset.Status != common.RST_STREAM_REFUSED_STREAM {
+		t.Fatalf("Expected REFUSED_STREAM reset, got %v", err)
+	}
+
+	if conn.Closed() {
+		t.Fatal("Connection closed by stream resets.")
+	}
+}
+
+func TestResetWriteError(t *testing.T) {
+	started := make(chan struct{})
+	errs := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		_, err := w.Write([]byte("too late"))
+		errs <- err
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	go conn.Run()
+	go io.Copy(ioutil.Discard, client)
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err := syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syn.WriteTo(client); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	rst := new(frames.RST_STREAM)
+	rst.StreamID = 1
+	rst.Status = common.RST_STREAM_CANCEL
+	if _, err := rst.WriteTo(client); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		reset, ok := err.(*common.StreamResetError)
+		if !ok || reset.Status != common.RST_STREAM_CANCEL || reset.Retryable() {
+			t.Errorf("Expected CANCEL reset from Write, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler did not see the stream reset.")
+	}
+
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestWebSocket(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !spdy.IsWebSocketRequest(r) {
+			if _, err := spdy.AcceptWebSocket(w, r); err != common.ErrNotWebSocket {
+				t.Errorf("Expected ErrNotWebSocket, got %v", err)
+			}
+			return
+		}
+
+		w.Header().Set("Sec-WebSocket-Protocol", "echo")
+		conn, err := spdy.AcceptWebSocket(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	defer ts.Close()
+
+	config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"spdy/3.1"}}
+	tlsConn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	defer conn.Close()
+
+	// A plain request is not upgraded.
+	req, err := http.NewRequest("GET", ts.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.RequestResponse(req, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{"Sec-WebSocket-Protocol": {"echo, chat"}}
+	ws, res, err := conn.(spdy.WebSocketDialer).DialWebSocket("wss"+strings.TrimPrefix(ts.URL, "https")+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if got := res.Header.Get("Sec-WebSocket-Protocol"); got != "echo" {
+		t.Fatalf("Expected subprotocol %q, got %q", "echo", got)
+	}
+
+	// A masked text frame containing "hello".
+	frame := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	if _, err := ws.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echo := make([]byte, len(frame))
+	if _, err := io.ReadFull(ws, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, frame) {
+		t.Fatalf("Expected %x, got %x", frame, echo)
+	}
+}
+
+func TestStarvationWatchdog(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 256)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bulk" {
+			for i := 0; i < 200; i++ {
+				w.Write(chunk)
+			}
+			return
+		}
+		io.WriteString(w, "small")
+	})
+
+	// The pipe is synchronous, so the connection can only
+	// send frames as fast as they are read below.
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	sc.SetStarvationBound(time.Millisecond)
+	sc.SetWriteBatching(0) // keep the frames queued in the scheduler.
+	starved := make(chan common.Priority, 1)
+	sc.StarvationHandler = func(priority common.Priority, _ time.Duration) {
+		select {
+		case starved <- priority:
+		default:
+		}
+	}
+	go conn.Run()
+
+	go func() {
+		compressor := common.NewCompressor(3)
+		for i, path := range []string{"/bulk", "/small"} {
+			syn := new(frames.SYN_STREAM)
+			syn.StreamID = common.StreamID(2*i + 1)
+			syn.Flags = common.FLAG_FIN
+			syn.Priority = common.Priority(7 * i)
+			syn.Header = make(http.Header)
+			syn.Header.Set(":method", "GET")
+			syn.Header.Set(":scheme", "http")
+			syn.Header.Set(":host", "example.com")
+			syn.Header.Set(":path", path)
+			syn.Header.Set(":version", "HTTP/1.1")
+			if err := syn.Compress(compressor); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := syn.WriteTo(client); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// Read slowly until both responses end.
+	buf := bufio.NewReader(client)
+	decom := common.NewDecompressor(3)
+	for finished := 0; finished < 2; {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*frames.DATA); ok && data.Flags.FIN() {
+			finished++
+		}
+		time.Sleep(time.Millisecond)
+	}
+	client.Close()
+	<-sc.CloseNotify()
+
+	select {
+	case priority := <-starved:
+		if priority != 7 {
+			t.Errorf("Expected starved priority 7, got %d", priority)
+		}
+	default:
+		t.Error("Starvation was not reported")
+	}
+	if n := sc.Stats().StarvedFrames; n == 0 {
+		t.Error("Expected starved frames to be counted")
+	}
+}
+
+func TestFlowStallTimeout(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 4096)
+	errs := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Write more than the initial window, then keep
+		// writing until the stalled stream is reset.
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				errs <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	sc.FlowStallThreshold = 10 * time.Millisecond
+	sc.FlowStallTimeout = 50 * time.Millisecond
+	go conn.Run()
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err := syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	go syn.WriteTo(client)
+
+	// Read the frames without ever sending a WINDOW_UPDATE.
+	buf := bufio.NewReader(client)
+	var received int
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*frames.DATA); ok {
+			received += len(data.Data)
+		}
+		if rst, ok := frame.(*frames.RST_STREAM); ok {
+			if rst.StreamID != 1 || rst.Status != common.RST_STREAM_CANCEL {
+				t.Fatalf("Expected CANCEL for stream 1, got %v", rst)
+			}
+			break
+		}
+	}
+	if received != common.DEFAULT_INITIAL_WINDOW_SIZE {
+		t.Errorf("Expected %d bytes of DATA, got %d", common.DEFAULT_INITIAL_WINDOW_SIZE, received)
+	}
+
+	select {
+	case err := <-errs:
+		if reset, ok := err.(*common.StreamResetError); !ok || reset.Status != common.RST_STREAM_CANCEL {
+			t.Errorf("Expected CANCEL reset from Write, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler did not see the stream reset.")
+	}
+
+	stats := sc.Stats()
+	if stats.FlowStalls != 1 || stats.FlowStallResets != 1 {
+		t.Errorf("Expected 1 stall reported and reset, got %d and %d", stats.FlowStalls, stats.FlowStallResets)
+	}
+
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestFrameSizes(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 2500)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			ioutil.ReadAll(r.Body)
+			return
+		}
+		w.Write(body)
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	if err := sc.SetFrameSizes(common.MIN_FRAME_SIZE-1, 1000); err != common.ErrBadFrameSize {
+		t.Errorf("Expected error %v, got %v", common.ErrBadFrameSize, err)
+	}
+	if err := sc.SetFrameSizes(common.MAX_FRAME_SIZE+9, 1000); err != common.ErrBadFrameSize {
+		t.Errorf("Expected error %v, got %v", common.ErrBadFrameSize, err)
+	}
+	if err := sc.SetFrameSizes(common.MIN_FRAME_SIZE, 0); err != common.ErrBadDataChunkSize {
+		t.Errorf("Expected error %v, got %v", common.ErrBadDataChunkSize, err)
+	}
+	if err := sc.SetFrameSizes(common.MIN_FRAME_SIZE, 1000); err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+
+	go func() {
+		compressor := common.NewCompressor(3)
+		for i, path := range []string{"/upload", "/download"} {
+			syn := new(frames.SYN_STREAM)
+			syn.StreamID = common.StreamID(2*i + 1)
+			if path == "/download" {
+				syn.Flags = common.FLAG_FIN
+			}
+			syn.Header = make(http.Header)
+			syn.Header.Set(":method", "POST")
+			syn.Header.Set(":scheme", "http")
+			syn.Header.Set(":host", "example.com")
+			syn.Header.Set(":path", path)
+			syn.Header.Set(":version", "HTTP/1.1")
+			if err := syn.Compress(compressor); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := syn.WriteTo(client); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		// Too large to be accepted.
+		data := new(frames.DATA)
+		data.StreamID = 1
+		data.Flags = common.FLAG_FIN
+		data.Data = make([]byte, common.MIN_FRAME_SIZE)
+		if _, err := data.WriteTo(client); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf := bufio.NewReader(client)
+	decom := common.NewDecompressor(3)
+	reset := false
+	received := 0
+	for !reset || received < len(body) {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.RST_STREAM:
+			if frame.StreamID != 1 || frame.Status != common.RST_STREAM_FRAME_TOO_LARGE {
+				t.Fatalf("Unexpected %v", frame)
+			}
+			reset = true
+		case *frames.DATA:
+			if frame.StreamID != 3 {
+				continue
+			}
+			if len(frame.Data) > 1000 {
+				t.Fatalf("Received %d-byte DATA frame, exceeding the chunk size", len(frame.Data))
+			}
+			received += len(frame.Data)
+		}
+	}
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestFrameSizesAfterWindowUpdate(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 5000)
+	written := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+		close(written)
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	if err := sc.SetFrameSizes(common.MIN_FRAME_SIZE, 1000); err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+
+	// The stream's window is too small for the body,
+	// so the rest of it is buffered in several chunks
+	// until the WINDOW_UPDATE. SPDY/3 is used, so that
+	// only the stream's window applies.
+	go func() {
+		settings := new(frames.SETTINGS)
+		settings.Settings = common.Settings{
+			common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{ID: common.SETTINGS_INITIAL_WINDOW_SIZE, Value: 500},
+		}
+		if _, err := settings.WriteTo(client); err != nil {
+			t.Error(err)
+			return
+		}
+
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = 1
+		syn.Flags = common.FLAG_FIN
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "GET")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", "/")
+		syn.Header.Set(":version", "HTTP/1.1")
+		if err := syn.Compress(common.NewCompressor(3)); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := syn.WriteTo(client); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf := bufio.NewReader(client)
+	decom := common.NewDecompressor(3)
+	received := 0
+	updated := false
+	for received < len(body) {
+		frame, err := frames.ReadFrame(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		data, ok := frame.(*frames.DATA)
+		if !ok || data.StreamID != 1 {
+			continue
+		}
+		if len(data.Data) > 1000 {
+			t.Fatalf("Received %d-byte DATA frame, exceeding the chunk size", len(data.Data))
+		}
+		received += len(data.Data)
+		if received == 500 && !updated {
+			select {
+			case <-written:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Handler did not finish writing.")
+			}
+			updated = true
+			update := new(frames.WINDOW_UPDATE)
+			update.StreamID = 1
+			update.DeltaWindowSize = uint32(len(body))
+			if _, err := update.WriteTo(client); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !updated {
+		t.Error("Expected the stream to be constrained by its window.")
+	}
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+// writeCountingConn counts the writes made to it.
+type writeCountingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.n, 1)
+	return c.Conn.Write(b)
+}
+
+func TestWriteBatching(t *testing.T) {
+	const count = 50
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < count; i++ {
+			io.WriteString(w, "0123456789")
+		}
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var writes int64
+	conn, err := spdy.NewServerConn(writeCountingConn{server, &writes}, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+
+	// Several streams send at once.
+	const streams = 8
+	go func() {
+		compressor := common.NewCompressor(3)
+		for i := 0; i < streams; i++ {
+			syn := new(frames.SYN_STREAM)
+			syn.StreamID = common.StreamID(2*i + 1)
+			syn.Flags = common.FLAG_FIN
+			syn.Header = make(http.Header)
+			syn.Header.Set(":method", "GET")
+			syn.Header.Set(":scheme", "http")
+			syn.Header.Set(":host", "example.com")
+			syn.Header.Set(":path", "/")
+			syn.Header.Set(":version", "HTTP/1.1")
+			if err := syn.Compress(compressor); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := syn.WriteTo(client); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// Read slowly, so that frames are waiting
+	// to be sent with each write.
+	buf := bufio.NewReader(client)
+	decom := common.NewDecompressor(3)
+	received := 0
+	for finished := 0; finished < streams; {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		received++
+		if data, ok := frame.(*frames.DATA); ok && data.Flags.FIN() {
+			finished++
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	client.Close()
+	<-conn.(*spdy3.Conn).CloseNotify()
+
+	if n := atomic.LoadInt64(&writes); n >= int64(received) {
+		t.Errorf("Expected %d frames to be batched into fewer writes, got %d writes", received, n)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	const streams = 6
+	var running, most int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&most)
+			if n <= m || atomic.CompareAndSwapInt64(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+		io.WriteString(w, "done")
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	sc.SetWorkers(2)
+	go conn.Run()
+
+	go func() {
+		compressor := common.NewCompressor(3)
+		for i := 0; i < streams; i++ {
+			syn := new(frames.SYN_STREAM)
+			syn.StreamID = common.StreamID(2*i + 1)
+			syn.Flags = common.FLAG_FIN
+			syn.Header = make(http.Header)
+			syn.Header.Set(":method", "GET")
+			syn.Header.Set(":scheme", "http")
+			syn.Header.Set(":host", "example.com")
+			syn.Header.Set(":path", "/")
+			syn.Header.Set(":version", "HTTP/1.1")
+			if err := syn.Compress(compressor); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := syn.WriteTo(client); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	buf := bufio.NewReader(client)
+	decom := common.NewDecompressor(3)
+	for finished := 0; finished < streams; {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*frames.DATA); ok && data.Flags.FIN() {
+			finished++
+		}
+	}
+	client.Close()
+	<-sc.CloseNotify()
+
+	if n := atomic.LoadInt64(&most); n != 2 {
+		t.Errorf("Expected at most 2 handlers to run at once, got %d", n)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const budget = 25000
+	chunk := bytes.Repeat([]byte("x"), 8000)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reset" {
+			<-r.Context().Done()
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, "done")
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	sc.SetMemoryBudget(budget)
+	sc.BufferRequestBodies = true
+	go conn.Run()
+
+	received := make(chan common.Frame, 16)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(sid common.StreamID, path string) {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "POST")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", path)
+		syn.Header.Set(":version", "HTTP/1.1")
+		syn.Header.Set("Content-Length", strconv.Itoa(7*len(chunk)))
+		send(syn)
+	}
+	data := func(sid common.StreamID, flags common.Flags) {
+		frame := new(frames.DATA)
+		frame.StreamID = sid
+		frame.Flags = flags
+		frame.Data = chunk
+		send(frame)
+	}
+
+	// Fill the first stream's window, which is not
+	// regrown once the budget has been exceeded.
+	open(1, "/")
+	for i := 0; i < 6; i++ {
+		data(1, 0)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if used, _ := sc.MemoryUsed(); used >= int64(6*len(chunk)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Request body was not charged to the memory budget")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Data on another stream cannot be buffered once
+	// twice the budget is in use.
+	open(3, "/reset")
+	data(3, 0)
+	data(3, 0)
+	for reset := false; !reset; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.RST_STREAM:
+			if frame.StreamID != 3 || frame.Status != common.RST_STREAM_INTERNAL_ERROR {
+				t.Fatalf("Unexpected %v", frame)
+			}
+			reset = true
+		case *frames.WINDOW_UPDATE:
+			t.Fatalf("Window grew while the memory budget was exceeded: %v", frame)
+		}
+	}
+
+	// Once the body is read, the window grows again.
+	for deadline := time.Now().Add(time.Second); ; {
+		if used, _ := sc.MemoryUsed(); used < 2*budget {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Reset stream's body was not released from the memory budget")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	data(1, common.FLAG_FIN)
+	for grown := false; !grown; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.WINDOW_UPDATE:
+			if frame.StreamID != 1 {
+				t.Fatalf("Unexpected %v", frame)
+			}
+			grown = true
+		}
+	}
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestStreamedRequestBody(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 8000)
+	called := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		<-release
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		io.WriteString(w, strconv.Itoa(len(b)))
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	go conn.Run()
+
+	received := make(chan common.Frame, 16)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "POST")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	syn.Header.Set("Content-Length", strconv.Itoa(8*len(chunk)))
+	send(syn)
+
+	// The handler is called before the body arrives.
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("Handler was not called before the body was received")
+	}
+
+	// Fill the stream's window, which does not grow
+	// while the handler has not read the body.
+	for i := 0; i < 8; i++ {
+		data := new(frames.DATA)
+		data.StreamID = 1
+		data.Data = chunk
+		send(data)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		info := sc.Streams()
+		if len(info) == 1 && info[0].ReceiveWindow == int64(common.DEFAULT_INITIAL_WINDOW_SIZE-8*len(chunk)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the receive window to be nearly exhausted, got %+v", info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case frame := <-received:
+		if update, ok := frame.(*frames.WINDOW_UPDATE); ok && update.StreamID == 1 {
+			t.Fatalf("Window grew before the body was read: %v", update)
+		}
+	default:
+	}
+
+	// Once the body is read, the window grows again.
+	close(release)
+	for grown := false; !grown; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.WINDOW_UPDATE:
+			grown = frame.StreamID == 1
+		}
+	}
+
+	fin := new(frames.DATA)
+	fin.StreamID = 1
+	fin.Flags = common.FLAG_FIN
+	send(fin)
+	for done := false; !done; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.DATA:
+			if string(frame.Data) != "" && string(frame.Data) != strconv.Itoa(8*len(chunk)) {
+				t.Fatalf("Handler read %q bytes", frame.Data)
+			}
+			done = frame.Flags.FIN()
+		}
+	}
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+// eagerFlowControl regrows a receive window
+// as soon as any of it has been used.
+type eagerFlowControl uint32
+
+func (f eagerFlowControl) InitialWindowSize() uint32 {
+	return uint32(f)
+}
+
+func (f eagerFlowControl) ReceiveData(_ common.StreamID, initialWindowSize uint32, newWindowSize int64) uint32 {
+	return uint32(int64(initialWindowSize) - newWindowSize)
+}
+
+func TestWindowUpdateCoalescing(t *testing.T) {
+	const frameCount = 64
+	chunk := bytes.Repeat([]byte("x"), 4000)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		io.WriteString(w, strconv.Itoa(len(b)))
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	sc.SetFlowControl(eagerFlowControl(common.DEFAULT_INITIAL_WINDOW_SIZE))
+	go conn.Run()
+
+	received := make(chan common.Frame, 256)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "POST")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	send(syn)
+
+	// Send the body as the stream and connection
+	// windows allow, counting the updates received.
+	streamWindow := int64(common.DEFAULT_INITIAL_WINDOW_SIZE)
+	connWindow := int64(common.DEFAULT_INITIAL_WINDOW_SIZE)
+	updates := make(map[common.StreamID]int)
+	handle := func(frame common.Frame) bool {
+		switch frame := frame.(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.WINDOW_UPDATE:
+			updates[frame.StreamID]++
+			if frame.StreamID == 0 {
+				connWindow += int64(frame.DeltaWindowSize)
+			} else {
+				streamWindow += int64(frame.DeltaWindowSize)
+			}
+		case *frames.DATA:
+			if string(frame.Data) != "" && string(frame.Data) != strconv.Itoa(frameCount*len(chunk)) {
+				t.Fatalf("Handler read %q bytes", frame.Data)
+			}
+			return frame.Flags.FIN()
+		}
+		return false
+	}
+	for i := 0; i < frameCount; {
+		if streamWindow < int64(len(chunk)) || connWindow < int64(len(chunk)) {
+			handle(<-received)
+			continue
+		}
+		data := new(frames.DATA)
+		data.StreamID = 1
+		data.Data = chunk
+		if i++; i == frameCount {
+			data.Flags = common.FLAG_FIN
+		}
+		send(data)
+		streamWindow -= int64(len(chunk))
+		connWindow -= int64(len(chunk))
+	}
+	for done := false; !done; {
+		done = handle(<-received)
+	}
+	client.Close()
+	<-sc.CloseNotify()
+
+	// The eager flow control module would send an update for
+	// each frame, but far fewer are sent.
+	max := frameCount / 4
+	for _, sid := range []common.StreamID{0, 1} {
+		if n := updates[sid]; n == 0 || n > max {
+			t.Errorf("Expected 1 to %d updates for stream %d, got %d", max, sid, n)
+		}
+	}
+}
+
+func TestWindowUpdateValidation(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 4000)
+	resets := make(chan error, 2)
+	more := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(chunk)
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/window" {
+			<-more
+			w.Write(chunk[:2000])
+			return
+		}
+
+		// Wait for the invalid WINDOW_UPDATE to reset the stream.
+		<-r.Context().Done()
+		_, err := w.Write(chunk)
+		resets <- err
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	go conn.Run()
+
+	received := make(chan common.Frame, 64)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 0)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update := func(sid common.StreamID, delta uint32) {
+		frame := new(frames.WINDOW_UPDATE)
+		frame.StreamID = sid
+		frame.DeltaWindowSize = delta
+		send(frame)
+	}
+
+	// data reads frames until n bytes of DATA
+	// have been received for the stream.
+	data := func(sid common.StreamID, n int) (fin bool) {
+		for n > 0 {
+			switch frame := (<-received).(type) {
+			case nil:
+				t.Fatal("Connection closed")
+			case *frames.DATA:
+				if frame.StreamID != sid {
+					t.Fatalf("Unexpected %v", frame)
+				}
+				n -= len(frame.Data)
+				fin = frame.Flags.FIN()
+			case *frames.RST_STREAM:
+				t.Fatalf("Unexpected %v", frame)
+			}
+		}
+		if n < 0 {
+			t.Fatalf("Received %d bytes too many for stream %d", -n, sid)
+		}
+		return fin
+	}
+	reset := func(sid common.StreamID) {
+		for {
+			switch frame := (<-received).(type) {
+			case nil:
+				t.Fatal("Connection closed")
+			case *frames.RST_STREAM:
+				if frame.StreamID != sid || frame.Status != common.RST_STREAM_FLOW_CONTROL_ERROR {
+					t.Fatalf("Expected FLOW_CONTROL_ERROR for stream %d, got %v", sid, frame)
+				}
+				select {
+				case err := <-resets:
+					if reset, ok := err.(*common.StreamResetError); !ok || reset.Status != common.RST_STREAM_FLOW_CONTROL_ERROR {
+						t.Errorf("Expected FLOW_CONTROL_ERROR reset from Write, got %v", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("Handler did not see the stream reset.")
+				}
+				return
+			case *frames.DATA:
+				t.Fatalf("Unexpected %v", frame)
+			}
+		}
+	}
+
+	for i, path := range []string{"/zero", "/overflow", "/window"} {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = common.StreamID(2*i + 1)
+		syn.Flags = common.FLAG_FIN
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "GET")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", path)
+		syn.Header.Set(":version", "HTTP/1.1")
+		send(syn)
+		data(syn.StreamID, len(chunk))
+	}
+
+	// A delta of 0, or one which overflows
+	// the window, resets the stream.
+	update(1, 0)
+	reset(1)
+	update(3, common.MAX_DELTA_WINDOW_SIZE)
+	reset(3)
+
+	// Lowering the initial window leaves stream 5's window
+	// negative, so that it must grow past zero before more
+	// DATA is sent. The PING ensures that the SETTINGS have
+	// been processed.
+	settings := new(frames.SETTINGS)
+	settings.Settings = common.Settings{
+		common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{ID: common.SETTINGS_INITIAL_WINDOW_SIZE, Value: 1000},
+	}
+	send(settings)
+	send(&frames.PING{PingID: 1})
+	for pinged := false; !pinged; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.PING:
+			pinged = true
+		case *frames.DATA, *frames.RST_STREAM:
+			t.Fatalf("Unexpected %v", frame)
+		}
+	}
+	close(more)
+	time.Sleep(20 * time.Millisecond)
+	update(5, 3500)
+	if data(5, 500) {
+		t.Fatal("Stream 5 ended early")
+	}
+	update(5, 2000)
+	if !data(5, 1500) {
+		for fin := false; !fin; {
+			frame, ok := (<-received).(*frames.DATA)
+			fin = ok && frame.StreamID == 5 && frame.Flags.FIN() && len(frame.Data) == 0
+		}
+	}
+
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestContentLength(t *testing.T) {
+	type result struct {
+		path string
+		err  error
+	}
+	bodies := make(chan result, 4)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/long":
+			w.Header().Set("Content-Length", "4")
+			if _, err := w.Write([]byte("too long")); err != http.ErrContentLength {
+				t.Errorf("Expected ErrContentLength, got %v", err)
+			}
+			w.Write([]byte("fine"))
+		case "/short":
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("short"))
+		default:
+			_, err := ioutil.ReadAll(r.Body)
+			bodies <- result{r.URL.Path, err}
+		}
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+
+	received := make(chan common.Frame, 16)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(sid common.StreamID, path, length string, flags common.Flags) {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = flags
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "POST")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", path)
+		syn.Header.Set(":version", "HTTP/1.1")
+		if length != "" {
+			syn.Header.Set("Content-Length", length)
+		}
+		send(syn)
+	}
+	data := func(sid common.StreamID, body string, flags common.Flags) {
+		frame := new(frames.DATA)
+		frame.StreamID = sid
+		frame.Flags = flags
+		frame.Data = []byte(body)
+		send(frame)
+	}
+	expectReset := func(sid common.StreamID, status common.StatusCode) {
+		for {
+			switch frame := (<-received).(type) {
+			case nil:
+				t.Fatalf("Connection closed waiting for stream %d to be reset", sid)
+			case *frames.RST_STREAM:
+				if frame.StreamID != sid || frame.Status != status {
+					t.Fatalf("Expected stream %d to be reset with %s, got %v", sid, status, frame)
+				}
+				return
+			}
+		}
+	}
+
+	// A request body longer than its Content-Length.
+	open(1, "/long-body", "5", 0)
+	data(1, "0123456789", common.FLAG_FIN)
+	expectReset(1, common.RST_STREAM_PROTOCOL_ERROR)
+
+	// A request body shorter than its Content-Length.
+	open(3, "/short-body", "5", 0)
+	data(3, "012", common.FLAG_FIN)
+	expectReset(3, common.RST_STREAM_PROTOCOL_ERROR)
+
+	// Requests with conflicting lengths are refused.
+	open(5, "/", "5, 6", 0)
+	expectReset(5, common.RST_STREAM_PROTOCOL_ERROR)
+
+	// A matching body is read in full. Handlers which
+	// had started reading the mismatched bodies must
+	// not have been given them as complete.
+	open(7, "/body", "5", 0)
+	data(7, "012", 0)
+	data(7, "34", common.FLAG_FIN)
+	for done := false; !done; {
+		body := <-bodies
+		switch {
+		case body.path == "/body":
+			if body.err != nil {
+				t.Errorf("Reading a matching body: %v", body.err)
+			}
+			done = true
+		case body.err != common.ErrContentLength:
+			t.Errorf("Expected ErrContentLength reading %s, got %v", body.path, body.err)
+		}
+	}
+
+	// Responses may not be longer than their Content-Length,
+	// and are reset if they are shorter.
+	open(9, "/long", "", common.FLAG_FIN)
+	var body []byte
+	for fin := false; !fin; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.DATA:
+			if frame.StreamID == 9 {
+				body = append(body, frame.Data...)
+				fin = frame.Flags.FIN()
+			}
+		case *frames.RST_STREAM:
+			t.Fatalf("Unexpected %v", frame)
+		}
+	}
+	if string(body) != "fine" {
+		t.Errorf("Expected %q, got %q", "fine", body)
+	}
+
+	open(11, "/short", "", common.FLAG_FIN)
+	expectReset(11, common.RST_STREAM_INTERNAL_ERROR)
+
+	client.Close()
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	readErrs := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/stream" {
+			readErrs <- err
+		}
+		io.WriteString(w, "read")
+	})
+
+	// A declared length over the limit is refused at once.
+	srv := &spdy.Server{Handler: handler, MaxRequestBodyBytes: 10}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePlaintext(l)
+	defer srv.Close()
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, body := range []string{"small", strings.Repeat("x", 100)} {
+		req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader(body))
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		want := http.StatusOK
+		if len(body) > 10 {
+			want = http.StatusRequestEntityTooLarge
+		}
+		if res.StatusCode != want {
+			t.Errorf("Expected %d for a %d-byte body, got %d", want, len(body), res.StatusCode)
+		}
+	}
+
+	// A body without a length is refused once it exceeds the limit.
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	sc, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.(*spdy3.Conn).MaxRequestBodyBytes = 10
+	go sc.Run()
+	defer sc.Close()
+
+	received := make(chan common.Frame, 16)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "POST")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/stream")
+	syn.Header.Set(":version", "HTTP/1.1")
+	send(syn)
+	for i := 0; i < 2; i++ {
+		data := new(frames.DATA)
+		data.StreamID = 1
+		data.Data = []byte("01234567")
+		send(data)
+	}
+
+	var replied bool
+	for reset := false; !reset; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatal("Connection closed")
+		case *frames.SYN_REPLY:
+			if status := frame.Header.Get(":status"); status != "413" || !frame.Flags.FIN() {
+				t.Errorf("Expected a final 413 reply, got %v", frame)
+			}
+			replied = true
+		case *frames.RST_STREAM:
+			if frame.StreamID != 1 || frame.Status != common.RST_STREAM_CANCEL {
+				t.Fatalf("Unexpected %v", frame)
+			}
+			reset = true
+		}
+	}
+	if !replied {
+		t.Error("Expected a 413 reply before the stream was reset")
+	}
+
+	var maxBytes *http.MaxBytesError
+	if err := <-readErrs; !errors.As(err, &maxBytes) || maxBytes.Limit != 10 {
+		t.Errorf("Expected an *http.MaxBytesError, got %v", err)
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	text := strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+	image := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), text...)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			w.Write(image)
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "identity")
+			io.WriteString(w, text)
+		case "/length":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			io.WriteString(w, text[:100])
+			w.(http.Flusher).Flush()
+			io.WriteString(w, text[100:])
+		default:
+			io.WriteString(w, text)
+		}
+	})
+
+	srv := &spdy.Server{Handler: handler, CompressResponses: true}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePlaintext(l)
+	defer srv.Close()
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		path     string
+		accept   string
+		encoding string
+		body     []byte
+	}{
+		{"/", "gzip, deflate", "gzip", []byte(text)},
+		{"/", "gzip;q=0.5, deflate", "deflate", []byte(text)},
+		{"/", "gzip;q=0", "", []byte(text)},
+		{"/", "", "", []byte(text)},
+		{"/length", "gzip", "gzip", []byte(text)},
+		{"/image", "gzip", "", image},
+		{"/encoded", "gzip", "identity", []byte(text)},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept-Encoding", test.accept)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body io.Reader = res.Body
+		switch encoding := res.Header.Get("Content-Encoding"); {
+		case encoding != test.encoding:
+			t.Errorf("%s with %q: expected encoding %q, got %q", test.path, test.accept, test.encoding, encoding)
+		case encoding == "gzip":
+			body, err = gzip.NewReader(body)
+		case encoding == "deflate":
+			body, err = zlib.NewReader(body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.encoding == "gzip" || test.encoding == "deflate" {
+			if length := res.Header.Get("Content-Length"); length != "" {
+				t.Errorf("%s with %q: unexpected Content-Length %s", test.path, test.accept, length)
+			}
+			if vary := res.Header.Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("%s with %q: expected Vary: Accept-Encoding, got %q", test.path, test.accept, vary)
+			}
+		}
+		data, err := ioutil.ReadAll(body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, test.body) {
+			t.Errorf("%s with %q: body did not match", test.path, test.accept)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flushed" {
+			io.WriteString(w, "Hello")
+			w.(http.Flusher).Flush()
+		}
+		time.Sleep(20 * time.Millisecond)
+		if r.URL.Path != "/empty" {
+			io.WriteString(w, "World")
+		}
+	})
+
+	srv := &spdy.Server{Handler: handler, ServerTiming: common.ServerTimingHeader}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePlaintext(l)
+	defer srv.Close()
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, path := range []string{"/", "/empty", "/flushed"} {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		value := res.Header.Get("Server-Timing")
+		timings := make(map[string]float64)
+		for _, metric := range strings.Split(value, ",") {
+			name, dur, ok := strings.Cut(strings.TrimSpace(metric), ";dur=")
+			if !ok {
+				t.Fatalf("%s: invalid Server-Timing %q", path, value)
+			}
+			timings[name], err = strconv.ParseFloat(dur, 64)
+			if err != nil {
+				t.Fatalf("%s: invalid Server-Timing %q", path, value)
+			}
+		}
+		for _, name := range []string{"queue", "handler", "flush", "stall"} {
+			if _, ok := timings[name]; !ok {
+				t.Errorf("%s: Server-Timing %q has no %s", path, value, name)
+			}
+		}
+		if timings["handler"] < 20 {
+			t.Errorf("%s: expected handler time of at least 20ms, got %vms", path, timings["handler"])
+		}
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.bin")
+	content := make([]byte, 200<<10)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	if err := ioutil.WriteFile(name, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Errorf("%T does not implement io.ReaderFrom", w)
+		}
+		switch r.URL.Path {
+		case "/dir":
+			spdy.ServeFile(w, r, dir)
+		case "/missing":
+			spdy.ServeFile(w, r, filepath.Join(dir, "missing"))
+		default:
+			spdy.ServeFile(w, r, name)
+		}
+	})
+
+	srv := &spdy.Server{Handler: handler}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServePlaintext(l)
+	defer srv.Close()
+
+	conn, err := spdy.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		path   string
+		ranges string
+		status int
+		body   []byte
+	}{
+		{"/data.bin", "", http.StatusOK, content},
+		{"/data.bin", "bytes=100-199", http.StatusPartialContent, content[100:200]},
+		{"/data.bin", "bytes=-10", http.StatusPartialContent, content[len(content)-10:]},
+		{"/data.bin", "bytes=0-9,20-29", http.StatusPartialContent, nil},
+		{"/data.bin", "bytes=300000-", http.StatusRequestedRangeNotSatisfiable, nil},
+		{"/dir", "", http.StatusNotFound, nil},
+		{"/missing", "", http.StatusNotFound, nil},
+		{"/a/../data.bin", "", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		if test.ranges != "" {
+			req.Header.Set("Range", test.ranges)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("%s with %q: expected status %d, got %d", test.path, test.ranges, test.status, res.StatusCode)
+			continue
+		}
+		if test.body != nil && !bytes.Equal(data, test.body) {
+			t.Errorf("%s with %q: expected %d bytes, got %d", test.path, test.ranges, len(test.body), len(data))
+		}
+	}
+
+	// Several ranges are sent as a multipart body.
+	req, _ := http.NewRequest("GET", "http://example.com/data.bin", nil)
+	req.Header.Set("Range", "bytes=0-9,20-29")
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	media, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || media != "multipart/byteranges" {
+		t.Fatalf("Expected multipart/byteranges, got %q", res.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(res.Body, params["boundary"])
+	for _, want := range [][]byte{content[0:10], content[20:30]} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("Expected part %x, got %x", want, data)
+		}
+	}
+}
+
+func TestHandleEarly(t *testing.T) {
+	called := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- r.URL.Path
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(b)
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	sc.HandleEarly = func(r *http.Request) bool {
+		return r.URL.Path == "/poll"
+	}
+	go conn.Run()
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		buf := bufio.NewReader(client)
+		for responses := 0; responses < 2; {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if data, ok := frame.(*frames.DATA); ok && data.Flags.FIN() {
+				responses++
+			}
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(sid common.StreamID, path string) {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "POST")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", path)
+		syn.Header.Set(":version", "HTTP/1.1")
+		send(syn)
+	}
+	data := func(sid common.StreamID, flags common.Flags) {
+		frame := new(frames.DATA)
+		frame.StreamID = sid
+		frame.Flags = flags
+		frame.Data = []byte("data")
+		send(frame)
+	}
+
+	// The long poll is handled before its body arrives.
+	open(1, "/poll")
+	select {
+	case path := <-called:
+		if path != "/poll" {
+			t.Fatalf("Expected /poll to be handled, got %s", path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Long poll was not handled before its body arrived")
+	}
+
+	// The upload is only handled once it is complete.
+	open(3, "/upload")
+	data(3, 0)
+	select {
+	case path := <-called:
+		t.Fatalf("%s was handled before the request was complete", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+	data(3, common.FLAG_FIN)
+	select {
+	case path := <-called:
+		if path != "/upload" {
+			t.Fatalf("Expected /upload to be handled, got %s", path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Upload was not handled once complete")
+	}
+
+	data(1, common.FLAG_FIN)
+	<-finished
+	client.Close()
+	<-sc.CloseNotify()
+}
+
+func TestServerType(t *testing.T) {
+	// Borrow httptest's certificate.
+	ts := httptest.NewTLSServer(nil)
+	certificates := ts.TLS.Certificates
+	ts.Close()
+
+	var lock sync.Mutex
+	states := make(map[http.ConnState]int)
+	srv := &spdy.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if spdy.UsingSPDY(w) {
+				fmt.Fprint(w, "SPDY")
+			} else {
+				fmt.Fprint(w, r.Proto)
+			}
+		}),
+		TLSConfig: &tls.Config{Certificates: certificates},
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			lock.Lock()
+			states[state]++
+			lock.Unlock()
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeTLS(l, "", "")
+	}()
+
+	https := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	url := "https://" + l.Addr().String()
+	for _, test := range []struct {
+		client *http.Client
+		want   string
+	}{
+		{newClient(), "SPDY"},
+		{https, "HTTP/1.1"},
+	} {
+		r, err := test.client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.want {
+			t.Errorf("Expected %q, got %q", test.want, body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Expected %v, got %v", http.ErrServerClosed, err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if states[http.StateNew] != 2 {
+		t.Errorf("Expected 2 new connections, got %d", states[http.StateNew])
+	}
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	certificates := ts.TLS.Certificates
+	ts.Close()
+
+	serverKeys := new(syncBuffer)
+	srv := &spdy.Server{
+		Handler:      robotsTxtHandler,
+		TLSConfig:    &tls.Config{Certificates: certificates},
+		KeyLogWriter: serverKeys,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Shutdown(context.Background())
+
+	name := filepath.Join(t.TempDir(), "keys")
+	t.Setenv("SSLKEYLOGFILE", name)
+	clientKeys, err := spdy.KeyLogFromEnv()
+	if err != nil || clientKeys == nil {
+		t.Fatalf("KeyLogFromEnv: %v, %v", clientKeys, err)
+	}
+	defer clientKeys.Close()
+
+	client := &http.Client{Transport: &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+		KeyLogWriter: clientKeys,
+	}}
+	r, err := client.Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	logged, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range [][]byte{serverKeys.Bytes(), logged} {
+		if !bytes.Contains(keys, []byte("CLIENT_")) {
+			t.Errorf("Expected session keys to be logged, got %q", keys)
+		}
+	}
+}
+
+func TestServePlaintextUnix(t *testing.T) {
+	srv := &spdy.Server{Handler: robotsTxtHandler}
+	path := filepath.Join(t.TempDir(), "spdy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix domain sockets unavailable:", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServePlaintext(l)
+	}()
+
+	client := &http.Client{Transport: &spdy.Transport{
+		UnixSockets: map[string]string{"app": path},
+	}}
+	r, err := client.Get("unix://app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := pedanticReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if !bytes.HasPrefix(data, []byte("User-agent: go")) {
+		t.Errorf("Expected robots.txt, got %q", data)
+	}
+
+	if _, err = client.Get("unix://other/"); err == nil {
+		t.Error("Expected an error for a host without a socket")
+	}
+
+	conn, err := spdy.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://app/", nil)
+	r, err = conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	select {
+	case err = <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServePlaintext did not return after Shutdown")
+	}
+}
+
+// clientCertificate returns a self-signed client certificate
+// with the given common name.
+func clientCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	certificates := ts.TLS.Certificates
+	ts.Close()
+
+	alice := clientCertificate(t, "alice")
+	mallory := clientCertificate(t, "mallory")
+	pool := x509.NewCertPool()
+	pool.AddCert(alice.Leaf)
+	pool.AddCert(mallory.Leaf)
+
+	var denied int32
+	spdy.SetAccessControl(func(identity *x509.Certificate, r *http.Request) error {
+		name := "anonymous"
+		if identity != nil {
+			name = identity.Subject.CommonName
+		}
+		if r.URL.Path == "/secret" && name != "alice" {
+			atomic.AddInt32(&denied, 1)
+			return fmt.Errorf("%s may not read secrets", name)
+		}
+		return nil
+	})
+	defer spdy.SetAccessControl(nil)
+
+	srv := &spdy.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cert := spdy.ClientCertificate(r)
+			if cert == nil || r.TLS.NegotiatedProtocol != "spdy/3.1" {
+				http.Error(w, "no identity", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, "%s %s", cert.Subject.CommonName, r.URL.Path)
+		}),
+		TLSConfig: &tls.Config{
+			Certificates: certificates,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	get := func(cert tls.Certificate, path string) (string, error) {
+		client := &http.Client{Transport: &spdy.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"spdy/3.1"},
+				Certificates:       []tls.Certificate{cert},
+			},
+		}}
+		r, err := client.Get("https://" + l.Addr().String() + path)
+		if err != nil {
+			return "", err
+		}
+		defer r.Body.Close()
+		data, err := ioutil.ReadAll(r.Body)
+		return string(data), err
+	}
+
+	for _, test := range []struct {
+		cert tls.Certificate
+		path string
+		want string
+	}{
+		{alice, "/", "alice /"},
+		{alice, "/secret", "alice /secret"},
+		{mallory, "/", "mallory /"},
+	} {
+		got, err := get(test.cert, test.path)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+		} else if got != test.want {
+			t.Errorf("Expected %q, got %q", test.want, got)
+		}
+	}
+
+	if got, err := get(mallory, "/secret"); err == nil {
+		t.Errorf("Expected mallory to be denied, got %q", got)
+	}
+
+	// A denial must not be retried as a refused stream.
+	if n := atomic.LoadInt32(&denied); n != 1 {
+		t.Errorf("Expected 1 denied request, got %d", n)
+	}
+}
+
+func TestConnStateHook(t *testing.T) {
+	states := make(chan http.ConnState, 10)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			states <- state
+		},
+	}
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := spdy.NewServerConn(server, srv, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(*spdy3.Conn)
+	go conn.Run()
+
+	go func() {
+		buf := bufio.NewReader(client)
+		for {
+			if _, err := frames.ReadFrame(buf, 1); err != nil {
+				return
+			}
+		}
+	}()
+
+	expect := func(want http.ConnState) {
+		select {
+		case state := <-states:
+			if state != want {
+				t.Fatalf("Expected state %d, got %d", want, state)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected state %d, got none", want)
+		}
+	}
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err := syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syn.WriteTo(client); err != nil {
+		t.Fatal(err)
+	}
+	expect(http.StateActive)
+	expect(http.StateIdle)
+
+	// Draining the idle connection reports the GOAWAY,
+	// and then closes it without further reports.
+	sc.Drain()
+	expect(spdy.StateGoAway)
+	<-sc.CloseNotify()
+	select {
+	case state := <-states:
+		t.Errorf("Unexpected state %d after closing", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+	client.Close()
+}
+
+func TestErrorHandler(t *testing.T) {
+	type report struct {
+		err   error
+		frame common.Frame
+	}
+	reports := make(chan report, 1)
+	action := common.ErrorActionGoaway
+	spdy.SetErrorHandler(func(err error, frame common.Frame) common.ErrorAction {
+		reports <- report{err, frame}
+		return action
+	})
+	defer spdy.SetErrorHandler(nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	// violate sends a RST_STREAM with an unknown status
+	// code, and returns the frames received until the
+	// connection is closed.
+	violate := func() []common.Frame {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		rst := new(frames.RST_STREAM)
+		rst.StreamID = 1
+		rst.Status = 99
+		if _, err = rst.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case r := <-reports:
+			if _, ok := r.frame.(*frames.RST_STREAM); !ok || r.err == nil {
+				t.Errorf("Expected RST_STREAM error, got %v for %T.", r.err, r.frame)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Protocol error was not reported.")
+		}
+
+		var received []common.Frame
+		buf := bufio.NewReader(conn)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					t.Fatal("Connection was not closed.")
+				}
+				return received
+			}
+			received = append(received, frame)
+		}
+	}
+
+	// The connection is ended with a GOAWAY and no RST_STREAM.
+	var goaway *frames.GOAWAY
+	for _, frame := range violate() {
+		switch frame := frame.(type) {
+		case *frames.GOAWAY:
+			goaway = frame
+		case *frames.RST_STREAM:
+			t.Errorf("Received unexpected RST_STREAM %s.", frame.Status)
+		}
+	}
+	if goaway == nil || goaway.Status != common.GOAWAY_PROTOCOL_ERROR {
+		t.Errorf("Expected PROTOCOL_ERROR GOAWAY, got %v.", goaway)
+	}
+
+	// The connection is closed without a word.
+	action = common.ErrorActionClose
+	for _, frame := range violate() {
+		switch frame.(type) {
+		case *frames.GOAWAY, *frames.RST_STREAM:
+			t.Errorf("Received unexpected %s.", frame.Name())
+		}
+	}
+}
+
+func TestValidationMode(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	modes := make(chan common.ValidationMode, 1)
+	go func() {
+		srv := &http.Server{Handler: robotsTxtHandler}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := spdy.NewServerConn(conn, srv, 3, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			server.(*spdy3.Conn).ValidationMode = <-modes
+			go server.Run()
+		}
+	}()
+
+	// exchange sends a SYN_STREAM for each of the given
+	// stream IDs, except stream 7, which is sent DATA
+	// without being opened. It returns the RST_STREAMs
+	// received, the GOAWAY status, if any, and whether the
+	// last stream was answered before the connection was
+	// closed.
+	exchange := func(mode common.ValidationMode, ids ...common.StreamID) (map[common.StreamID]common.StatusCode, common.GoawayStatus, bool) {
+		modes <- mode
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		compressor := common.NewCompressor(3)
+		for _, sid := range ids {
+			var frame common.Frame
+			if sid == 7 {
+				data := new(frames.DATA)
+				data.StreamID = sid
+				data.Data = []byte("stray")
+				frame = data
+			} else {
+				syn := new(frames.SYN_STREAM)
+				syn.StreamID = sid
+				syn.Flags = common.FLAG_FIN
+				syn.Header = make(http.Header)
+				syn.Header.Set(":method", "GET")
+				syn.Header.Set(":scheme", "http")
+				syn.Header.Set(":host", l.Addr().String())
+				syn.Header.Set(":path", "/")
+				syn.Header.Set(":version", "HTTP/1.1")
+				if err = syn.Compress(compressor); err != nil {
+					t.Fatal(err)
+				}
+				frame = syn
+			}
+			if _, err = frame.WriteTo(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		resets := make(map[common.StreamID]common.StatusCode)
+		goaway := common.GOAWAY_OK
+		last := ids[len(ids)-1]
+		buf := bufio.NewReader(conn)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					t.Fatal("Connection was neither closed nor replied.")
+				}
+				return resets, goaway, false
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Fatal(err)
+			}
+			switch frame := frame.(type) {
+			case *frames.RST_STREAM:
+				resets[frame.StreamID] = frame.Status
+			case *frames.GOAWAY:
+				goaway = frame.Status
+			case *frames.SYN_REPLY:
+				if frame.StreamID == last {
+					return resets, goaway, true
+				}
+			}
+		}
+	}
+
+	// Lenient validation ignores the stray DATA, but still
+	// refuses streams with misused IDs, without ending the
+	// connection.
+	lenient := []struct {
+		ids   []common.StreamID
+		reset common.StreamID
+	}{
+		{[]common.StreamID{2, 7, 9}, 2},
+		{[]common.StreamID{3, 1, 5}, 1},
+		{[]common.StreamID{3, 3, 5}, 3},
+	}
+	for _, test := range lenient {
+		resets, goaway, replied := exchange(common.ValidationLenient, test.ids...)
+		if len(resets) != 1 || resets[test.reset] != common.RST_STREAM_PROTOCOL_ERROR || goaway != common.GOAWAY_OK || !replied {
+			t.Errorf("Lenient %v: expected PROTOCOL_ERROR reset of stream %d and a reply, got %v, %s and %v.",
+				test.ids, test.reset, resets, goaway, replied)
+		}
+	}
+
+	// Strict validation resets streams with misused IDs.
+	tests := []struct {
+		ids    []common.StreamID
+		reset  common.StreamID
+		status common.StatusCode
+	}{
+		{[]common.StreamID{1, 7, 9}, 7, common.RST_STREAM_INVALID_STREAM},
+		{[]common.StreamID{2, 9}, 2, common.RST_STREAM_PROTOCOL_ERROR},
+		{[]common.StreamID{3, 3, 5}, 3, common.RST_STREAM_PROTOCOL_ERROR},
+	}
+	for _, test := range tests {
+		resets, goaway, replied := exchange(common.ValidationStrict, test.ids...)
+		if len(resets) != 1 || resets[test.reset] != test.status || goaway != common.GOAWAY_OK || !replied {
+			t.Errorf("Strict %v: expected %s reset of stream %d and a reply, got %v, %s and %v.",
+				test.ids, test.status, test.reset, resets, goaway, replied)
+		}
+	}
+
+	// Strict validation ends the connection when stream IDs decrease.
+	resets, goaway, replied := exchange(common.ValidationStrict, 3, 1, 5)
+	if len(resets) != 0 || goaway != common.GOAWAY_PROTOCOL_ERROR || replied {
+		t.Errorf("Strict: expected PROTOCOL_ERROR GOAWAY and no reply, got %v, %s and %v.", resets, goaway, replied)
+	}
+}
+
+func TestLateFrames(t *testing.T) {
+	spdy.SetClosedStreamGrace(200 * time.Millisecond)
+	defer spdy.SetClosedStreamGrace(10 * time.Second)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go spdy.ServePlaintext(l, &http.Server{Handler: robotsTxtHandler})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	send := func(frames ...common.Frame) {
+		for _, frame := range frames {
+			if _, err := frame.WriteTo(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	buf := bufio.NewReader(conn)
+	decom := common.NewDecompressor(3)
+	read := func() common.Frame {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = frame.Decompress(decom); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	// Complete stream 1.
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", l.Addr().String())
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err = syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	send(syn)
+	for {
+		if data, ok := read().(*frames.DATA); ok && data.Flags.FIN() {
+			break
+		}
+	}
+
+	// late sends DATA and a WINDOW_UPDATE for stream 1, and
+	// a WINDOW_UPDATE for unknown stream 99, then returns any
+	// RST_STREAMs received before the PING sent after them.
+	pingID := uint32(1)
+	late := func() map[common.StreamID]common.StatusCode {
+		data := new(frames.DATA)
+		data.StreamID = 1
+		data.Data = []byte("late")
+		update := new(frames.WINDOW_UPDATE)
+		update.StreamID = 1
+		update.DeltaWindowSize = 100
+		unknown := new(frames.WINDOW_UPDATE)
+		unknown.StreamID = 99
+		unknown.DeltaWindowSize = 100
+		ping := new(frames.PING)
+		ping.PingID = pingID
+		pingID += 2
+		send(data, update, unknown, ping)
+
+		resets := make(map[common.StreamID]common.StatusCode)
+		for {
+			switch frame := read().(type) {
+			case *frames.RST_STREAM:
+				resets[frame.StreamID] = frame.Status
+			case *frames.PING:
+				if frame.PingID == ping.PingID {
+					return resets
+				}
+			}
+		}
+	}
+
+	// Frames in flight when the stream closed are ignored.
+	if resets := late(); len(resets) != 0 {
+		t.Errorf("Expected late frames to be ignored, got %v.", resets)
+	}
+
+	// Frames after the grace period are answered once.
+	time.Sleep(300 * time.Millisecond)
+	if resets := late(); len(resets) != 1 || resets[1] != common.RST_STREAM_STREAM_ALREADY_CLOSED {
+		t.Errorf("Expected STREAM_ALREADY_CLOSED reset of stream 1, got %v.", resets)
+	}
+	if resets := late(); len(resets) != 0 {
+		t.Errorf("Expected frames after the reset to be ignored, got %v.", resets)
+	}
+}
+
+func TestUnknownFrames(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	servers := make(chan common.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server, err := spdy.NewServerConn(conn, &http.Server{Handler: robotsTxtHandler}, 3, 1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		servers <- server
+		server.Run()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A SPDY/2 NOOP, which SPDY/3 does not define, an unknown
+	// frame with a payload, then a PING to show that the
+	// connection survived.
+	ping := &frames.PING{PingID: 1}
+	for _, frame := range []common.Frame{
+		&frames.UNKNOWN{Type: 5},
+		&frames.UNKNOWN{Type: 0xff, Flags: 1, Data: []byte("ignore me")},
+		ping,
+	} {
+		if _, err := frame.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := bufio.NewReader(conn)
+	for {
+		frame, err := frames.ReadFrame(buf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if goaway, ok := frame.(*frames.GOAWAY); ok {
+			t.Fatalf("Connection ended with %s.", goaway.Status)
+		}
+		if reply, ok := frame.(*frames.PING); ok && reply.PingID == ping.PingID {
+			break
+		}
+	}
+
+	server := <-servers
+	if n := server.(*spdy3.Conn).Stats().UnknownFrames; n != 2 {
+		t.Errorf("Expected 2 unknown frames to be counted, got %d.", n)
+	}
+}
+
+func TestStreamRegistry(t *testing.T) {
+	cancelled := make(chan string, 2)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			cancelled <- r.URL.Path
+		}),
+	}
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := spdy.NewServerConn(server, srv, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := conn.(spdy.StreamLister)
+	go conn.Run()
+	defer conn.Close()
+
+	resets := make(chan *frames.RST_STREAM, 2)
+	go func() {
+		buf := bufio.NewReader(client)
+		for {
+			frame, err := frames.ReadFrame(buf, 1)
+			if err != nil {
+				return
+			}
+			if rst, ok := frame.(*frames.RST_STREAM); ok {
+				resets <- rst
+			}
+		}
+	}()
+
+	compressor := common.NewCompressor(3)
+	for _, sid := range []common.StreamID{1, 3} {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "POST")
+		syn.Header.Set(":scheme", "http")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":path", fmt.Sprintf("/%d", sid))
+		syn.Header.Set(":version", "HTTP/1.1")
+		if err := syn.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syn.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func() []common.StreamID {
+		var out []common.StreamID
+		for _, info := range sc.Streams() {
+			if info.Kind != "response" {
+				t.Errorf("Stream %d has kind %q", info.ID, info.Kind)
+			}
+			out = append(out, info.ID)
+		}
+		return out
+	}
+	for deadline := time.Now().Add(time.Second); len(ids()) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 streams, got %v", ids())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := ids(); got[0] != 1 || got[1] != 3 {
+		t.Fatalf("Expected streams [1 3], got %v", got)
+	}
+	if sc.Stream(5) != nil {
+		t.Error("Stream returned an unknown stream")
+	}
+
+	// A misbehaving stream can be reset.
+	stream, ok := sc.Stream(3).(spdy.Resetter)
+	if !ok {
+		t.Fatalf("Stream 3 cannot be reset: %T", sc.Stream(3))
+	}
+	if err := stream.Reset(common.RST_STREAM_CANCEL); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rst := <-resets:
+		if rst.StreamID != 3 || rst.Status != common.RST_STREAM_CANCEL {
+			t.Errorf("Unexpected RST_STREAM %v", rst)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stream 3 was not reset")
+	}
+	if path := <-cancelled; path != "/3" {
+		t.Errorf("Expected /3 to be cancelled, got %s", path)
+	}
+	if got := ids(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("Expected streams [1], got %v", got)
+	}
+	if sc.Stream(3) != nil {
+		t.Error("Stream returned a reset stream")
+	}
+}
+
+func TestNegotiatingListener(t *testing.T) {
+	// Borrow httptest's certificate.
+	ts := httptest.NewTLSServer(nil)
+	certificates := ts.TLS.Certificates
+	ts.Close()
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if spdy.UsingSPDY(w) {
+				fmt.Fprint(w, "SPDY")
+			} else {
+				fmt.Fprint(w, r.Proto)
+			}
+		}),
+		TLSConfig: &tls.Config{Certificates: certificates},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nl := spdy.NewNegotiatingListener(l, srv)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(nl)
+	}()
+
+	h2 := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	https := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	url := "https://" + l.Addr().String()
+	for _, test := range []struct {
+		client *http.Client
+		want   string
+	}{
+		{newClient(), "SPDY"},
+		{h2, "HTTP/2.0"},
+		{https, "HTTP/1.1"},
+	} {
+		r, err := test.client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.want {
+			t.Errorf("Expected %q, got %q", test.want, body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nl.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Expected %v, got %v", http.ErrServerClosed, err)
+	}
+}
+
+func TestProtocolMux(t *testing.T) {
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if spdy.UsingSPDY(w) {
+				fmt.Fprint(w, "SPDY")
+			} else {
+				fmt.Fprint(w, r.Proto)
+			}
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := spdy.NewProtocolMux(l, srv)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(mux)
+	}()
+
+	url := "http://" + l.Addr().String()
+	for _, version := range []int{2, 3} {
+		tcpConn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := spdy.NewClientConn(tcpConn, nil, version, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Run()
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatalf("SPDY/%d: %v", version, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "SPDY" {
+			t.Errorf("SPDY/%d: Expected %q, got %q", version, "SPDY", body)
+		}
+	}
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("Expected %q, got %q", "HTTP/1.1", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mux.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Expected %v, got %v", http.ErrServerClosed, err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	wrongConn := make(chan bool, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.URL.Path))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			select {
+			case c := <-accepted:
+				accepted <- c
+				if c != conn {
+					wrongConn <- true
+				}
+			default:
+			}
+		},
+	}
+
+	upgraded := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			upgraded <- err
+			return
+		}
+		accepted <- conn
+
+		// Sniff the start of the first frame, as a front
+		// door serving HTTP/1.1 too would.
+		start := make([]byte, 3)
+		if _, err := io.ReadFull(conn, start); err != nil {
+			upgraded <- err
+			return
+		}
+		if start[0] != 0x80 {
+			upgraded <- fmt.Errorf("Unexpected first byte %x", start[0])
+			return
+		}
+		upgraded <- spdy.Upgrade(conn, start, srv, 3, 1)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	framer, err := frames.NewFramer(1, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer framer.Close()
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "http")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/sniffed")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err := framer.WriteFrame(syn); err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	for done := false; !done; {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.SYN_REPLY:
+			if frame.StreamID != 1 {
+				t.Fatalf("Unexpected SYN_REPLY on stream %d", frame.StreamID)
+			}
+		case *frames.DATA:
+			body = append(body, frame.Data...)
+			done = frame.Flags.FIN()
+		case *frames.RST_STREAM:
+			t.Fatalf("Unexpected %s on stream %d", frame.Status, frame.StreamID)
+		}
+	}
+	if string(body) != "/sniffed" {
+		t.Errorf("Expected body %q, got %q", "/sniffed", body)
+	}
+
+	conn.Close()
+	select {
+	case err := <-upgraded:
+		if err != nil && err != io.EOF {
+			t.Errorf("Unexpected error from Upgrade: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Upgrade did not return once the client closed")
+	}
+	select {
+	case <-wrongConn:
+		t.Error("ConnState hook was not given the accepted connection")
+	default:
+	}
+}
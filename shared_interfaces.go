@@ -55,8 +55,88 @@ type PriorityStream interface {
 }
 
 var _ = PriorityStream(&spdy2.ResponseStream{})
+var _ = PriorityStream(&spdy3.PushStream{})
+var _ = PriorityStream(&spdy3.RequestStream{})
 var _ = PriorityStream(&spdy3.ResponseStream{})
 
+// PrioritySetter represents a stream whose priority
+// can be changed after it has been opened.
+type PrioritySetter interface {
+	SetPriority(common.Priority) error
+}
+
+var _ = PrioritySetter(&spdy3.PushStream{})
+var _ = PrioritySetter(&spdy3.RequestStream{})
+var _ = PrioritySetter(&spdy3.ResponseStream{})
+
+// HeaderFlusher represents a stream whose response
+// headers can be sent ahead of other frames.
+type HeaderFlusher interface {
+	SetFlushHeaders(bool)
+}
+
+var _ = HeaderFlusher(&spdy3.ResponseStream{})
+
+// NetConner represents a stream which can
+// be used as a net.Conn.
+type NetConner interface {
+	NetConn() net.Conn
+}
+
+var _ = NetConner(&spdy3.ResponseStream{})
+
+// StreamDialer represents a connection which
+// can open streams for use as a net.Conn.
+type StreamDialer interface {
+	Dial(request *http.Request, priority common.Priority) (net.Conn, *http.Response, error)
+}
+
+var _ = StreamDialer(&spdy3.Conn{})
+
+// ConnectServer represents a stream which can
+// serve a CONNECT request as a forward proxy.
+type ConnectServer interface {
+	ServeConnect(dial func(network, address string) (net.Conn, error)) error
+}
+
+var _ = ConnectServer(&spdy3.ResponseStream{})
+
+// WebSocketAccepter represents a stream which can
+// accept a WebSocket opened with an extended CONNECT.
+type WebSocketAccepter interface {
+	AcceptWebSocket() (net.Conn, error)
+}
+
+var _ = WebSocketAccepter(&spdy3.ResponseStream{})
+
+// WebSocketDialer represents a connection which
+// can open WebSockets over its streams.
+type WebSocketDialer interface {
+	DialWebSocket(rawurl string, header http.Header) (net.Conn, *http.Response, error)
+}
+
+var _ = WebSocketDialer(&spdy3.Conn{})
+
+// Resetter represents a stream which can be
+// ended abruptly with a RST_STREAM.
+type Resetter interface {
+	Reset(status common.StatusCode) error
+}
+
+var _ = Resetter(&spdy3.RequestStream{})
+var _ = Resetter(&spdy3.ResponseStream{})
+var _ = Resetter(&spdy3.StreamConn{})
+
+// HalfCloser represents a stream which can be
+// half-closed in either direction.
+type HalfCloser interface {
+	CloseWrite() error
+	CloseRead(refuse bool) error
+}
+
+var _ = HalfCloser(&spdy3.RequestStream{})
+var _ = HalfCloser(&spdy3.ResponseStream{})
+
 // Compressor is used to compress the text header of a SPDY frame.
 type Compressor interface {
 	io.Closer
@@ -77,6 +157,34 @@ type Pinger interface {
 var _ = Pinger(&spdy2.Conn{})
 var _ = Pinger(&spdy3.Conn{})
 
+// Idler represents a connection which can
+// report whether it has any active streams.
+type Idler interface {
+	Idle() bool
+}
+
+var _ = Idler(&spdy2.Conn{})
+var _ = Idler(&spdy3.Conn{})
+
+// Drainer represents a connection which can be
+// shut down gracefully, closing once its active
+// streams have finished.
+type Drainer interface {
+	Drain()
+}
+
+var _ = Drainer(&spdy3.Conn{})
+
+// GoawayReporter represents a connection which can
+// report whether it is going away, after sending or
+// receiving a GOAWAY, so that new requests must use
+// another connection.
+type GoawayReporter interface {
+	GoingAway() bool
+}
+
+var _ = GoawayReporter(&spdy3.Conn{})
+
 // Pusher represents something able to send
 // server puhes.
 type Pusher interface {
@@ -86,6 +194,78 @@ type Pusher interface {
 var _ = Pusher(&spdy2.Conn{})
 var _ = Pusher(&spdy3.Conn{})
 
+// PushTracker represents a connection which
+// tracks the push streams associated with each
+// stream.
+type PushTracker interface {
+	PushedStreams(common.StreamID) []common.StreamID
+}
+
+var _ = PushTracker(&spdy3.Conn{})
+
+// PushWatcher represents a push stream which
+// reports what became of the push.
+type PushWatcher interface {
+	Outcome() common.PushOutcome
+	Done() <-chan struct{}
+}
+
+var _ = PushWatcher(&spdy3.PushStream{})
+
+// StatsReporter represents a connection which
+// keeps statistics of its activity.
+type StatsReporter interface {
+	Stats() common.Stats
+	ResetStats() common.Stats
+	StatsDelta() common.Stats
+}
+
+var _ = StatsReporter(&spdy3.Conn{})
+
+// StreamLister represents a connection which can
+// list its active streams and look them up by ID.
+type StreamLister interface {
+	Streams() []common.StreamInfo
+	Stream(id common.StreamID) common.Stream
+}
+
+var _ = StreamLister(&spdy3.Conn{})
+
+// StateReporter represents a connection which can
+// report a snapshot of its state.
+type StateReporter interface {
+	State() common.ConnState
+}
+
+var _ = StateReporter(&spdy3.Conn{})
+
+// Handoffer represents a connection which can be
+// handed off between processes during a restart.
+type Handoffer interface {
+	Export() common.ConnHandoff
+	Import(common.ConnHandoff) error
+}
+
+var _ = Handoffer(&spdy3.Conn{})
+
+// StreamStatsReporter represents a stream which
+// keeps statistics of its activity.
+type StreamStatsReporter interface {
+	Stats() common.StreamStats
+}
+
+var _ = StreamStatsReporter(&spdy3.PushStream{})
+var _ = StreamStatsReporter(&spdy3.RequestStream{})
+var _ = StreamStatsReporter(&spdy3.ResponseStream{})
+
+// RateLimiter represents a connection which can
+// limit the rate at which it sends data.
+type RateLimiter interface {
+	SetRateLimits(connection, stream int64)
+}
+
+var _ = RateLimiter(&spdy3.Conn{})
+
 // SetFlowController represents a connection
 // which can have its flow control mechanism
 // customised.
@@ -5,10 +5,15 @@
 package spdy
 
 import (
+	"compress/flate"
 	"crypto/tls"
+	"crypto/x509"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy2"
@@ -28,7 +33,351 @@ func SetMaxBenignErrors(n int) {
 	common.MaxBenignErrors = n
 }
 
+// SetValidationMode determines how new SPDY/3 and SPDY/3.1
+// connections respond to violations of the specification which
+// they could tolerate, such as misused stream IDs or frames for
+// streams which are not open. Strict validation ends the
+// connection or resets the stream, as the specification
+// requires, whereas lenient validation, the default, logs the
+// violations and ignores the frames involved, so that sloppy
+// legacy clients can still be served. Either way, a new stream
+// with a misused ID is reset, so that the client is not left
+// waiting for it.
+func SetValidationMode(mode common.ValidationMode) {
+	common.Validation = mode
+}
+
+// SetRejectionResponses determines whether servers refuse
+// streams which cannot be handled, such as those with bad
+// headers or which exceed the stream limit, with a minimal
+// error response rather than a bare RST_STREAM. The response
+// body is produced with common.RejectionTemplate. This is
+// only supported on SPDY/3 and SPDY/3.1 connections. Note
+// that clients retry streams refused with REFUSED_STREAM for
+// exceeding the stream limit, but not those given a response.
+func SetRejectionResponses(enabled bool) {
+	common.RejectionResponses = enabled
+}
+
+// SetRejectUnidirectional determines whether servers refuse
+// client streams sent with FLAG_UNIDIRECTIONAL, which can
+// never be replied to, with a PROTOCOL_ERROR RST_STREAM. A
+// spdy3.Conn's UnidirectionalHandler, if set, takes
+// precedence. This is only supported on SPDY/3 and SPDY/3.1
+// connections.
+func SetRejectUnidirectional(enabled bool) {
+	common.RejectUnidirectional = enabled
+}
+
+// SetBufferRequestBodies determines whether new SPDY/3 and
+// SPDY/3.1 connections buffer request bodies of known length
+// in full before calling their handlers. By default, handlers
+// are called as soon as the request headers arrive, and read
+// the body as it is received, with the client only allowed to
+// send more as the handler reads it. Buffering, as in earlier
+// versions, lets handlers read the whole body without waiting
+// on the client, at the cost of memory, which can be bounded
+// with SetBodySpillThreshold.
+func SetBufferRequestBodies(enabled bool) {
+	common.BufferRequestBodies = enabled
+}
+
+// SetHandleEarly sets a function which decides, for each request
+// with a body received by new SPDY/3 and SPDY/3.1 connections,
+// whether its handler is called as soon as the request headers
+// arrive, with the body streamed to it, or only once the whole
+// request has been received. This takes the place of
+// SetBufferRequestBodies, so that endpoints such as long polls
+// and streamed uploads can start at once while other bodies
+// are buffered. CONNECT requests and those sent with Expect:
+// 100-continue are always handled early. A nil function
+// restores the default.
+func SetHandleEarly(decide func(request *http.Request) bool) {
+	common.HandleEarly = decide
+}
+
+// SetBodySpillThreshold limits the memory used to buffer
+// request bodies on new SPDY/3 and SPDY/3.1 connections,
+// once buffering is enabled with SetBufferRequestBodies.
+// Bodies larger than threshold bytes are spilled to
+// temporary files in dir, or os.TempDir if it is empty,
+// which are removed once the request has been handled.
+// Handlers read them as usual. A threshold of 0 holds all
+// bodies in memory, which is the default.
+func SetBodySpillThreshold(threshold int64, dir string) {
+	common.BodySpillThreshold = threshold
+	common.BodySpillDir = dir
+}
+
+// SetEventHistory sets the number of recent frames recorded
+// by each new SPDY/3 and SPDY/3.1 connection, which are
+// included in the snapshots served by the debug package to
+// help diagnose wedged connections. Header blocks are not
+// recorded. A history of 0 disables the record. The default
+// is 64.
+func SetEventHistory(n int) {
+	common.EventHistory = n
+}
+
+// SetFrameCapture sets the Capture which records the traffic of
+// each new connection, so that it can be inspected in Wireshark.
+// A nil Capture, which is the default, disables capture:
+//
+//	f, err := os.Create("spdy.pcap")
+//	...
+//	capture, err := common.NewCapture(f)
+//	...
+//	spdy.SetFrameCapture(capture)
+//
+// Connections over TLS are recorded as plaintext. To inspect the
+// encrypted traffic instead, capture it with a packet sniffer
+// and set the KeyLogWriter of the Transport or Server.
+func SetFrameCapture(capture *common.Capture) {
+	common.FrameCapture = capture
+}
+
+// SetHeaderLimits sets the limits on the header blocks
+// received by SPDY/3 and SPDY/3.1 connections: the maximum
+// number of header values, the maximum total size of the
+// decompressed header block, and the maximum size of any one
+// value. A limit of 0 disables that check. Requests exceeding
+// a limit are refused with RST_STREAM, or with a 431 response
+// if SetRejectionResponses is enabled.
+func SetHeaderLimits(count, blockSize, valueLength int) {
+	common.MaxHeaderCount = count
+	common.MaxHeaderBlockSize = blockSize
+	common.MaxHeaderValueLength = valueLength
+}
+
+// SetLogHeaderBlockSize causes new SPDY/3 and SPDY/3.1
+// connections to log each header block sent or received
+// whose names and values exceed size bytes, with its stream
+// ID. A size of 0, the default, disables the logging. The
+// totals for all header blocks are given by each connection's
+// State.
+func SetLogHeaderBlockSize(size int) {
+	common.LogHeaderBlockSize = size
+}
+
+// SetFrameSizes sets the size of the largest frame, including
+// its 8-byte header, accepted by new SPDY/3 and SPDY/3.1
+// connections, and the size of the largest DATA payload they
+// send. Larger DATA frames received are discarded, and their
+// streams are reset with FRAME_TOO_LARGE, while other larger
+// frames end the connection. The maximum frame size must be
+// at least 8192 bytes, as required by the specification. Both
+// default to the largest the protocol allows: a frame of
+// 16777223 bytes, being a 16777215-byte length and its header,
+// and a DATA payload of 16777215 bytes.
+func SetFrameSizes(maxFrame, dataChunk int) error {
+	if err := common.CheckFrameSizes(maxFrame, dataChunk); err != nil {
+		return err
+	}
+	common.MaxFrameSize = maxFrame
+	common.DataChunkSize = dataChunk
+	return nil
+}
+
+// SetWriteBatching sets the largest batch of frames which new
+// SPDY/3 and SPDY/3.1 connections hold before writing them to
+// the network. While more frames are waiting to be sent, they
+// are batched, so that several are written with each system
+// call, and the batch is written once no more are waiting. A
+// size of 0 disables batching. The default is 64kB.
+func SetWriteBatching(size int) {
+	common.WriteBatchSize = size
+}
+
+// SetMemoryBudget limits the memory used by each new SPDY/3
+// and SPDY/3.1 connection to buffer data, such as request
+// bodies which handlers have not yet read. Once a connection
+// exceeds its budget, it stops growing its receive windows,
+// so that the client must stop sending until the data has
+// been consumed, and streams which receive DATA while twice
+// the budget is in use are reset. This stops a client from
+// exhausting the server's memory by sending bodies which are
+// never read. A budget of 0 disables the limit, which is the
+// default.
+func SetMemoryBudget(budget int64) {
+	common.MemoryBudget = budget
+}
+
+// SetWorkers bounds the goroutines used to run the handlers
+// of new SPDY/3 and SPDY/3.1 connections. At most global
+// handlers run at once across all of those connections, and
+// at most perConn on each one. Streams opened while a limit
+// is reached are queued until a handler finishes, rather than
+// each being given its own goroutine, which lets a server hold
+// very many connections with few goroutines. Since a queued
+// stream waits for another handler to finish, the limits suit
+// short handlers; long-polling or streaming handlers should be
+// served without them. A limit of 0 disables that limit, and
+// by default each handler runs in its own goroutine.
+func SetWorkers(global, perConn int) {
+	common.Workers = common.NewWorkerPool(global, nil)
+	common.ConnWorkers = perConn
+}
+
+// SetFairScheduling enables fair bandwidth sharing between
+// the streams in each priority class on new SPDY/3 and
+// SPDY/3.1 connections. Each stream's share is measured over
+// the given window, which should be short, such as 100ms.
+// A window of 0 disables fair scheduling, which is the
+// default.
+func SetFairScheduling(window time.Duration) {
+	common.FairnessWindow = window
+}
+
+// SetRoundRobin enables round robin scheduling between the
+// streams in each priority class on new SPDY/3 and SPDY/3.1
+// connections, so that a stream which writes first cannot
+// monopolise the connection. The streams with data waiting
+// take turns, each sending up to quantum bytes of DATA per
+// turn, such as 16kB. This takes precedence over
+// SetFairScheduling. A quantum of 0 disables round robin
+// scheduling, which is the default.
+func SetRoundRobin(quantum int) {
+	common.RoundRobinQuantum = quantum
+}
+
+// SetStarvationBound enables the starvation watchdog on new
+// SPDY/3 and SPDY/3.1 connections. If a priority class makes
+// no progress for longer than the given bound, while frames of
+// higher priority are sent, its next frame is sent ahead of
+// them, and counted in the connection's StarvedFrames stat. A
+// bound of 0 disables the watchdog, which is the default.
+func SetStarvationBound(bound time.Duration) {
+	common.StarvationBound = bound
+}
+
+// SetBodyDrainLimit sets the number of bytes which new SPDY/3
+// and SPDY/3.1 client connections read and discard from a push
+// whose body is closed before it has been read fully, so that
+// the push can finish rather than being cancelled with a
+// RST_STREAM. If more than limit bytes remain, as far as is
+// known from its Content-Length, the push is cancelled at once.
+// A limit of 0, the default, cancels every such push.
+func SetBodyDrainLimit(limit int64) {
+	common.BodyDrainLimit = limit
+}
+
+// SetPushBufferLimit sets the number of bytes which new SPDY/3
+// and SPDY/3.1 client connections buffer from a push before its
+// body is read. A push which sends more is cancelled with a
+// RST_STREAM. A limit of 0 disables the check. By default, the
+// limit is 1 MiB.
+func SetPushBufferLimit(limit int64) {
+	common.PushBufferLimit = limit
+}
+
+// SetMaxRequestBodyBytes sets the limit on the size of each
+// request body received by new SPDY/3 and SPDY/3.1 connections.
+// A request which exceeds it is answered with 413 Request Entity
+// Too Large, if its handler has not yet responded, and its stream
+// is reset, so that the client stops sending. Handlers reading
+// the body are given an *http.MaxBytesError. A limit of 0, the
+// default, leaves request bodies unlimited.
+func SetMaxRequestBodyBytes(limit int64) {
+	common.MaxRequestBodyBytes = limit
+}
+
+// SetResponseCompression determines whether new SPDY/3 and
+// SPDY/3.1 connections compress response bodies with gzip or
+// deflate, where the request's Accept-Encoding allows it, and
+// the flate compression level used, such as flate.BestSpeed.
+// Responses with their own Content-Encoding, partial responses
+// and those whose content is already compressed, such as
+// images and archives, are sent as written. The Content-Type is
+// sniffed from the first write if the handler has not set it.
+// Compressed responses are sent without a Content-Length. By
+// default, responses are not compressed.
+func SetResponseCompression(enabled bool, level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return common.ErrCompressionLevel
+	}
+	common.CompressResponses = enabled
+	common.ResponseCompressionLevel = level
+	return nil
+}
+
+// SetPanicHandler sets a function which new SPDY/3 and SPDY/3.1
+// connections call when a handler panics, with the request, the
+// value passed to panic and the stack trace, so that applications
+// can report panics to their error tracker. Either way, the stream
+// is ended with a 500 response if the handler had not yet sent its
+// headers, or a RST_STREAM with INTERNAL_ERROR otherwise, so that
+// the client is not left waiting. As with net/http, a handler can
+// panic with http.ErrAbortHandler to reset the stream with CANCEL
+// without a report. A nil function, the default, logs the panics.
+func SetPanicHandler(handler func(request *http.Request, v interface{}, stack []byte)) {
+	common.PanicHandler = handler
+}
+
+// SetClosedStreamGrace sets how long new SPDY/3 and SPDY/3.1
+// connections remember streams which have closed or been reset.
+// Frames which arrive for such a stream within this period are
+// assumed to have been in flight, and are ignored. Later frames
+// for the stream are answered with a RST_STREAM with the status
+// STREAM_ALREADY_CLOSED. The default is 10 seconds.
+func SetClosedStreamGrace(grace time.Duration) {
+	common.ClosedStreamGrace = grace
+}
+
+// SetErrorHandler sets a function which new SPDY/3 and SPDY/3.1
+// connections call when the peer violates the protocol, just
+// before the connection is ended. It is given the error and the
+// offending frame, if one was read, so that the frame can be
+// logged, and chooses whether the connection is ended with a
+// GOAWAY or closed immediately. A nil function, the default,
+// leaves protocol errors to be logged.
+func SetErrorHandler(handler func(err error, frame common.Frame) common.ErrorAction) {
+	common.ErrorHandler = handler
+}
+
+// SetAccessControl sets a function which new connections call
+// for each request, before its handler, with the client's
+// verified certificate, or nil if the client did not present
+// one. If it returns an error, the stream is denied, so access
+// can be limited by client identity, such as by the certificate's
+// subject. The server's TLS config must set ClientAuth for
+// clients to be asked for certificates. A nil function, the
+// default, allows every request.
+func SetAccessControl(control func(identity *x509.Certificate, request *http.Request) error) {
+	common.AccessControl = control
+}
+
+// ClientCertificate returns the verified certificate with which
+// the client of r authenticated, or nil if r was not received
+// over TLS or the client did not present a verified certificate.
+// This applies to requests received over SPDY and HTTPS alike.
+func ClientCertificate(r *http.Request) *x509.Certificate {
+	return common.ClientCertificate(r.TLS)
+}
+
+// SetDataChecksums determines whether new SPDY/3 and SPDY/3.1
+// connections offer the DATA checksum extension. If both
+// endpoints offer it, every DATA frame carries a CRC32 of its
+// payload, and a connection on which a checksum fails to match
+// is ended. This is intended for deployments where broken
+// middleboxes have been seen to corrupt data silently. The
+// extension is disabled by default.
+func SetDataChecksums(enabled bool) {
+	common.DataChecksums = enabled
+}
+
+// SetRateLimits limits the DATA sent by each new SPDY/3 and
+// SPDY/3.1 connection, and by each of its streams, to the
+// given number of bytes per second, so that one greedy stream
+// or client cannot starve the others. A limit of 0 disables
+// that limit, which is the default. Limits can also be set on
+// individual connections with their SetRateLimits method.
+func SetRateLimits(connection, stream int64) {
+	common.ConnectionRateLimit = connection
+	common.StreamRateLimit = stream
+}
+
 // AddSPDY adds SPDY support to srv, and must be called before srv begins serving.
+// The SPDY versions are advertised using both ALPN and NPN.
 func AddSPDY(srv *http.Server) {
 	if srv == nil {
 		return
@@ -41,25 +390,7 @@ func AddSPDY(srv *http.Server) {
 	if srv.TLSConfig == nil {
 		srv.TLSConfig = new(tls.Config)
 	}
-	if srv.TLSConfig.NextProtos == nil {
-		srv.TLSConfig.NextProtos = npnStrings
-	} else {
-		// Collect compatible alternative protocols.
-		others := make([]string, 0, len(srv.TLSConfig.NextProtos))
-		for _, other := range srv.TLSConfig.NextProtos {
-			if !strings.Contains(other, "spdy/") && !strings.Contains(other, "http/") {
-				others = append(others, other)
-			}
-		}
-
-		// Start with spdy.
-		srv.TLSConfig.NextProtos = make([]string, 0, len(others)+len(npnStrings))
-		srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, npnStrings[:len(npnStrings)-1]...)
-
-		// Add the others.
-		srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, others...)
-		srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, "http/1.1")
-	}
+	ConfigureTLS(srv.TLSConfig)
 	if srv.TLSNextProto == nil {
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
@@ -75,6 +406,88 @@ func AddSPDY(srv *http.Server) {
 	}
 }
 
+// SetPushCacheDigest sets how clients of new SPDY/3 and SPDY/3.1
+// connections list the resources they have cached, in a request
+// header or cookie, as described for common.CacheDigest. A push
+// of a listed resource is cancelled with RST_STREAM CANCEL once
+// its headers are set, before any of it is sent, and writes to it
+// fail with the ErrPushCached error. A nil digest, the default,
+// never cancels pushes.
+func SetPushCacheDigest(digest *common.CacheDigest) {
+	common.PushCacheDigest = digest
+}
+
+// SetFlowStallLimits sets how long streams on new SPDY/3 and
+// SPDY/3.1 connections may be blocked by flow control, waiting
+// for the peer to grow the transfer window with a WINDOW_UPDATE.
+// A stream blocked for longer than threshold is logged and
+// counted in the connection's FlowStalls stat, and one blocked
+// for longer than timeout is reset with RST_STREAM CANCEL and
+// counted in its FlowStallResets stat. Either may be 0 to
+// disable it, which is the default. The time each stream has
+// spent blocked is given by its FlowControlStall stat.
+func SetFlowStallLimits(threshold, timeout time.Duration) {
+	common.FlowStallThreshold = threshold
+	common.FlowStallTimeout = timeout
+}
+
+// SetWindowUpdateThreshold sets the fraction of a receive window
+// whose growth new SPDY/3 and SPDY/3.1 connections accumulate
+// before sending a WINDOW_UPDATE, so that a peer sending many
+// small DATA frames is not sent an update for each. Growth is sent
+// sooner once it exceeds what is left of the peer's window, so that
+// the peer is not left waiting. A threshold of 0 sends each growth
+// as soon as the flow control module grants it. By default, the
+// threshold is 0.5.
+func SetWindowUpdateThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1 {
+		return common.ErrWindowUpdateThreshold
+	}
+	common.WindowUpdateThreshold = threshold
+	return nil
+}
+
+// SetServerTiming sets how new SPDY/3 and SPDY/3.1 connections
+// report where the time was spent on each response: queueing
+// before the handler, in the handler, flushing its DATA, and
+// stalled by flow control. With common.ServerTimingHeader, a
+// Server-Timing header is sent with the final frame of each
+// response, and with common.ServerTimingLog, the timings are
+// logged. By default, timings are not reported.
+func SetServerTiming(mode common.ServerTimingMode) {
+	common.ServerTiming = mode
+}
+
+// SetPushPolicy adds SPDY support to srv, as AddSPDY, with
+// the given policy used to push resources automatically on
+// SPDY/3 and SPDY/3.1 connections. SPDY/2 connections do not
+// use the policy. SetPushPolicy must be called before srv
+// begins serving.
+func SetPushPolicy(srv *http.Server, policy *common.PushPolicy) {
+	if srv == nil {
+		return
+	}
+
+	AddSPDY(srv)
+	if srv.TLSNextProto == nil {
+		return
+	}
+	if _, ok := srv.TLSNextProto["spdy/3"]; ok {
+		srv.TLSNextProto["spdy/3"] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+			conn := spdy3.NewConn(tlsConn, s, 0)
+			conn.PushPolicy = policy
+			conn.Run()
+		}
+	}
+	if _, ok := srv.TLSNextProto["spdy/3.1"]; ok {
+		srv.TLSNextProto["spdy/3.1"] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+			conn := spdy3.NewConn(tlsConn, s, 1)
+			conn.PushPolicy = policy
+			conn.Run()
+		}
+	}
+}
+
 // GetPriority is used to identify the request priority of the
 // given stream. This can be used to manually enforce stream
 // priority, although this is already performed by the
@@ -114,6 +527,238 @@ func GetPriority(w http.ResponseWriter) (int, error) {
 	return 0, common.ErrNotSPDY
 }
 
+// SetPriority changes the priority at which the rest of the
+// response on the stream underlying the given ResponseWriter
+// is sent, so that a handler can re-prioritise a response as
+// it learns more about it. SPDY/3 cannot signal the change to
+// the client, so only the server's scheduling is affected.
+// Client streams returned by a connection's Request method
+// can be re-prioritised with their own SetPriority method.
+// This is only supported on SPDY/3 and SPDY/3.1 connections.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// SetPriority will return the ErrNotSPDY error.
+func SetPriority(w http.ResponseWriter, priority int) error {
+	if stream, ok := w.(PrioritySetter); ok {
+		return stream.SetPriority(common.Priority(priority))
+	}
+	return common.ErrNotSPDY
+}
+
+// GetStreamStats returns the statistics of the stream
+// underlying the given ResponseWriter, including the bytes
+// and DATA frames sent and received, the time its DATA spent
+// queued on the connection, the times at which its first and
+// last bytes were sent and received, and its current
+// throughput. These can be used to add Server-Timing headers,
+// or to detect slow streams.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// GetStreamStats will return the ErrNotSPDY error.
+func GetStreamStats(w http.ResponseWriter) (common.StreamStats, error) {
+	if stream, ok := w.(StreamStatsReporter); ok {
+		return stream.Stats(), nil
+	}
+	return common.StreamStats{}, common.ErrNotSPDY
+}
+
+// FlushHeaders ensures that the response headers of the
+// stream underlying the given ResponseWriter are sent ahead
+// of any other pending frames on the connection, so that
+// they reach the client promptly after WriteHeader or Flush.
+// This is intended for streaming responses, where clients
+// may time out waiting for headers. FlushHeaders must be
+// called before WriteHeader. This is only supported on
+// SPDY/3 and SPDY/3.1 connections.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// FlushHeaders will return the ErrNotSPDY error.
+func FlushHeaders(w http.ResponseWriter) error {
+	if stream, ok := w.(HeaderFlusher); ok {
+		stream.SetFlushHeaders(true)
+		return nil
+	}
+	return common.ErrNotSPDY
+}
+
+// FlushHeadersHandler returns a handler which calls
+// FlushHeaders on each response before calling handler.
+// This can be used to set the option for a route.
+func FlushHeadersHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FlushHeaders(w)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// NetConn returns a net.Conn carried by the stream underlying
+// the given ResponseWriter, so that the stream can be used as a
+// generic tunnel. Reads return the request body, and writes send
+// the response body. The response headers are sent at once. The
+// request body is only streamed if the client sent the request
+// without FLAG_FIN or a Content-Length, as with a request made
+// using spdy3.Conn.Dial. This is only supported on SPDY/3 and
+// SPDY/3.1 connections.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// NetConn will return the ErrNotSPDY error.
+func NetConn(w http.ResponseWriter) (net.Conn, error) {
+	if stream, ok := w.(NetConner); ok {
+		return stream.NetConn(), nil
+	}
+	return nil, common.ErrNotSPDY
+}
+
+// CloseWrite half-closes the stream underlying the given
+// ResponseWriter, ending the response while the request body
+// can still be read, as with a streamed upload which the
+// handler answers before it has finished. This is only
+// supported on SPDY/3 and SPDY/3.1 connections.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// CloseWrite will return the ErrNotSPDY error.
+func CloseWrite(w http.ResponseWriter) error {
+	if stream, ok := w.(HalfCloser); ok {
+		return stream.CloseWrite()
+	}
+	return common.ErrNotSPDY
+}
+
+// CloseRead stops reading the request body of the stream
+// underlying the given ResponseWriter, discarding any more
+// that is received, while the response can still be written.
+// If refuse is true and the client is still sending, the stream
+// is reset with RST_STREAM CANCEL instead, ending the response
+// too. This is only supported on SPDY/3 and SPDY/3.1
+// connections.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// CloseRead will return the ErrNotSPDY error.
+func CloseRead(w http.ResponseWriter, refuse bool) error {
+	if stream, ok := w.(HalfCloser); ok {
+		return stream.CloseRead(refuse)
+	}
+	return common.ErrNotSPDY
+}
+
+// ServeConnect serves a CONNECT request made over the stream
+// underlying the given ResponseWriter, as a forward proxy. The
+// request's target is dialled with dial, or net.Dial if dial is
+// nil, and the stream then carries the tunnelled bytes in both
+// directions, subject to flow control. If the target cannot be
+// reached, the request is refused with a 502 status. This is
+// only supported on SPDY/3 and SPDY/3.1 connections.
+//
+// A simple forward proxy is:
+//
+//	func proxy(w http.ResponseWriter, r *http.Request) {
+//		if r.Method != "CONNECT" {
+//			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+//			return
+//		}
+//		if err := spdy.ServeConnect(w, nil); err != nil {
+//			log.Println(err)
+//		}
+//	}
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// ServeConnect will return the ErrNotSPDY error.
+func ServeConnect(w http.ResponseWriter, dial func(network, address string) (net.Conn, error)) error {
+	if stream, ok := w.(ConnectServer); ok {
+		return stream.ServeConnect(dial)
+	}
+	return common.ErrNotSPDY
+}
+
+// ServeFile replies to the request with the contents of the named
+// file, using http.ServeContent, so that Range requests, including
+// those for several ranges, If-Range and the conditional request
+// headers are honoured. Unlike http.ServeFile, directories are not
+// listed. Requests whose path contains a ".." element are rejected,
+// as the path may have been used to build name.
+//
+// Over SPDY/3 and SPDY/3.1, the file is read directly into DATA
+// frames sized to the stream's send window, as described for
+// spdy3.ResponseStream.ReadFrom, so that it is not buffered twice.
+// Over HTTP, ServeFile behaves as http.ServeContent.
+func ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	if containsDotDot(r.URL.Path) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		serveFileError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		serveFileError(w, err)
+		return
+	}
+	if info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// serveFileError replies to a request for a file
+// which could not be opened.
+func serveFileError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// containsDotDot returns true iff the path
+// has a ".." element.
+func containsDotDot(path string) bool {
+	if !strings.Contains(path, "..") {
+		return false
+	}
+	for _, element := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWebSocketRequest indicates whether the request opens a
+// WebSocket over a SPDY stream, using the extended CONNECT
+// described in spdy3.IsWebSocketRequest. Such requests cannot
+// be hijacked, so should be passed to AcceptWebSocket.
+func IsWebSocketRequest(r *http.Request) bool {
+	return spdy3.IsWebSocketRequest(r)
+}
+
+// AcceptWebSocket accepts a WebSocket opened over the stream
+// underlying the given ResponseWriter, and returns a net.Conn
+// carrying the WebSocket's frames. Any headers set on w, such
+// as Sec-WebSocket-Protocol, are sent with the 200 reply. The
+// net.Conn can be used by a WebSocket library in place of the
+// connection it would otherwise hijack. This is only supported
+// on SPDY/3 and SPDY/3.1 connections.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// AcceptWebSocket will return the ErrNotSPDY error.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if stream, ok := w.(WebSocketAccepter); ok {
+		return stream.AcceptWebSocket()
+	}
+	return nil, common.ErrNotSPDY
+}
+
 // PingClient is used to send PINGs with SPDY servers.
 // PingClient takes a ResponseWriter and returns a channel on
 // which a spdy.Ping will be sent when the PING response is
@@ -265,6 +910,41 @@ func Push(w http.ResponseWriter, url string) (common.PushStream, error) {
 	}
 }
 
+// PushResult waits for the given push to end, and returns
+// its outcome, which is common.PushAccepted if the push was
+// sent in full, common.PushCancelled if it was cancelled as
+// the client has the resource cached, or common.PushReset
+// if the client reset it. A push ends when it is finished,
+// so PushResult should be called after Finish, or from
+// another goroutine.
+//
+// If the push was not made over SPDY/3 or SPDY/3.1, so its
+// outcome is unknown, PushResult returns the ErrNotSPDY
+// error.
+func PushResult(push common.PushStream) (common.PushOutcome, error) {
+	watcher, ok := push.(PushWatcher)
+	if !ok {
+		return common.PushPending, common.ErrNotSPDY
+	}
+	<-watcher.Done()
+	return watcher.Outcome(), nil
+}
+
+// PushedStreams returns the IDs of the open push streams
+// associated with the stream used by the given
+// http.ResponseWriter. This is intended for diagnostics.
+// If the connection does not track pushes, PushedStreams
+// returns the ErrNotSPDY error.
+func PushedStreams(w http.ResponseWriter) ([]common.StreamID, error) {
+	if stream, ok := w.(Stream); !ok {
+		return nil, common.ErrNotSPDY
+	} else if tracker, ok := stream.Conn().(PushTracker); !ok {
+		return nil, common.ErrNotSPDY
+	} else {
+		return tracker.PushedStreams(stream.StreamID()), nil
+	}
+}
+
 // SetFlowControl can be used to set the flow control mechanism on
 // the underlying SPDY connection.
 func SetFlowControl(w http.ResponseWriter, f common.FlowControl) error {
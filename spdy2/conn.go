@@ -7,6 +7,7 @@ package spdy2
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/url"
@@ -23,12 +24,35 @@ import (
 type Conn struct {
 	PushReceiver common.Receiver // Receiver to call for server Pushes.
 
+	// AccessControl, if set, is called for each request received,
+	// with the client's verified certificate, if any, and the
+	// stream is denied if it returns an error. It is initialised
+	// to common.AccessControl.
+	AccessControl func(identity *x509.Certificate, request *http.Request) error
+
+	// PersistedSettings, if set on a client connection, holds
+	// the settings which the server asked to be persisted in
+	// an earlier session. They are applied as the connection
+	// starts, and returned to the server, flagged
+	// FLAG_SETTINGS_PERSISTED, after the client's own settings.
+	PersistedSettings common.Settings
+
+	// PersistSettings, if set on a client connection, is called
+	// when SETTINGS are received with FLAG_SETTINGS_CLEAR_SETTINGS,
+	// or with values flagged FLAG_SETTINGS_PERSIST_VALUE. If clear
+	// is true, any settings persisted previously must be discarded,
+	// and then the values in persist replace any persisted with the
+	// same IDs. It is called from the read loop, so it must not
+	// block.
+	PersistSettings func(clear bool, persist common.Settings)
+
 	// network state
 	remoteAddr  string
 	server      *http.Server                      // nil if client connection.
 	conn        net.Conn                          // underlying network (TLS) connection.
 	connLock    sync.Mutex                        // protects the interface value of the above conn.
 	buf         *bufio.Reader                     // buffered reader on conn.
+	capture     *common.CaptureConn               // records traffic, or nil.
 	tlsState    *tls.ConnectionState              // underlying TLS connection state.
 	streams     map[common.StreamID]common.Stream // map of active streams.
 	streamsLock sync.Mutex                        // protects streams.
@@ -37,6 +61,8 @@ type Conn struct {
 	// other state
 	compressor       common.Compressor   // outbound compression state.
 	decompressor     common.Decompressor // inbound decompression state.
+	compressionLevel int                 // zlib level used by compressor.
+	headerDictionary []byte              // custom zlib dictionary, or nil.
 	receivedSettings common.Settings     // settings sent by client.
 	goawayReceived   bool                // goaway has been received.
 	goawaySent       bool                // goaway has been sent.
@@ -83,8 +109,12 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 	out.remoteAddr = conn.RemoteAddr().String()
 	out.server = server
 	out.conn = conn
-	out.buf = bufio.NewReader(conn)
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	out.capture = common.FrameCapture.Conn(conn.LocalAddr(), conn.RemoteAddr())
+	out.buf = bufio.NewReader(out.capture.Reader(conn))
+	out.AccessControl = common.AccessControl
+	if tlsConn, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
 		out.tlsState = new(tls.ConnectionState)
 		*out.tlsState = tlsConn.ConnectionState()
 	}
@@ -99,6 +129,7 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 	out.output[7] = make(chan common.Frame)
 	out.pings = make(map[uint32]chan<- bool)
 	out.compressor = common.NewCompressor(2)
+	out.compressionLevel = common.CompressionLevel
 	out.decompressor = common.NewDecompressor(2)
 	out.receivedSettings = make(common.Settings)
 	out.lastPushStreamID = 0
@@ -138,6 +169,7 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 			settings := new(frames.SETTINGS)
 			settings.Settings = defaultClientSettings(common.DEFAULT_STREAM_LIMIT)
 			out.output[0] <- settings
+			out.sendPersistedSettings()
 		}
 	}
 	return out
@@ -151,6 +183,8 @@ func NextProto(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
 
 func (c *Conn) Run() error {
 	defer common.Recover()
+	common.RegisterConn(c)
+	defer common.UnregisterConn(c)
 	go c.send()        // Start the send loop.
 	if c.init != nil { // Must be after sending is enabled.
 		c.init() // Prepare any initialisation frames.
@@ -160,6 +194,23 @@ func (c *Conn) Run() error {
 	return nil
 }
 
+// connectionState returns the state of the underlying TLS
+// connection, or nil if there is none. If the handshake had
+// not completed when the connection was created, the state
+// is taken again. It is only called from the read loop.
+func (c *Conn) connectionState() *tls.ConnectionState {
+	if c.tlsState == nil || c.tlsState.HandshakeComplete {
+		return c.tlsState
+	}
+	if tlsConn, ok := c.Conn().(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		state := tlsConn.ConnectionState()
+		c.tlsState = &state
+	}
+	return c.tlsState
+}
+
 // newStream is used to create a new serverStream from a SYN_STREAM frame.
 func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 	header := frame.Header
@@ -189,7 +240,15 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 		Header:     header,
 		Host:       url.Host,
 		RequestURI: url.RequestURI(),
-		TLS:        c.tlsState,
+		TLS:        c.connectionState(),
+	}
+
+	if c.AccessControl != nil {
+		if err := c.AccessControl(common.ClientCertificate(request.TLS), request); err != nil {
+			log.Printf("Denied request for %q from %s: %v\n", request.URL, c.remoteAddr, err)
+			c._RST_STREAM(frame.StreamID, common.RST_STREAM_CANCEL)
+			return nil
+		}
 	}
 
 	output := c.output[frame.Priority]
@@ -6,7 +6,8 @@ package frames
 
 import (
 	"bufio"
-	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/SlyMarbo/spdy/common"
 )
@@ -18,10 +19,20 @@ func ReadFrame(reader *bufio.Reader) (frame common.Frame, err error) {
 		return nil, err
 	}
 
+	frame, err = newFrame(start)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = frame.ReadFrom(reader)
+	return frame, err
+}
+
+// newFrame returns an empty frame of the type given
+// by the first four bytes of its encoding.
+func newFrame(start []byte) (frame common.Frame, err error) {
 	if start[0] != 128 {
-		frame = new(DATA)
-		_, err = frame.ReadFrom(reader)
-		return frame, err
+		return new(DATA), nil
 	}
 
 	switch common.BytesToUint16(start[2:4]) {
@@ -45,11 +56,22 @@ func ReadFrame(reader *bufio.Reader) (frame common.Frame, err error) {
 		frame = new(WINDOW_UPDATE)
 
 	default:
-		return nil, errors.New("Error Failed to parse frame type.")
+		frame = new(UNKNOWN)
 	}
 
-	_, err = frame.ReadFrom(reader)
-	return frame, err
+	return frame, nil
+}
+
+// PeekFrameSize returns the size of the next frame in reader,
+// including its 8-byte header, without consuming it. This is
+// the number of bytes which ReadFrame will consume, if the
+// frame is valid.
+func PeekFrameSize(reader *bufio.Reader) (int, error) {
+	header, err := reader.Peek(8)
+	if err != nil {
+		return 0, err
+	}
+	return 8 + int(common.BytesToUint24(header[5:8])), nil
 }
 
 // controlFrameCommonProcessing performs checks identical between
@@ -113,3 +135,67 @@ var frameNames = map[int]string{
 	_CONTROL_FRAME: "CONTROL_FRAME",
 	_DATA_FRAME:    "DATA_FRAME",
 }
+
+// frameFlag names a flag, for use in frame summaries
+// and JSON. Flag values are only meaningful for the
+// frame types that use them.
+type frameFlag struct {
+	flag common.Flags
+	name string
+}
+
+var (
+	flagFIN            = frameFlag{common.FLAG_FIN, "FIN"}
+	flagUnidirectional = frameFlag{common.FLAG_UNIDIRECTIONAL, "UNIDIRECTIONAL"}
+	flagClearSettings  = frameFlag{common.FLAG_SETTINGS_CLEAR_SETTINGS, "CLEAR_SETTINGS"}
+	flagPersistValue   = frameFlag{common.FLAG_SETTINGS_PERSIST_VALUE, "PERSIST_VALUE"}
+	flagPersisted      = frameFlag{common.FLAG_SETTINGS_PERSISTED, "PERSISTED"}
+)
+
+// flagNames gives the names of the known flags set in
+// flags. Any other bits set are given in hex.
+func flagNames(flags common.Flags, known ...frameFlag) []string {
+	names := []string{}
+	for _, f := range known {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#02x", byte(flags)))
+	}
+
+	return names
+}
+
+// summaryFlags gives the flags part of a frame summary,
+// which is omitted if no flags are set.
+func summaryFlags(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return " flags=" + strings.Join(names, "|")
+}
+
+// settingJSON is the JSON form of a single setting.
+type settingJSON struct {
+	ID    string   `json:"id"`
+	Flags []string `json:"flags"`
+	Value uint32   `json:"value"`
+}
+
+// settingsJSON gives the settings in JSON form, sorted by
+// ID.
+func settingsJSON(settings common.Settings) []settingJSON {
+	out := []settingJSON{}
+	for _, setting := range settings.Settings() {
+		out = append(out, settingJSON{
+			ID:    setting.ID.String(),
+			Flags: flagNames(setting.Flags, flagPersistValue, flagPersisted),
+			Value: setting.Value,
+		})
+	}
+
+	return out
+}
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -23,10 +24,38 @@ func (frame *DATA) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *DATA) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *DATA) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *DATA) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *DATA) MarshalJSON() ([]byte, error) {
+	var data []byte
+	if common.VerboseLogging {
+		data = frame.Data
+	}
+
+	return json.Marshal(struct {
+		Type     string          `json:"type"`
+		Version  int             `json:"version"`
+		Flags    []string        `json:"flags"`
+		StreamID common.StreamID `json:"stream_id"`
+		Length   int             `json:"length"`
+		Data     []byte          `json:"data,omitempty"`
+	}{frame.Name(), 2, flagNames(frame.Flags, flagFIN), frame.StreamID, len(frame.Data), data})
+}
+
 func (frame *DATA) Name() string {
 	return "DATA"
 }
@@ -98,6 +127,12 @@ func (frame *DATA) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *DATA) Summary() string {
+	return fmt.Sprintf("DATA stream=%d%s length=%d", frame.StreamID,
+		summaryFlags(flagNames(frame.Flags, flagFIN)), len(frame.Data))
+}
+
 func (frame *DATA) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	length := len(frame.Data)
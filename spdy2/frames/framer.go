@@ -0,0 +1,113 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package frames
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// Framer reads and writes the frames of a SPDY/2 session,
+// holding the session's header compression state. Each frame
+// is read into a single buffer and then decoded from it, so
+// the frames returned hold no references to the reader's
+// buffer. A Framer is not safe for concurrent use, although
+// one goroutine may read while another writes.
+type Framer struct {
+	r            *bufio.Reader
+	w            io.Writer
+	compressor   common.Compressor
+	decompressor common.Decompressor
+
+	// MaxFrameSize is the size of the largest frame, including
+	// its 8-byte header, which ReadFrame accepts. It is
+	// initialised to common.MaxFrameSize.
+	MaxFrameSize int
+}
+
+// NewFramer returns a Framer reading and writing rw.
+func NewFramer(rw io.ReadWriter) *Framer {
+	f := new(Framer)
+	f.r = bufio.NewReader(rw)
+	f.w = rw
+	f.compressor = common.NewCompressor(2)
+	f.decompressor = common.NewDecompressor(2)
+	f.MaxFrameSize = common.MaxFrameSize
+	return f
+}
+
+// ReadFrame reads the next frame, decompressing its header
+// block if it has one. A frame larger than MaxFrameSize is
+// left unread, and common.FrameTooLarge is returned.
+func (f *Framer) ReadFrame() (common.Frame, error) {
+	size, err := PeekFrameSize(f.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > f.MaxFrameSize {
+		return nil, common.FrameTooLarge
+	}
+
+	start, err := f.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := newFrame(start)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return nil, err
+	}
+	if err := decode(frame, data); err != nil {
+		return nil, err
+	}
+	if err := frame.Decompress(f.decompressor); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// WriteFrame compresses frame's header block, if it
+// has one, and writes the frame.
+func (f *Framer) WriteFrame(frame common.Frame) error {
+	if err := frame.Compress(f.compressor); err != nil {
+		return err
+	}
+	_, err := frame.WriteTo(f.w)
+	return err
+}
+
+// Close releases the Framer's compression state.
+func (f *Framer) Close() error {
+	return f.compressor.Close()
+}
+
+// decode parses frame from data, which must
+// hold exactly one frame.
+func decode(frame common.Frame, data []byte) error {
+	r := common.NewSliceReader(data)
+	if _, err := frame.ReadFrom(r); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return common.IncorrectDataLength(len(data), len(data)-r.Len())
+	}
+	return nil
+}
+
+// encode returns the serialised form of frame.
+func encode(frame common.Frame) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := frame.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
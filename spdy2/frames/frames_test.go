@@ -0,0 +1,283 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package frames
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// goldenFrames maps each file in testdata to the frame it
+// encodes. Frames with header blocks give the offset of the
+// block, which is copied from the file, as the compressed
+// form of a header is not canonical.
+var goldenFrames = []struct {
+	file   string
+	frame  common.Frame
+	header int
+}{
+	{"syn_stream.hex", &SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Priority: 1}, 18},
+	{"syn_reply.hex", &SYN_REPLY{StreamID: 1}, 14},
+	{"rst_stream.hex", &RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL}, 0},
+	{"settings.hex", &SETTINGS{Settings: common.Settings{
+		common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
+			Flags: common.FLAG_SETTINGS_PERSIST_VALUE,
+			ID:    common.SETTINGS_MAX_CONCURRENT_STREAMS,
+			Value: 100,
+		},
+	}}, 0},
+	{"noop.hex", &NOOP{}, 0},
+	{"ping.hex", &PING{PingID: 1}, 0},
+	{"goaway.hex", &GOAWAY{LastGoodStreamID: 1}, 0},
+	{"headers.hex", &HEADERS{Flags: common.FLAG_FIN, StreamID: 1}, 14},
+	{"window_update.hex", &WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1 << 16}, 0},
+	{"data.hex", &DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("hello")}, 0},
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, test := range goldenFrames {
+		name := reflect.TypeOf(test.frame).Elem().Name()
+		golden := readGolden(t, test.file)
+		if test.header != 0 {
+			setRawHeader(test.frame, golden[test.header:])
+		}
+
+		size, err := PeekFrameSize(bufio.NewReader(bytes.NewReader(golden)))
+		if err != nil || size != len(golden) {
+			t.Errorf("%s: PeekFrameSize gave %d, %v, expected %d", name, size, err, len(golden))
+		}
+
+		buf := new(bytes.Buffer)
+		n, err := test.frame.WriteTo(buf)
+		if err != nil {
+			t.Errorf("%s: WriteTo: %v", name, err)
+		} else if !bytes.Equal(buf.Bytes(), golden) {
+			t.Errorf("%s: encoded as\n\t%x\nexpected\n\t%x", name, buf.Bytes(), golden)
+		} else if n != int64(len(golden)) {
+			t.Errorf("%s: WriteTo reported %d bytes, expected %d", name, n, len(golden))
+		}
+
+		r := bufio.NewReader(bytes.NewReader(golden))
+		frame, err := ReadFrame(r)
+		if err != nil {
+			t.Errorf("%s: ReadFrame: %v", name, err)
+			continue
+		}
+		if r.Buffered() != 0 {
+			t.Errorf("%s: %d bytes left unread", name, r.Buffered())
+		}
+		if !reflect.DeepEqual(frame, test.frame) {
+			t.Errorf("%s: decoded as\n%v\nexpected\n%v", name, frame, test.frame)
+		}
+
+		// Every truncation must fail cleanly.
+		for i := 0; i < len(golden); i++ {
+			r := bufio.NewReader(bytes.NewReader(golden[:i]))
+			if frame, err := ReadFrame(r); err == nil {
+				t.Errorf("%s: decoded %d of %d bytes as %v", name, i, len(golden), frame)
+			}
+		}
+
+		// As must a length too large for any frame.
+		oversized := append([]byte(nil), golden...)
+		copy(oversized[5:8], []byte{0xff, 0xff, 0xff})
+		r = bufio.NewReader(bytes.NewReader(oversized))
+		if frame, err := ReadFrame(r); err == nil {
+			t.Errorf("%s: decoded oversized frame as %v", name, frame)
+		}
+	}
+}
+
+// codec is implemented by every frame type.
+type codec interface {
+	common.Frame
+	Decode([]byte) error
+	Encode() ([]byte, error)
+}
+
+func TestDecodeEncode(t *testing.T) {
+	for _, test := range goldenFrames {
+		name := reflect.TypeOf(test.frame).Elem().Name()
+		golden := readGolden(t, test.file)
+		if test.header != 0 {
+			setRawHeader(test.frame, golden[test.header:])
+		}
+
+		out, err := test.frame.(codec).Encode()
+		if err != nil {
+			t.Errorf("%s: Encode: %v", name, err)
+		} else if !bytes.Equal(out, golden) {
+			t.Errorf("%s: encoded as\n\t%x\nexpected\n\t%x", name, out, golden)
+		}
+
+		frame := reflect.New(reflect.TypeOf(test.frame).Elem()).Interface().(codec)
+		if err := frame.Decode(golden); err != nil {
+			t.Errorf("%s: Decode: %v", name, err)
+		} else if !reflect.DeepEqual(frame, test.frame) {
+			t.Errorf("%s: decoded as\n%v\nexpected\n%v", name, frame, test.frame)
+		}
+
+		// Trailing data must be rejected.
+		if err := frame.Decode(append(golden, 0)); err == nil {
+			t.Errorf("%s: decoded frame with trailing data", name)
+		}
+	}
+}
+
+func TestDecodeZeroCopy(t *testing.T) {
+	golden := readGolden(t, "data.hex")
+	frame := new(DATA)
+	if err := frame.Decode(golden); err != nil {
+		t.Fatal(err)
+	}
+	if &frame.Data[0] != &golden[8] {
+		t.Error("DATA payload was copied")
+	}
+	if cap(frame.Data) != len(frame.Data) {
+		t.Errorf("DATA payload has capacity %d, expected %d", cap(frame.Data), len(frame.Data))
+	}
+}
+
+func TestFramer(t *testing.T) {
+	// Header blocks share a compression context,
+	// so they can only be read by the same Framer.
+	header := http.Header{"Method": {"GET"}, "Url": {"/"}, "Host": {"example.com"}}
+	sent := []common.Frame{
+		&SYN_STREAM{StreamID: 1, Priority: 1, Header: header},
+		&NOOP{},
+		&HEADERS{StreamID: 1, Header: header},
+		&DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("hello")},
+		&SYN_STREAM{StreamID: 3, Header: header},
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewFramer(buf)
+	for _, frame := range sent {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatalf("WriteFrame: %v", err)
+		}
+	}
+	w.Close()
+
+	r := NewFramer(buf)
+	for _, want := range sent {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if reflect.TypeOf(frame) != reflect.TypeOf(want) {
+			t.Fatalf("read %s, expected %s", frame.Name(), want.Name())
+		}
+		switch frame := frame.(type) {
+		case *SYN_STREAM:
+			sent := want.(*SYN_STREAM)
+			if frame.StreamID != sent.StreamID || frame.Priority != sent.Priority || !reflect.DeepEqual(frame.Header, header) {
+				t.Errorf("read\n%v\nexpected\n%v", frame, sent)
+			}
+		case *HEADERS:
+			if !reflect.DeepEqual(frame.Header, header) {
+				t.Errorf("read header %v", frame.Header)
+			}
+		default:
+			if !reflect.DeepEqual(frame, want) {
+				t.Errorf("read\n%v\nexpected\n%v", frame, want)
+			}
+		}
+	}
+	if frame, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v, %v", frame, err)
+	}
+
+	// Oversized frames are left unread.
+	golden := readGolden(t, "data.hex")
+	f := NewFramer(bytes.NewBuffer(golden))
+	f.MaxFrameSize = len(golden) - 1
+	if frame, err := f.ReadFrame(); err != common.FrameTooLarge {
+		t.Errorf("expected common.FrameTooLarge, got %v, %v", frame, err)
+	}
+}
+
+func TestSummaryAndJSON(t *testing.T) {
+	for _, test := range goldenFrames {
+		summary := test.frame.Summary()
+		if !strings.HasPrefix(summary, test.frame.Name()) || strings.Contains(summary, "\n") {
+			t.Errorf("%s: bad summary %q", test.frame.Name(), summary)
+		}
+
+		var out struct {
+			Type    string
+			Version int
+		}
+		data, err := json.Marshal(test.frame)
+		if err != nil {
+			t.Errorf("%s: MarshalJSON: %v", test.frame.Name(), err)
+		} else if err = json.Unmarshal(data, &out); err != nil || out.Type != test.frame.Name() || out.Version != 2 {
+			t.Errorf("%s: bad JSON %s (%v)", test.frame.Name(), data, err)
+		}
+	}
+
+	frame := &SYN_REPLY{Flags: common.FLAG_FIN, StreamID: 1}
+	if got, want := frame.Summary(), "SYN_REPLY stream=1 flags=FIN headers=0"; got != want {
+		t.Errorf("Expected summary %q, got %q", want, got)
+	}
+}
+
+func TestGoldenHeaders(t *testing.T) {
+	decom := common.NewDecompressor(2)
+	golden := readGolden(t, "syn_stream.hex")
+	frame, err := ReadFrame(bufio.NewReader(bytes.NewReader(golden)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := frame.Decompress(decom); err != nil {
+		t.Fatal(err)
+	}
+	header := frame.(*SYN_STREAM).Header
+	if header.Get("Method") != "GET" || header.Get("Url") != "/" || header.Get("Host") != "example.com" {
+		t.Errorf("Unexpected header %v", header)
+	}
+}
+
+// readGolden reads a frame's encoding from testdata. Lines
+// starting with # are comments, and whitespace is ignored.
+func readGolden(t *testing.T, file string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			digits = append(digits, strings.Fields(line)...)
+		}
+	}
+	out, err := hex.DecodeString(strings.Join(digits, ""))
+	if err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return out
+}
+
+func setRawHeader(frame common.Frame, header []byte) {
+	switch frame := frame.(type) {
+	case *SYN_STREAM:
+		frame.rawHeader = header
+	case *SYN_REPLY:
+		frame.rawHeader = header
+	case *HEADERS:
+		frame.rawHeader = header
+	}
+}
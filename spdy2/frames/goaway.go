@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -20,10 +21,30 @@ func (frame *GOAWAY) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *GOAWAY) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *GOAWAY) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *GOAWAY) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *GOAWAY) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type             string          `json:"type"`
+		Version          int             `json:"version"`
+		LastGoodStreamID common.StreamID `json:"last_good_stream_id"`
+	}{frame.Name(), 2, frame.LastGoodStreamID})
+}
+
 func (frame *GOAWAY) Name() string {
 	return "GOAWAY"
 }
@@ -65,6 +86,11 @@ func (frame *GOAWAY) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *GOAWAY) Summary() string {
+	return fmt.Sprintf("GOAWAY last=%d", frame.LastGoodStreamID)
+}
+
 func (frame *GOAWAY) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	if !frame.LastGoodStreamID.Valid() {
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +36,13 @@ func (frame *HEADERS) Compress(com common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *HEADERS) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *HEADERS) Decompress(decom common.Decompressor) error {
 	if frame.Header != nil {
 		return nil
@@ -50,13 +58,28 @@ func (frame *HEADERS) Decompress(decom common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *HEADERS) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *HEADERS) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string          `json:"type"`
+		Version  int             `json:"version"`
+		Flags    []string        `json:"flags"`
+		StreamID common.StreamID `json:"stream_id"`
+		Header   http.Header     `json:"header"`
+	}{frame.Name(), 2, flagNames(frame.Flags, flagFIN), frame.StreamID, frame.Header})
+}
+
 func (frame *HEADERS) Name() string {
 	return "HEADERS"
 }
 
 func (frame *HEADERS) ReadFrom(reader io.Reader) (int64, error) {
 	c := common.ReadCounter{R: reader}
-	data, err := common.ReadExactly(&c, 16)
+	data, err := common.ReadExactly(&c, 14)
 	if err != nil {
 		return c.N, err
 	}
@@ -75,7 +98,7 @@ func (frame *HEADERS) ReadFrom(reader io.Reader) (int64, error) {
 	}
 
 	// Read in data.
-	header, err := common.ReadExactly(&c, length-8)
+	header, err := common.ReadExactly(&c, length-6)
 	if err != nil {
 		return c.N, err
 	}
@@ -116,6 +139,12 @@ func (frame *HEADERS) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *HEADERS) Summary() string {
+	return fmt.Sprintf("HEADERS stream=%d%s headers=%d", frame.StreamID,
+		summaryFlags(flagNames(frame.Flags, flagFIN)), len(frame.Header))
+}
+
 func (frame *HEADERS) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	if frame.rawHeader == nil {
@@ -129,8 +158,8 @@ func (frame *HEADERS) WriteTo(writer io.Writer) (int64, error) {
 	}
 
 	header := frame.rawHeader
-	length := 4 + len(header)
-	out := make([]byte, 16)
+	length := 6 + len(header)
+	out := make([]byte, 14)
 
 	out[0] = 128                  // Control bit and Version
 	out[1] = 2                    // Version
@@ -144,6 +173,8 @@ func (frame *HEADERS) WriteTo(writer io.Writer) (int64, error) {
 	out[9] = frame.StreamID.B2()  // Stream ID
 	out[10] = frame.StreamID.B3() // Stream ID
 	out[11] = frame.StreamID.B4() // Stream ID
+	out[12] = 0                   // Unused
+	out[13] = 0                   // Unused
 
 	err := common.WriteExactly(&c, out)
 	if err != nil {
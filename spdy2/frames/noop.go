@@ -5,6 +5,7 @@
 package frames
 
 import (
+	"encoding/json"
 	"io"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -16,10 +17,29 @@ func (frame *NOOP) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *NOOP) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *NOOP) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *NOOP) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *NOOP) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+	}{frame.Name(), 2})
+}
+
 func (frame *NOOP) Name() string {
 	return "NOOP"
 }
@@ -49,6 +69,28 @@ func (frame *NOOP) String() string {
 	return "NOOP {\n\tVersion:              2\n}\n"
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *NOOP) Summary() string {
+	return "NOOP"
+}
+
 func (frame *NOOP) WriteTo(writer io.Writer) (int64, error) {
-	return 0, nil
+	c := common.WriteCounter{W: writer}
+	out := make([]byte, 8)
+
+	out[0] = 128 // Control bit and Version
+	out[1] = 2   // Version
+	out[2] = 0   // Type
+	out[3] = 5   // Type
+	out[4] = 0   // Flags
+	out[5] = 0   // Length
+	out[6] = 0   // Length
+	out[7] = 0   // Length
+
+	err := common.WriteExactly(&c, out)
+	if err != nil {
+		return c.N, err
+	}
+
+	return c.N, nil
 }
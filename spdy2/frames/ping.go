@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -20,10 +21,30 @@ func (frame *PING) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *PING) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *PING) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *PING) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *PING) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+		PingID  uint32 `json:"ping_id"`
+	}{frame.Name(), 2, frame.PingID})
+}
+
 func (frame *PING) Name() string {
 	return "PING"
 }
@@ -61,6 +82,11 @@ func (frame *PING) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *PING) Summary() string {
+	return fmt.Sprintf("PING id=%d", frame.PingID)
+}
+
 func (frame *PING) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	out := make([]byte, 12)
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -21,16 +22,34 @@ func (frame *RST_STREAM) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *RST_STREAM) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *RST_STREAM) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
 func (frame *RST_STREAM) Error() string {
-	if err := frame.Status.String(); err != "" {
-		return err
-	}
+	return frame.Status.String()
+}
 
-	return fmt.Sprintf("[unknown status code %d]", frame.Status)
+// Encode returns the frame's serialised form.
+func (frame *RST_STREAM) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *RST_STREAM) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type       string          `json:"type"`
+		Version    int             `json:"version"`
+		StreamID   common.StreamID `json:"stream_id"`
+		Status     string          `json:"status"`
+		StatusCode uint32          `json:"status_code"`
+	}{frame.Name(), 2, frame.StreamID, frame.Status.String(), uint32(frame.Status)})
 }
 
 func (frame *RST_STREAM) Name() string {
@@ -73,11 +92,16 @@ func (frame *RST_STREAM) String() string {
 	buf.WriteString("RST_STREAM {\n\t")
 	buf.WriteString(fmt.Sprintf("Version:              2\n\t"))
 	buf.WriteString(fmt.Sprintf("Stream ID:            %d\n\t", frame.StreamID))
-	buf.WriteString(fmt.Sprintf("Status code:          %s\n}\n", frame.Status))
+	buf.WriteString(fmt.Sprintf("Status code:          %s (%d)\n}\n", frame.Status, frame.Status))
 
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *RST_STREAM) Summary() string {
+	return fmt.Sprintf("RST_STREAM stream=%d status=%s", frame.StreamID, frame.Status)
+}
+
 func (frame *RST_STREAM) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	if !frame.StreamID.Valid() {
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -19,18 +20,39 @@ type SETTINGS struct {
 	Settings common.Settings
 }
 
-func (frame *SETTINGS) Add(Flags common.Flags, id uint32, value uint32) {
-	frame.Settings[id] = &common.Setting{Flags, id, value}
+func (frame *SETTINGS) Add(flags common.Flags, id common.SettingID, value uint32) {
+	frame.Settings[id] = &common.Setting{flags, id, value}
 }
 
 func (frame *SETTINGS) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *SETTINGS) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *SETTINGS) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *SETTINGS) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *SETTINGS) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string        `json:"type"`
+		Version  int           `json:"version"`
+		Flags    []string      `json:"flags"`
+		Settings []settingJSON `json:"settings"`
+	}{frame.Name(), 2, flagNames(frame.Flags, flagClearSettings), settingsJSON(frame.Settings)})
+}
+
 func (frame *SETTINGS) Name() string {
 	return "SETTINGS"
 }
@@ -106,6 +128,18 @@ func (frame *SETTINGS) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *SETTINGS) Summary() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("SETTINGS")
+	buf.WriteString(summaryFlags(flagNames(frame.Flags, flagClearSettings)))
+	for _, setting := range frame.Settings.Settings() {
+		buf.WriteString(fmt.Sprintf(" %s=%d", setting.ID, setting.Value))
+	}
+
+	return buf.String()
+}
+
 func (frame *SETTINGS) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	settings := encodeSettings(frame.Settings)
@@ -145,7 +179,7 @@ func decodeSetting(data []byte) *common.Setting {
 	}
 
 	setting := new(common.Setting)
-	setting.ID = common.BytesToUint24Reverse(data[0:]) // Might need to reverse this.
+	setting.ID = common.SettingID(common.BytesToUint24Reverse(data[0:])) // Might need to reverse this.
 	setting.Flags = common.Flags(data[3])
 	setting.Value = common.BytesToUint32(data[4:])
 
@@ -168,7 +202,7 @@ func encodeSettings(s common.Settings) []byte {
 
 	offset := 0
 	for _, id := range ids {
-		setting := s[uint32(id)]
+		setting := s[common.SettingID(id)]
 		out[offset] = byte(setting.ID)         // Might need to reverse this.
 		out[offset+1] = byte(setting.ID >> 8)  // Might need to reverse this.
 		out[offset+2] = byte(setting.ID >> 16) // Might need to reverse this.
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -37,6 +38,13 @@ func (frame *SYN_STREAM) Compress(com common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *SYN_STREAM) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *SYN_STREAM) Decompress(decom common.Decompressor) error {
 	if frame.Header != nil {
 		return nil
@@ -52,6 +60,24 @@ func (frame *SYN_STREAM) Decompress(decom common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *SYN_STREAM) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *SYN_STREAM) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type          string          `json:"type"`
+		Version       int             `json:"version"`
+		Flags         []string        `json:"flags"`
+		StreamID      common.StreamID `json:"stream_id"`
+		AssocStreamID common.StreamID `json:"assoc_stream_id"`
+		Priority      common.Priority `json:"priority"`
+		Header        http.Header     `json:"header"`
+	}{frame.Name(), 2, flagNames(frame.Flags, flagFIN, flagUnidirectional), frame.StreamID, frame.AssocStreamID,
+		frame.Priority, frame.Header})
+}
+
 func (frame *SYN_STREAM) Name() string {
 	return "SYN_STREAM"
 }
@@ -127,6 +153,13 @@ func (frame *SYN_STREAM) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *SYN_STREAM) Summary() string {
+	return fmt.Sprintf("SYN_STREAM stream=%d assoc=%d priority=%d%s headers=%d", frame.StreamID,
+		frame.AssocStreamID, frame.Priority, summaryFlags(flagNames(frame.Flags, flagFIN, flagUnidirectional)),
+		len(frame.Header))
+}
+
 func (frame *SYN_STREAM) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	if frame.rawHeader == nil {
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -22,10 +23,31 @@ func (frame *WINDOW_UPDATE) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *WINDOW_UPDATE) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *WINDOW_UPDATE) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *WINDOW_UPDATE) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *WINDOW_UPDATE) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type            string          `json:"type"`
+		Version         int             `json:"version"`
+		StreamID        common.StreamID `json:"stream_id"`
+		DeltaWindowSize uint32          `json:"delta_window_size"`
+	}{frame.Name(), 2, frame.StreamID, frame.DeltaWindowSize})
+}
+
 func (frame *WINDOW_UPDATE) Name() string {
 	return "WINDOW_UPDATE"
 }
@@ -75,6 +97,36 @@ func (frame *WINDOW_UPDATE) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *WINDOW_UPDATE) Summary() string {
+	return fmt.Sprintf("WINDOW_UPDATE stream=%d delta=%d", frame.StreamID, frame.DeltaWindowSize)
+}
+
 func (frame *WINDOW_UPDATE) WriteTo(writer io.Writer) (int64, error) {
-	return 0, nil
+	c := common.WriteCounter{W: writer}
+	out := make([]byte, 16)
+
+	out[0] = 128                                     // Control bit and Version
+	out[1] = 2                                       // Version
+	out[2] = 0                                       // Type
+	out[3] = 9                                       // Type
+	out[4] = 0                                       // Flags
+	out[5] = 0                                       // Length
+	out[6] = 0                                       // Length
+	out[7] = 8                                       // Length
+	out[8] = frame.StreamID.B1()                     // Stream ID
+	out[9] = frame.StreamID.B2()                     // Stream ID
+	out[10] = frame.StreamID.B3()                    // Stream ID
+	out[11] = frame.StreamID.B4()                    // Stream ID
+	out[12] = byte(frame.DeltaWindowSize>>24) & 0x7f // Delta Window Size
+	out[13] = byte(frame.DeltaWindowSize >> 16)      // Delta Window Size
+	out[14] = byte(frame.DeltaWindowSize >> 8)       // Delta Window Size
+	out[15] = byte(frame.DeltaWindowSize)            // Delta Window Size
+
+	err := common.WriteExactly(&c, out)
+	if err != nil {
+		return c.N, err
+	}
+
+	return c.N, nil
 }
@@ -3,6 +3,8 @@ package spdy2
 import (
 	"net"
 	"time"
+
+	"github.com/SlyMarbo/spdy/common"
 )
 
 func (c *Conn) CloseNotify() <-chan bool {
@@ -13,6 +15,47 @@ func (c *Conn) Conn() net.Conn {
 	return c.conn
 }
 
+// Idle indicates whether the connection has
+// no active streams.
+func (c *Conn) Idle() bool {
+	c.streamsLock.Lock()
+	idle := len(c.streams) == 0
+	c.streamsLock.Unlock()
+	return idle
+}
+
+// SetHeaderDictionary sets the zlib dictionary used to compress
+// the header blocks sent and received on the connection, in place
+// of the SPDY/2 dictionary, for experimentation with peers using
+// the same dictionary. A nil dictionary restores the default.
+// SetHeaderDictionary must be called before Run.
+func (c *Conn) SetHeaderDictionary(dict []byte) error {
+	return c.setCompression(c.compressionLevel, dict)
+}
+
+// SetCompressionLevel sets the zlib compression level used for
+// the header blocks sent on the connection, such as zlib.BestSpeed
+// or zlib.NoCompression, in place of common.CompressionLevel. The
+// compression state is only allocated once the first header block
+// is sent. SetCompressionLevel must be called before Run.
+func (c *Conn) SetCompressionLevel(level int) error {
+	return c.setCompression(level, c.headerDictionary)
+}
+
+// setCompression replaces the connection's compression
+// state with one using the given level and dictionary.
+func (c *Conn) setCompression(level int, dict []byte) error {
+	compressor, err := common.NewCompressorLevel(2, level, dict)
+	if err != nil {
+		return err
+	}
+	c.compressor = compressor
+	c.decompressor = common.NewDecompressorDict(2, dict)
+	c.compressionLevel = level
+	c.headerDictionary = dict
+	return nil
+}
+
 func (c *Conn) SetReadTimeout(d time.Duration) {
 	c.timeoutLock.Lock()
 	c.readTimeout = d
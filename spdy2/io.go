@@ -73,6 +73,16 @@ func (c *Conn) send() {
 		}
 	}()
 
+	// The send loop is the only writer to the
+	// network connection, so it keeps its own
+	// reference, which shutdown does not clear.
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
+	if conn == nil {
+		return
+	}
+
 	// Enter the processing loop.
 	i := 1
 	for {
@@ -108,7 +118,7 @@ func (c *Conn) send() {
 		// Leave the specifics of writing to the
 		// connection up to the frame.
 		c.refreshWriteTimeout()
-		_, err = frame.WriteTo(c.conn)
+		_, err = frame.WriteTo(c.capture.Writer(conn))
 		if err != nil {
 			c.handleReadWriteError(err)
 			return
@@ -37,25 +37,25 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 
 	case *frames.SETTINGS:
 		for _, setting := range frame.Settings {
-			c.receivedSettings[setting.ID] = setting
-			switch setting.ID {
-			case common.SETTINGS_INITIAL_WINDOW_SIZE:
-				c.initialWindowSizeLock.Lock()
-				c.initialWindowSize = setting.Value
-				c.initialWindowSizeLock.Unlock()
-
-			case common.SETTINGS_MAX_CONCURRENT_STREAMS:
-				if c.server == nil {
-					c.requestStreamLimit.SetLimit(setting.Value)
-				} else {
-					c.pushStreamLimit.SetLimit(setting.Value)
-				}
+			// Values a client returns with FLAG_SETTINGS_PERSISTED
+			// were sent by this server, so they are not the
+			// client's own settings.
+			if c.server != nil && setting.Flags.PERSISTED() {
+				continue
 			}
+			c.applySetting(setting)
+		}
+		if c.server == nil && c.PersistSettings != nil {
+			c.persistSettings(frame)
 		}
 
 	case *frames.NOOP:
 		// Ignore.
 
+	case *frames.UNKNOWN:
+		// Unrecognised control frames must be ignored.
+		debug.Printf("Ignoring control frame of unknown type %d.\n", frame.Type)
+
 	case *frames.PING:
 		// Check whether Ping ID is a response.
 		c.nextPingIDLock.Lock()
@@ -242,7 +242,7 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 		Header:     header,
 		Host:       url.Host,
 		RequestURI: url.RequestURI(),
-		TLS:        c.tlsState,
+		TLS:        c.connectionState(),
 	}
 
 	// Check whether the receiver wants this resource.
@@ -313,6 +313,7 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 	nextStream := c.newStream(frame)
 	// Make sure an error didn't occur when making the stream.
 	if nextStream == nil {
+		c.requestStreamLimit.Close()
 		return
 	}
 
@@ -353,7 +354,8 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 			return
 		}
 		fallthrough
-	case common.RST_STREAM_REFUSED_STREAM:
+	case common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_INTERNAL_ERROR:
 		if stream != nil {
 			go stream.Close()
 		}
@@ -418,3 +420,56 @@ func (c *Conn) handleSynReply(frame *frames.SYN_REPLY) {
 	// Stream ID is fine.
 	stream.ReceiveFrame(frame)
 }
+
+// applySetting applies a setting received from the
+// other endpoint.
+func (c *Conn) applySetting(setting *common.Setting) {
+	c.receivedSettings[setting.ID] = setting
+	switch setting.ID {
+	case common.SETTINGS_INITIAL_WINDOW_SIZE:
+		c.initialWindowSizeLock.Lock()
+		c.initialWindowSize = setting.Value
+		c.initialWindowSizeLock.Unlock()
+
+	case common.SETTINGS_MAX_CONCURRENT_STREAMS:
+		if c.server == nil {
+			c.requestStreamLimit.SetLimit(setting.Value)
+		} else {
+			c.pushStreamLimit.SetLimit(setting.Value)
+		}
+	}
+}
+
+// sendPersistedSettings applies the settings persisted from
+// an earlier session, and returns them to the server. They
+// are sent in their own frame, as they may share IDs with
+// the client's settings.
+func (c *Conn) sendPersistedSettings() {
+	if len(c.PersistedSettings) == 0 {
+		return
+	}
+
+	persisted := new(frames.SETTINGS)
+	persisted.Settings = make(common.Settings, len(c.PersistedSettings))
+	for id, setting := range c.PersistedSettings {
+		persisted.Add(common.FLAG_SETTINGS_PERSISTED, id, setting.Value)
+		c.applySetting(&common.Setting{ID: id, Value: setting.Value})
+	}
+	c.output[0] <- persisted
+}
+
+// persistSettings passes the settings which the server
+// asked to be persisted, or cleared, to the PersistSettings
+// hook.
+func (c *Conn) persistSettings(frame *frames.SETTINGS) {
+	persist := make(common.Settings)
+	for id, setting := range frame.Settings {
+		if setting.Flags.PERSIST_VALUE() {
+			persist[id] = &common.Setting{ID: id, Value: setting.Value}
+		}
+	}
+	clearing := frame.Flags.CLEAR_SETTINGS()
+	if clearing || len(persist) > 0 {
+		c.PersistSettings(clearing, persist)
+	}
+}
@@ -26,6 +26,7 @@ type PushStream struct {
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
+	sentHeader   common.HeaderSnapshot
 	stop         <-chan bool
 }
 
@@ -204,9 +205,9 @@ func (p *PushStream) writeHeader() {
 
 	header := new(frames.HEADERS)
 	header.StreamID = p.streamID
-	header.Header = common.CloneHeader(p.header)
-	for name := range header.Header {
-		p.header.Del(name)
+	header.Header = p.sentHeader.Changes(p.header)
+	if len(header.Header) == 0 {
+		return
 	}
 	p.output <- header
 }
@@ -29,6 +29,7 @@ type RequestStream struct {
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
+	sentHeader   common.HeaderSnapshot
 	headerChan   chan func()
 	responseCode int
 	stop         <-chan bool
@@ -260,11 +261,9 @@ func (s *RequestStream) writeHeader() {
 	// Create the HEADERS frame.
 	header := new(frames.HEADERS)
 	header.StreamID = s.streamID
-	header.Header = common.CloneHeader(s.header)
-
-	// Clear the headers that have been sent.
-	for name := range header.Header {
-		s.header.Del(name)
+	header.Header = s.sentHeader.Changes(s.header)
+	if len(header.Header) == 0 {
+		return
 	}
 
 	s.output <- header
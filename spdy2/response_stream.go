@@ -31,6 +31,7 @@ type ResponseStream struct {
 	request        *http.Request
 	handler        http.Handler
 	header         http.Header
+	sentHeader     common.HeaderSnapshot
 	priority       common.Priority
 	unidirectional bool
 	responseCode   int
@@ -135,18 +136,14 @@ func (s *ResponseStream) WriteHeader(code int) {
 
 	s.wroteHeader = true
 	s.responseCode = code
-	s.header.Set("status", strconv.Itoa(code))
-	s.header.Set("version", "HTTP/1.1")
 
-	// Create the response SYN_REPLY.
+	// Create the response SYN_REPLY from a
+	// snapshot of the headers.
 	synReply := new(frames.SYN_REPLY)
 	synReply.StreamID = s.streamID
-	synReply.Header = common.CloneHeader(s.header)
-
-	// Clear the headers that have been sent.
-	for name := range synReply.Header {
-		s.header.Del(name)
-	}
+	synReply.Header = s.sentHeader.Changes(s.header)
+	synReply.Header.Set("status", strconv.Itoa(code))
+	synReply.Header.Set("version", "HTTP/1.1")
 
 	// These responses have no body, so close the stream now.
 	if code == 204 || code == 304 || code/100 == 1 {
@@ -260,11 +257,19 @@ func (s *ResponseStream) Run() error {
 		}
 	}()
 
-	// Make sure Request is prepared.
-	if s.requestBody == nil || s.request.Body == nil {
+	// Make sure Request is prepared. The stream
+	// may have been closed with the connection.
+	s.Lock()
+	handler, request := s.handler, s.request
+	if handler == nil || request == nil {
+		s.Unlock()
+		return nil
+	}
+	if s.requestBody == nil || request.Body == nil {
 		s.requestBody = new(bytes.Buffer)
-		s.request.Body = &common.ReadCloser{s.requestBody}
+		request.Body = &common.ReadCloser{s.requestBody}
 	}
+	s.Unlock()
 
 	// Wait until the full request has been received.
 	<-s.ready
@@ -272,7 +277,7 @@ func (s *ResponseStream) Run() error {
 	/***************
 	 *** HANDLER ***
 	 ***************/
-	s.handler.ServeHTTP(s, s.request)
+	handler.ServeHTTP(s, request)
 
 	// Close the stream with a SYN_REPLY if
 	// none has been sent, or an empty DATA
@@ -282,11 +287,7 @@ func (s *ResponseStream) Run() error {
 	// this end, then nothing happens.
 	if !s.unidirectional {
 		if s.state.OpenHere() && !s.wroteHeader {
-			h := s.header
-			if h == nil {
-				h = make(http.Header)
-			}
-
+			h := s.sentHeader.Changes(s.header)
 			h.Set("status", "200")
 			h.Set("version", "HTTP/1.1")
 
@@ -327,7 +328,10 @@ func (s *ResponseStream) StreamID() common.StreamID {
 }
 
 func (s *ResponseStream) closed() bool {
-	if s.conn == nil || s.state == nil || s.handler == nil {
+	s.Lock()
+	handler := s.handler
+	s.Unlock()
+	if s.conn == nil || s.state == nil || handler == nil {
 		return true
 	}
 	select {
@@ -347,11 +351,9 @@ func (s *ResponseStream) writeHeader() {
 	// Create the HEADERS frame.
 	header := new(frames.HEADERS)
 	header.StreamID = s.streamID
-	header.Header = common.CloneHeader(s.header)
-
-	// Clear the headers that have been sent.
-	for name := range header.Header {
-		s.header.Del(name)
+	header.Header = s.sentHeader.Changes(s.header)
+	if len(header.Header) == 0 {
+		return
 	}
 
 	s.output <- header
@@ -6,6 +6,7 @@ package spdy3
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
@@ -22,35 +23,199 @@ import (
 // servers and clients, and is created with either NewServerConn,
 // or NewClientConn.
 type Conn struct {
-	PushReceiver common.Receiver // Receiver to call for server Pushes.
-	Subversion   int             // SPDY 3 subversion (eg 0 for SPDY/3, 1 for SPDY/3.1).
+	PushReceiver common.Receiver    // Receiver to call for server Pushes. If nil, as is PushHandler, pushes are refused.
+	PushHandler  common.PushHandler // Handler for server pushes. Takes precedence over PushReceiver.
+	Subversion   int                // SPDY 3 subversion (eg 0 for SPDY/3, 1 for SPDY/3.1).
+	PushPolicy   *common.PushPolicy // Policy for automatic server pushes. nil disables.
+
+	// SettingsHandler and GoawayHandler, if set, are called
+	// from the read loop when SETTINGS or GOAWAY frames are
+	// received, so they must not block.
+	SettingsHandler func(common.Settings)
+	GoawayHandler   func(lastGoodStreamID common.StreamID, status common.GoawayStatus)
+
+	// StarvationHandler, if set, is called from the send loop
+	// whenever the starvation watchdog sends a frame early, with
+	// the frame's priority and the time for which its priority
+	// class had made no progress. It must not block.
+	StarvationHandler func(priority common.Priority, stalled time.Duration)
+
+	// ExpectContinueTimeout is the longest that a request
+	// sent with Expect: 100-continue waits for the server's
+	// 100 Continue before its body is sent anyway. If zero,
+	// the body is held until the server responds. It is
+	// initialised to common.ExpectContinueTimeout.
+	ExpectContinueTimeout time.Duration
+
+	// UnidirectionalHandler, if set, serves client requests
+	// sent with FLAG_UNIDIRECTIONAL, in place of the server's
+	// Handler. Otherwise, if RejectUnidirectional is true,
+	// they are refused with a PROTOCOL_ERROR. Either way, no
+	// response can be sent on them. RejectUnidirectional is
+	// initialised to common.RejectUnidirectional.
+	UnidirectionalHandler http.Handler
+	RejectUnidirectional  bool
+
+	// BufferRequestBodies determines whether request bodies of
+	// known length are buffered in full before their handlers
+	// are called. Otherwise, handlers are called as soon as the
+	// headers arrive, and read bodies as they are received,
+	// with the receive window growing as they are read. It is
+	// initialised to common.BufferRequestBodies.
+	BufferRequestBodies bool
+
+	// HandleEarly, if set, decides for each request with a body
+	// whether its handler is called as soon as the headers
+	// arrive, or only once the request is complete, in place of
+	// BufferRequestBodies. This lets long polls and streamed
+	// uploads start at once while other bodies are buffered.
+	// CONNECT requests and those sent with Expect: 100-continue
+	// are always handled early. It is initialised to
+	// common.HandleEarly.
+	HandleEarly func(request *http.Request) bool
+
+	// BodySpillThreshold, if positive, is the size beyond which
+	// request bodies buffered for handlers are spilled to
+	// temporary files in BodySpillDir, or os.TempDir if it is
+	// empty. They are initialised to common.BodySpillThreshold
+	// and common.BodySpillDir.
+	BodySpillThreshold int64
+	BodySpillDir       string
+
+	// MaxRequestBodyBytes, if positive, limits the size of each
+	// request body, as described for common.MaxRequestBodyBytes,
+	// to which it is initialised. It must be set before Run.
+	MaxRequestBodyBytes int64
+
+	// CompressResponses determines whether response bodies
+	// are compressed, as described for common.CompressResponses,
+	// to which it is initialised. It must be set before Run.
+	CompressResponses bool
+
+	// CacheDigest, if set, is used to cancel pushes of
+	// resources which the client has cached, as described
+	// for common.PushCacheDigest, to which it is initialised.
+	CacheDigest *common.CacheDigest
+
+	// FlowStallThreshold and FlowStallTimeout determine when a
+	// stream blocked by flow control is reported and reset, as
+	// described for common.FlowStallThreshold and
+	// common.FlowStallTimeout, to which they are initialised.
+	FlowStallThreshold time.Duration
+	FlowStallTimeout   time.Duration
+
+	// WindowUpdateThreshold determines how much receive window
+	// growth is sent in each WINDOW_UPDATE, as described for
+	// common.WindowUpdateThreshold, to which it is initialised.
+	// It must be set before Run.
+	WindowUpdateThreshold float64
+
+	// ServerTiming determines how the timing of each response
+	// is reported, as described for common.ServerTiming, to
+	// which it is initialised. It must be set before Run.
+	ServerTiming common.ServerTimingMode
+
+	// PanicHandler, if set, is called when a handler panics,
+	// with the request, the value passed to panic and the stack
+	// trace. Otherwise, panics are logged. It is initialised to
+	// common.PanicHandler.
+	PanicHandler func(request *http.Request, v interface{}, stack []byte)
+
+	// AccessControl, if set, is called for each request received,
+	// with the client's verified certificate, if any, and the
+	// stream is denied if it returns an error. It is initialised
+	// to common.AccessControl.
+	AccessControl func(identity *x509.Certificate, request *http.Request) error
+
+	// ValidationMode determines the response to violations of
+	// the specification which could be tolerated. It is
+	// initialised to common.Validation.
+	ValidationMode common.ValidationMode
+
+	// ErrorHandler, if set, is called when the peer violates
+	// the protocol, with the error and the offending frame, if
+	// one was read, and chooses how the connection is ended. It is initialised to common.ErrorHandler.
+	ErrorHandler func(err error, frame common.Frame) common.ErrorAction
+
+	// BodyDrainLimit is the number of bytes read and discarded
+	// from a push given to PushHandler whose body is closed
+	// before it has been read fully, so that it can finish
+	// rather than being cancelled. It is initialised to
+	// common.BodyDrainLimit.
+	BodyDrainLimit int64
+
+	// PushBufferLimit is the number of bytes buffered unread
+	// from a push given to PushHandler, beyond which the push
+	// is cancelled. It is initialised to common.PushBufferLimit.
+	PushBufferLimit int64
+
+	// LogHeaderBlockSize, if positive, causes each header block
+	// sent or received whose names and values exceed this many
+	// bytes to be logged, with its stream ID. It is initialised
+	// to common.LogHeaderBlockSize.
+	LogHeaderBlockSize int
+
+	// ConnState, if set, is called as the connection becomes
+	// active or idle, and once a GOAWAY has been sent or
+	// received, with the state http.StateActive, StateIdle or
+	// common.StateGoAway. The connection is active while it
+	// has any open streams. StateNew and StateClosed are left
+	// to whoever accepted the connection, as by http.Server
+	// when it hands the connection over with TLSNextProto. It
+	// is initialised to the server's ConnState hook.
+	ConnState func(net.Conn, http.ConnState)
+
+	// PersistedSettings, if set on a client connection, holds
+	// the settings which the server asked to be persisted in
+	// an earlier session. They are applied as the connection
+	// starts, and returned to the server, flagged
+	// FLAG_SETTINGS_PERSISTED, after the client's own settings.
+	PersistedSettings common.Settings
+
+	// PersistSettings, if set on a client connection, is called
+	// when SETTINGS are received with FLAG_SETTINGS_CLEAR_SETTINGS,
+	// or with values flagged FLAG_SETTINGS_PERSIST_VALUE. If clear
+	// is true, any settings persisted previously must be discarded,
+	// and then the values in persist replace any persisted with the
+	// same IDs. It is called from the read loop, so it must not
+	// block.
+	PersistSettings func(clear bool, persist common.Settings)
 
 	// SPDY/3.1
-	connectionWindowLock      sync.Mutex
-	dataBuffer                []*frames.DATA // used to store frames witheld for flow control.
+	connectionWindowLock      sync.Mutex     // protects connectionWindowSize, connectionWindowSizeThere, connectionWindowPending and connectionWindowStalled.
+	dataBuffer                []common.Frame // used to store frames witheld for flow control.
 	connectionWindowSize      int64
+	connectionWindowGrown     chan struct{} // signalled when the connection window grows.
 	initialWindowSizeThere    uint32
 	connectionWindowSizeThere int64
+	connectionWindowPending   int64 // receive window growth not yet sent in a WINDOW_UPDATE.
+	connectionWindowStalled   bool  // the receive window was not regrown, to keep within the memory budget.
 
 	// network state
 	remoteAddr  string
-	server      *http.Server                      // nil if client connection.
-	conn        net.Conn                          // underlying network (TLS) connection.
-	connLock    sync.Mutex                        // protects the interface value of the above conn.
-	buf         *bufio.Reader                     // buffered reader on conn.
-	tlsState    *tls.ConnectionState              // underlying TLS connection state.
-	streams     map[common.StreamID]common.Stream // map of active streams.
-	streamsLock sync.Mutex                        // protects streams.
-	output      [8]chan common.Frame              // one output channel per priority level.
+	server      *http.Server         // nil if client connection.
+	conn        net.Conn             // underlying network (TLS) connection.
+	connLock    sync.Mutex           // protects the interface value of the above conn.
+	buf         *bufio.Reader        // buffered reader on conn.
+	readCounter *common.ReadCounter  // counts bytes read from conn.
+	capture     *common.CaptureConn  // records traffic, or nil.
+	tlsState    *tls.ConnectionState // underlying TLS connection state.
+	streams     streamRegistry       // active streams.
+	output      [8]chan common.Frame // one output channel per priority level, never closed.
 
 	// other state
 	compressor       common.Compressor              // outbound compression state.
 	decompressor     common.Decompressor            // inbound decompression state.
+	compressionLevel int                            // zlib level used by compressor.
+	headerDictionary []byte                         // custom zlib dictionary, or nil.
 	receivedSettings common.Settings                // settings sent by client.
+	sentSettings     common.Settings                // settings sent to client.
+	settingsLock     sync.Mutex                     // protects receivedSettings and sentSettings.
 	goawayReceived   bool                           // goaway has been received.
 	goawaySent       bool                           // goaway has been sent.
 	goawayLock       sync.Mutex                     // protects goawaySent and goawayReceived.
 	numBenignErrors  int                            // number of non-serious errors encountered.
+	reading          common.Frame                   // frame being processed, used only by readFrames.
 	readTimeout      time.Duration                  // optional timeout for network reads.
 	writeTimeout     time.Duration                  // optional timeout for network writes.
 	timeoutLock      sync.Mutex                     // protects changes to readTimeout and writeTimeout.
@@ -58,17 +223,44 @@ type Conn struct {
 	certificates     map[uint16][]*x509.Certificate // certificates from CREDENTIALs and TLS handshake.
 	flowControl      common.FlowControl             // flow control module.
 	flowControlLock  sync.Mutex                     // protects flowControl.
+	fair             *fairScheduler                 // optional fair scheduling, used only by send.
+	starvation       *starvationWatchdog            // optional starvation watchdog, used only by send.
+	stats            *common.StatsCounter           // connection statistics.
+	events           *common.EventLog               // recent frames, or nil.
+	maxFrameSize     int                            // largest frame accepted.
+	dataChunkSize    int                            // largest DATA payload sent.
+	writeBatchSize   int                            // largest batch of frames written at once.
+	writer           *batchWriter                   // batches frames, used only by send.
+	workers          *common.WorkerPool             // optional pool running the streams' handlers.
+	memory           *common.MemoryAccount          // optional budget for buffered data.
+	dataChecksums    bool                           // whether DATA checksums are offered.
+	checksums        bool                           // whether DATA checksums have been negotiated.
+	checksumsLock    sync.Mutex                     // protects checksums.
+	connRateLimit    *common.RateLimiter            // optional limit on DATA sent by the connection.
+	streamRateLimit  int64                          // optional limit on DATA sent by each stream.
+	rateLimitLock    sync.Mutex                     // protects connRateLimit and streamRateLimit.
+	peerStreamID     common.StreamID                // highest stream ID opened by the other endpoint.
+	misusedStreamID  common.StreamID                // highest stream ID of this endpoint's parity opened by the other endpoint.
+	peerStreamIDLock sync.Mutex                     // protects peerStreamID and misusedStreamID.
+	connState        http.ConnState                 // last state given to the ConnState hook.
+	connStateGoaway  bool                           // whether StateGoAway has been reported.
+	connStateDone    bool                           // whether the connection is closing, ending reports.
+	connStateLock    sync.Mutex                     // protects the above, and serialises reports.
 
 	// SPDY features
-	pings                map[uint32]chan<- bool                // response channel for pings.
-	pingsLock            sync.Mutex                            // protects pings.
-	nextPingID           uint32                                // next outbound ping ID.
-	nextPingIDLock       sync.Mutex                            // protects nextPingID.
-	pushStreamLimit      *common.StreamLimit                   // Limit on streams started by the server.
-	pushRequests         map[common.StreamID]*http.Request     // map of requests sent in server pushes.
-	lastPushStreamID     common.StreamID                       // last push stream ID. (even)
-	lastPushStreamIDLock sync.Mutex                            // protects lastPushStreamID.
-	pushedResources      map[common.Stream]map[string]struct{} // prevents duplicate headers being pushed.
+	pings                map[uint32]chan<- bool                           // response channel for pings.
+	pingsLock            sync.Mutex                                       // protects pings.
+	nextPingID           uint32                                           // next outbound ping ID.
+	nextPingIDLock       sync.Mutex                                       // protects nextPingID.
+	pushStreamLimit      *common.StreamLimit                              // Limit on streams started by the server.
+	pushRequests         map[common.StreamID]*http.Request                // map of requests sent in server pushes.
+	pushResponses        map[common.StreamID]*common.PushedResponse       // map of pushes given to the PushHandler.
+	pushResponsesLock    sync.Mutex                                       // protects pushResponses.
+	lastPushStreamID     common.StreamID                                  // last push stream ID. (even)
+	lastPushStreamIDLock sync.Mutex                                       // protects lastPushStreamID.
+	pushedResources      map[common.Stream]map[string]struct{}            // prevents duplicate headers being pushed.
+	pushedStreams        map[common.StreamID]map[common.StreamID]struct{} // open push streams by associated stream.
+	pushedStreamsLock    sync.Mutex                                       // protects pushedStreams.
 
 	// requests
 	lastRequestStreamID     common.StreamID     // last request stream ID. (odd)
@@ -96,12 +288,15 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 	out.remoteAddr = conn.RemoteAddr().String()
 	out.server = server
 	out.conn = conn
-	out.buf = bufio.NewReader(conn)
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	out.capture = common.FrameCapture.Conn(conn.LocalAddr(), conn.RemoteAddr())
+	out.readCounter = &common.ReadCounter{R: out.capture.Reader(conn)}
+	out.buf = bufio.NewReader(out.readCounter)
+	if tlsConn, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
 		out.tlsState = new(tls.ConnectionState)
 		*out.tlsState = tlsConn.ConnectionState()
 	}
-	out.streams = make(map[common.StreamID]common.Stream)
 	out.output[0] = make(chan common.Frame)
 	out.output[1] = make(chan common.Frame)
 	out.output[2] = make(chan common.Frame)
@@ -112,12 +307,54 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 	out.output[7] = make(chan common.Frame)
 	out.pings = make(map[uint32]chan<- bool)
 	out.compressor = common.NewCompressor(3)
+	out.compressionLevel = common.CompressionLevel
 	out.decompressor = common.NewDecompressor(3)
 	out.receivedSettings = make(common.Settings)
+	out.sentSettings = make(common.Settings)
 	out.lastPushStreamID = 0
 	out.lastRequestStreamID = 0
 	out.stop = make(chan bool)
+	out.connectionWindowGrown = make(chan struct{}, 1)
 	out.Subversion = subversion
+	out.stats = common.NewStatsCounter()
+	out.events = common.NewEventLog(common.EventHistory)
+	out.maxFrameSize = common.MaxFrameSize
+	out.dataChunkSize = common.DataChunkSize
+	out.writeBatchSize = common.WriteBatchSize
+	out.workers = common.NewWorkerPool(common.ConnWorkers, common.Workers)
+	out.memory = common.NewMemoryAccount(common.MemoryBudget, out.resumeWindows)
+	out.dataChecksums = common.DataChecksums
+	out.connRateLimit = common.NewRateLimiter(common.ConnectionRateLimit, 0)
+	out.streamRateLimit = common.StreamRateLimit
+	out.ExpectContinueTimeout = common.ExpectContinueTimeout
+	out.RejectUnidirectional = common.RejectUnidirectional
+	out.BufferRequestBodies = common.BufferRequestBodies
+	out.BodyDrainLimit = common.BodyDrainLimit
+	out.PushBufferLimit = common.PushBufferLimit
+	out.MaxRequestBodyBytes = common.MaxRequestBodyBytes
+	out.CompressResponses = common.CompressResponses
+	out.CacheDigest = common.PushCacheDigest
+	out.ServerTiming = common.ServerTiming
+	out.FlowStallThreshold = common.FlowStallThreshold
+	out.FlowStallTimeout = common.FlowStallTimeout
+	out.WindowUpdateThreshold = common.WindowUpdateThreshold
+	out.PanicHandler = common.PanicHandler
+	out.AccessControl = common.AccessControl
+	out.ErrorHandler = common.ErrorHandler
+	out.streams.grace = common.ClosedStreamGrace
+	out.ValidationMode = common.Validation
+	out.HandleEarly = common.HandleEarly
+	out.BodySpillThreshold = common.BodySpillThreshold
+	out.LogHeaderBlockSize = common.LogHeaderBlockSize
+	out.BodySpillDir = common.BodySpillDir
+	if common.RoundRobinQuantum > 0 {
+		out.fair = newRoundRobinScheduler(common.RoundRobinQuantum)
+	} else if common.FairnessWindow > 0 {
+		out.fair = newFairScheduler(common.FairnessWindow)
+	}
+	if common.StarvationBound > 0 {
+		out.starvation = newStarvationWatchdog(common.StarvationBound)
+	}
 
 	// Server/client specific.
 	if server != nil { // servers
@@ -131,8 +368,12 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 			// Initialise the connection by sending the connection settings.
 			settings := new(frames.SETTINGS)
 			settings.Settings = defaultServerSettings(common.DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			if out.dataChecksums {
+				settings.Add(0, common.SETTINGS_DATA_CHECKSUM, 1)
+			}
+			out.sendSettings(settings)
 		}
+		out.ConnState = server.ConnState
 		if d := server.ReadTimeout; d != 0 {
 			out.SetReadTimeout(d)
 		}
@@ -141,6 +382,7 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 		}
 		out.flowControl = DefaultFlowControl(common.DEFAULT_INITIAL_WINDOW_SIZE)
 		out.pushedResources = make(map[common.Stream]map[string]struct{})
+		out.pushedStreams = make(map[common.StreamID]map[common.StreamID]struct{})
 
 		if subversion == 0 {
 			out.certificates = make(map[uint16][]*x509.Certificate, 8)
@@ -158,11 +400,16 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 		out.requestStreamLimit = common.NewStreamLimit(common.NO_STREAM_LIMIT)
 		out.pushStreamLimit = common.NewStreamLimit(common.DEFAULT_STREAM_LIMIT)
 		out.pushRequests = make(map[common.StreamID]*http.Request)
+		out.pushResponses = make(map[common.StreamID]*common.PushedResponse)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(frames.SETTINGS)
 			settings.Settings = defaultClientSettings(common.DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			if out.dataChecksums {
+				settings.Add(0, common.SETTINGS_DATA_CHECKSUM, 1)
+			}
+			out.sendSettings(settings)
+			out.sendPersistedSettings()
 		}
 		out.flowControl = DefaultFlowControl(common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE)
 
@@ -192,6 +439,8 @@ func NextProto1(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
 
 func (c *Conn) Run() error {
 	defer common.Recover()
+	common.RegisterConn(c)
+	defer common.UnregisterConn(c)
 	go c.send()        // Start the send loop.
 	if c.init != nil { // Must be after sending is enabled.
 		c.init() // Prepare any initialisation frames.
@@ -201,46 +450,107 @@ func (c *Conn) Run() error {
 	return nil
 }
 
+// requestErrorReasons explains the errors returned by
+// common.RequestFromHeader in rejection responses.
+var requestErrorReasons = map[error]string{
+	common.ErrMissingPseudoHeader:  "Missing request pseudo-header.",
+	common.ErrConnectionHeader:     "Connection-specific header in request.",
+	common.ErrInvalidHTTPVersion:   "Invalid HTTP version.",
+	common.ErrInvalidRequestURL:    "Invalid request URL.",
+	common.ErrInvalidContentLength: "Invalid Content-Length.",
+}
+
+// connectionState returns the state of the underlying TLS
+// connection, or nil if there is none. If the handshake had
+// not completed when the connection was created, the state
+// is taken again. It is only called from the read loop.
+func (c *Conn) connectionState() *tls.ConnectionState {
+	if c.tlsState == nil || c.tlsState.HandshakeComplete {
+		return c.tlsState
+	}
+	if tlsConn, ok := c.Conn().(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		state := tlsConn.ConnectionState()
+		c.tlsState = &state
+	}
+	return c.tlsState
+}
+
 // newStream is used to create a new serverStream from a SYN_STREAM frame.
 func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 	header := frame.Header
-	rawUrl := header.Get(":scheme") + "://" + header.Get(":host") + header.Get(":path")
 
-	url, err := url.Parse(rawUrl)
-	if c.check(err != nil, "Received SYN_STREAM with invalid request URL (%v)", err) {
+	// Build this into a request to present to the Handler.
+	request, err := common.RequestFromHeader(header)
+	if c.check(err != nil, "Received SYN_STREAM with invalid request: %v", err) {
+		status, reason := http.StatusBadRequest, requestErrorReasons[err]
+		if err == common.ErrInvalidHTTPVersion {
+			status = http.StatusHTTPVersionNotSupported
+		}
+		c.reject(frame.StreamID, status, reason, common.RST_STREAM_PROTOCOL_ERROR)
 		return nil
 	}
 
-	vers := header.Get(":version")
-	major, minor, ok := http.ParseHTTPVersion(vers)
-	if c.check(!ok, "Invalid HTTP version: "+vers) {
+	// A request without a body must not declare one.
+	if frame.Flags.FIN() {
+		if c.check(request.ContentLength > 0, "Received SYN_STREAM with FLAG_FIN and Content-Length %d", request.ContentLength) {
+			c.reject(frame.StreamID, http.StatusBadRequest, "Request body shorter than Content-Length.", common.RST_STREAM_PROTOCOL_ERROR)
+			return nil
+		}
+		request.ContentLength = 0
+	}
+
+	// A request declaring too large a body is refused
+	// before any of it is received.
+	if c.MaxRequestBodyBytes > 0 && request.ContentLength > c.MaxRequestBodyBytes {
+		debug.Printf("Refusing stream %d, as its %d-byte body exceeds the limit.\n", frame.StreamID, request.ContentLength)
+		c.refuseBody(frame.StreamID, true)
 		return nil
 	}
 
-	method := header.Get(":method")
+	// Its context is cancelled when the stream ends.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	request.RemoteAddr = c.remoteAddr
+	request.TLS = c.connectionState()
+	request = request.WithContext(ctx)
 
-	// Build this into a request to present to the Handler.
-	request := &http.Request{
-		Method:     method,
-		URL:        url,
-		Proto:      vers,
-		ProtoMajor: major,
-		ProtoMinor: minor,
-		RemoteAddr: c.remoteAddr,
-		Header:     header,
-		Host:       url.Host,
-		RequestURI: url.RequestURI(),
-		TLS:        c.tlsState,
+	// A CONNECT request names only its target, as in net/http.
+	// Extended CONNECTs, such as WebSockets, keep their path.
+	if request.Method == "CONNECT" && header.Get(":protocol") == "" {
+		request.URL = &url.URL{Host: request.Host}
+		request.RequestURI = request.Host
+	}
+
+	if c.AccessControl != nil {
+		if err := c.AccessControl(common.ClientCertificate(request.TLS), request); err != nil {
+			log.Printf("Denied request for %q from %s: %v\n", request.URL, c.remoteAddr, err)
+			cancel(err)
+			c.reject(frame.StreamID, http.StatusForbidden, "Access denied.", common.RST_STREAM_CANCEL)
+			return nil
+		}
+	}
+
+	handler := c.server.Handler
+	if frame.Flags.UNIDIRECTIONAL() && c.UnidirectionalHandler != nil {
+		handler = c.UnidirectionalHandler
 	}
 
 	output := c.output[frame.Priority]
 	c.streamCreation.Lock()
-	out := NewResponseStream(c, frame, output, c.server.Handler, request)
+	out := NewResponseStream(c, frame, output, handler, request)
 	c.streamCreation.Unlock()
+	out.cancel = cancel
 	c.flowControlLock.Lock()
 	f := c.flowControl
 	c.flowControlLock.Unlock()
 	out.AddFlowControl(f)
+	out.flow.maxReceive = c.MaxRequestBodyBytes
+
+	// The body received must match any Content-Length.
+	if request.ContentLength >= 0 && !frame.Flags.FIN() {
+		c.streams.expectLength(frame.StreamID, request.ContentLength)
+	}
 
 	return out
 }
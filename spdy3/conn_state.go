@@ -0,0 +1,69 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"net/http"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// updateState reports to the ConnState hook whether the
+// connection is active or idle, if that has changed. The
+// state is read from the stream table while the report is
+// made, so concurrent changes are reported in order. The
+// caller must not hold the stream registry's lock.
+func (c *Conn) updateState() {
+	if c.ConnState == nil {
+		return
+	}
+
+	c.connStateLock.Lock()
+	defer c.connStateLock.Unlock()
+	state := http.StateActive
+	if c.Idle() {
+		state = http.StateIdle
+	}
+	if state != c.connState && c.reportState(state) {
+		c.connState = state
+	}
+}
+
+// reportGoaway reports to the ConnState hook that a
+// GOAWAY has been sent or received, if it has not already.
+func (c *Conn) reportGoaway() {
+	if c.ConnState == nil {
+		return
+	}
+
+	c.connStateLock.Lock()
+	defer c.connStateLock.Unlock()
+	if !c.connStateGoaway && c.reportState(common.StateGoAway) {
+		c.connStateGoaway = true
+	}
+}
+
+// endStates ends the reports to the ConnState hook, as
+// the connection is closing.
+func (c *Conn) endStates() {
+	c.connStateLock.Lock()
+	c.connStateDone = true
+	c.connStateLock.Unlock()
+}
+
+// reportState calls the ConnState hook, unless the
+// connection is closing, and reports whether it did.
+// The caller must hold connStateLock.
+func (c *Conn) reportState(state http.ConnState) bool {
+	if c.connStateDone {
+		return false
+	}
+	conn := c.Conn()
+	if conn == nil {
+		return false
+	}
+	c.ConnState(conn, state)
+	return true
+}
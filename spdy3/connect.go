@@ -0,0 +1,63 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ServeConnect serves a CONNECT request as a forward proxy. The
+// target named by the request's host is dialled with dial, or
+// net.Dial if dial is nil, and the stream's DATA then carries the
+// tunnelled bytes in both directions, subject to flow control. If
+// the target cannot be reached, the request is refused with a 502
+// status and the error returned.
+//
+// Each direction is half-closed as it ends, and ServeConnect
+// returns once both have ended.
+func (s *ResponseStream) ServeConnect(dial func(network, address string) (net.Conn, error)) error {
+	if s.closed() || s.wroteHeader {
+		return errors.New("Error: Response headers already written.")
+	}
+
+	if s.request.Method != "CONNECT" || IsWebSocketRequest(s.request) {
+		return errors.New("Error: Not a CONNECT request.")
+	}
+
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	target, err := dial("tcp", s.request.Host)
+	if err != nil {
+		s.WriteHeader(http.StatusBadGateway)
+		return err
+	}
+	defer target.Close()
+
+	conn := s.NetConn().(*StreamConn)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, conn)
+		if half, ok := target.(interface {
+			CloseWrite() error
+		}); ok {
+			half.CloseWrite()
+		} else {
+			target.Close()
+		}
+		close(done)
+	}()
+
+	io.Copy(conn, target)
+	conn.CloseWrite()
+	<-done
+	return nil
+}
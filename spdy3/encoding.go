@@ -0,0 +1,87 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// minEncodedLength is the Content-Length below which
+// a response body is not worth compressing.
+const minEncodedLength = 256
+
+// bodyEncoder compresses a response body.
+type bodyEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodedBody receives the output of a stream's
+// encoder, and sends it as the response body.
+type encodedBody struct {
+	stream *ResponseStream
+}
+
+func (b encodedBody) Write(data []byte) (int, error) {
+	return b.stream.writeData(data, false)
+}
+
+// startEncoding decides whether the response body is
+// compressed, from the request's Accept-Encoding and the
+// response's headers. If the handler has not set the
+// Content-Type, it is sniffed from the start of the body,
+// which is nil if nothing has been written. The caller
+// must hold headerLock.
+func (s *ResponseStream) startEncoding(code int, body []byte) {
+	if s.acceptEncoding == "" || s.head || s.unidirectional || code == http.StatusPartialContent {
+		return
+	}
+	if s.header.Get("Content-Encoding") != "" || s.header.Get("Content-Range") != "" {
+		return
+	}
+	if length, err := common.ContentLength(s.header); err != nil || (length >= 0 && length < minEncodedLength) {
+		return
+	}
+
+	contentType := s.header.Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+	}
+	if !common.Compressible(contentType) {
+		return
+	}
+
+	var err error
+	switch encoding := common.ResponseEncoding(s.acceptEncoding); encoding {
+	case "gzip":
+		s.encoder, err = gzip.NewWriterLevel(encodedBody{s}, common.ResponseCompressionLevel)
+		s.encoding = encoding
+	case "deflate":
+		s.encoder, err = zlib.NewWriterLevel(encodedBody{s}, common.ResponseCompressionLevel)
+		s.encoding = encoding
+	}
+	if err != nil {
+		debug.Println(err)
+		s.encoder = nil
+		s.encoding = ""
+	}
+}
+
+// finishEncoding sends the remainder of a compressed
+// body, so that it ends before the stream is closed.
+func (s *ResponseStream) finishEncoding() {
+	if s.encoder == nil {
+		return
+	}
+	if err := s.encoder.Close(); err != nil {
+		debug.Println(err)
+	}
+	s.encoder = nil
+}
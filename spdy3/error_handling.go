@@ -1,8 +1,11 @@
 package spdy3
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -26,8 +29,9 @@ func (c *Conn) criticalCheck(condition bool, sid common.StreamID, format string,
 	if !condition {
 		return false
 	}
-	log.Printf("Error: "+format+".\n", v...)
-	c.protocolError(sid)
+	err := fmt.Errorf("Error: "+format+".", v...)
+	log.Println(err)
+	c.protocolError(sid, err)
 	return true
 }
 
@@ -35,22 +39,204 @@ func (c *Conn) _RST_STREAM(streamID common.StreamID, status common.StatusCode) {
 	rst := new(frames.RST_STREAM)
 	rst.StreamID = streamID
 	rst.Status = status
-	c.output[0] <- rst
+	select {
+	case c.output[0] <- rst:
+	case <-c.stop:
+	}
+	c.streams.reset(streamID)
+
+	if c.server != nil {
+		c.resetPushedStreams(streamID)
+	}
+}
+
+// validResetStatus indicates whether status can be used
+// to reset a single stream. Fatal status codes end the
+// whole connection, so are not allowed.
+func validResetStatus(status common.StatusCode) bool {
+	valid := status >= common.RST_STREAM_PROTOCOL_ERROR && status <= common.RST_STREAM_FRAME_TOO_LARGE
+	return valid && !status.IsFatal()
+}
+
+// reject refuses a stream before its handler has run. If
+// common.RejectionResponses is set, a minimal response is
+// sent with the given HTTP status and reason. Otherwise, or
+// if the response cannot be produced, a RST_STREAM with the
+// given status code is sent. The stream has no flow control,
+// so the response is only sent if its body fits within the
+// peer's initial transfer window.
+func (c *Conn) reject(streamID common.StreamID, status int, reason string, rstStatus common.StatusCode) {
+	if !common.RejectionResponses {
+		c._RST_STREAM(streamID, rstStatus)
+		return
+	}
+
+	body, err := common.NewRejection(status, reason).Body()
+	if err != nil {
+		log.Printf("Error: Failed to render rejection response: %v\n", err)
+		c._RST_STREAM(streamID, rstStatus)
+		return
+	}
+
+	c.initialWindowSizeLock.Lock()
+	window := c.initialWindowSize
+	c.initialWindowSizeLock.Unlock()
+	if uint64(len(body)) > uint64(window) {
+		debug.Printf("Rejection response of %d bytes exceeds the transfer window of %d bytes.\n", len(body), window)
+		c._RST_STREAM(streamID, rstStatus)
+		return
+	}
+
+	reply := new(frames.SYN_REPLY)
+	reply.StreamID = streamID
+	reply.Header = make(http.Header)
+	reply.Header.Set(":status", strconv.Itoa(status))
+	reply.Header.Set(":version", "HTTP/1.1")
+	reply.Header.Set("Content-Type", "text/html; charset=utf-8")
+	reply.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	select {
+	case c.output[0] <- reply:
+	case <-c.stop:
+	}
+
+	data := new(frames.DATA)
+	data.StreamID = streamID
+	data.Flags = common.FLAG_FIN
+	data.Data = body
+	select {
+	case c.output[0] <- data:
+	case <-c.stop:
+	}
+}
+
+// refuseBody answers a request whose body exceeds the
+// connection's MaxRequestBodyBytes with 413 Request Entity
+// Too Large, if reply is set, then resets the stream with
+// CANCEL, so that the client stops sending the body.
+func (c *Conn) refuseBody(streamID common.StreamID, reply bool) {
+	if reply {
+		syn := new(frames.SYN_REPLY)
+		syn.Flags = common.FLAG_FIN
+		syn.StreamID = streamID
+		syn.Header = make(http.Header)
+		syn.Header.Set(":status", strconv.Itoa(http.StatusRequestEntityTooLarge))
+		syn.Header.Set(":version", "HTTP/1.1")
+		select {
+		case c.output[0] <- syn:
+		case <-c.stop:
+		}
+	}
+	c._RST_STREAM(streamID, common.RST_STREAM_CANCEL)
+}
+
+// flowControlError handles a breach of the flow control rules by
+// the other endpoint, such as an invalid WINDOW_UPDATE. The stream
+// is reset with FLOW_CONTROL_ERROR, so that any handler learns of
+// the reset and the stream is closed, or, for the connection's own
+// window, with stream ID 0, the connection is ended with a GOAWAY.
+func (c *Conn) flowControlError(sid common.StreamID, err error) {
+	log.Println(err)
+	if sid.Zero() {
+		c._GOAWAY(common.GOAWAY_FLOW_CONTROL_ERROR)
+		return
+	}
+
+	stream := c.streams.get(sid)
+	c.abortStream(sid, common.RST_STREAM_FLOW_CONTROL_ERROR)
+	c._RST_STREAM(sid, common.RST_STREAM_FLOW_CONTROL_ERROR)
+	if stream != nil {
+		go stream.Close()
+	}
 }
 
-func (c *Conn) _GOAWAY(status common.StatusCode) {
+func (c *Conn) _GOAWAY(status common.GoawayStatus) {
 	goaway := new(frames.GOAWAY)
 	goaway.Status = status
-	c.output[0] <- goaway
+	select {
+	case c.output[0] <- goaway:
+	case <-c.stop:
+	}
 	c.Close()
 }
 
+// violationCheck returns the condition of a violation of the
+// specification which could be tolerated. In strict mode, it
+// ends the connection accordingly, and otherwise the violation
+// is treated as a benign error.
+func (c *Conn) violationCheck(condition bool, sid common.StreamID, format string, v ...interface{}) bool {
+	if c.ValidationMode == common.ValidationStrict {
+		return c.criticalCheck(condition, sid, format, v...)
+	}
+	return c.check(condition, format, v...)
+}
+
+// streamIDCheck handles a SYN_STREAM which misused its stream
+// ID, returning true. In strict mode, the stream is reset with
+// PROTOCOL_ERROR or, if fatal, the connection is ended with a
+// GOAWAY. Otherwise, the violation is treated as a benign error,
+// but the new stream is still refused with a PROTOCOL_ERROR
+// RST_STREAM, so that the other endpoint is not left waiting
+// for a reply which will never come.
+func (c *Conn) streamIDCheck(sid common.StreamID, fatal bool, format string, v ...interface{}) bool {
+	if c.ValidationMode != common.ValidationStrict {
+		c.check(true, format, v...)
+		c._RST_STREAM(sid, common.RST_STREAM_PROTOCOL_ERROR)
+		return true
+	}
+
+	err := fmt.Errorf("Error: "+format+".", v...)
+	log.Println(err)
+	if fatal {
+		c.sessionError(err)
+	} else {
+		c.resetReceived(sid, common.RST_STREAM_PROTOCOL_ERROR, err)
+	}
+	return true
+}
+
+// streamCheck reports whether a frame of the given type
+// has been received for a stream which is not open, in
+// which case the frame is handled as a late frame:
+//
+//   - A frame for a stream which the other endpoint has
+//     closed is a benign error, and in strict mode the
+//     stream is reset with STREAM_ALREADY_CLOSED.
+//   - A frame for a stream which has closed or been reset
+//     within the grace period was in flight, so is ignored.
+//   - A frame for a stream which closed before then is
+//     answered with STREAM_ALREADY_CLOSED.
+//   - A frame for a stream which was never opened is a
+//     benign error, and in strict mode the stream is
+//     reset with INVALID_STREAM.
+func (c *Conn) streamCheck(stream common.Stream, sid common.StreamID, name string) bool {
+	strict := c.ValidationMode == common.ValidationStrict
+	switch {
+	case stream != nil && !stream.State().ClosedThere():
+		return false
+	case stream != nil:
+		c.check(true, "Received %s for closed Stream ID %d", name, sid)
+		if strict {
+			c._RST_STREAM(sid, common.RST_STREAM_STREAM_ALREADY_CLOSED)
+		}
+	case c.streams.recentlyClosed(sid):
+		debug.Printf("Ignoring %s for recently closed Stream ID %d.\n", name, sid)
+	case c.opened(sid):
+		debug.Printf("Received %s for closed Stream ID %d.\n", name, sid)
+		c._RST_STREAM(sid, common.RST_STREAM_STREAM_ALREADY_CLOSED)
+	default:
+		c.check(true, "Received %s for unopened Stream ID %d", name, sid)
+		if strict {
+			c._RST_STREAM(sid, common.RST_STREAM_INVALID_STREAM)
+		}
+	}
+	return true
+}
+
 // handleReadWriteError differentiates between normal and
 // unexpected errors when performing I/O with the network,
 // then shuts down the connection.
 func (c *Conn) handleReadWriteError(err error) {
-	if _, ok := err.(*net.OpError); ok || err == io.EOF || err == common.ErrConnNil ||
-		err.Error() == "use of closed network connection" {
+	if disconnected(err) {
 		// Client has closed the TCP connection.
 		debug.Println("Note: Endpoint has disconnected.")
 	} else {
@@ -58,6 +244,19 @@ func (c *Conn) handleReadWriteError(err error) {
 		log.Printf("Error: Encountered error: %q (%T)\n", err.Error(), err)
 	}
 
+	c.closeNow()
+}
+
+// disconnected indicates whether err shows that the
+// other endpoint has closed the network connection.
+func disconnected(err error) bool {
+	_, ok := err.(*net.OpError)
+	return ok || err == io.EOF || err == common.ErrConnNil ||
+		err.Error() == "use of closed network connection"
+}
+
+// closeNow ends the connection without sending a GOAWAY.
+func (c *Conn) closeNow() {
 	// Make sure c.Close succeeds and sending stops.
 	c.sendingLock.Lock()
 	if c.sending == nil {
@@ -68,16 +267,82 @@ func (c *Conn) handleReadWriteError(err error) {
 	c.Close()
 }
 
+// handleReadError ends the connection after a frame could
+// not be read. Errors other than disconnection mean that
+// the frame was malformed, so are passed to ErrorHandler.
+func (c *Conn) handleReadError(err error) {
+	if !disconnected(err) && c.errorAction(err) == common.ErrorActionGoaway {
+		log.Printf("Error: Encountered error: %q (%T)\n", err.Error(), err)
+		c.goawayError()
+		return
+	}
+	c.handleReadWriteError(err)
+}
+
+// errorAction passes a protocol error and the frame being
+// processed to ErrorHandler, if set, and returns its choice
+// of how to end the connection.
+func (c *Conn) errorAction(err error) common.ErrorAction {
+	if c.ErrorHandler == nil {
+		return common.ErrorActionDefault
+	}
+	return c.ErrorHandler(err, c.reading)
+}
+
+// goawayError sends a GOAWAY with PROTOCOL_ERROR and
+// ends the connection.
+func (c *Conn) goawayError() {
+	goaway := c.newGoaway()
+	goaway.Status = common.GOAWAY_PROTOCOL_ERROR
+	select {
+	case c.output[0] <- goaway:
+		c.goawayLock.Lock()
+		c.goawaySent = true
+		c.goawayLock.Unlock()
+	case <-time.After(100 * time.Millisecond):
+		debug.Println("Failed to send PROTOCOL_ERROR GOAWAY.")
+	}
+	c.Close()
+}
+
+// sessionError ends the connection with a GOAWAY with
+// PROTOCOL_ERROR, unless ErrorHandler chooses to close it
+// without sending anything.
+func (c *Conn) sessionError(err error) {
+	if c.errorAction(err) == common.ErrorActionClose {
+		c.closeNow()
+		return
+	}
+	c.goawayError()
+}
+
 // protocolError informs the other endpoint that a protocol error has
 // occurred, stops all running streams, and ends the connection.
-func (c *Conn) protocolError(streamID common.StreamID) {
+func (c *Conn) protocolError(streamID common.StreamID, err error) {
+	c.fatalError(streamID, common.RST_STREAM_PROTOCOL_ERROR, err)
+}
+
+// fatalError informs the other endpoint of an error with the
+// given status, stops all running streams, and ends the
+// connection. ErrorHandler, if set, may instead choose to
+// send only a GOAWAY, or nothing at all.
+func (c *Conn) fatalError(streamID common.StreamID, status common.StatusCode, err error) {
+	switch c.errorAction(err) {
+	case common.ErrorActionGoaway:
+		c.goawayError()
+		return
+	case common.ErrorActionClose:
+		c.closeNow()
+		return
+	}
+
 	reply := new(frames.RST_STREAM)
 	reply.StreamID = streamID
-	reply.Status = common.RST_STREAM_PROTOCOL_ERROR
+	reply.Status = status
 	select {
 	case c.output[0] <- reply:
 	case <-time.After(100 * time.Millisecond):
-		debug.Println("Failed to send PROTOCOL_ERROR RST_STREAM.")
+		debug.Printf("Failed to send %s RST_STREAM.\n", status)
 	}
 	if c.shutdownError == nil {
 		c.shutdownError = reply
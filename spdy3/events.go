@@ -0,0 +1,79 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// Events returns the most recent frames sent and
+// received on the connection, oldest first.
+func (c *Conn) Events() []common.Event {
+	return c.events.Events()
+}
+
+// SchedulerState summarises the frames and data
+// waiting to be sent on the connection.
+func (c *Conn) SchedulerState() common.SchedulerState {
+	var out common.SchedulerState
+	for _, info := range c.Streams() {
+		out.Streams[info.Priority]++
+		out.Buffered[info.Priority] += info.Buffered
+	}
+	if c.fair != nil {
+		out.FairHeld = c.fair.heldCounts()
+	}
+	return out
+}
+
+// newEvent describes a frame for the event log.
+func newEvent(frame common.Frame, sent bool) common.Event {
+	event := common.Event{Time: time.Now(), Sent: sent}
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		event.Frame = "DATA"
+		event.StreamID = frame.StreamID
+		event.Detail = fmt.Sprintf("length=%d fin=%t", len(frame.Data), frame.Flags.FIN())
+	case *frames.SYN_STREAM:
+		event.Frame = "SYN_STREAM"
+		event.StreamID = frame.StreamID
+		event.Detail = fmt.Sprintf("priority=%d fin=%t", frame.Priority, frame.Flags.FIN())
+	case *frames.SYN_REPLY:
+		event.Frame = "SYN_REPLY"
+		event.StreamID = frame.StreamID
+		event.Detail = fmt.Sprintf("fin=%t", frame.Flags.FIN())
+	case *frames.HEADERS:
+		event.Frame = "HEADERS"
+		event.StreamID = frame.StreamID
+		event.Detail = fmt.Sprintf("fin=%t", frame.Flags.FIN())
+	case *frames.RST_STREAM:
+		event.Frame = "RST_STREAM"
+		event.StreamID = frame.StreamID
+		event.Detail = frame.Status.String()
+	case *frames.WINDOW_UPDATE:
+		event.Frame = "WINDOW_UPDATE"
+		event.StreamID = frame.StreamID
+		event.Detail = fmt.Sprintf("delta=%d", frame.DeltaWindowSize)
+	case *frames.SETTINGS:
+		event.Frame = "SETTINGS"
+		event.Detail = fmt.Sprintf("settings=%d", len(frame.Settings))
+	case *frames.PING:
+		event.Frame = "PING"
+		event.Detail = fmt.Sprintf("id=%d", frame.PingID)
+	case *frames.GOAWAY:
+		event.Frame = "GOAWAY"
+		event.Detail = fmt.Sprintf("last=%d status=%s", frame.LastGoodStreamID, frame.Status)
+	case *frames.CREDENTIAL:
+		event.Frame = "CREDENTIAL"
+		event.Detail = fmt.Sprintf("slot=%d", frame.Slot)
+	default:
+		event.Frame = fmt.Sprintf("%T", frame)
+	}
+	return event
+}
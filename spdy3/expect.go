@@ -0,0 +1,230 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// expectsContinue indicates whether a request asks the
+// server to confirm that it wants the request body
+// before the body is sent.
+func expectsContinue(header http.Header) bool {
+	return strings.EqualFold(header.Get("Expect"), "100-continue")
+}
+
+/**********
+ * Server *
+ **********/
+
+// continueReader is the body of a request sent with
+// Expect: 100-continue. The interim 100 Continue
+// response is sent when the handler first reads the
+// body, so a handler which replies without reading
+// it spares the client from sending it.
+type continueReader struct {
+	stream *ResponseStream
+	body   io.ReadCloser
+	once   sync.Once
+}
+
+func (r *continueReader) Read(b []byte) (int, error) {
+	r.once.Do(r.stream.writeContinue)
+	return r.body.Read(b)
+}
+
+func (r *continueReader) Close() error {
+	return r.body.Close()
+}
+
+// writeContinue sends the interim 100 Continue
+// response, unless the final response has been
+// sent already.
+func (s *ResponseStream) writeContinue() {
+	s.headerLock.Lock()
+	defer s.unlockHeader()
+
+	s.writeInterim(http.StatusContinue, make(http.Header))
+}
+
+// writeInterim sends an interim 1xx response with the
+// given headers, unless the final response has been
+// sent already. The first response is sent in the
+// SYN_REPLY, and any others, including the final
+// response, in HEADERS frames. The headers are not
+// recorded as sent, as the client does not treat them
+// as part of the final response. The caller must hold
+// headerLock.
+func (s *ResponseStream) writeInterim(code int, header http.Header) {
+	if s.wroteHeader || s.closed() || s.state.ClosedHere() {
+		return
+	}
+
+	header.Set(":status", strconv.Itoa(code))
+	header.Set(":version", "HTTP/1.1")
+
+	var frame common.Frame
+	if s.sentInterim {
+		headers := new(frames.HEADERS)
+		headers.StreamID = s.streamID
+		headers.Header = header
+		frame = headers
+	} else {
+		synReply := new(frames.SYN_REPLY)
+		synReply.StreamID = s.streamID
+		synReply.Header = header
+		frame = synReply
+	}
+
+	s.sentInterim = true
+	s.queue(frame, s.headerOutput())
+}
+
+/**********
+ * Client *
+ **********/
+
+// statusCode returns the status code in a header
+// block, if it has one.
+func statusCode(header http.Header) (int, bool) {
+	status := strings.TrimSpace(header.Get(":status"))
+	if i := strings.Index(status, " "); i >= 0 {
+		status = status[:i]
+	}
+	code, err := strconv.Atoi(status)
+	return code, err == nil
+}
+
+// isInterim indicates whether a status code is for an
+// interim response, which is followed by the final
+// response. As in net/http, 101 Switching Protocols is
+// final.
+func isInterim(code int) bool {
+	return code/100 == 1 && code != http.StatusSwitchingProtocols
+}
+
+// receivedStatus is called with each header block
+// received, to release any request body held for
+// Expect: 100-continue once the status is known.
+// Interim responses other than 100 Continue are
+// ignored.
+func (s *RequestStream) receivedStatus(header http.Header) {
+	code, ok := statusCode(header)
+	if !ok || (isInterim(code) && code != http.StatusContinue) {
+		return
+	}
+
+	select {
+	case s.continued <- code == http.StatusContinue:
+	default:
+	}
+}
+
+// interimResponse indicates whether a header block is
+// an interim 1xx response, which is passed to the
+// request's httptrace.ClientTrace, if any, rather than
+// the Receiver. If the trace's Got1xxResponse returns
+// an error, the stream is cancelled, and the request
+// fails with that error.
+func (s *RequestStream) interimResponse(request *http.Request, header http.Header) bool {
+	code, ok := statusCode(header)
+	if !ok || !isInterim(code) {
+		return false
+	}
+
+	trace := httptrace.ContextClientTrace(request.Context())
+	if trace == nil || trace.Got1xxResponse == nil {
+		return true
+	}
+
+	mime := make(textproto.MIMEHeader, len(header))
+	for name, values := range header {
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		mime[name] = append(mime[name], values...)
+	}
+
+	if err := trace.Got1xxResponse(code, mime); err != nil {
+		s.Lock()
+		s.err = err
+		s.Unlock()
+		s.Reset(common.RST_STREAM_CANCEL)
+	}
+	return true
+}
+
+// sendHeldBody sends a request body held for Expect:
+// 100-continue, once the server responds with 100
+// Continue, or the timeout expires. If the server sends
+// its final response first, the body is unwanted, so
+// the stream is half-closed without it.
+func (s *RequestStream) sendHeldBody(body []*frames.DATA, timeout time.Duration) {
+	defer common.Recover()
+
+	if !s.waitToSend(body, timeout) {
+		return
+	}
+
+	s.state.CloseHere()
+	if s.state.Closed() {
+		s.Close()
+	}
+}
+
+// waitToSend performs the sending for sendHeldBody,
+// reporting whether the stream should be half-closed.
+// The stream's shutdown waits for it to return.
+func (s *RequestStream) waitToSend(body []*frames.DATA, timeout time.Duration) bool {
+	defer s.heldBody.Done()
+
+	output := s.out()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	send := true
+	select {
+	case send = <-s.continued:
+	case <-expired:
+	case <-s.finished:
+		return false
+	}
+
+	if !send {
+		end := new(frames.DATA)
+		end.Flags = common.FLAG_FIN
+		end.Data = []byte{}
+		body = []*frames.DATA{end}
+	}
+
+	for _, frame := range body {
+		frame.StreamID = s.streamID
+		select {
+		case output <- frame:
+		case <-s.finished:
+			return false
+		case <-s.conn.stop:
+			return false
+		}
+	}
+
+	return true
+}
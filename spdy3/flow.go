@@ -7,6 +7,8 @@ package spdy3
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -34,16 +36,47 @@ type flowControl struct {
 	conn                *Conn
 	stream              common.Stream
 	streamID            common.StreamID
+	path                string // request path, used in errors.
 	output              chan<- common.Frame
 	initialWindow       uint32
 	transferWindow      int64
-	sent                uint32
-	buffer              [][]byte
+	buffer              []flowChunk
+	queue               []queuedFrame // frames released by flow control, awaiting submission.
+	submitting          chan struct{} // closed when the current submission ends.
 	constrained         bool
 	initialWindowThere  uint32
 	transferWindowThere int64
+	pendingUpdate       int64 // receive window growth not yet sent in a WINDOW_UPDATE.
 	flowControl         common.FlowControl
+	stalled             bool  // the receive window was not regrown, to keep within the memory budget.
+	unconsumed          int64 // DATA received but not yet consumed by the stream.
+	received            int64 // DATA received in total.
+	maxReceive          int64 // if positive, the window is not grown beyond this much DATA.
 	waiting             chan bool
+	updated             chan struct{}         // signalled when the transfer window grows.
+	limit               *common.RateLimiter   // optional per-stream rate limit.
+	dataSent            uint64                // accessed atomically.
+	dataFrames          uint64                // accessed atomically.
+	counter             *common.StreamCounter // the stream's statistics.
+	stallGen            uint64                // incremented each time the stream becomes constrained.
+	stallTimers         []*time.Timer         // report or reset a long stall.
+	throughput          common.ThroughputMeter
+}
+
+// flowChunk is an item held by flow control. This is
+// either DATA, sent as the transfer window allows, or
+// a frame which must follow the DATA held ahead of it.
+type flowChunk struct {
+	data   []byte
+	frame  common.Frame
+	output chan<- common.Frame
+}
+
+// queuedFrame is a frame released by flow control,
+// with the channel on which it is to be sent.
+type queuedFrame struct {
+	frame  common.Frame
+	output chan<- common.Frame
 }
 
 // AddFlowControl initialises flow control for
@@ -62,14 +95,17 @@ func (s *PushStream) AddFlowControl(f common.FlowControl) {
 	initialWindow := s.conn.initialWindowSize
 	s.conn.initialWindowSizeLock.Unlock()
 	s.flow.streamID = s.streamID
-	s.flow.output = s.output
-	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.output = s.out()
+	s.flow.buffer = make([]flowChunk, 0, 10)
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	s.flow.limit = s.conn.newStreamRateLimiter()
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.transferWindowThere)
+	s.flow.path = s.path
+	s.flow.counter = &s.stats
 }
 
 // AddFlowControl initialises flow control for
@@ -88,14 +124,19 @@ func (s *RequestStream) AddFlowControl(f common.FlowControl) {
 	initialWindow := s.conn.initialWindowSize
 	s.conn.initialWindowSizeLock.Unlock()
 	s.flow.streamID = s.streamID
-	s.flow.output = s.output
-	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.output = s.out()
+	s.flow.buffer = make([]flowChunk, 0, 10)
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	s.flow.limit = s.conn.newStreamRateLimiter()
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
+	if s.Request != nil && s.Request.URL != nil {
+		s.flow.path = s.Request.URL.Path
+	}
+	s.flow.counter = &s.stats
 }
 
 // AddFlowControl initialises flow control for
@@ -114,14 +155,19 @@ func (s *ResponseStream) AddFlowControl(f common.FlowControl) {
 	initialWindow := s.conn.initialWindowSize
 	s.conn.initialWindowSizeLock.Unlock()
 	s.flow.streamID = s.streamID
-	s.flow.output = s.output
-	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.output = s.out()
+	s.flow.buffer = make([]flowChunk, 0, 10)
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	s.flow.limit = s.conn.newStreamRateLimiter()
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
+	if s.request != nil && s.request.URL != nil {
+		s.flow.path = s.request.URL.Path
+	}
+	s.flow.counter = &s.stats
 }
 
 // CheckInitialWindow is used to handle the race
@@ -141,13 +187,12 @@ func (f *flowControl) CheckInitialWindow() {
 	f.conn.initialWindowSizeLock.Unlock()
 
 	if f.initialWindow != newWindow {
-		if f.initialWindow > newWindow {
-			f.transferWindow = int64(newWindow - f.sent)
-		} else if f.initialWindow < newWindow {
-			f.transferWindow += int64(newWindow - f.initialWindow)
-		}
+		// The window moves by the change in its initial
+		// size, and may become negative if the initial
+		// size is lowered after DATA has been sent.
+		f.transferWindow += int64(newWindow) - int64(f.initialWindow)
 		if f.transferWindow <= 0 {
-			f.constrained = true
+			f.setConstrained(true)
 		}
 		f.initialWindow = newWindow
 	}
@@ -155,51 +200,273 @@ func (f *flowControl) CheckInitialWindow() {
 
 // Close nils any references held by the flowControl.
 func (f *flowControl) Close() {
+	f.Lock()
+	defer f.Unlock()
+	for _, chunk := range f.buffer {
+		f.conn.memory.Release(int64(len(chunk.data)))
+	}
 	f.buffer = nil
 	f.stream = nil
+	f.stopStallTimers()
+
+	// Wake anything waiting for the window.
+	select {
+	case f.waiting <- true:
+	default:
+	}
+	if f.updated != nil {
+		select {
+		case f.updated <- struct{}{}:
+		default:
+		}
+	}
 }
 
-// Flush is used to send buffered data to
-// the connection, if the transfer window
+// Flush is used to release buffered data
+// to the connection, if the transfer window
 // will allow. Flush does not guarantee
 // that any or all buffered data will be
-// sent with a single flush.
+// released with a single flush. Frames held
+// behind the data are released once the
+// data ahead of them has been released.
+// Released data is sent in DATA frames of at
+// most the connection's DATA chunk size, and
+// released frames are queued, to be sent by
+// submit. The caller must hold the lock.
 func (f *flowControl) Flush() {
 	f.CheckInitialWindow()
-	if !f.constrained || f.transferWindow == 0 {
+	if !f.constrained {
 		return
 	}
 
-	out := make([]byte, 0, f.transferWindow)
+	var out []byte
 	left := f.transferWindow
-	for i := 0; i < len(f.buffer); i++ {
-		if l := int64(len(f.buffer[i])); l <= left {
-			out = append(out, f.buffer[i]...)
-			left -= l
+	size := int64(f.conn.dataChunkSize)
+	for len(f.buffer) > 0 {
+		chunk := f.buffer[0]
+		if chunk.frame != nil {
+			f.sendData(out)
+			out = nil
+			f.queue = append(f.queue, queuedFrame{chunk.frame, chunk.output})
 			f.buffer = f.buffer[1:]
-		} else {
-			out = append(out, f.buffer[i][:left]...)
-			f.buffer[i] = f.buffer[i][left:]
-			left = 0
+			continue
 		}
 
-		if left == 0 {
+		if left <= 0 {
 			break
 		}
+		n := int64(len(chunk.data))
+		if n > left {
+			n = left
+		}
+		if room := size - int64(len(out)); n > room {
+			n = room
+		}
+		out = append(out, chunk.data[:n]...)
+		left -= n
+		f.conn.memory.Release(n)
+		if n == int64(len(chunk.data)) {
+			f.buffer = f.buffer[1:]
+		} else {
+			f.buffer[0].data = chunk.data[n:]
+		}
+		if int64(len(out)) == size {
+			f.sendData(out)
+			out = nil
+		}
 	}
+	f.sendData(out)
 
-	f.transferWindow -= int64(len(out))
-
-	if f.transferWindow > 0 {
-		f.constrained = false
+	if len(f.buffer) == 0 {
+		f.setConstrained(false)
 		debug.Printf("Stream %d is no longer constrained.\n", f.streamID)
 	}
+}
+
+// setConstrained records whether the stream is
+// constrained by flow control, timing any stall. A
+// stall which lasts beyond the connection's
+// FlowStallThreshold is reported, and one which lasts
+// beyond its FlowStallTimeout resets the stream. The
+// caller must hold the lock.
+func (f *flowControl) setConstrained(constrained bool) {
+	was := f.constrained
+	f.constrained = constrained
+	if f.counter != nil {
+		f.counter.Stalled(constrained)
+	}
+
+	switch {
+	case constrained && !was:
+		f.stallGen++
+		gen := f.stallGen
+		if d := f.conn.FlowStallThreshold; d > 0 {
+			f.stallTimers = append(f.stallTimers, time.AfterFunc(d, func() { f.reportStall(gen, d) }))
+		}
+		if d := f.conn.FlowStallTimeout; d > 0 {
+			f.stallTimers = append(f.stallTimers, time.AfterFunc(d, func() { f.resetStall(gen, d) }))
+		}
+	case !constrained && was:
+		f.stopStallTimers()
+	}
+}
+
+// stopStallTimers stops the timers of any current
+// stall. The caller must hold the lock.
+func (f *flowControl) stopStallTimers() {
+	for _, timer := range f.stallTimers {
+		timer.Stop()
+	}
+	f.stallTimers = nil
+}
+
+// stalledStream returns the stream if it is still in
+// the given stall, or nil otherwise.
+func (f *flowControl) stalledStream(gen uint64) common.Stream {
+	f.Lock()
+	defer f.Unlock()
+	if !f.constrained || f.stallGen != gen {
+		return nil
+	}
+	return f.stream
+}
+
+// reportStall logs and counts a stall which has lasted
+// beyond the connection's FlowStallThreshold.
+func (f *flowControl) reportStall(gen uint64, d time.Duration) {
+	if f.stalledStream(gen) == nil {
+		return
+	}
+	f.conn.stats.Add(common.Stats{FlowStalls: 1})
+	log.Printf("Stream %d (%s) has been blocked by flow control for over %v, waiting for a WINDOW_UPDATE from %s.\n", f.streamID, f.path, d, f.conn.remoteAddr)
+}
+
+// resetStall resets the stream with CANCEL, as its peer has not
+// grown the transfer window within the FlowStallTimeout.
+func (f *flowControl) resetStall(gen uint64, d time.Duration) {
+	stream := f.stalledStream(gen)
+	if stream == nil {
+		return
+	}
+	f.conn.stats.Add(common.Stats{FlowStallResets: 1})
+	log.Printf("Resetting stream %d (%s), as it has been blocked by flow control for over %v.\n", f.streamID, f.path, d)
+
+	switch stream := stream.(type) {
+	case *PushStream:
+		f.conn._RST_STREAM(f.streamID, common.RST_STREAM_CANCEL)
+		stream.Close()
+	case interface{ Reset(common.StatusCode) error }:
+		stream.Reset(common.RST_STREAM_CANCEL)
+	}
+}
+
+// sendData queues buffered data in a DATA frame,
+// charging it to the transfer window. The caller
+// must hold the lock.
+func (f *flowControl) sendData(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	f.transferWindow -= int64(len(data))
 
 	dataFrame := new(frames.DATA)
 	dataFrame.StreamID = f.streamID
-	dataFrame.Data = out
+	dataFrame.Data = data
+
+	f.recordSent(dataFrame)
+	f.queue = append(f.queue, queuedFrame{dataFrame, f.output})
+}
+
+// Queue is used to send a frame other than DATA on
+// the stream, such as HEADERS or the final DATA
+// frame. If any data is buffered, the frame is held
+// until that data has been released, so the stream's
+// frames reach the connection in the order they
+// were written. Otherwise, the frame is queued
+// immediately. Either way, the frame is sent on
+// output by a later call to submit, so Queue never
+// blocks, and can be called with the stream's
+// header lock held.
+func (f *flowControl) Queue(frame common.Frame, output chan<- common.Frame) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.buffer == nil || f.stream == nil {
+		return f.wrapError(errors.New("Error: Stream closed."))
+	}
+
+	f.CheckInitialWindow()
+	if f.constrained {
+		f.Flush()
+	}
 
-	f.output <- dataFrame
+	if f.constrained {
+		f.buffer = append(f.buffer, flowChunk{frame: frame, output: output})
+		return nil
+	}
+
+	f.queue = append(f.queue, queuedFrame{frame, output})
+	return nil
+}
+
+// submit sends the frames released by flow control
+// on their outputs, in the order they were released,
+// and returns once every frame queued before the call
+// has been sent. Only one goroutine submits at a time,
+// and the lock is not held while a frame is sent, so a
+// full output blocks only the submitter, rather than
+// everything using the flow control, such as the read
+// loop's UpdateWindow. The caller must not hold the
+// lock.
+func (f *flowControl) submit() {
+	f.Lock()
+	for f.submitting != nil {
+		done := f.submitting
+		f.Unlock()
+		<-done
+		f.Lock()
+	}
+	if len(f.queue) == 0 {
+		f.Unlock()
+		return
+	}
+
+	done := make(chan struct{})
+	f.submitting = done
+	defer func() {
+		f.Lock()
+		f.submitting = nil
+		f.Unlock()
+		close(done)
+	}()
+
+	for len(f.queue) > 0 {
+		next := f.queue[0]
+		f.queue[0] = queuedFrame{}
+		f.queue = f.queue[1:]
+		f.Unlock()
+		select {
+		case next.output <- next.frame:
+		case <-f.conn.stop:
+		}
+		f.Lock()
+	}
+	f.queue = nil
+	f.Unlock()
+}
+
+// submitLater submits any queued frames from a new
+// goroutine, for callers which must not block, such
+// as the read loop. The caller must hold the lock.
+func (f *flowControl) submitLater() {
+	if len(f.queue) == 0 {
+		return
+	}
+	go func() {
+		defer common.Recover()
+		f.submit()
+	}()
 }
 
 // Paused indicates whether there is data buffered.
@@ -217,24 +484,124 @@ func (f *flowControl) Paused() bool {
 // window, and sends errors if necessary.
 func (f *flowControl) Receive(data []byte) {
 	// The transfer window shouldn't already be negative.
-	if f.transferWindowThere < 0 {
+	f.Lock()
+	negative := f.transferWindowThere < 0
+	output := f.output
+	f.Unlock()
+	if negative {
 		rst := new(frames.RST_STREAM)
 		rst.StreamID = f.streamID
 		rst.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-		f.output <- rst
+		select {
+		case output <- rst:
+		case <-f.conn.stop:
+		}
 	}
 
 	// Update the window.
+	f.Lock()
 	f.transferWindowThere -= int64(len(data))
+	f.received += int64(len(data))
+	f.Unlock()
+	f.regrow()
+}
+
+// Hold records that n bytes of DATA about to be received
+// will be held until the stream consumes them, which it
+// reports with Consumed. The receive window counts held
+// data as unused, so that it only grows as data is
+// consumed.
+func (f *flowControl) Hold(n int) {
+	f.Lock()
+	f.unconsumed += int64(n)
+	f.Unlock()
+}
+
+// Consumed is called once n bytes of held DATA have been
+// consumed, and regrows the receive window as needed.
+func (f *flowControl) Consumed(n int) {
+	f.Lock()
+	f.unconsumed -= int64(n)
+	f.Unlock()
+	f.regrow()
+}
 
-	// Regrow the window if it's half-empty.
-	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, f.transferWindowThere)
+// regrow regrows the receive window if it's half-empty,
+// unless the connection has exceeded its memory budget,
+// in which case the window is left to shrink until the
+// buffered data has been consumed. The growth is sent
+// once it is large enough, as decided by
+// coalesceWindowUpdate.
+func (f *flowControl) regrow() {
+	f.Lock()
+	if f.conn.memory.Exceeded() {
+		f.stalled = true
+		f.Unlock()
+		return
+	}
+	f.stalled = false
+	window := f.transferWindowThere + f.pendingUpdate + f.unconsumed
+	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, window)
+	if f.maxReceive > 0 {
+		// Grow the window no further than the limit.
+		allowed := f.maxReceive - f.received - f.transferWindowThere - f.pendingUpdate
+		if allowed <= 0 {
+			delta = 0
+		} else if int64(delta) > allowed {
+			delta = uint32(allowed)
+		}
+	}
+	f.pendingUpdate += int64(delta)
+	threshold := f.conn.windowUpdateThreshold(f.initialWindowThere)
+	if !coalesceWindowUpdate(f.pendingUpdate, f.transferWindowThere, threshold) {
+		f.Unlock()
+		return
+	}
+	delta = uint32(f.pendingUpdate)
+	f.transferWindowThere += f.pendingUpdate
+	f.pendingUpdate = 0
+	output := f.output
+	f.Unlock()
 	if delta != 0 {
 		grow := new(frames.WINDOW_UPDATE)
 		grow.StreamID = f.streamID
 		grow.DeltaWindowSize = delta
-		f.output <- grow
-		f.transferWindowThere += int64(grow.DeltaWindowSize)
+		select {
+		case output <- grow:
+		case <-f.conn.stop:
+		}
+	}
+}
+
+// coalesceWindowUpdate returns true iff a receive window's pending
+// growth should be sent in a WINDOW_UPDATE now, given the window as
+// the peer sees it. Growth is held until it reaches the threshold,
+// so that a peer sending many small DATA frames is not sent an
+// update for each, but is sent sooner once it exceeds what is left
+// of the peer's window, so that the peer is not left waiting where
+// the window is not regrown fully, such as near a body size limit.
+func coalesceWindowUpdate(pending, window, threshold int64) bool {
+	if pending <= 0 {
+		return false
+	}
+	return pending >= threshold || pending > window
+}
+
+// windowUpdateThreshold returns the growth of a receive window
+// with the given initial size which is sent in a single update,
+// as set by the connection's WindowUpdateThreshold.
+func (c *Conn) windowUpdateThreshold(initialWindow uint32) int64 {
+	return int64(c.WindowUpdateThreshold * float64(initialWindow))
+}
+
+// resume regrows the receive window if it was
+// stalled by the memory budget.
+func (f *flowControl) resume() {
+	f.Lock()
+	stalled := f.stalled
+	f.Unlock()
+	if stalled {
+		f.regrow()
 	}
 }
 
@@ -244,8 +611,11 @@ func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
 	f.Lock()
 	defer f.Unlock()
 
+	// Apply any change to the initial window first, so
+	// that the overflow check sees the current window.
+	f.CheckInitialWindow()
 	if int64(deltaWindowSize)+f.transferWindow > common.MAX_TRANSFER_WINDOW_SIZE {
-		return errors.New("Error: WINDOW_UPDATE delta window size overflows transfer window size.")
+		return f.wrapError(errors.New("Error: WINDOW_UPDATE delta window size overflows transfer window size."))
 	}
 
 	// Grow window and flush queue.
@@ -253,14 +623,32 @@ func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
 	f.transferWindow += int64(deltaWindowSize)
 
 	f.Flush()
+	f.submitLater()
 	select {
 	case f.waiting <- true:
 	default:
 	}
+	if f.updated != nil {
+		select {
+		case f.updated <- struct{}{}:
+		default:
+		}
+	}
 
 	return nil
 }
 
+// windowUpdates returns a channel which is signalled
+// whenever the transfer window grows.
+func (f *flowControl) windowUpdates() <-chan struct{} {
+	f.Lock()
+	defer f.Unlock()
+	if f.updated == nil {
+		f.updated = make(chan struct{}, 1)
+	}
+	return f.updated
+}
+
 // Wait blocks until any buffered data has been sent.
 // This may involve waiting for a window update from
 // the peer.
@@ -269,26 +657,62 @@ func (f *flowControl) Wait() error {
 	f.Flush()
 	if !f.Paused() {
 		f.Unlock()
+		f.submit()
 		return nil
 	}
 
 	if f.waiting != nil {
 		f.Unlock()
-		return errors.New("waiting for flow control twice")
+		return f.wrapError(errors.New("Error: Waiting for flow control twice."))
 	}
 
-	f.waiting = make(chan bool)
+	f.waiting = make(chan bool, 1)
 	f.Unlock()
+	f.submit()
 
 	for {
 		<-f.waiting
+		f.Lock()
 		f.Flush()
-		if !f.Paused() {
+		paused := f.Paused()
+		f.Unlock()
+		f.submit()
+		if !paused {
 			return nil
 		}
 	}
 }
 
+// sendWindow blocks until no DATA is held and the transfer
+// window has room, and returns the room available, so that
+// a writer can size its next write to be sent at once.
+func (f *flowControl) sendWindow() (int64, error) {
+	updates := f.windowUpdates()
+	for {
+		f.Lock()
+		if f.buffer == nil || f.stream == nil {
+			f.Unlock()
+			return 0, f.wrapError(errors.New("Error: Stream closed."))
+		}
+		f.CheckInitialWindow()
+		if f.constrained {
+			f.Flush()
+		}
+		window, constrained := f.transferWindow, f.constrained
+		f.Unlock()
+		f.submit()
+		if !constrained && window > 0 {
+			return window, nil
+		}
+
+		select {
+		case <-updates:
+		case <-f.conn.stop:
+			return 0, f.wrapError(errors.New("Error: Stream closed."))
+		}
+	}
+}
+
 // Write is used to send data to the connection. This
 // takes care of the windowing. Although data may be
 // buffered, rather than actually sent, this is not
@@ -299,17 +723,32 @@ func (f *flowControl) Write(data []byte) (int, error) {
 		return 0, nil
 	}
 
-	if f.buffer == nil || f.stream == nil {
-		return 0, errors.New("Error: Stream closed.")
+	f.Lock()
+	closed := f.buffer == nil || f.stream == nil
+	f.Unlock()
+	if closed {
+		return 0, f.wrapError(errors.New("Error: Stream closed."))
 	}
 
-	// Transfer window processing.
+	// Rate limiting. The whole write is charged
+	// now, even if some of it is buffered.
+	if !f.conn.waitRateLimit(f.limit, l) {
+		return 0, f.wrapError(errors.New("Error: Stream closed."))
+	}
+
+	// Transfer window processing. Any buffered
+	// data is sent first. The stream may have
+	// been closed while waiting for the rate limit.
+	f.Lock()
+	if f.buffer == nil || f.stream == nil {
+		f.Unlock()
+		return 0, f.wrapError(errors.New("Error: Stream closed."))
+	}
 	f.CheckInitialWindow()
 	if f.constrained {
 		f.Flush()
 	}
 
-	f.Lock()
 	var window uint32
 	if f.transferWindow < 0 {
 		window = 0
@@ -324,25 +763,98 @@ func (f *flowControl) Write(data []byte) (int, error) {
 		constrained = true
 	}
 
-	f.sent += sending
 	f.transferWindow -= int64(sending)
 
 	if constrained {
-		f.buffer = append(f.buffer, data[window:])
+		f.buffer = append(f.buffer, flowChunk{data: append([]byte(nil), data[window:]...)})
+		f.conn.memory.Add(int64(len(data) - int(window)))
 		data = data[:window]
-		f.constrained = true
+		f.setConstrained(true)
 		debug.Printf("Stream %d is now constrained.\n", f.streamID)
 	}
+
+	// The frame is queued before unlocking, so
+	// that a concurrent Flush cannot release the
+	// buffered remainder ahead of it.
+	if len(data) > 0 {
+		dataFrame := new(frames.DATA)
+		dataFrame.StreamID = f.streamID
+		dataFrame.Data = data
+
+		f.recordSent(dataFrame)
+		f.queue = append(f.queue, queuedFrame{dataFrame, f.output})
+	}
 	f.Unlock()
+	f.submit()
 
-	if len(data) == 0 {
-		return l, nil
+	return l, nil
+}
+
+// recordSent updates the stream's statistics as a
+// DATA frame is released to the connection.
+func (f *flowControl) recordSent(frame *frames.DATA) {
+	n := len(frame.Data)
+	atomic.AddUint64(&f.dataSent, uint64(n))
+	atomic.AddUint64(&f.dataFrames, 1)
+	f.throughput.Add(n)
+	if f.counter != nil {
+		f.counter.Queued(frame)
 	}
+}
 
-	dataFrame := new(frames.DATA)
-	dataFrame.StreamID = f.streamID
-	dataFrame.Data = data
+// setOutput changes the channel on which the
+// stream's frames are sent, when its priority
+// changes.
+func (f *flowControl) setOutput(output chan<- common.Frame) {
+	f.Lock()
+	f.output = output
+	f.Unlock()
+}
 
-	f.output <- dataFrame
-	return l, nil
+// windows returns the stream's send and receive windows,
+// and the bytes of DATA held for the send window.
+func (f *flowControl) windows() (send, receive int64, buffered int) {
+	f.Lock()
+	defer f.Unlock()
+	for _, chunk := range f.buffer {
+		buffered += len(chunk.data)
+	}
+	return f.transferWindow, f.transferWindowThere, buffered
+}
+
+// Stats returns the stream's statistics.
+func (f *flowControl) Stats() common.StreamStats {
+	var out common.StreamStats
+	if f.counter != nil {
+		out = f.counter.Snapshot()
+	}
+	out.DataBytesSent = atomic.LoadUint64(&f.dataSent)
+	out.DataFramesSent = atomic.LoadUint64(&f.dataFrames)
+	out.Throughput = f.throughput.Rate()
+	return out
+}
+
+// wrapError annotates err with the stream's context.
+func (f *flowControl) wrapError(err error) error {
+	return common.WrapStreamError(err, f.streamID, f.path, f.conn.remoteAddr)
+}
+
+// newStreamRateLimiter returns the rate limiter for a
+// new stream, or nil if streams are not rate limited.
+func (c *Conn) newStreamRateLimiter() *common.RateLimiter {
+	c.rateLimitLock.Lock()
+	defer c.rateLimitLock.Unlock()
+	return common.NewRateLimiter(c.streamRateLimit, 0)
+}
+
+// waitRateLimit blocks until n bytes of DATA may be sent
+// under both the stream's limit and the connection's
+// limit. If the connection closes first, waitRateLimit
+// returns false.
+func (c *Conn) waitRateLimit(stream *common.RateLimiter, n int) bool {
+	c.rateLimitLock.Lock()
+	conn := c.connRateLimit
+	c.rateLimitLock.Unlock()
+
+	return stream.Wait(n, c.stop) && conn.Wait(n, c.stop)
 }
@@ -0,0 +1,69 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"fmt"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// SetFrameSizes sets the size of the largest frame, including
+// its 8-byte header, which the connection accepts, and the size
+// of the largest DATA payload it sends. Larger DATA frames are
+// discarded, and their streams reset with FRAME_TOO_LARGE, while
+// other larger frames end the connection. SetFrameSizes must be
+// called before Run.
+func (c *Conn) SetFrameSizes(maxFrame, dataChunk int) error {
+	if err := common.CheckFrameSizes(maxFrame, dataChunk); err != nil {
+		return err
+	}
+	c.maxFrameSize = maxFrame
+	c.dataChunkSize = dataChunk
+	return nil
+}
+
+// checkFrameSize enforces the maximum frame size on the
+// next frame, before it is read. An oversized DATA frame
+// is discarded, and its stream reset with FRAME_TOO_LARGE.
+// Any other oversized frame ends the connection, as the
+// compression state would be lost if its header block was
+// skipped. checkFrameSize reports whether the frame has
+// been discarded, and whether the connection has ended.
+func (c *Conn) checkFrameSize() (discarded, end bool) {
+	size, err := frames.PeekFrameSize(c.buf)
+	if err != nil {
+		return false, false // ReadFrame will report the error.
+	}
+	if size <= c.maxFrameSize {
+		return false, false
+	}
+
+	header, _ := c.buf.Peek(8)
+	sid := frames.PeekStreamID(c.buf)
+	if header[0]&0x80 != 0 {
+		err := fmt.Errorf("Error: Received %d-byte control frame, exceeding the limit of %d bytes.", size, c.maxFrameSize)
+		log.Println(err)
+		c.fatalError(sid, common.RST_STREAM_FRAME_TOO_LARGE, err)
+		return false, true
+	}
+
+	frame := new(frames.DATA)
+	frame.StreamID = sid
+	frame.Flags = common.Flags(header[4])
+	if _, err := c.buf.Discard(size); err != nil {
+		c.handleReadWriteError(err)
+		return false, true
+	}
+	c.recordReceived(frame, c.readCounter.N)
+	c.readCounter.N = 0
+
+	debug.Printf("Discarding %d-byte DATA frame on stream %d.\n", size, frame.StreamID)
+	if c.receiveConnectionData(size - 8) {
+		c.resetReceived(frame.StreamID, common.RST_STREAM_FRAME_TOO_LARGE, common.FrameTooLarge)
+	}
+	return true, false
+}
@@ -6,8 +6,8 @@ package frames
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/SlyMarbo/spdy/common"
 )
@@ -19,22 +19,29 @@ func ReadFrame(reader *bufio.Reader, subversion int) (frame common.Frame, err er
 		return nil, err
 	}
 
+	frame, err = newFrame(start, subversion)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = frame.ReadFrom(reader)
+	return frame, err
+}
+
+// newFrame returns an empty frame of the type given
+// by the first four bytes of its encoding.
+func newFrame(start []byte, subversion int) (frame common.Frame, err error) {
+	if err := checkSubversion(subversion); err != nil {
+		return nil, err
+	}
+
 	if start[0] != 128 {
-		frame = new(DATA)
-		_, err = frame.ReadFrom(reader)
-		return frame, err
+		return new(DATA), nil
 	}
 
 	switch common.BytesToUint16(start[2:4]) {
 	case _SYN_STREAM:
-		switch subversion {
-		case 0:
-			frame = new(SYN_STREAM)
-		case 1:
-			frame = new(SYN_STREAMV3_1)
-		default:
-			return nil, fmt.Errorf("Error: Given subversion %d is unrecognised.", subversion)
-		}
+		frame = &SYN_STREAM{subversion: subversion}
 	case _SYN_REPLY:
 		frame = new(SYN_REPLY)
 	case _RST_STREAM:
@@ -53,11 +60,43 @@ func ReadFrame(reader *bufio.Reader, subversion int) (frame common.Frame, err er
 		frame = new(CREDENTIAL)
 
 	default:
-		return nil, errors.New("Error Failed to parse frame type.")
+		frame = new(UNKNOWN)
 	}
 
-	_, err = frame.ReadFrom(reader)
-	return frame, err
+	return frame, nil
+}
+
+// PeekStreamID returns the stream ID of the next frame in
+// reader, without consuming it, or 0 if the frame has none
+// or cannot be read. The frame must be at least 12 bytes
+// long.
+func PeekStreamID(reader *bufio.Reader) common.StreamID {
+	start, err := reader.Peek(12)
+	if err != nil {
+		return 0
+	}
+
+	if start[0] != 128 {
+		return common.StreamID(common.BytesToUint32(start[0:4]) & common.MAX_STREAM_ID)
+	}
+
+	switch common.BytesToUint16(start[2:4]) {
+	case _SYN_STREAM, _SYN_REPLY, _RST_STREAM, _HEADERS, _WINDOW_UPDATE:
+		return common.StreamID(common.BytesToUint32(start[8:12]) & common.MAX_STREAM_ID)
+	}
+	return 0
+}
+
+// PeekFrameSize returns the size of the next frame in reader,
+// including its 8-byte header, without consuming it. This is
+// the number of bytes which ReadFrame will consume, if the
+// frame is valid.
+func PeekFrameSize(reader *bufio.Reader) (int, error) {
+	header, err := reader.Peek(8)
+	if err != nil {
+		return 0, err
+	}
+	return 8 + int(common.BytesToUint24(header[5:8])), nil
 }
 
 // controlFrameCommonProcessing performs checks identical between
@@ -121,3 +160,68 @@ var frameNames = map[int]string{
 	_CONTROL_FRAME: "CONTROL_FRAME",
 	_DATA_FRAME:    "DATA_FRAME",
 }
+
+// frameFlag names a flag, for use in frame summaries
+// and JSON. Flag values are only meaningful for the
+// frame types that use them.
+type frameFlag struct {
+	flag common.Flags
+	name string
+}
+
+var (
+	flagFIN            = frameFlag{common.FLAG_FIN, "FIN"}
+	flagUnidirectional = frameFlag{common.FLAG_UNIDIRECTIONAL, "UNIDIRECTIONAL"}
+	flagClearSettings  = frameFlag{common.FLAG_SETTINGS_CLEAR_SETTINGS, "CLEAR_SETTINGS"}
+	flagDataChecksum   = frameFlag{common.FLAG_DATA_CHECKSUM, "DATA_CHECKSUM"}
+	flagPersistValue   = frameFlag{common.FLAG_SETTINGS_PERSIST_VALUE, "PERSIST_VALUE"}
+	flagPersisted      = frameFlag{common.FLAG_SETTINGS_PERSISTED, "PERSISTED"}
+)
+
+// flagNames gives the names of the known flags set in
+// flags. Any other bits set are given in hex.
+func flagNames(flags common.Flags, known ...frameFlag) []string {
+	names := []string{}
+	for _, f := range known {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#02x", byte(flags)))
+	}
+
+	return names
+}
+
+// summaryFlags gives the flags part of a frame summary,
+// which is omitted if no flags are set.
+func summaryFlags(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return " flags=" + strings.Join(names, "|")
+}
+
+// settingJSON is the JSON form of a single setting.
+type settingJSON struct {
+	ID    string   `json:"id"`
+	Flags []string `json:"flags"`
+	Value uint32   `json:"value"`
+}
+
+// settingsJSON gives the settings in JSON form, sorted by
+// ID.
+func settingsJSON(settings common.Settings) []settingJSON {
+	out := []settingJSON{}
+	for _, setting := range settings.Settings() {
+		out = append(out, settingJSON{
+			ID:    setting.ID.String(),
+			Flags: flagNames(setting.Flags, flagPersistValue, flagPersisted),
+			Value: setting.Value,
+		})
+	}
+
+	return out
+}
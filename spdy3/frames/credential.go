@@ -7,6 +7,8 @@ package frames
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
@@ -23,17 +25,39 @@ func (frame *CREDENTIAL) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *CREDENTIAL) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *CREDENTIAL) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *CREDENTIAL) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *CREDENTIAL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type         string `json:"type"`
+		Version      int    `json:"version"`
+		Slot         uint16 `json:"slot"`
+		Proof        []byte `json:"proof"`
+		Certificates int    `json:"certificates"`
+	}{frame.Name(), 3, frame.Slot, frame.Proof, len(frame.Certificates)})
+}
+
 func (frame *CREDENTIAL) Name() string {
 	return "CREDENTIAL"
 }
 
 func (frame *CREDENTIAL) ReadFrom(reader io.Reader) (int64, error) {
 	c := common.ReadCounter{R: reader}
-	data, err := common.ReadExactly(&c, 18)
+	data, err := common.ReadExactly(&c, 14)
 	if err != nil {
 		return c.N, err
 	}
@@ -51,35 +75,39 @@ func (frame *CREDENTIAL) ReadFrom(reader io.Reader) (int64, error) {
 		return c.N, common.FrameTooLarge
 	}
 
+	// Check the proof fits in the frame.
+	proofLen := int(common.BytesToUint32(data[10:14]))
+	if proofLen < 0 || proofLen > length-6 {
+		return c.N, common.IncorrectDataLength(length, 6+proofLen)
+	}
+
 	// Read in data.
-	certs, err := common.ReadExactly(&c, length-10)
+	rest, err := common.ReadExactly(&c, length-6)
 	if err != nil {
 		return c.N, err
 	}
 
 	frame.Slot = common.BytesToUint16(data[8:10])
-	proofLen := int(common.BytesToUint32(data[10:14]))
-	if proofLen > 0 {
-		frame.Proof = data[14 : 14+proofLen]
-	} else {
-		frame.Proof = []byte{}
-	}
-
-	numCerts := 0
-	for offset := 0; offset < length-10; {
-		offset += int(common.BytesToUint32(certs[offset:offset+4])) + 4
-		numCerts++
-	}
-
-	frame.Certificates = make([]*x509.Certificate, numCerts)
-	for i, offset := 0, 0; offset < length-10; i++ {
-		length := int(common.BytesToUint32(certs[offset : offset+4]))
-		rawCert := certs[offset+4 : offset+4+length]
-		frame.Certificates[i], err = x509.ParseCertificate(rawCert)
+	frame.Proof = rest[:proofLen]
+	certs := rest[proofLen:]
+
+	// Each certificate is prefixed with its length.
+	frame.Certificates = make([]*x509.Certificate, 0, 1)
+	for offset := 0; offset < len(certs); {
+		if len(certs)-offset < 4 {
+			return c.N, errors.New("Error: Truncated certificate length.")
+		}
+		certLen := int(common.BytesToUint32(certs[offset : offset+4]))
+		offset += 4
+		if certLen < 0 || certLen > len(certs)-offset {
+			return c.N, errors.New("Error: Truncated certificate.")
+		}
+		cert, err := x509.ParseCertificate(certs[offset : offset+certLen])
 		if err != nil {
 			return c.N, err
 		}
-		offset += length + 4
+		frame.Certificates = append(frame.Certificates, cert)
+		offset += certLen
 	}
 
 	return c.N, nil
@@ -97,12 +125,18 @@ func (frame *CREDENTIAL) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *CREDENTIAL) Summary() string {
+	return fmt.Sprintf("CREDENTIAL slot=%d proof=%d certificates=%d", frame.Slot, len(frame.Proof),
+		len(frame.Certificates))
+}
+
 func (frame *CREDENTIAL) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	proofLength := len(frame.Proof)
 	certsLength := 0
 	for _, cert := range frame.Certificates {
-		certsLength += len(cert.Raw)
+		certsLength += 4 + len(cert.Raw)
 	}
 
 	length := 6 + proofLength + certsLength
@@ -135,13 +169,22 @@ func (frame *CREDENTIAL) WriteTo(writer io.Writer) (int64, error) {
 		}
 	}
 
-	written := int64(14 + len(frame.Proof))
 	for _, cert := range frame.Certificates {
+		certLength := len(cert.Raw)
+		prefix := []byte{
+			byte(certLength >> 24), // Certificate Length
+			byte(certLength >> 16), // Certificate Length
+			byte(certLength >> 8),  // Certificate Length
+			byte(certLength),       // Certificate Length
+		}
+		err = common.WriteExactly(&c, prefix)
+		if err != nil {
+			return c.N, err
+		}
 		err = common.WriteExactly(&c, cert.Raw)
 		if err != nil {
 			return c.N, err
 		}
-		written += int64(len(cert.Raw))
 	}
 
 	return c.N, nil
@@ -6,8 +6,10 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -23,10 +25,38 @@ func (frame *DATA) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *DATA) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *DATA) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *DATA) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *DATA) MarshalJSON() ([]byte, error) {
+	var data []byte
+	if common.VerboseLogging {
+		data = frame.Data
+	}
+
+	return json.Marshal(struct {
+		Type     string          `json:"type"`
+		Version  int             `json:"version"`
+		Flags    []string        `json:"flags"`
+		StreamID common.StreamID `json:"stream_id"`
+		Length   int             `json:"length"`
+		Data     []byte          `json:"data,omitempty"`
+	}{frame.Name(), 3, flagNames(frame.Flags, flagFIN, flagDataChecksum), frame.StreamID, len(frame.Data), data})
+}
+
 func (frame *DATA) Name() string {
 	return "DATA"
 }
@@ -44,7 +74,7 @@ func (frame *DATA) ReadFrom(reader io.Reader) (int64, error) {
 	}
 
 	// Check flags.
-	if data[4] & ^byte(common.FLAG_FIN) != 0 {
+	if data[4] & ^byte(common.FLAG_FIN|common.FLAG_DATA_CHECKSUM) != 0 {
 		return c.N, common.InvalidField("flags", int(data[4]), common.FLAG_FIN)
 	}
 
@@ -70,6 +100,19 @@ func (frame *DATA) ReadFrom(reader io.Reader) (int64, error) {
 		frame.Data = []byte{}
 	}
 
+	// Verify and remove any checksum.
+	if frame.Flags.DATA_CHECKSUM() {
+		if length < 4 {
+			return c.N, common.IncorrectDataLength(length, 4)
+		}
+		payload := frame.Data[:length-4]
+		expected := common.BytesToUint32(frame.Data[length-4:])
+		frame.Data = payload
+		if actual := crc32.ChecksumIEEE(payload); actual != expected {
+			return c.N, &common.ChecksumError{StreamID: frame.StreamID, Expected: expected, Actual: actual}
+		}
+	}
+
 	return c.N, nil
 }
 
@@ -80,6 +123,9 @@ func (frame *DATA) String() string {
 	if frame.Flags.FIN() {
 		flags += " common.FLAG_FIN"
 	}
+	if frame.Flags.DATA_CHECKSUM() {
+		flags += " common.FLAG_DATA_CHECKSUM"
+	}
 	if flags == "" {
 		flags = "[NONE]"
 	} else {
@@ -100,6 +146,12 @@ func (frame *DATA) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *DATA) Summary() string {
+	return fmt.Sprintf("DATA stream=%d%s length=%d", frame.StreamID,
+		summaryFlags(flagNames(frame.Flags, flagFIN, flagDataChecksum)), len(frame.Data))
+}
+
 func (frame *DATA) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	length := len(frame.Data)
@@ -110,6 +162,20 @@ func (frame *DATA) WriteTo(writer io.Writer) (int64, error) {
 		return c.N, errors.New("Error: Data is empty.")
 	}
 
+	var checksum []byte
+	if frame.Flags.DATA_CHECKSUM() {
+		checksum = make([]byte, 4)
+		sum := crc32.ChecksumIEEE(frame.Data)
+		checksum[0] = byte(sum >> 24)
+		checksum[1] = byte(sum >> 16)
+		checksum[2] = byte(sum >> 8)
+		checksum[3] = byte(sum)
+		length += 4
+		if length > common.MAX_DATA_SIZE {
+			return c.N, errors.New("Error: Data size too large.")
+		}
+	}
+
 	out := make([]byte, 8)
 
 	out[0] = frame.StreamID.B1() // Control bit and Stream ID
@@ -129,5 +195,11 @@ func (frame *DATA) WriteTo(writer io.Writer) (int64, error) {
 		return c.N, err
 	}
 
+	if checksum != nil {
+		if err := common.WriteExactly(&c, checksum); err != nil {
+			return c.N, err
+		}
+	}
+
 	return c.N, nil
 }
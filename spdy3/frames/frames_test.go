@@ -0,0 +1,478 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package frames
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// goldenFrames maps each file in testdata to the frame it
+// encodes. Frames with header blocks give the offset of the
+// block, which is copied from the file, as the compressed
+// form of a header is not canonical.
+var goldenFrames = []struct {
+	file       string
+	subversion int
+	frame      common.Frame
+	header     int
+}{
+	{"syn_stream.hex", 0, &SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Priority: 3}, 18},
+	{"syn_stream.hex", 1, &SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Priority: 3, subversion: 1}, 18},
+	{"syn_reply.hex", 0, &SYN_REPLY{StreamID: 1}, 12},
+	{"rst_stream.hex", 0, &RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL}, 0},
+	{"settings.hex", 0, &SETTINGS{Settings: common.Settings{
+		common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
+			Flags: common.FLAG_SETTINGS_PERSIST_VALUE,
+			ID:    common.SETTINGS_MAX_CONCURRENT_STREAMS,
+			Value: 100,
+		},
+	}}, 0},
+	{"ping.hex", 0, &PING{PingID: 1}, 0},
+	{"goaway.hex", 0, &GOAWAY{LastGoodStreamID: 1, Status: common.GOAWAY_PROTOCOL_ERROR}, 0},
+	{"headers.hex", 0, &HEADERS{Flags: common.FLAG_FIN, StreamID: 1}, 12},
+	{"window_update.hex", 0, &WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1 << 16}, 0},
+	{"window_update.hex", 1, &WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1 << 16, subversion: 1}, 0},
+	{"credential.hex", 0, &CREDENTIAL{Slot: 1, Proof: []byte("proof"), Certificates: []*x509.Certificate{}}, 0},
+	{"data.hex", 0, &DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("hello")}, 0},
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, test := range goldenFrames {
+		name := reflect.TypeOf(test.frame).Elem().Name()
+		golden := readGolden(t, test.file)
+		if test.header != 0 {
+			setRawHeader(test.frame, golden[test.header:])
+		}
+
+		size, err := PeekFrameSize(bufio.NewReader(bytes.NewReader(golden)))
+		if err != nil || size != len(golden) {
+			t.Errorf("%s: PeekFrameSize gave %d, %v, expected %d", name, size, err, len(golden))
+		}
+
+		buf := new(bytes.Buffer)
+		n, err := test.frame.WriteTo(buf)
+		if err != nil {
+			t.Errorf("%s: WriteTo: %v", name, err)
+		} else if !bytes.Equal(buf.Bytes(), golden) {
+			t.Errorf("%s: encoded as\n\t%x\nexpected\n\t%x", name, buf.Bytes(), golden)
+		} else if n != int64(len(golden)) {
+			t.Errorf("%s: WriteTo reported %d bytes, expected %d", name, n, len(golden))
+		}
+
+		r := bufio.NewReader(bytes.NewReader(golden))
+		frame, err := ReadFrame(r, test.subversion)
+		if err != nil {
+			t.Errorf("%s: ReadFrame: %v", name, err)
+			continue
+		}
+		if r.Buffered() != 0 {
+			t.Errorf("%s: %d bytes left unread", name, r.Buffered())
+		}
+		if !reflect.DeepEqual(frame, test.frame) {
+			t.Errorf("%s: decoded as\n%v\nexpected\n%v", name, frame, test.frame)
+		}
+
+		// Every truncation must fail cleanly.
+		for i := 0; i < len(golden); i++ {
+			r := bufio.NewReader(bytes.NewReader(golden[:i]))
+			if frame, err := ReadFrame(r, test.subversion); err == nil {
+				t.Errorf("%s: decoded %d of %d bytes as %v", name, i, len(golden), frame)
+			}
+		}
+
+		// As must a length too large for any frame.
+		oversized := append([]byte(nil), golden...)
+		copy(oversized[5:8], []byte{0xff, 0xff, 0xff})
+		r = bufio.NewReader(bytes.NewReader(oversized))
+		if frame, err := ReadFrame(r, test.subversion); err == nil {
+			t.Errorf("%s: decoded oversized frame as %v", name, frame)
+		}
+	}
+}
+
+// codec is implemented by every frame type.
+type codec interface {
+	common.Frame
+	Decode([]byte) error
+	Encode() ([]byte, error)
+}
+
+func TestDecodeEncode(t *testing.T) {
+	for _, test := range goldenFrames {
+		name := reflect.TypeOf(test.frame).Elem().Name()
+		golden := readGolden(t, test.file)
+		if test.header != 0 {
+			setRawHeader(test.frame, golden[test.header:])
+		}
+
+		out, err := test.frame.(codec).Encode()
+		if err != nil {
+			t.Errorf("%s: Encode: %v", name, err)
+		} else if !bytes.Equal(out, golden) {
+			t.Errorf("%s: encoded as\n\t%x\nexpected\n\t%x", name, out, golden)
+		}
+
+		frame := reflect.New(reflect.TypeOf(test.frame).Elem()).Interface().(codec)
+		setSubversion(frame, test.subversion)
+		if err := frame.Decode(golden); err != nil {
+			t.Errorf("%s: Decode: %v", name, err)
+		} else if !reflect.DeepEqual(frame, test.frame) {
+			t.Errorf("%s: decoded as\n%v\nexpected\n%v", name, frame, test.frame)
+		}
+
+		// Trailing data must be rejected.
+		if err := frame.Decode(append(golden, 0)); err == nil {
+			t.Errorf("%s: decoded frame with trailing data", name)
+		}
+	}
+}
+
+func TestDecodeZeroCopy(t *testing.T) {
+	golden := readGolden(t, "data.hex")
+	frame := new(DATA)
+	if err := frame.Decode(golden); err != nil {
+		t.Fatal(err)
+	}
+	if &frame.Data[0] != &golden[8] {
+		t.Error("DATA payload was copied")
+	}
+	if cap(frame.Data) != len(frame.Data) {
+		t.Errorf("DATA payload has capacity %d, expected %d", cap(frame.Data), len(frame.Data))
+	}
+}
+
+func TestFramer(t *testing.T) {
+	header := http.Header{":method": {"GET"}, ":path": {"/"}, ":host": {"example.com"}}
+	for subversion := 0; subversion <= 1; subversion++ {
+		// Header blocks share a compression context,
+		// so they can only be read by the same Framer.
+		sent := []common.Frame{
+			&SYN_STREAM{StreamID: 1, Priority: 3, Slot: 2, Header: header},
+			&WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1 << 16},
+			&HEADERS{StreamID: 1, Header: header},
+			&DATA{StreamID: 1, Flags: common.FLAG_FIN, Data: []byte("hello")},
+			&SYN_STREAM{StreamID: 3, Header: header},
+		}
+
+		buf := new(bytes.Buffer)
+		w, err := NewFramer(subversion, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range sent {
+			if err := w.WriteFrame(frame); err != nil {
+				t.Fatalf("subversion %d: WriteFrame: %v", subversion, err)
+			}
+		}
+		w.Close()
+
+		r, err := NewFramer(subversion, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range sent {
+			frame, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("subversion %d: ReadFrame: %v", subversion, err)
+			}
+			if reflect.TypeOf(frame) != reflect.TypeOf(want) {
+				t.Fatalf("subversion %d: read %s, expected %s", subversion, frame.Name(), want.Name())
+			}
+			switch frame := frame.(type) {
+			case *SYN_STREAM:
+				// SPDY/3.1 has no credential slots.
+				sent := want.(*SYN_STREAM)
+				slot := sent.Slot
+				if subversion == 1 {
+					slot = 0
+				}
+				if frame.StreamID != sent.StreamID || frame.Priority != sent.Priority || frame.Slot != slot ||
+					!reflect.DeepEqual(frame.Header, header) {
+					t.Errorf("subversion %d: read\n%v\nexpected\n%v", subversion, frame, sent)
+				}
+			case *HEADERS:
+				if !reflect.DeepEqual(frame.Header, header) {
+					t.Errorf("subversion %d: read header %v", subversion, frame.Header)
+				}
+			default:
+				setSubversion(want, subversion)
+				if !reflect.DeepEqual(frame, want) {
+					t.Errorf("subversion %d: read\n%v\nexpected\n%v", subversion, frame, want)
+				}
+			}
+		}
+		if frame, err := r.ReadFrame(); err != io.EOF {
+			t.Errorf("subversion %d: expected io.EOF, got %v, %v", subversion, frame, err)
+		}
+	}
+
+	// Only SPDY/3.1 has a session window.
+	golden := readGolden(t, "window_update.hex")
+	copy(golden[8:12], []byte{0, 0, 0, 0})
+	for subversion, valid := range []bool{false, true} {
+		f, _ := NewFramer(subversion, bytes.NewBuffer(golden))
+		if _, err := f.ReadFrame(); (err == nil) != valid {
+			t.Errorf("subversion %d: session WINDOW_UPDATE gave %v", subversion, err)
+		}
+	}
+
+	if _, err := NewFramer(2, new(bytes.Buffer)); err == nil {
+		t.Error("NewFramer accepted subversion 2")
+	}
+
+	// Oversized frames are left unread.
+	golden = readGolden(t, "data.hex")
+	f, _ := NewFramer(0, bytes.NewBuffer(golden))
+	f.MaxFrameSize = len(golden) - 1
+	if frame, err := f.ReadFrame(); err != common.FrameTooLarge {
+		t.Errorf("expected common.FrameTooLarge, got %v, %v", frame, err)
+	}
+
+	// By default, frames of the largest legal length are read.
+	big := make([]byte, 8+common.MAX_FRAME_SIZE)
+	big[0], big[1], big[3] = 0x80, 3, 0xff // Unknown control frame.
+	big[5], big[6], big[7] = 0xff, 0xff, 0xff
+	f, _ = NewFramer(0, bytes.NewBuffer(big))
+	if _, err := f.ReadFrame(); err != nil {
+		t.Errorf("expected largest frame to be read, got %v", err)
+	}
+}
+
+func TestSummaryAndJSON(t *testing.T) {
+	for _, test := range goldenFrames {
+		summary := test.frame.Summary()
+		if !strings.HasPrefix(summary, test.frame.Name()) || strings.Contains(summary, "\n") {
+			t.Errorf("%s: bad summary %q", test.frame.Name(), summary)
+		}
+
+		var out struct {
+			Type    string
+			Version int
+		}
+		data, err := json.Marshal(test.frame)
+		if err != nil {
+			t.Errorf("%s: MarshalJSON: %v", test.frame.Name(), err)
+		} else if err = json.Unmarshal(data, &out); err != nil || out.Type != test.frame.Name() || out.Version != 3 {
+			t.Errorf("%s: bad JSON %s (%v)", test.frame.Name(), data, err)
+		}
+	}
+
+	summaries := []struct {
+		frame common.Frame
+		want  string
+	}{
+		{&SYN_STREAM{Flags: common.FLAG_FIN, StreamID: 1, Priority: 3, Header: http.Header{"Host": {"a"}}},
+			"SYN_STREAM stream=1 assoc=0 priority=3 flags=FIN headers=1"},
+		{&DATA{StreamID: 3, Flags: common.FLAG_FIN | common.FLAG_DATA_CHECKSUM | 0x40, Data: []byte("hi")},
+			"DATA stream=3 flags=FIN|DATA_CHECKSUM|0x40 length=2"},
+		{&SETTINGS{Settings: common.Settings{
+			common.SETTINGS_INITIAL_WINDOW_SIZE:    &common.Setting{ID: common.SETTINGS_INITIAL_WINDOW_SIZE, Value: 1024},
+			common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{ID: common.SETTINGS_MAX_CONCURRENT_STREAMS, Value: 10},
+		}}, "SETTINGS MAX_CONCURRENT_STREAMS=10 INITIAL_WINDOW_SIZE=1024"},
+		{&GOAWAY{LastGoodStreamID: 5, Status: common.GOAWAY_PROTOCOL_ERROR}, "GOAWAY last=5 status=PROTOCOL_ERROR"},
+	}
+	for _, test := range summaries {
+		if got := test.frame.Summary(); got != test.want {
+			t.Errorf("Expected summary %q, got %q", test.want, got)
+		}
+	}
+
+	data, err := json.Marshal(&RST_STREAM{StreamID: 1, Status: common.RST_STREAM_CANCEL})
+	want := `{"type":"RST_STREAM","version":3,"stream_id":1,"status":"CANCEL","status_code":5}`
+	if err != nil || string(data) != want {
+		t.Errorf("Expected JSON %s, got %s (%v)", want, data, err)
+	}
+}
+
+func TestGoldenHeaders(t *testing.T) {
+	decom := common.NewDecompressor(3)
+	golden := readGolden(t, "syn_stream.hex")
+	frame, err := ReadFrame(bufio.NewReader(bytes.NewReader(golden)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := frame.Decompress(decom); err != nil {
+		t.Fatal(err)
+	}
+	header := frame.(*SYN_STREAM).Header
+	if header.Get(":method") != "GET" || header.Get(":path") != "/" || header.Get(":host") != "example.com" {
+		t.Errorf("Unexpected header %v", header)
+	}
+}
+
+func TestCookieCrumbs(t *testing.T) {
+	header := http.Header{"Cookie": {"a=1; b=2", "c=3;"}}
+	block, err := common.NewCompressor(3).Compress(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each cookie is sent as a separate value.
+	r, err := zlib.NewReaderDict(bytes.NewReader(block), common.HeaderDictionaryV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte("a=1\x00b=2\x00c=3")) {
+		t.Errorf("Cookies were not crumbled: %q", raw)
+	}
+
+	// And rejoined when received.
+	got, err := common.NewDecompressor(3).Decompress(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookies := got["Cookie"]; len(cookies) != 1 || cookies[0] != "a=1; b=2; c=3" {
+		t.Errorf("Cookies were not rejoined: %q", cookies)
+	}
+}
+
+func TestHeaderValues(t *testing.T) {
+	header := http.Header{
+		"Accept":  {"text/html", "", "text/plain"},
+		"X-Empty": {""},
+		"X-Nul":   {"a\x00b", "c"},
+	}
+	block, err := common.NewCompressor(3).Compress(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := common.NewDecompressor(3).Decompress(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := http.Header{
+		"Accept":  {"text/html", "text/plain"},
+		"X-Empty": {""},
+		"X-Nul":   {"c"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decompressed %q, expected %q", got, want)
+	}
+
+	// Blocks with empty values among several are malformed,
+	// but leave the decompressor able to read the next block.
+	buf := new(bytes.Buffer)
+	w, err := zlib.NewWriterLevelDict(buf, zlib.DefaultCompression, common.HeaderDictionaryV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decom := common.NewDecompressor(3)
+	for _, test := range []struct {
+		value string
+		err   error
+	}{
+		{"a\x00", common.ErrMalformedHeader},
+		{"\x00a", common.ErrMalformedHeader},
+		{"a\x00\x00b", common.ErrMalformedHeader},
+		{"a\x00b", nil},
+		{"", nil},
+	} {
+		w.Write(rawHeaderBlock("x-test", test.value))
+		w.Flush()
+		block := append([]byte(nil), buf.Bytes()...)
+		buf.Reset()
+		if _, err := decom.Decompress(block); err != test.err {
+			t.Errorf("Value %q gave %v, expected %v", test.value, err, test.err)
+		}
+	}
+}
+
+// rawHeaderBlock returns an uncompressed SPDY/3
+// header block with a single name and value.
+func TestStatusNames(t *testing.T) {
+	tests := []struct {
+		frame common.Frame
+		want  string
+	}{
+		{&RST_STREAM{StreamID: 1, Status: common.RST_STREAM_FLOW_CONTROL_ERROR}, "FLOW_CONTROL_ERROR (7)"},
+		{&RST_STREAM{StreamID: 1, Status: 12}, "StatusCode(12) (12)"},
+		{&GOAWAY{Status: common.GOAWAY_INTERNAL_ERROR}, "INTERNAL_ERROR (2)"},
+		{&GOAWAY{Status: 4}, "GoawayStatus(4) (4)"},
+		{&SETTINGS{Settings: common.Settings{
+			common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{ID: common.SETTINGS_INITIAL_WINDOW_SIZE},
+		}}, "INITIAL_WINDOW_SIZE:"},
+		{&SETTINGS{Settings: common.Settings{
+			9: &common.Setting{ID: 9},
+		}}, "SettingID(9):"},
+	}
+
+	for _, test := range tests {
+		if s := test.frame.String(); !strings.Contains(s, test.want) {
+			t.Errorf("Expected %s to contain %q, got:\n%s", test.frame.Name(), test.want, s)
+		}
+	}
+
+	if err := (&GOAWAY{Status: common.GOAWAY_FLOW_CONTROL_ERROR}).Error(); err != "FLOW_CONTROL_ERROR" {
+		t.Errorf("Expected GOAWAY error FLOW_CONTROL_ERROR, got %q.", err)
+	}
+}
+
+func rawHeaderBlock(name, value string) []byte {
+	out := []byte{0, 0, 0, 1}
+	for _, s := range []string{name, value} {
+		n := len(s)
+		out = append(out, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		out = append(out, s...)
+	}
+	return out
+}
+
+// readGolden reads a frame's encoding from testdata. Lines
+// starting with # are comments, and whitespace is ignored.
+func readGolden(t *testing.T, file string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			digits = append(digits, strings.Fields(line)...)
+		}
+	}
+	out, err := hex.DecodeString(strings.Join(digits, ""))
+	if err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return out
+}
+
+func setSubversion(frame common.Frame, subversion int) {
+	switch frame := frame.(type) {
+	case *SYN_STREAM:
+		frame.subversion = subversion
+	case *WINDOW_UPDATE:
+		frame.subversion = subversion
+	}
+}
+
+func setRawHeader(frame common.Frame, header []byte) {
+	switch frame := frame.(type) {
+	case *SYN_STREAM:
+		frame.rawHeader = header
+	case *SYN_REPLY:
+		frame.rawHeader = header
+	case *HEADERS:
+		frame.rawHeader = header
+	}
+}
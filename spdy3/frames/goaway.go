@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -14,23 +15,41 @@ import (
 
 type GOAWAY struct {
 	LastGoodStreamID common.StreamID
-	Status           common.StatusCode
+	Status           common.GoawayStatus
 }
 
 func (frame *GOAWAY) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *GOAWAY) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *GOAWAY) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
 func (frame *GOAWAY) Error() string {
-	if err := frame.Status.String(); err != "" {
-		return err
-	}
+	return frame.Status.String()
+}
 
-	return fmt.Sprintf("[unknown status code %d]", frame.Status)
+// Encode returns the frame's serialised form.
+func (frame *GOAWAY) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *GOAWAY) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type             string          `json:"type"`
+		Version          int             `json:"version"`
+		LastGoodStreamID common.StreamID `json:"last_good_stream_id"`
+		Status           string          `json:"status"`
+		StatusCode       uint32          `json:"status_code"`
+	}{frame.Name(), 3, frame.LastGoodStreamID, frame.Status.String(), uint32(frame.Status)})
 }
 
 func (frame *GOAWAY) Name() string {
@@ -56,7 +75,7 @@ func (frame *GOAWAY) ReadFrom(reader io.Reader) (int64, error) {
 	}
 
 	frame.LastGoodStreamID = common.StreamID(common.BytesToUint32(data[8:12]))
-	frame.Status = common.StatusCode(common.BytesToUint32(data[12:16]))
+	frame.Status = common.GoawayStatus(common.BytesToUint32(data[12:16]))
 
 	if !frame.LastGoodStreamID.Valid() {
 		return c.N, common.StreamIdTooLarge
@@ -76,6 +95,11 @@ func (frame *GOAWAY) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *GOAWAY) Summary() string {
+	return fmt.Sprintf("GOAWAY last=%d status=%s", frame.LastGoodStreamID, frame.Status)
+}
+
 func (frame *GOAWAY) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	if !frame.LastGoodStreamID.Valid() {
@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -19,7 +20,7 @@ type SETTINGS struct {
 	Settings common.Settings
 }
 
-func (frame *SETTINGS) Add(flags common.Flags, id uint32, value uint32) {
+func (frame *SETTINGS) Add(flags common.Flags, id common.SettingID, value uint32) {
 	frame.Settings[id] = &common.Setting{flags, id, value}
 }
 
@@ -27,10 +28,31 @@ func (frame *SETTINGS) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *SETTINGS) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *SETTINGS) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *SETTINGS) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *SETTINGS) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string        `json:"type"`
+		Version  int           `json:"version"`
+		Flags    []string      `json:"flags"`
+		Settings []settingJSON `json:"settings"`
+	}{frame.Name(), 3, flagNames(frame.Flags, flagClearSettings), settingsJSON(frame.Settings)})
+}
+
 func (frame *SETTINGS) Name() string {
 	return "SETTINGS"
 }
@@ -107,6 +129,18 @@ func (frame *SETTINGS) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *SETTINGS) Summary() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("SETTINGS")
+	buf.WriteString(summaryFlags(flagNames(frame.Flags, flagClearSettings)))
+	for _, setting := range frame.Settings.Settings() {
+		buf.WriteString(fmt.Sprintf(" %s=%d", setting.ID, setting.Value))
+	}
+
+	return buf.String()
+}
+
 func (frame *SETTINGS) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	settings := encodeSettings(frame.Settings)
@@ -147,7 +181,7 @@ func decodeSetting(data []byte) *common.Setting {
 
 	setting := new(common.Setting)
 	setting.Flags = common.Flags(data[0])
-	setting.ID = common.BytesToUint24(data[1:])
+	setting.ID = common.SettingID(common.BytesToUint24(data[1:]))
 	setting.Value = common.BytesToUint32(data[4:])
 
 	return setting
@@ -169,7 +203,7 @@ func encodeSettings(s common.Settings) []byte {
 
 	offset := 0
 	for _, id := range ids {
-		setting := s[uint32(id)]
+		setting := s[common.SettingID(id)]
 		out[offset] = byte(setting.Flags)
 		out[offset+1] = byte(setting.ID >> 16)
 		out[offset+2] = byte(setting.ID >> 8)
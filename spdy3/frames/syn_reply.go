@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +36,13 @@ func (frame *SYN_REPLY) Compress(com common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *SYN_REPLY) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *SYN_REPLY) Decompress(decom common.Decompressor) error {
 	if frame.Header != nil {
 		return nil
@@ -50,6 +58,21 @@ func (frame *SYN_REPLY) Decompress(decom common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *SYN_REPLY) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *SYN_REPLY) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string          `json:"type"`
+		Version  int             `json:"version"`
+		Flags    []string        `json:"flags"`
+		StreamID common.StreamID `json:"stream_id"`
+		Header   http.Header     `json:"header"`
+	}{frame.Name(), 3, flagNames(frame.Flags, flagFIN), frame.StreamID, frame.Header})
+}
+
 func (frame *SYN_REPLY) Name() string {
 	return "SYN_REPLY"
 }
@@ -108,6 +131,12 @@ func (frame *SYN_REPLY) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *SYN_REPLY) Summary() string {
+	return fmt.Sprintf("SYN_REPLY stream=%d%s headers=%d", frame.StreamID,
+		summaryFlags(flagNames(frame.Flags, flagFIN)), len(frame.Header))
+}
+
 func (frame *SYN_REPLY) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	if frame.rawHeader == nil {
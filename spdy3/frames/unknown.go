@@ -0,0 +1,135 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package frames
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// UNKNOWN is a control frame of a type not defined in
+// SPDY/3. The specification requires such frames to be
+// ignored, so they are read in full and then discarded.
+type UNKNOWN struct {
+	Type  uint16
+	Flags common.Flags
+	Data  []byte
+}
+
+func (frame *UNKNOWN) Compress(comp common.Compressor) error {
+	return nil
+}
+
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *UNKNOWN) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
+func (frame *UNKNOWN) Decompress(decomp common.Decompressor) error {
+	return nil
+}
+
+// Encode returns the frame's serialised form.
+func (frame *UNKNOWN) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *UNKNOWN) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type      string `json:"type"`
+		Version   int    `json:"version"`
+		FrameType uint16 `json:"frame_type"`
+		Flags     byte   `json:"flags"`
+		Length    int    `json:"length"`
+	}{frame.Name(), 3, frame.Type, byte(frame.Flags), len(frame.Data)})
+}
+
+func (frame *UNKNOWN) Name() string {
+	return "UNKNOWN"
+}
+
+func (frame *UNKNOWN) ReadFrom(reader io.Reader) (int64, error) {
+	c := common.ReadCounter{R: reader}
+	data, err := common.ReadExactly(&c, 8)
+	if err != nil {
+		return c.N, err
+	}
+
+	// Check it's a control frame.
+	if data[0] != 128 {
+		return c.N, common.IncorrectFrame(_DATA_FRAME, _CONTROL_FRAME, 3)
+	}
+
+	// Check version.
+	version := (uint16(data[0]&0x7f) << 8) + uint16(data[1])
+	if version != 3 {
+		return c.N, common.UnsupportedVersion(version)
+	}
+
+	frame.Type = common.BytesToUint16(data[2:4])
+	frame.Flags = common.Flags(data[4])
+
+	length := int(common.BytesToUint24(data[5:8]))
+	frame.Data, err = common.ReadExactly(&c, length)
+	if err != nil {
+		return c.N, err
+	}
+
+	return c.N, nil
+}
+
+func (frame *UNKNOWN) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString("UNKNOWN {\n\t")
+	buf.WriteString(fmt.Sprintf("Version:              3\n\t"))
+	buf.WriteString(fmt.Sprintf("Type:                 %d\n\t", frame.Type))
+	buf.WriteString(fmt.Sprintf("Flags:                %#04x\n\t", byte(frame.Flags)))
+	buf.WriteString(fmt.Sprintf("Length:               %d\n}\n", len(frame.Data)))
+
+	return buf.String()
+}
+
+// Summary gives a one-line description of the frame.
+func (frame *UNKNOWN) Summary() string {
+	return fmt.Sprintf("UNKNOWN type=%d flags=%#02x length=%d", frame.Type, byte(frame.Flags), len(frame.Data))
+}
+
+func (frame *UNKNOWN) WriteTo(writer io.Writer) (int64, error) {
+	c := common.WriteCounter{W: writer}
+	length := len(frame.Data)
+	if length > common.MAX_FRAME_SIZE-8 {
+		return 0, common.FrameTooLarge
+	}
+
+	out := make([]byte, 8)
+
+	out[0] = 128                   // Control bit and Version
+	out[1] = 3                     // Version
+	out[2] = byte(frame.Type >> 8) // Type
+	out[3] = byte(frame.Type)      // Type
+	out[4] = byte(frame.Flags)     // Flags
+	out[5] = byte(length >> 16)    // Length
+	out[6] = byte(length >> 8)     // Length
+	out[7] = byte(length)          // Length
+
+	err := common.WriteExactly(&c, out)
+	if err != nil {
+		return c.N, err
+	}
+
+	err = common.WriteExactly(&c, frame.Data)
+	if err != nil {
+		return c.N, err
+	}
+
+	return c.N, nil
+}
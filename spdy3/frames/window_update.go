@@ -6,6 +6,7 @@ package frames
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -23,10 +24,31 @@ func (frame *WINDOW_UPDATE) Compress(comp common.Compressor) error {
 	return nil
 }
 
+// Decode parses the frame from data, which must hold exactly
+// one frame. The frame may refer to data, which must not be
+// modified while the frame is in use.
+func (frame *WINDOW_UPDATE) Decode(data []byte) error {
+	return decode(frame, data)
+}
+
 func (frame *WINDOW_UPDATE) Decompress(decomp common.Decompressor) error {
 	return nil
 }
 
+// Encode returns the frame's serialised form.
+func (frame *WINDOW_UPDATE) Encode() ([]byte, error) {
+	return encode(frame)
+}
+
+func (frame *WINDOW_UPDATE) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type            string          `json:"type"`
+		Version         int             `json:"version"`
+		StreamID        common.StreamID `json:"stream_id"`
+		DeltaWindowSize uint32          `json:"delta_window_size"`
+	}{frame.Name(), 3, frame.StreamID, frame.DeltaWindowSize})
+}
+
 func (frame *WINDOW_UPDATE) Name() string {
 	return "WINDOW_UPDATE"
 }
@@ -55,7 +77,7 @@ func (frame *WINDOW_UPDATE) ReadFrom(reader io.Reader) (int64, error) {
 	if !frame.StreamID.Valid() {
 		return c.N, common.StreamIdTooLarge
 	}
-	if frame.StreamID.Zero() && frame.subversion == 0 {
+	if frame.StreamID.Zero() && !subversions[frame.subversion].sessionWindow {
 		return c.N, common.StreamIdIsZero
 	}
 	if frame.DeltaWindowSize > common.MAX_DELTA_WINDOW_SIZE {
@@ -76,6 +98,11 @@ func (frame *WINDOW_UPDATE) String() string {
 	return buf.String()
 }
 
+// Summary gives a one-line description of the frame.
+func (frame *WINDOW_UPDATE) Summary() string {
+	return fmt.Sprintf("WINDOW_UPDATE stream=%d delta=%d", frame.StreamID, frame.DeltaWindowSize)
+}
+
 func (frame *WINDOW_UPDATE) WriteTo(writer io.Writer) (int64, error) {
 	c := common.WriteCounter{W: writer}
 	out := make([]byte, 16)
@@ -0,0 +1,65 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// Export begins handing the connection off during a restart.
+// The connection is drained, so that the other endpoint opens
+// a new connection for any further streams, and its state is
+// returned, including the streams it will finish before
+// closing.
+func (c *Conn) Export() common.ConnHandoff {
+	c.Drain()
+
+	out := common.ConnHandoff{
+		State:   c.State(),
+		Streams: c.Streams(),
+	}
+	if conn := c.Conn(); conn != nil {
+		out.LocalAddr = conn.LocalAddr().String()
+		out.RemoteAddr = conn.RemoteAddr().String()
+	}
+	return out
+}
+
+// Import prepares a new connection to the same endpoint as
+// one exported by a previous process. On a client, settings
+// which the server flagged FLAG_SETTINGS_PERSIST_VALUE are
+// added to PersistedSettings, so that they are applied as
+// the connection starts and returned to the server. Other
+// settings are not imported, as the new connection's peer
+// has not sent them. Import must be called before Run.
+//
+// The stream table and connection windows are not restored,
+// since the new connection starts afresh with the other
+// endpoint.
+func (c *Conn) Import(handoff common.ConnHandoff) error {
+	if !strings.HasPrefix(handoff.State.Version, "spdy/3") {
+		return errors.New("Error: Cannot import state from a connection using " + handoff.State.Version + ".")
+	}
+	if handoff.State.Server != (c.server != nil) {
+		return errors.New("Error: Cannot import state from a connection with the other endpoint's role.")
+	}
+
+	if c.server != nil {
+		return nil // Only servers ask for settings to be persisted.
+	}
+	for id, setting := range handoff.State.ReceivedSettings {
+		if !setting.Flags.PERSIST_VALUE() {
+			continue
+		}
+		if c.PersistedSettings == nil {
+			c.PersistedSettings = make(common.Settings)
+		}
+		c.PersistedSettings[id] = &common.Setting{ID: id, Value: setting.Value}
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package spdy3
 import (
 	"net"
 	"time"
+
+	"github.com/SlyMarbo/spdy/common"
 )
 
 func (c *Conn) CloseNotify() <-chan bool {
@@ -10,9 +12,94 @@ func (c *Conn) CloseNotify() <-chan bool {
 }
 
 func (c *Conn) Conn() net.Conn {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
 	return c.conn
 }
 
+// Idle indicates whether the connection has
+// no active streams.
+func (c *Conn) Idle() bool {
+	return c.streams.len() == 0
+}
+
+// GoingAway indicates whether a GOAWAY has been sent
+// or received, so no new streams can be started.
+func (c *Conn) GoingAway() bool {
+	c.goawayLock.Lock()
+	defer c.goawayLock.Unlock()
+	return c.goawayReceived || c.goawaySent
+}
+
+// SetFairScheduling enables fair bandwidth sharing between the
+// streams in each priority class, measured over the given window.
+// A window of 0 disables fair scheduling. SetFairScheduling must
+// be called before Run.
+func (c *Conn) SetFairScheduling(window time.Duration) {
+	if window > 0 {
+		c.fair = newFairScheduler(window)
+	} else {
+		c.fair = nil
+	}
+}
+
+// SetWriteBatching sets the largest batch of frames held
+// before writing them to the network, while more frames are
+// waiting to be sent. A size of 0 disables batching.
+// SetWriteBatching must be called before Run.
+func (c *Conn) SetWriteBatching(size int) {
+	c.writeBatchSize = size
+}
+
+// SetWorkers limits the number of the connection's stream
+// handlers which run at once to limit. Streams opened while
+// the limit is reached are queued until a handler finishes,
+// rather than each being given its own goroutine. The handlers
+// also run in the global pool set by spdy.SetWorkers, if any.
+// A limit of 0 removes the connection's own limit. SetWorkers
+// must be called before Run.
+func (c *Conn) SetWorkers(limit int) {
+	c.workers = common.NewWorkerPool(limit, common.Workers)
+}
+
+// SetRoundRobin enables round robin scheduling between the
+// streams in each priority class, in which the streams with
+// data waiting take turns to send up to quantum bytes of DATA.
+// This replaces any fair scheduling enabled by
+// SetFairScheduling. A quantum of 0 disables round robin
+// scheduling. SetRoundRobin must be called before Run.
+func (c *Conn) SetRoundRobin(quantum int) {
+	if quantum > 0 {
+		c.fair = newRoundRobinScheduler(quantum)
+	} else {
+		c.fair = nil
+	}
+}
+
+// SetStarvationBound enables the starvation watchdog, so that
+// a priority class which makes no progress for longer than the
+// given bound, while higher-priority frames are sent, has its
+// waiting frames sent ahead of them. A bound of 0 disables the
+// watchdog. SetStarvationBound must be called before Run.
+func (c *Conn) SetStarvationBound(bound time.Duration) {
+	if bound > 0 {
+		c.starvation = newStarvationWatchdog(bound)
+	} else {
+		c.starvation = nil
+	}
+}
+
+// SetRateLimits limits the DATA sent by the connection as a
+// whole, and by each of its streams, to the given number of
+// bytes per second. A limit of 0 disables that limit. The
+// stream limit applies to streams opened after the call.
+func (c *Conn) SetRateLimits(connection, stream int64) {
+	c.rateLimitLock.Lock()
+	c.connRateLimit = common.NewRateLimiter(connection, 0)
+	c.streamRateLimit = stream
+	c.rateLimitLock.Unlock()
+}
+
 func (c *Conn) SetReadTimeout(d time.Duration) {
 	c.timeoutLock.Lock()
 	c.readTimeout = d
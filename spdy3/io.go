@@ -2,6 +2,7 @@ package spdy3
 
 import (
 	"runtime"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -30,22 +31,60 @@ func (c *Conn) readFrames() {
 		}
 
 		// ReadFrame takes care of the frame parsing for us.
+		c.reading = nil
 		c.refreshReadTimeout()
+		if discarded, end := c.checkFrameSize(); end {
+			return
+		} else if discarded {
+			continue
+		}
 		frame, err := frames.ReadFrame(c.buf, c.Subversion)
+		c.reading = frame
+		if checksumErr, ok := err.(*common.ChecksumError); ok {
+			// The connection is corrupting data, so it
+			// cannot be trusted.
+			err = c.wrapFrameError(err, frame)
+			c.criticalCheck(true, checksumErr.StreamID, "%v", err)
+			return
+		}
 		if err != nil {
-			c.handleReadWriteError(err)
+			c.handleReadError(err)
 			return
 		}
+		c.recordReceived(frame, c.readCounter.N)
+		c.readCounter.N = 0
+		misused := c.checkPeerStream(frame)
 
 		debug.Printf("Receiving %s:\n", frame.Name()) // Print frame type.
 
 		// Decompress the frame's headers, if there are any.
+		// The headers of a SYN_STREAM which misused its
+		// stream ID are only decompressed to keep the
+		// compression state in step.
 		err = frame.Decompress(c.decompressor)
+		if misused && (err == nil || err == common.ErrHeaderBlockTooLarge || err == common.ErrMalformedHeader) {
+			continue
+		}
+		if err == common.ErrHeaderBlockTooLarge || err == common.ErrMalformedHeader {
+			// The decompression state is intact, so
+			// only the stream need be refused.
+			c.checkHeaders(frame, err)
+			continue
+		}
+		if err != nil {
+			err = c.wrapFrameError(err, frame)
+		}
 		if c.criticalCheck(err != nil, 0, "Decompression: %v", err) {
 			return
 		}
 
 		debug.Println(frame) // Print frame once the content's been decompressed.
+		c.logHeaderBlock("Receiving", frame)
+		c.recordReceivedHeaders(frame)
+
+		if c.checkHeaders(frame, nil) {
+			continue
+		}
 
 		if c.processFrame(frame) {
 			return
@@ -66,6 +105,21 @@ func (c *Conn) send() {
 		}
 	}()
 
+	// The send loop is the only writer to the
+	// network connection, so it keeps its own
+	// reference, which shutdown does not clear.
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
+	if conn == nil {
+		return
+	}
+	c.writer = newBatchWriter(conn, c.writeBatchSize)
+	c.writer.capture = c.capture
+
+	// The highest stream ID opened by this endpoint.
+	var ownStreamID common.StreamID
+
 	for i := 1; ; i++ {
 		if i >= 5 {
 			i = 0 // Once per 5 frames, pick randomly.
@@ -83,38 +137,53 @@ func (c *Conn) send() {
 			return
 		}
 
+		// Drop any frames for streams which were never
+		// opened on this connection, such as those queued
+		// by a previous session.
+		if syn, ok := frame.(*frames.SYN_STREAM); ok && syn.StreamID > ownStreamID {
+			ownStreamID = syn.StreamID
+		} else if c.stale(frame, ownStreamID) {
+			debug.Printf("Dropping stale %s.\n", frame.Name())
+			c.stats.Add(common.Stats{StaleFrames: 1})
+			continue
+		}
+
 		// Process connection-level flow control.
 		if c.Subversion > 0 {
 			c.connectionWindowLock.Lock()
-			if frame, ok := frame.(*frames.DATA); ok {
-				size := int64(len(frame.Data))
+			if data, ok := frame.(*frames.DATA); ok {
+				size := int64(len(data.Data))
 				constrained := false
 				sending := size
 				if sending > c.connectionWindowSize {
 					sending = c.connectionWindowSize
 					constrained = true
 				}
-				if sending < 0 {
-					sending = 0
+				if sending <= 0 && size > 0 {
+					// Nothing can be sent, so hold the whole frame.
+					c.dataBuffer = append([]common.Frame{data}, c.dataBuffer...)
+					c.connectionWindowLock.Unlock()
+					continue
 				}
 
 				c.connectionWindowSize -= sending
 
 				if constrained {
-					// Chop off what we can send now.
+					// Chop off what we can send now. Only the
+					// last part of the frame may end the stream.
 					partial := new(frames.DATA)
-					partial.Flags = frame.Flags
-					partial.StreamID = frame.StreamID
+					partial.Flags = data.Flags &^ common.FLAG_FIN
+					partial.StreamID = data.StreamID
 					partial.Data = make([]byte, int(sending))
-					copy(partial.Data, frame.Data[:sending])
-					frame.Data = frame.Data[sending:]
+					copy(partial.Data, data.Data[:sending])
+					data.Data = data.Data[sending:]
 
 					// Buffer this frame and try again.
 					if c.dataBuffer == nil {
-						c.dataBuffer = []*frames.DATA{frame}
+						c.dataBuffer = []common.Frame{data}
 					} else {
-						buffer := make([]*frames.DATA, 1, len(c.dataBuffer)+1)
-						buffer[0] = frame
+						buffer := make([]common.Frame, 1, len(c.dataBuffer)+1)
+						buffer[0] = data
 						buffer = append(buffer, c.dataBuffer...)
 						c.dataBuffer = buffer
 					}
@@ -125,9 +194,15 @@ func (c *Conn) send() {
 			c.connectionWindowLock.Unlock()
 		}
 
+		// Add checksums to DATA frames, if negotiated.
+		if data, ok := frame.(*frames.DATA); ok && c.checksumsNegotiated() {
+			data.Flags |= common.FLAG_DATA_CHECKSUM
+		}
+
 		// Compress any name/value header blocks.
 		err := frame.Compress(c.compressor)
 		if err != nil {
+			err = c.wrapFrameError(err, frame)
 			log.Printf("Error in compression: %v (type %T).\n", err, frame)
 			c.Close()
 			return
@@ -135,14 +210,17 @@ func (c *Conn) send() {
 
 		debug.Printf("Sending %s:\n", frame.Name())
 		debug.Println(frame)
+		c.logHeaderBlock("Sending", frame)
 
 		// Leave the specifics of writing to the
 		// connection up to the frame.
 		c.refreshWriteTimeout()
-		if _, err = frame.WriteTo(c.conn); err != nil {
+		n, err := frame.WriteTo(c.writer)
+		if err != nil {
 			c.handleReadWriteError(err)
 			return
 		}
+		c.recordSent(frame, n)
 	}
 }
 
@@ -151,43 +229,156 @@ func (c *Conn) send() {
 // (a smaller number) first. If the given boolean is false,
 // this priority is temporarily ignored, which can be used
 // when high load is ignoring low-priority frames.
-func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
-	if c.Closed() {
-		return nil
+//
+// If the starvation watchdog is enabled, a frame from a
+// priority class which has been starved is sent first.
+//
+// DATA frames held back by connection-level flow control
+// are sent first, and any other DATA is held behind them,
+// so that each stream's data is sent in order. HEADERS
+// for a stream with DATA held are also held, and a
+// stream's held frames are discarded if it is reset.
+func (c *Conn) selectFrameToSend(prioritise bool) common.Frame {
+	for !c.Closed() {
+		if frame := c.starvedFrame(); frame != nil {
+			if !c.holdData(frame) {
+				return frame
+			}
+			continue
+		}
+
+		frame, priority := c.nextFrame(prioritise)
+		if frame == nil {
+			continue // Closed, or the connection window grew.
+		}
+		if priority >= 0 {
+			if c.starvation != nil {
+				c.starvation.progress(priority)
+			}
+			if c.holdData(frame) {
+				continue
+			}
+		}
+		return frame
+	}
+
+	return nil
+}
+
+// holdData adds a frame to those held back by
+// connection-level flow control, if it must follow
+// them, and reports whether it did so.
+func (c *Conn) holdData(frame common.Frame) bool {
+	if c.Subversion == 0 {
+		return false
+	}
+
+	c.connectionWindowLock.Lock()
+	defer c.connectionWindowLock.Unlock()
+	if len(c.dataBuffer) == 0 {
+		return false
+	}
+
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		// Fall through.
+
+	case *frames.HEADERS:
+		if !c.holdingStream(frame.StreamID) {
+			return false
+		}
+
+	case *frames.RST_STREAM:
+		// Nothing more may be sent on the stream.
+		held := c.dataBuffer[:0]
+		for _, f := range c.dataBuffer {
+			if streamID(f) != frame.StreamID {
+				held = append(held, f)
+			}
+		}
+		c.dataBuffer = held
+		return false
+
+	default:
+		return false
 	}
 
-	// Try buffered DATA frames first.
+	c.dataBuffer = append(c.dataBuffer, frame)
+	return true
+}
+
+// holdingStream indicates whether any frames are held
+// for the given stream. The caller must hold
+// connectionWindowLock.
+func (c *Conn) holdingStream(id common.StreamID) bool {
+	for _, frame := range c.dataBuffer {
+		if streamID(frame) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// streamID returns the stream ID of a held frame.
+func streamID(frame common.Frame) common.StreamID {
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		return frame.StreamID
+	case *frames.HEADERS:
+		return frame.StreamID
+	}
+	return 0
+}
+
+// nextFrame returns the next frame to send, as described
+// in selectFrameToSend, and its priority. The priority is
+// -1 for frames held back by connection-level flow
+// control. The frame is nil if the connection closes or
+// its window grows while waiting.
+func (c *Conn) nextFrame(prioritise bool) (frame common.Frame, priority int) {
+	// Try buffered frames first. Only DATA
+	// is constrained by the window.
 	if c.Subversion > 0 {
-		if c.dataBuffer != nil {
-			if len(c.dataBuffer) == 0 {
-				c.dataBuffer = nil
-			} else {
-				first := c.dataBuffer[0]
-				if c.connectionWindowSize >= int64(8+len(first.Data)) {
-					if len(c.dataBuffer) > 1 {
-						c.dataBuffer = c.dataBuffer[1:]
-					} else {
-						c.dataBuffer = nil
-					}
-					return first
-				}
+		c.connectionWindowLock.Lock()
+		if len(c.dataBuffer) > 0 {
+			first := c.dataBuffer[0]
+			if _, ok := first.(*frames.DATA); !ok || c.connectionWindowSize > 0 {
+				c.dataBuffer = c.dataBuffer[1:]
+				c.connectionWindowLock.Unlock()
+				return first, -1
 			}
 		}
+		c.connectionWindowLock.Unlock()
 	}
 
 	// Then in priority order.
 	if prioritise {
 		for i := 0; i < 8; i++ {
+			if c.fair != nil {
+				if frame = c.selectFairFrame(i); frame != nil {
+					return frame, i
+				}
+				continue
+			}
 			select {
 			case frame = <-c.output[i]:
-				return frame
+				return frame, i
 			default:
 			}
 		}
 
-		// No frames are immediately pending, so if the
-		// cection is being closed, cease sending
-		// safely.
+		// No frames are immediately pending, so write
+		// any batched frames. More may be pending once
+		// the write has finished, so check again.
+		if c.writer != nil && c.writer.Buffered() > 0 {
+			if !c.flushWrites() {
+				return nil, -1
+			}
+			return c.nextFrame(prioritise)
+		}
+
+		// If the connection is being closed, cease
+		// sending safely.
 		c.sendingLock.Lock()
 		if c.sending != nil {
 			close(c.sending)
@@ -198,24 +389,161 @@ func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
 	}
 
 	// Wait for any frame.
+	if c.fair != nil {
+		return c.waitFairFrame()
+	}
+	return c.receiveFrame()
+}
+
+// receiveFrame waits for a frame from any priority class,
+// choosing randomly between those which are ready, and
+// returns the frame and its priority. The frame is nil if
+// the connection closes or its window grows while waiting.
+// If no frame is ready, any batched frames are written
+// before waiting.
+func (c *Conn) receiveFrame() (frame common.Frame, priority int) {
 	select {
 	case frame = <-c.output[0]:
-		return frame
+		return frame, 0
 	case frame = <-c.output[1]:
-		return frame
+		return frame, 1
 	case frame = <-c.output[2]:
-		return frame
+		return frame, 2
 	case frame = <-c.output[3]:
-		return frame
+		return frame, 3
 	case frame = <-c.output[4]:
-		return frame
+		return frame, 4
 	case frame = <-c.output[5]:
-		return frame
+		return frame, 5
 	case frame = <-c.output[6]:
-		return frame
+		return frame, 6
 	case frame = <-c.output[7]:
-		return frame
+		return frame, 7
+	default:
+	}
+
+	if !c.flushWrites() {
+		return nil, -1
+	}
+
+	select {
+	case frame = <-c.output[0]:
+	case frame = <-c.output[1]:
+		priority = 1
+	case frame = <-c.output[2]:
+		priority = 2
+	case frame = <-c.output[3]:
+		priority = 3
+	case frame = <-c.output[4]:
+		priority = 4
+	case frame = <-c.output[5]:
+		priority = 5
+	case frame = <-c.output[6]:
+		priority = 6
+	case frame = <-c.output[7]:
+		priority = 7
+	case <-c.connectionWindowGrown:
+		return nil, -1
 	case _ = <-c.stop:
+		return nil, -1
+	}
+	return frame, priority
+}
+
+// flushWrites writes any batched frames to the network.
+// If this fails, the connection is closed, and false is
+// returned.
+func (c *Conn) flushWrites() bool {
+	if c.writer == nil || c.writer.Buffered() == 0 {
+		return true
+	}
+	c.refreshWriteTimeout()
+	if err := c.writer.Flush(); err != nil {
+		c.handleReadWriteError(err)
+		return false
+	}
+	return true
+}
+
+// starvedFrame returns a frame from the lowest priority
+// class which has made no progress for longer than the
+// starvation bound while higher-priority frames have been
+// sent, or nil if there is none. Each starved frame is
+// recorded, and reported to the StarvationHandler.
+func (c *Conn) starvedFrame() common.Frame {
+	w := c.starvation
+	if w == nil {
 		return nil
 	}
+
+	now := time.Now()
+	for i := 7; i > 0; i-- {
+		if !w.starving(i, now) {
+			continue
+		}
+
+		var frame common.Frame
+		if c.fair != nil {
+			frame = c.selectFairFrame(i)
+		} else {
+			select {
+			case frame = <-c.output[i]:
+			default:
+			}
+		}
+
+		if frame == nil {
+			w.idle(i, now) // Nothing is waiting.
+			continue
+		}
+
+		stalled := w.stalled(i, now)
+		w.progress(i)
+
+		c.stats.Add(common.Stats{StarvedFrames: 1})
+		if c.StarvationHandler != nil {
+			c.StarvationHandler(common.Priority(i), stalled)
+		}
+		return frame
+	}
+
+	return nil
+}
+
+// selectFairFrame returns the next frame to send from the
+// given priority class using fair scheduling, or nil if no
+// frames are pending at that priority.
+func (c *Conn) selectFairFrame(priority int) common.Frame {
+	for !c.fair.full(priority) {
+		select {
+		case frame := <-c.output[priority]:
+			if c.fair.admit(priority, frame) {
+				return frame
+			}
+			continue
+		default:
+		}
+		break
+	}
+	return c.fair.release(priority)
+}
+
+// waitFairFrame waits for any frame, as nextFrame, but
+// using fair scheduling. Held frames are sent first.
+func (c *Conn) waitFairFrame() (common.Frame, int) {
+	if frame, priority := c.fair.releaseAny(); frame != nil {
+		return frame, priority
+	}
+
+	frame, priority := c.receiveFrame()
+	if frame == nil {
+		return nil, -1
+	}
+
+	// Nothing else is waiting, so a held frame
+	// is sent anyway.
+	if !c.fair.admit(priority, frame) {
+		return c.fair.release(priority), priority
+	}
+	return frame, priority
 }
@@ -0,0 +1,57 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// SetMemoryBudget limits the memory used by the connection to
+// buffer data, as described for common.MemoryBudget. A budget
+// of 0 disables the limit. SetMemoryBudget must be called
+// before Run.
+func (c *Conn) SetMemoryBudget(budget int64) {
+	c.memory = common.NewMemoryAccount(budget, c.resumeWindows)
+}
+
+// MemoryUsed returns the memory used by the connection to
+// buffer data, and the most it has used at once. These are
+// only counted if the connection has a memory budget.
+func (c *Conn) MemoryUsed() (used, peak int64) {
+	return c.memory.Used()
+}
+
+// resumeWindows regrows the receive windows which were
+// stalled while the connection exceeded its memory budget.
+func (c *Conn) resumeWindows() {
+	if c.Subversion > 0 {
+		c.connectionWindowLock.Lock()
+		stalled := c.connectionWindowStalled
+		c.connectionWindowLock.Unlock()
+		if stalled {
+			c.flowControlLock.Lock()
+			f := c.flowControl
+			c.flowControlLock.Unlock()
+			if f != nil {
+				c.regrowConnectionWindow(f)
+			}
+		}
+	}
+
+	for _, stream := range c.streams.list(nil) {
+		var flow *flowControl
+		switch stream := stream.(type) {
+		case *RequestStream:
+			flow = stream.flow
+		case *ResponseStream:
+			flow = stream.flow
+		case *PushStream:
+			flow = stream.flow
+		}
+		if flow != nil {
+			flow.resume()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"errors"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// SPDY/3 has no way to signal a change of priority to the
+// other endpoint, so SetPriority changes only the priority
+// at which this endpoint sends the stream's remaining frames.
+// The send loop keeps each stream's frames in order as its
+// priority changes.
+
+var errBadPriority = errors.New("Error: Priority must be in the range 0 - 7.")
+
+/*****************
+ * RequestStream *
+ *****************/
+
+// Priority returns the stream's priority.
+func (s *RequestStream) Priority() common.Priority {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority at which the
+// request's remaining frames are sent.
+func (s *RequestStream) SetPriority(priority common.Priority) error {
+	if !priority.Valid(3) {
+		return errBadPriority
+	}
+	output := s.conn.output[priority]
+
+	s.outputLock.Lock()
+	if s.output == nil {
+		s.outputLock.Unlock()
+		return common.ErrStreamClosed
+	}
+	s.priority = priority
+	s.output = output
+	s.outputLock.Unlock()
+
+	if s.flow != nil {
+		s.flow.setOutput(output)
+	}
+	return nil
+}
+
+// out returns the channel on which the
+// stream's frames are sent.
+func (s *RequestStream) out() chan<- common.Frame {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+	return s.output
+}
+
+/******************
+ * ResponseStream *
+ ******************/
+
+// Priority returns the stream's priority.
+func (s *ResponseStream) Priority() common.Priority {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority at which the
+// response's remaining frames are sent.
+func (s *ResponseStream) SetPriority(priority common.Priority) error {
+	if !priority.Valid(3) {
+		return errBadPriority
+	}
+	if s.closed() || s.state.ClosedHere() {
+		return common.ErrStreamClosed
+	}
+	output := s.conn.output[priority]
+
+	s.outputLock.Lock()
+	s.priority = priority
+	s.output = output
+	s.outputLock.Unlock()
+
+	if s.flow != nil {
+		s.flow.setOutput(output)
+	}
+	return nil
+}
+
+// out returns the channel on which the
+// stream's frames are sent.
+func (s *ResponseStream) out() chan<- common.Frame {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+	return s.output
+}
+
+/**************
+ * PushStream *
+ **************/
+
+// Priority returns the stream's priority.
+func (p *PushStream) Priority() common.Priority {
+	p.outputLock.Lock()
+	defer p.outputLock.Unlock()
+	return p.priority
+}
+
+// SetPriority changes the priority at which the
+// push's remaining frames are sent.
+func (p *PushStream) SetPriority(priority common.Priority) error {
+	if !priority.Valid(3) {
+		return errBadPriority
+	}
+	output := p.conn.output[priority]
+
+	p.outputLock.Lock()
+	if p.output == nil {
+		p.outputLock.Unlock()
+		return common.ErrStreamClosed
+	}
+	p.priority = priority
+	p.output = output
+	p.outputLock.Unlock()
+
+	if p.flow != nil {
+		p.flow.setOutput(output)
+	}
+	return nil
+}
+
+// out returns the channel on which the
+// stream's frames are sent.
+func (p *PushStream) out() chan<- common.Frame {
+	p.outputLock.Lock()
+	defer p.outputLock.Unlock()
+	return p.output
+}
@@ -1,9 +1,11 @@
 package spdy3
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -22,19 +24,6 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		} else {
 			c.handleRequest(frame)
 		}
-	case *frames.SYN_STREAMV3_1:
-		f3 := new(frames.SYN_STREAM)
-		f3.Flags = frame.Flags
-		f3.StreamID = frame.StreamID
-		f3.AssocStreamID = frame.AssocStreamID
-		f3.Priority = frame.Priority
-		f3.Slot = 0
-		f3.Header = frame.Header
-		if c.server == nil {
-			c.handlePush(f3)
-		} else {
-			c.handleRequest(f3)
-		}
 
 	case *frames.SYN_REPLY:
 		c.handleSynReply(frame)
@@ -43,6 +32,7 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		if frame.Status.IsFatal() {
 			code := frame.Status.String()
 			log.Printf("Warning: Received %s on stream %d. Closing connection.\n", code, frame.StreamID)
+			c.abortStream(frame.StreamID, frame.Status)
 			c.shutdownError = frame
 			c.Close()
 			return true
@@ -51,30 +41,24 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 
 	case *frames.SETTINGS:
 		for _, setting := range frame.Settings {
-			c.receivedSettings[setting.ID] = setting
-			switch setting.ID {
-			case common.SETTINGS_INITIAL_WINDOW_SIZE:
-				c.initialWindowSizeLock.Lock()
-				initial := int64(c.initialWindowSize)
-				current := c.connectionWindowSize
-				inbound := int64(setting.Value)
-				if initial != inbound {
-					if initial > inbound {
-						c.connectionWindowSize = inbound - (initial - current)
-					} else {
-						c.connectionWindowSize += (inbound - initial)
-					}
-					c.initialWindowSize = setting.Value
-				}
-				c.initialWindowSizeLock.Unlock()
-
-			case common.SETTINGS_MAX_CONCURRENT_STREAMS:
-				if c.server == nil {
-					c.requestStreamLimit.SetLimit(setting.Value)
-				} else {
-					c.pushStreamLimit.SetLimit(setting.Value)
-				}
+			// Values a client returns with FLAG_SETTINGS_PERSISTED
+			// were sent by this server, so they are not the
+			// client's own settings.
+			if c.server != nil && setting.Flags.PERSISTED() {
+				continue
+			}
+			c.applySetting(setting)
+		}
+		if c.server == nil && c.PersistSettings != nil {
+			c.persistSettings(frame)
+		}
+		if c.SettingsHandler != nil {
+			settings := make(common.Settings, len(frame.Settings))
+			for id, setting := range frame.Settings {
+				copied := *setting
+				settings[id] = &copied
 			}
+			c.SettingsHandler(settings)
 		}
 
 	case *frames.PING:
@@ -94,24 +78,40 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 			c.pingsLock.Unlock()
 		} else {
 			debug.Println("Received PING. Replying...")
-			c.output[0] <- frame
+			select {
+			case c.output[0] <- frame:
+			case <-c.stop:
+			}
 		}
 
 	case *frames.GOAWAY:
 		lastProcessed := frame.LastGoodStreamID
-		c.streamsLock.Lock()
-		for streamID, stream := range c.streams {
-			if streamID&1 == c.oddity && streamID > lastProcessed {
-				// Stream is locally-sent and has not been processed.
-				// TODO: Inform the server that the push has not been successful.
-				stream.Close()
+		// Streams which were locally-sent and have not been processed.
+		// TODO: Inform the server that the push has not been successful.
+		unprocessed := c.streams.list(func(streamID common.StreamID) bool {
+			return streamID&1 == c.oddity && streamID > lastProcessed
+		})
+
+		// Requests which were not processed can be
+		// retried safely on another connection.
+		for _, stream := range unprocessed {
+			if stream, ok := stream.(*RequestStream); ok {
+				stream.Lock()
+				stream.err = common.ErrUnprocessed
+				stream.Unlock()
 			}
+			stream.Close()
+		}
+		if frame.Status != common.GOAWAY_OK {
+			c.shutdownError = frame
 		}
-		c.streamsLock.Unlock()
-		c.shutdownError = frame
 		c.goawayLock.Lock()
 		c.goawayReceived = true
 		c.goawayLock.Unlock()
+		c.reportGoaway()
+		if c.GoawayHandler != nil {
+			c.GoawayHandler(frame.LastGoodStreamID, frame.Status)
+		}
 
 	case *frames.HEADERS:
 		c.handleHeaders(frame)
@@ -135,32 +135,14 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 					Value: uint32(frame.Slot + 4),
 				},
 			}
-			c.output[0] <- setting
+			c.sendSettings(setting)
 			c.vectorIndex += 4
 		}
 		c.certificates[frame.Slot] = frame.Certificates
 
 	case *frames.DATA:
-		if c.Subversion > 0 {
-			// The transfer window shouldn't already be negative.
-			if c.connectionWindowSizeThere < 0 {
-				c._GOAWAY(common.GOAWAY_FLOW_CONTROL_ERROR)
-				return false
-			}
-
-			c.connectionWindowSizeThere -= int64(len(frame.Data))
-
-			c.flowControlLock.Lock()
-			f := c.flowControl
-			c.flowControlLock.Unlock()
-			delta := f.ReceiveData(0, c.initialWindowSizeThere, c.connectionWindowSizeThere)
-			if delta != 0 {
-				grow := new(frames.WINDOW_UPDATE)
-				grow.StreamID = 0
-				grow.DeltaWindowSize = delta
-				c.output[0] <- grow
-				c.connectionWindowSizeThere += int64(grow.DeltaWindowSize)
-			}
+		if !c.receiveConnectionData(len(frame.Data)) {
+			return false
 		}
 		if c.server == nil {
 			c.handleServerData(frame)
@@ -168,12 +150,136 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 			c.handleClientData(frame)
 		}
 
+	case *frames.UNKNOWN:
+		// Unrecognised control frames must be ignored.
+		debug.Printf("Ignoring control frame of unknown type %d.\n", frame.Type)
+		c.stats.Add(common.Stats{UnknownFrames: 1})
+
 	default:
 		log.Println(fmt.Sprintf("Ignored unexpected frame type %T", frame))
 	}
 	return false
 }
 
+// receiveConnectionData charges n bytes of DATA received
+// to the connection's transfer window, in SPDY/3.1, and
+// grows the window as the flow control module decides.
+// It returns false if the window had already been
+// exceeded, in which case a GOAWAY has been sent.
+func (c *Conn) receiveConnectionData(n int) bool {
+	if c.Subversion == 0 {
+		return true
+	}
+
+	c.flowControlLock.Lock()
+	f := c.flowControl
+	c.flowControlLock.Unlock()
+
+	// The transfer window shouldn't already be negative.
+	c.connectionWindowLock.Lock()
+	if c.connectionWindowSizeThere < 0 {
+		c.connectionWindowLock.Unlock()
+		c._GOAWAY(common.GOAWAY_FLOW_CONTROL_ERROR)
+		return false
+	}
+
+	c.connectionWindowSizeThere -= int64(n)
+	c.connectionWindowLock.Unlock()
+
+	c.regrowConnectionWindow(f)
+	return true
+}
+
+// regrowConnectionWindow grows the connection's receive
+// window, in SPDY/3.1, as the flow control module decides,
+// unless the connection has exceeded its memory budget.
+func (c *Conn) regrowConnectionWindow(f common.FlowControl) {
+	c.connectionWindowLock.Lock()
+	if c.memory.Exceeded() {
+		c.connectionWindowStalled = true
+		c.connectionWindowLock.Unlock()
+		return
+	}
+	c.connectionWindowStalled = false
+	window := c.connectionWindowSizeThere + c.connectionWindowPending
+	c.connectionWindowPending += int64(f.ReceiveData(0, c.initialWindowSizeThere, window))
+	threshold := c.windowUpdateThreshold(c.initialWindowSizeThere)
+	if !coalesceWindowUpdate(c.connectionWindowPending, c.connectionWindowSizeThere, threshold) {
+		c.connectionWindowLock.Unlock()
+		return
+	}
+	delta := uint32(c.connectionWindowPending)
+	c.connectionWindowSizeThere += c.connectionWindowPending
+	c.connectionWindowPending = 0
+	c.connectionWindowLock.Unlock()
+
+	if delta != 0 {
+		grow := new(frames.WINDOW_UPDATE)
+		grow.StreamID = 0
+		grow.DeltaWindowSize = delta
+		select {
+		case c.output[0] <- grow:
+		case <-c.stop:
+		}
+	}
+}
+
+// checkHeaders validates the header block of frame, if it
+// has one, using common.ValidateHeader. If err is non-nil,
+// the header block could not be decompressed safely, and is
+// treated as invalid. Requests with invalid headers are
+// refused, and any other stream whose headers are invalid is
+// reset. checkHeaders returns true if frame has been rejected
+// and should not be processed further.
+func (c *Conn) checkHeaders(frame common.Frame, err error) bool {
+	sid, header, ok := frameHeader(frame)
+	if !ok {
+		return false
+	}
+	_, request := frame.(*frames.SYN_STREAM)
+	request = request && c.server != nil
+
+	if err == nil {
+		err = common.ValidateHeader(header)
+	}
+	if err == nil {
+		return false
+	}
+
+	status, reason := http.StatusBadRequest, "Malformed request headers."
+	if err != common.ErrMalformedHeader {
+		status, reason = http.StatusRequestHeaderFieldsTooLarge, "Request headers too large."
+	}
+
+	err = c.wrapFrameError(err, frame)
+	c.check(true, "Received invalid header block (%v)", err)
+
+	if request {
+		c.reject(sid, status, reason, common.RST_STREAM_PROTOCOL_ERROR)
+		return true
+	}
+
+	c.resetReceived(sid, common.RST_STREAM_PROTOCOL_ERROR, err)
+	return true
+}
+
+// resetReceived resets a stream because of a frame received
+// on it, closing the stream and ending any pushed response
+// with err.
+func (c *Conn) resetReceived(sid common.StreamID, status common.StatusCode, err error) {
+	c._RST_STREAM(sid, status)
+	stream := c.streams.get(sid)
+	if stream != nil {
+		go stream.Close()
+	}
+	if c.server == nil {
+		if push := c.pushResponse(sid); push != nil {
+			push.Reset(err)
+			c.removePushResponse(sid)
+		}
+	}
+}
+
 // handleClientData performs the processing of DATA frames sent by the client.
 func (c *Conn) handleClientData(frame *frames.DATA) {
 	sid := frame.StreamID
@@ -183,7 +289,7 @@ func (c *Conn) handleClientData(frame *frames.DATA) {
 	}
 
 	// Handle request data.
-	if c.check(sid&1 == 0, "Received DATA with even Stream ID %d", sid) {
+	if c.violationCheck(sid&1 == 0, sid, "Received DATA with even Stream ID %d", sid) {
 		return
 	}
 
@@ -193,23 +299,111 @@ func (c *Conn) handleClientData(frame *frames.DATA) {
 	}
 
 	// Check stream is open.
-	c.streamsLock.Lock()
-	stream := c.streams[sid]
-	c.streamsLock.Unlock()
-	closed := stream == nil || stream.State().ClosedThere()
-	if c.check(closed, "Received DATA with unopened or closed Stream ID %d", sid) {
+	stream := c.streams.get(sid)
+	if c.streamCheck(stream, sid, "DATA") {
+		return
+	}
+
+	// The other endpoint has kept sending while the
+	// memory budget was exceeded, so the data cannot
+	// be buffered.
+	if c.memory.Exceeds(2) {
+		debug.Printf("Resetting stream %d, as the memory budget has been exceeded.\n", sid)
+		c.resetReceived(sid, common.RST_STREAM_INTERNAL_ERROR, common.ErrMemoryBudget)
+		return
+	}
+
+	// The request body may not exceed MaxRequestBodyBytes.
+	if rs, ok := stream.(*ResponseStream); ok && !rs.receiveBody(len(frame.Data)) {
+		debug.Printf("Refusing stream %d, as its body exceeds the limit.\n", sid)
+		rs.refuseBody()
+		return
+	}
+
+	if !c.checkLength(frame) {
 		return
 	}
 
 	stream.ReceiveFrame(frame) // Send data to stream.
 }
 
+// checkLength ensures that the DATA received on a stream
+// neither exceeds its Content-Length, nor ends short of it.
+// If it does, the stream is reset with PROTOCOL_ERROR, and
+// its local end is given common.ErrContentLength, so that
+// the body is not mistaken for being complete.
+func (c *Conn) checkLength(frame *frames.DATA) bool {
+	sid := frame.StreamID
+	if c.streams.receiveData(sid, len(frame.Data), frame.Flags.FIN()) {
+		return true
+	}
+
+	debug.Printf("Resetting stream %d, as its body does not match its Content-Length.\n", sid)
+	c.failLength(sid)
+	return false
+}
+
+// failLength resets the stream with the given ID, whose
+// body does not match its Content-Length.
+func (c *Conn) failLength(sid common.StreamID) {
+	switch stream := c.streams.get(sid).(type) {
+	case *ResponseStream:
+		stream.abort(common.ErrContentLength)
+	case *RequestStream:
+		stream.abort(common.ErrContentLength)
+	}
+	c.resetReceived(sid, common.RST_STREAM_PROTOCOL_ERROR, common.ErrContentLength)
+}
+
+// checkResponseLength records the Content-Length of the
+// response headers received on a request stream, if any,
+// so that the body can be checked against it. Responses to
+// HEAD requests, and those with statuses which have no body,
+// are not checked. It returns false if the stream is reset
+// because the Content-Length is invalid, or the response
+// ends without the body it declares.
+func (c *Conn) checkResponseLength(stream common.Stream, header http.Header, fin bool) bool {
+	request, ok := stream.(*RequestStream)
+	if !ok || request.Request == nil || request.Request.Method == "HEAD" {
+		return true
+	}
+	sid := request.StreamID()
+	if c.streams.expectsLength(sid) {
+		return true
+	}
+
+	status, err := strconv.Atoi(header.Get(":status"))
+	if err != nil || status/100 == 1 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return true
+	}
+
+	length, err := common.ContentLength(header)
+	if err == nil && length > 0 && fin {
+		err = common.ErrContentLength
+	}
+	if err != nil {
+		debug.Printf("Resetting stream %d: %v\n", sid, err)
+		c.failLength(sid)
+		return false
+	}
+
+	if length >= 0 && !fin {
+		c.streams.expectLength(sid, length)
+	}
+	return true
+}
+
 // handleHeaders performs the processing of HEADERS frames.
 func (c *Conn) handleHeaders(frame *frames.HEADERS) {
 	sid := frame.StreamID
 
 	// Handle push headers.
 	if sid&1 == 0 && c.server == nil {
+		if push := c.pushResponse(sid); push != nil {
+			push.ReceiveHeader(frame.Header)
+			return
+		}
+
 		// Ignore refused push headers.
 		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
 			c.PushReceiver.ReceiveHeader(req, frame.Header)
@@ -218,11 +412,12 @@ func (c *Conn) handleHeaders(frame *frames.HEADERS) {
 	}
 
 	// Check stream is open.
-	c.streamsLock.Lock()
-	stream := c.streams[sid]
-	c.streamsLock.Unlock()
-	closed := stream == nil || stream.State().ClosedThere()
-	if c.check(closed, "Received HEADERS with unopened or closed Stream ID %d", sid) {
+	stream := c.streams.get(sid)
+	if c.streamCheck(stream, sid, "HEADERS") {
+		return
+	}
+
+	if !c.checkResponseLength(stream, frame.Header, frame.Flags.FIN()) {
 		return
 	}
 
@@ -246,17 +441,6 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 		return
 	}
 
-	if c.check(sid&1 != 0, "Received SYN_STREAM with odd Stream ID %d", sid) {
-		return
-	}
-
-	c.lastPushStreamIDLock.Lock()
-	lsid := c.lastPushStreamID
-	c.lastPushStreamIDLock.Unlock()
-	if c.check(sid <= lsid, "Received SYN_STREAM with Stream ID %d, less than %d", sid, lsid) {
-		return
-	}
-
 	if c.criticalCheck(!sid.Valid(), sid, "Received SYN_STREAM with excessive Stream ID %d", sid) {
 		return
 	}
@@ -282,6 +466,14 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 		return
 	}
 
+	// Pushes must share the associated request's origin.
+	if !c.pushAllowed(frame.AssocStreamID, url) {
+		debug.Printf("Resetting push stream %d for %q, as it does not match stream %d's origin.\n", sid, rawUrl, frame.AssocStreamID)
+		c.pushStreamLimit.Close()
+		c._RST_STREAM(sid, common.RST_STREAM_PROTOCOL_ERROR)
+		return
+	}
+
 	vers := header.Get(":version")
 	major, minor, ok := http.ParseHTTPVersion(vers)
 	if c.check(!ok, "Invalid HTTP version: "+vers) {
@@ -299,11 +491,48 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 		Header:     header,
 		Host:       url.Host,
 		RequestURI: url.RequestURI(),
-		TLS:        c.tlsState,
+		TLS:        c.connectionState(),
+	}
+
+	// Offer the push to the handler, if there is one.
+	if c.PushHandler != nil {
+		push := common.NewPushedResponse(request, sid, func() {
+			c.removePushResponse(sid)
+			rst := new(frames.RST_STREAM)
+			rst.StreamID = sid
+			rst.Status = common.RST_STREAM_CANCEL
+			select {
+			case c.output[0] <- rst:
+			case <-c.stop:
+			}
+		})
+		push.SetDrainLimit(c.BodyDrainLimit)
+		push.SetBufferLimit(c.PushBufferLimit)
+
+		if !c.PushHandler.HandlePush(push) {
+			c.pushStreamLimit.Close()
+			c._RST_STREAM(sid, common.RST_STREAM_CANCEL)
+			return
+		}
+
+		c.pushResponsesLock.Lock()
+		c.pushResponses[sid] = push
+		c.pushResponsesLock.Unlock()
+		c.lastPushStreamIDLock.Lock()
+		c.lastPushStreamID = sid
+		c.lastPushStreamIDLock.Unlock()
+		if frame.Flags.FIN() {
+			push.ReceiveData([]byte{}, true)
+			c.removePushResponse(sid)
+		}
+		return
 	}
 
-	// Check whether the receiver wants this resource.
-	if c.PushReceiver != nil && !c.PushReceiver.ReceiveRequest(request) {
+	// Check whether the receiver wants this resource. With
+	// no receiver, the push is refused, rather than its
+	// data being received and discarded.
+	if c.PushReceiver == nil || !c.PushReceiver.ReceiveRequest(request) {
+		c.pushStreamLimit.Close()
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
 		return
 	}
@@ -333,55 +562,80 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 		return
 	}
 
-	if c.check(sid&1 == 0, "Received SYN_STREAM with even Stream ID %d", sid) {
+	if c.criticalCheck(!sid.Valid(), sid, "Received SYN_STREAM with excessive Stream ID %d", sid) {
 		return
 	}
 
-	c.lastRequestStreamIDLock.Lock()
-	lsid := c.lastRequestStreamID
-	c.lastRequestStreamIDLock.Unlock()
-	if c.check(sid <= lsid && lsid != 0, "Received SYN_STREAM with Stream ID %d, less than %d", sid, lsid) {
-		return
-	}
+	// Stream ID is fine.
 
-	if c.criticalCheck(!sid.Valid(), sid, "Received SYN_STREAM with excessive Stream ID %d", sid) {
+	// Unidirectional streams can never be replied to.
+	if frame.Flags.UNIDIRECTIONAL() && c.UnidirectionalHandler == nil && c.RejectUnidirectional {
+		debug.Printf("Refusing unidirectional SYN_STREAM with Stream ID %d.\n", sid)
+		c._RST_STREAM(sid, common.RST_STREAM_PROTOCOL_ERROR)
 		return
 	}
 
-	// Stream ID is fine.
-
 	// Check stream limit would allow the new stream.
 	if !c.requestStreamLimit.Add() {
-		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		c.reject(sid, http.StatusServiceUnavailable, "Too many concurrent requests.", common.RST_STREAM_REFUSED_STREAM)
 		return
 	}
 
 	p := frame.Priority
-	if c.criticalCheck(!p.Valid(3), sid, "Received SYN_STREAM with bad priority %d.\n", p) {
+	if c.criticalCheck(!p.Valid(3), sid, "Received SYN_STREAM with bad priority %d", p) {
 		return
 	}
 
 	// Create and start new stream.
 	nextStream := c.newStream(frame)
 	if nextStream == nil {
+		c.requestStreamLimit.Close()
 		return
 	}
 
-	c.streamsLock.Lock()
-	c.streams[sid] = nextStream
-	c.streamsLock.Unlock()
+	c.streams.add(sid, nextStream)
+	c.updateState()
 	c.lastRequestStreamIDLock.Lock()
 	c.lastRequestStreamID = sid
 	c.lastRequestStreamIDLock.Unlock()
-	go nextStream.Run()
+	c.workers.Go(func() { nextStream.Run() })
+}
+
+// abortStream gives the local end of a stream reset by
+// the peer a *common.StreamResetError, which is returned
+// by the client's request or the handler's writes.
+func (c *Conn) abortStream(sid common.StreamID, status common.StatusCode) {
+	stream := c.streams.get(sid)
+
+	err := &common.StreamResetError{StreamID: sid, Status: status}
+	switch stream := stream.(type) {
+	case *ResponseStream:
+		stream.abort(err)
+	case *RequestStream:
+		stream.abort(err)
+	case *PushStream:
+		stream.settle(common.PushReset)
+	}
 }
 
 // handleRstStream performs the processing of RST_STREAM frames.
 func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 	sid := frame.StreamID
-	c.streamsLock.Lock()
-	stream := c.streams[sid]
-	c.streamsLock.Unlock()
+	stream := c.streams.get(sid)
+
+	// Any pushes associated with the stream are
+	// no longer wanted, and a handler serving the
+	// stream learns why it was reset.
+	if c.server != nil {
+		c.resetPushedStreams(sid)
+		c.abortStream(sid, frame.Status)
+	} else if push := c.pushResponse(sid); push != nil {
+		push.Reset(common.ErrPushCancelled)
+		c.removePushResponse(sid)
+		return
+	} else {
+		c.abortStream(sid, frame.Status)
+	}
 
 	// Determine the status code and react accordingly.
 	switch frame.Status {
@@ -399,7 +653,8 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 			return
 		}
 		fallthrough
-	case common.RST_STREAM_REFUSED_STREAM:
+	case common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_INTERNAL_ERROR:
 		if stream != nil {
 			go stream.Close()
 		}
@@ -423,19 +678,32 @@ func (c *Conn) handleServerData(frame *frames.DATA) {
 	sid := frame.StreamID
 
 	if sid&1 == 0 { // Handle push data.
+		if push := c.pushResponse(sid); push != nil {
+			push.ReceiveData(frame.Data, frame.Flags.FIN())
+			if frame.Flags.FIN() {
+				c.removePushResponse(sid)
+			}
+			return
+		}
+
 		// Ignore refused push data.
 		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
 			c.PushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
+			if frame.Flags.FIN() {
+				delete(c.pushRequests, sid)
+				c.pushStreamLimit.Close()
+			}
 		}
 		return
 	}
 
 	// Check stream is open.
-	c.streamsLock.Lock()
-	stream := c.streams[sid]
-	c.streamsLock.Unlock()
-	closed := stream == nil || stream.State().ClosedThere()
-	if c.check(closed, "Received DATA with unopened or closed Stream ID %d", sid) {
+	stream := c.streams.get(sid)
+	if c.streamCheck(stream, sid, "DATA") {
+		return
+	}
+
+	if !c.checkLength(frame) {
 		return
 	}
 
@@ -451,7 +719,7 @@ func (c *Conn) handleSynReply(frame *frames.SYN_REPLY) {
 		return
 	}
 
-	if c.check(sid&1 == 0, "Received SYN_REPLY with even Stream ID %d", sid) {
+	if c.violationCheck(sid&1 == 0, sid, "Received SYN_REPLY with even Stream ID %d", sid) {
 		return
 	}
 
@@ -459,11 +727,12 @@ func (c *Conn) handleSynReply(frame *frames.SYN_REPLY) {
 		return
 	}
 
-	c.streamsLock.Lock()
-	stream := c.streams[sid]
-	c.streamsLock.Unlock()
-	closed := stream == nil || stream.State().ClosedThere()
-	if c.check(closed, "Received SYN_REPLY with unopened or closed Stream ID %d", sid) {
+	stream := c.streams.get(sid)
+	if c.streamCheck(stream, sid, "SYN_REPLY") {
+		return
+	}
+
+	if !c.checkResponseLength(stream, frame.Header, frame.Flags.FIN()) {
 		return
 	}
 
@@ -479,45 +748,92 @@ func (c *Conn) handleWindowUpdate(frame *frames.WINDOW_UPDATE) {
 		return
 	}
 
+	// A delta of 0 is not allowed, and one which
+	// would take the window beyond 2^31-1 is a flow
+	// control error, on the stream or connection.
 	delta := frame.DeltaWindowSize
-	bad := delta > common.MAX_DELTA_WINDOW_SIZE || delta < 1
-	if c.criticalCheck(bad, sid, "Received WINDOW_UPDATE with invalid delta window size %d", delta) {
+	if delta > common.MAX_DELTA_WINDOW_SIZE || delta < 1 {
+		if sid.Zero() || c.streamOpenHere(sid) {
+			c.flowControlError(sid, fmt.Errorf("Error: Received WINDOW_UPDATE for stream %d with invalid delta window size %d.", sid, delta))
+		}
 		return
 	}
 
 	// Handle connection-level flow control.
 	if sid.Zero() && c.Subversion > 0 {
 		c.connectionWindowLock.Lock()
-		defer c.connectionWindowLock.Unlock()
-
 		if int64(delta)+c.connectionWindowSize > common.MAX_TRANSFER_WINDOW_SIZE {
-			goaway := new(frames.GOAWAY)
-			if c.server != nil {
-				c.lastRequestStreamIDLock.Lock()
-				goaway.LastGoodStreamID = c.lastRequestStreamID
-				c.lastRequestStreamIDLock.Unlock()
-			} else {
-				c.lastPushStreamIDLock.Lock()
-				goaway.LastGoodStreamID = c.lastPushStreamID
-				c.lastPushStreamIDLock.Unlock()
-			}
-			goaway.Status = common.GOAWAY_FLOW_CONTROL_ERROR
-			c.output[0] <- goaway
+			c.connectionWindowLock.Unlock()
+			c.flowControlError(sid, errors.New("Error: WINDOW_UPDATE delta window size overflows connection window size."))
 			return
 		}
+		defer c.connectionWindowLock.Unlock()
 		c.connectionWindowSize += int64(delta)
+
+		// Wake the send loop if DATA is waiting.
+		if len(c.dataBuffer) > 0 {
+			select {
+			case c.connectionWindowGrown <- struct{}{}:
+			default:
+			}
+		}
 		return
 	}
 
 	// Check stream is open.
-	c.streamsLock.Lock()
-	stream := c.streams[sid]
-	c.streamsLock.Unlock()
-	if stream == nil || stream.State().ClosedHere() {
+	if !c.streamOpenHere(sid) {
 		// This is almost certainly benign
 		return
 	}
 
-	// Stream ID is fine.
-	stream.ReceiveFrame(frame)
+	// Stream ID is fine. The stream's flow control
+	// rejects a delta which overflows its window.
+	if err := c.streams.get(sid).ReceiveFrame(frame); err != nil {
+		c.flowControlError(sid, err)
+	}
+}
+
+// streamOpenHere returns true iff the stream with the
+// given ID exists and is still open at this end.
+func (c *Conn) streamOpenHere(sid common.StreamID) bool {
+	stream := c.streams.get(sid)
+	return stream != nil && !stream.State().ClosedHere()
+}
+
+// applySetting records and acts on a setting
+// received from the other endpoint.
+func (c *Conn) applySetting(setting *common.Setting) {
+	c.settingsLock.Lock()
+	c.receivedSettings[setting.ID] = setting
+	c.settingsLock.Unlock()
+	switch setting.ID {
+	case common.SETTINGS_INITIAL_WINDOW_SIZE:
+		c.initialWindowSizeLock.Lock()
+		c.connectionWindowLock.Lock()
+		initial := int64(c.initialWindowSize)
+		current := c.connectionWindowSize
+		inbound := int64(setting.Value)
+		if initial != inbound {
+			if initial > inbound {
+				c.connectionWindowSize = inbound - (initial - current)
+			} else {
+				c.connectionWindowSize += (inbound - initial)
+			}
+			c.initialWindowSize = setting.Value
+		}
+		c.connectionWindowLock.Unlock()
+		c.initialWindowSizeLock.Unlock()
+
+	case common.SETTINGS_MAX_CONCURRENT_STREAMS:
+		if c.server == nil {
+			c.requestStreamLimit.SetLimit(setting.Value)
+		} else {
+			c.pushStreamLimit.SetLimit(setting.Value)
+		}
+
+	case common.SETTINGS_DATA_CHECKSUM:
+		c.checksumsLock.Lock()
+		c.checksums = c.dataChecksums && setting.Value != 0
+		c.checksumsLock.Unlock()
+	}
 }
@@ -0,0 +1,82 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// autoPush issues the pushes chosen by the connection's
+// PushPolicy for the given stream's request. Each push is
+// served by the stream's handler in a new goroutine, which
+// is tracked by the returned WaitGroup. The origin stream
+// must not be closed until the pushes have completed.
+func (c *Conn) autoPush(origin *ResponseStream) *sync.WaitGroup {
+	wg := new(sync.WaitGroup)
+	policy := c.PushPolicy
+	if policy == nil {
+		return wg
+	}
+
+	request := origin.request
+	policy.Observe(request)
+
+	for _, resource := range policy.Resources(request) {
+		if !strings.HasPrefix(resource, "/") {
+			resource = "/" + resource
+		}
+
+		u, err := request.URL.Parse(resource)
+		if err != nil {
+			debug.Printf("Error: Invalid push resource %q: %v\n", resource, err)
+			continue
+		}
+
+		push, err := c.Push(u.String(), origin)
+		if err != nil {
+			debug.Printf("Error: Failed to push %q: %v\n", u, err)
+			continue
+		}
+
+		// Build the request the client would have sent. A
+		// Range applies only to the resource requested.
+		header := make(http.Header)
+		for name, values := range request.Header {
+			if strings.HasPrefix(name, ":") || name == "Content-Length" || name == "Content-Type" {
+				continue
+			}
+			if name == "Range" || name == "If-Range" {
+				continue
+			}
+			header[name] = values
+		}
+		pushRequest := &http.Request{
+			Method:     "GET",
+			URL:        u,
+			Proto:      request.Proto,
+			ProtoMajor: request.ProtoMajor,
+			ProtoMinor: request.ProtoMinor,
+			RemoteAddr: request.RemoteAddr,
+			Header:     header,
+			Host:       u.Host,
+			RequestURI: u.RequestURI(),
+			TLS:        request.TLS,
+		}
+
+		push.Header().Set(":status", "200")
+		push.Header().Set(":version", "HTTP/1.1")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer push.Finish()
+			origin.handler.ServeHTTP(push, pushRequest)
+		}()
+	}
+
+	return wg
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -23,12 +24,24 @@ type PushStream struct {
 	shutdownOnce sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	path         string
 	flow         *flowControl
 	origin       common.Stream
 	state        *common.StreamState
 	output       chan<- common.Frame
+	outputLock   sync.Mutex // protects output and priority.
+	priority     common.Priority
 	header       http.Header
+	sentHeader   common.HeaderSnapshot
+	headerLock   sync.Mutex // protects sentHeader, wroteHeader and cancelled.
+	wroteHeader  bool
+	cancelled    bool          // the push was cancelled, as the client has it cached.
+	request      *http.Request // the request with which the push was made.
 	stop         <-chan bool
+	outcome      common.PushOutcome
+	outcomeLock  sync.Mutex // protects outcome.
+	done         chan struct{}
+	stats        common.StreamCounter
 }
 
 func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, output chan<- common.Frame) *PushStream {
@@ -37,9 +50,12 @@ func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, o
 	out.streamID = streamID
 	out.origin = origin
 	out.output = output
+	out.priority = 7
 	out.stop = conn.stop
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
+	out.done = make(chan struct{})
+	out.stats.Open()
 	return out
 }
 
@@ -53,6 +69,9 @@ func (p *PushStream) Header() http.Header {
 
 // Write is used for sending data in the push.
 func (p *PushStream) Write(inputData []byte) (int, error) {
+	if p.wasCancelled() {
+		return 0, common.ErrPushCached
+	}
 	if p.closed() || p.state.ClosedHere() {
 		return 0, errors.New("Error: Stream already closed.")
 	}
@@ -62,7 +81,13 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
+	p.headerLock.Lock()
 	p.writeHeader()
+	cancelled := p.cancelled
+	p.unlockHeader()
+	if cancelled {
+		return 0, common.ErrPushCached
+	}
 
 	// Copy the data locally to avoid any pointer issues.
 	data := make([]byte, len(inputData))
@@ -72,13 +97,14 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
-		n, err := p.flow.Write(data[:common.MAX_DATA_SIZE])
+	chunk := p.conn.dataChunkSize
+	for len(data) > chunk {
+		n, err := p.flow.Write(data[:chunk])
 		if err != nil {
 			return written, err
 		}
 		written += n
-		data = data[common.MAX_DATA_SIZE:]
+		data = data[chunk:]
 	}
 
 	n, err := p.flow.Write(data)
@@ -87,11 +113,20 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 	return written, err
 }
 
-// WriteHeader is provided to satisfy the Stream
-// interface, but has no effect.
-func (p *PushStream) WriteHeader(int) {
+// WriteHeader sets the pushed response's status, such as
+// 206 Partial Content for a range, and sends its headers.
+// The status cannot be changed once the headers have been
+// sent, such as by a previous Write.
+func (p *PushStream) WriteHeader(code int) {
+	p.headerLock.Lock()
+	if !p.wroteHeader {
+		p.header.Set(":status", strconv.Itoa(code))
+		if p.header.Get(":version") == "" {
+			p.header.Set(":version", "HTTP/1.1")
+		}
+	}
 	p.writeHeader()
-	return
+	p.unlockHeader()
 }
 
 /*****************
@@ -107,18 +142,27 @@ func (p *PushStream) Close() error {
 }
 
 func (p *PushStream) shutdown() {
+	p.headerLock.Lock()
 	p.writeHeader()
+	p.unlockHeader()
+	if p.origin != nil {
+		p.conn.removePushedStream(p.origin.StreamID(), p.streamID)
+	}
 	if p.state != nil {
 		p.state.Close()
 	}
 	if p.flow != nil {
 		p.flow.Close()
 	}
+	p.settle(common.PushAborted)
 	p.conn.pushStreamLimit.Close()
 	p.origin = nil
+	p.outputLock.Lock()
 	p.output = nil
-	p.header = nil
-	p.stop = nil
+	p.outputLock.Unlock()
+
+	p.conn.streams.remove(p.streamID)
+	p.conn.updateState()
 }
 
 /**********
@@ -140,12 +184,7 @@ func (p *PushStream) ReceiveFrame(frame common.Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.WINDOW_UPDATE:
-		err := p.flow.UpdateWindow(frame.DeltaWindowSize)
-		if err != nil {
-			reply := new(frames.RST_STREAM)
-			reply.StreamID = p.streamID
-			reply.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-			p.output <- reply
+		if err := p.flow.UpdateWindow(frame.DeltaWindowSize); err != nil {
 			return err
 		}
 
@@ -172,20 +211,78 @@ func (p *PushStream) StreamID() common.StreamID {
 	return p.streamID
 }
 
+// Stats returns the stream's statistics, including
+// its current throughput.
+func (p *PushStream) Stats() common.StreamStats {
+	if p.flow == nil {
+		return p.stats.Snapshot()
+	}
+	return p.flow.Stats()
+}
+
 /**************
  * PushStream *
  **************/
 
 func (p *PushStream) Finish() {
+	p.headerLock.Lock()
 	p.writeHeader()
-	end := new(frames.DATA)
-	end.StreamID = p.streamID
-	end.Data = []byte{}
-	end.Flags = common.FLAG_FIN
-	p.output <- end
+	if !p.cancelled && !p.closed() && !p.state.ClosedHere() {
+		end := new(frames.DATA)
+		end.StreamID = p.streamID
+		end.Data = []byte{}
+		end.Flags = common.FLAG_FIN
+		p.queue(end)
+		p.settle(common.PushAccepted)
+	}
+	p.unlockHeader()
 	p.Close()
 }
 
+// Outcome returns what became of the push, which
+// is common.PushPending until the push has ended.
+func (p *PushStream) Outcome() common.PushOutcome {
+	p.outcomeLock.Lock()
+	defer p.outcomeLock.Unlock()
+	return p.outcome
+}
+
+// Done returns a channel which is closed once
+// the push has ended, and its Outcome is known.
+func (p *PushStream) Done() <-chan struct{} {
+	return p.done
+}
+
+// settle records the outcome of the push,
+// unless it has ended already.
+func (p *PushStream) settle(outcome common.PushOutcome) {
+	p.outcomeLock.Lock()
+	if p.outcome == common.PushPending {
+		p.outcome = outcome
+		close(p.done)
+	}
+	p.outcomeLock.Unlock()
+}
+
+// wasCancelled returns true iff the push was cancelled,
+// as the client has the resource cached.
+func (p *PushStream) wasCancelled() bool {
+	p.headerLock.Lock()
+	defer p.headerLock.Unlock()
+	return p.cancelled
+}
+
+// cancel resets the push with CANCEL, as the client has
+// the resource cached. The caller must hold headerLock.
+func (p *PushStream) cancel() {
+	debug.Printf("Cancelling push stream %d, as the client has %s cached.\n", p.streamID, p.path)
+	p.cancelled = true
+	p.conn._RST_STREAM(p.streamID, common.RST_STREAM_CANCEL)
+	p.state.Close()
+	p.settle(common.PushCancelled)
+	go p.Close()
+}
+
 /**********
  * Others *
  **********/
@@ -202,27 +299,57 @@ func (p *PushStream) closed() bool {
 	}
 }
 
-// writeHeader is used to send HTTP headers to
-// the client.
+// writeHeader is used to send any HTTP headers which
+// have changed since they were last sent to the client.
+// The caller must hold headerLock.
 func (p *PushStream) writeHeader() {
-	if len(p.header) == 0 || p.closed() {
+	if p.closed() || p.cancelled {
+		return
+	}
+
+	// The client may have the resource cached, which is
+	// known once the response's validators have been set.
+	if !p.wroteHeader && p.conn.CacheDigest.Cached(p.request, p.path, p.header) {
+		p.cancel()
+		return
+	}
+
+	changes := p.sentHeader.Changes(p.header)
+	if len(changes) == 0 {
 		return
 	}
 
 	header := new(frames.HEADERS)
 	header.StreamID = p.streamID
-	header.Header = make(http.Header)
+	header.Header = changes
 
-	for name, values := range p.header {
-		for _, value := range values {
-			header.Header.Add(name, value)
-		}
-		p.header.Del(name)
-	}
+	p.wroteHeader = true
+	p.queue(header)
+}
 
-	if len(header.Header) == 0 {
+// queue is used to send a frame on the stream,
+// behind any DATA buffered by flow control. The
+// frame is sent once the flow control's queue is
+// submitted, which unlockHeader does.
+func (p *PushStream) queue(frame common.Frame) {
+	if p.flow == nil {
+		select {
+		case p.out() <- frame:
+		case <-p.conn.stop:
+		}
 		return
 	}
+	if err := p.flow.Queue(frame, p.out()); err != nil {
+		debug.Println(err)
+	}
+}
 
-	p.output <- header
+// unlockHeader releases headerLock, then submits any
+// frames queued while it was held, so that the lock is
+// never held while waiting for the connection's output.
+func (p *PushStream) unlockHeader() {
+	p.headerLock.Unlock()
+	if p.flow != nil {
+		p.flow.submit()
+	}
 }
@@ -5,6 +5,7 @@
 package spdy3
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -26,14 +27,27 @@ type RequestStream struct {
 	shutdownOnce sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	priority     common.Priority
 	flow         *flowControl
 	state        *common.StreamState
 	output       chan<- common.Frame
+	outputLock   sync.Mutex // protects output and priority.
 	header       http.Header
+	sentHeader   common.HeaderSnapshot
+	headerLock   sync.Mutex // protects sentHeader.
 	headerChan   chan func()
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
+	drained      chan struct{}  // closed once queued frames have been processed.
+	continued    chan bool      // receives whether to send a body held for 100-continue.
+	heldBody     sync.WaitGroup // tracks sendHeldBody, which shutdown waits for.
+	onReset      func(error)    // called if the server resets the stream.
+	stopWatch    func() bool    // stops watching the request's context.
+	err          error          // error which ended the request, if any.
+	responded    bool           // the whole response has been received.
+	readClosed   bool           // further response data is discarded.
+	stats        common.StreamCounter
 }
 
 func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common.Frame) *RequestStream {
@@ -46,7 +60,10 @@ func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common
 	out.state.CloseHere()
 	out.header = make(http.Header)
 	out.finished = make(chan struct{})
+	out.drained = make(chan struct{})
+	out.continued = make(chan bool, 1)
 	out.headerChan = make(chan func(), 5)
+	out.stats.Open()
 	go out.processFrames()
 	return out
 }
@@ -70,19 +87,22 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 	copy(data, inputData)
 
 	// Send any new headers.
+	s.headerLock.Lock()
 	s.writeHeader()
+	s.unlockHeader()
 
 	// Chunk the response if necessary.
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
-		n, err := s.flow.Write(data[:common.MAX_DATA_SIZE])
+	chunk := s.conn.dataChunkSize
+	for len(data) > chunk {
+		n, err := s.flow.Write(data[:chunk])
 		if err != nil {
 			return written, err
 		}
 		written += n
-		data = data[common.MAX_DATA_SIZE:]
+		data = data[chunk:]
 	}
 
 	if len(data) > 0 {
@@ -98,7 +118,9 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 
 // WriteHeader is used to set the HTTP status code.
 func (s *RequestStream) WriteHeader(int) {
+	s.headerLock.Lock()
 	s.writeHeader()
+	s.unlockHeader()
 }
 
 /*****************
@@ -114,41 +136,198 @@ func (s *RequestStream) Close() error {
 	return nil
 }
 
+// Reset ends the stream abruptly, sending a RST_STREAM
+// with the given status code, rather than the CANCEL
+// sent by Close. The server's handler for the request
+// sees its context cancelled, with a
+// *common.StreamResetError carrying the status as the
+// cause. Status codes which are fatal to the connection,
+// such as PROTOCOL_ERROR, cannot be used.
+func (s *RequestStream) Reset(status common.StatusCode) error {
+	if !validResetStatus(status) {
+		return errors.New("Error: Invalid RST_STREAM status code.")
+	}
+
+	s.Lock()
+	if s.closed() {
+		s.Unlock()
+		return common.ErrStreamClosed
+	}
+	s.conn._RST_STREAM(s.streamID, status)
+	s.state.Close()
+	s.Unlock()
+
+	return s.Close()
+}
+
+// CloseWrite half-closes the stream with an empty DATA
+// frame carrying FLAG_FIN, once any data buffered by flow
+// control has been sent. The response can still be
+// received, but further writes fail. If the stream is then
+// closed in both directions, it is cleaned up.
+func (s *RequestStream) CloseWrite() error {
+	s.Lock()
+	if s.closed() {
+		s.Unlock()
+		return common.ErrStreamClosed
+	}
+	if s.state.ClosedHere() {
+		s.Unlock()
+		return nil
+	}
+
+	data := new(frames.DATA)
+	data.StreamID = s.streamID
+	data.Flags = common.FLAG_FIN
+	data.Data = []byte{}
+	if s.flow == nil {
+		select {
+		case s.out() <- data:
+		case <-s.conn.stop:
+		}
+	} else if err := s.flow.Queue(data, s.out()); err != nil {
+		s.Unlock()
+		return err
+	}
+	s.state.CloseHere()
+	closed := s.state.Closed()
+	s.Unlock()
+	if s.flow != nil {
+		s.flow.submit()
+	}
+
+	if closed {
+		s.Close()
+	}
+	return nil
+}
+
+// CloseRead stops passing the response's data to the
+// Receiver. Any data received since is discarded, though
+// the stream still ends normally when the server finishes.
+// If refuse is true and the server is still sending, the
+// stream is reset with RST_STREAM CANCEL instead, which
+// also ends the request, since SPDY cannot refuse one
+// direction alone.
+func (s *RequestStream) CloseRead(refuse bool) error {
+	s.Lock()
+	if s.closed() {
+		s.Unlock()
+		return common.ErrStreamClosed
+	}
+	if refuse && s.state.OpenThere() {
+		s.Unlock()
+		return s.Reset(common.RST_STREAM_CANCEL)
+	}
+	s.readClosed = true
+	s.Unlock()
+	return nil
+}
+
+// abort is called when the server resets the stream.
+// The error is returned by RequestResponse, unless the
+// request had already failed or the whole response had
+// been received, as when the server has no use for the
+// rest of the request body.
+func (s *RequestStream) abort(err error) {
+	s.Lock()
+	if s.err == nil && !s.responded {
+		s.err = err
+	}
+	onReset := s.onReset
+	s.Unlock()
+	if onReset != nil {
+		onReset(err)
+	}
+}
+
+// watchContext cancels the stream if ctx ends before
+// the whole response has been received.
+func (s *RequestStream) watchContext(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		s.cancel(ctx.Err())
+	})
+	s.Lock()
+	if s.closed() {
+		stop()
+	} else {
+		s.stopWatch = stop
+	}
+	s.Unlock()
+}
+
+// cancel ends the stream with RST_STREAM CANCEL, unless
+// the whole response has been received. The error is
+// returned by RequestResponse.
+func (s *RequestStream) cancel(err error) {
+	s.Lock()
+	if s.responded {
+		s.Unlock()
+		return
+	}
+	if s.err == nil {
+		s.err = err
+	}
+	s.Unlock()
+	s.Close()
+}
+
+// markResponded records that the server has
+// finished its response.
+func (s *RequestStream) markResponded() {
+	s.Lock()
+	s.responded = true
+	s.Unlock()
+}
+
 func (s *RequestStream) shutdown() {
+	s.headerLock.Lock()
 	s.writeHeader()
+	s.unlockHeader()
 	if s.state != nil {
 		if s.state.OpenThere() {
 			// Send the RST_STREAM.
 			rst := new(frames.RST_STREAM)
 			rst.StreamID = s.streamID
 			rst.Status = common.RST_STREAM_CANCEL
-			s.output <- rst
+			select {
+			case s.out() <- rst:
+			case <-s.conn.stop:
+			}
 		}
 		s.state.Close()
 	}
 	if s.flow != nil {
 		s.flow.Close()
 	}
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
+	}
 	select {
 	case <-s.finished:
 	default:
 		close(s.finished)
 	}
-	select {
-	case <-s.headerChan:
-	default:
-		close(s.headerChan)
-	}
+
+	// A held body may still be being sent, and must
+	// not use the output once the connection has
+	// closed it.
+	s.heldBody.Wait()
+
 	s.conn.requestStreamLimit.Close()
+	s.outputLock.Lock()
 	s.output = nil
-	s.Request = nil
-	s.Receiver = nil
+	s.outputLock.Unlock()
 	s.header = nil
 	s.stop = nil
 
-	s.conn.streamsLock.Lock()
-	delete(s.conn.streams, s.streamID)
-	s.conn.streamsLock.Unlock()
+	s.conn.streams.remove(s.streamID)
+	s.conn.updateState()
 }
 
 /**********
@@ -179,42 +358,76 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 
 		// Give to the client.
 		s.flow.Receive(frame.Data)
-		s.headerChan <- func() {
-			s.Receiver.ReceiveData(s.Request, data, frame.Flags.FIN())
+		if frame.Flags.FIN() {
+			s.markResponded()
+		}
+		s.Lock()
+		discard := s.readClosed
+		s.Unlock()
+		s.queue(func() {
+			receiver, request := s.receiver()
+			if receiver == nil {
+				return // The stream has closed.
+			}
+			if !discard {
+				receiver.ReceiveData(request, data, frame.Flags.FIN())
+			}
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				s.Close()
+				if s.state.Closed() {
+					s.Close()
+				}
 			}
-		}
+		})
 
 	case *frames.SYN_REPLY:
-		s.headerChan <- func() {
-			s.Receiver.ReceiveHeader(s.Request, frame.Header)
+		s.receivedStatus(frame.Header)
+		if frame.Flags.FIN() {
+			s.markResponded()
+		}
+		s.queue(func() {
+			receiver, request := s.receiver()
+			if receiver == nil {
+				return // The stream has closed.
+			}
+			if !s.interimResponse(request, frame.Header) {
+				receiver.ReceiveHeader(request, frame.Header)
+			}
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				s.Close()
+				if s.state.Closed() {
+					s.Close()
+				}
 			}
-		}
+		})
 
 	case *frames.HEADERS:
-		s.headerChan <- func() {
-			s.Receiver.ReceiveHeader(s.Request, frame.Header)
+		s.receivedStatus(frame.Header)
+		if frame.Flags.FIN() {
+			s.markResponded()
+		}
+		s.queue(func() {
+			receiver, request := s.receiver()
+			if receiver == nil {
+				return // The stream has closed.
+			}
+			if !s.interimResponse(request, frame.Header) {
+				receiver.ReceiveHeader(request, frame.Header)
+			}
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				s.Close()
+				if s.state.Closed() {
+					s.Close()
+				}
 			}
-		}
+		})
 
 	case *frames.WINDOW_UPDATE:
-		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
-		if err != nil {
-			reply := new(frames.RST_STREAM)
-			reply.StreamID = s.streamID
-			reply.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-			s.output <- reply
+		if err := s.flow.UpdateWindow(frame.DeltaWindowSize); err != nil {
+			return err
 		}
 
 	default:
@@ -235,9 +448,13 @@ func (s *RequestStream) CloseNotify() <-chan bool {
 func (s *RequestStream) Run() error {
 	// Receive and process inbound frames.
 	<-s.finished
+	<-s.drained
 
 	// Make sure any queued data has been sent.
-	if s.flow.Paused() {
+	s.flow.Lock()
+	paused := s.flow.Paused()
+	s.flow.Unlock()
+	if paused {
 		return errors.New(fmt.Sprintf("Error: Stream %d has been closed with data still buffered.\n", s.streamID))
 	}
 
@@ -254,11 +471,22 @@ func (s *RequestStream) StreamID() common.StreamID {
 	return s.streamID
 }
 
+// Stats returns the stream's statistics, including
+// its current throughput.
+func (s *RequestStream) Stats() common.StreamStats {
+	if s.flow == nil {
+		return s.stats.Snapshot()
+	}
+	return s.flow.Stats()
+}
+
 func (s *RequestStream) closed() bool {
 	if s.conn == nil || s.state == nil || s.Receiver == nil {
 		return true
 	}
 	select {
+	case <-s.finished:
+		return true
 	case _ = <-s.stop:
 		return true
 	default:
@@ -266,31 +494,88 @@ func (s *RequestStream) closed() bool {
 	}
 }
 
-// writeHeader is used to flush HTTP headers.
+// writeHeader is used to flush any HTTP headers which
+// have changed since they were last sent. The caller
+// must hold headerLock.
 func (s *RequestStream) writeHeader() {
-	if len(s.header) == 0 {
+	if s.state == nil || s.state.ClosedHere() {
+		return
+	}
+
+	changes := s.sentHeader.Changes(s.header)
+	if len(changes) == 0 {
 		return
 	}
 
 	// Create the HEADERS frame.
 	header := new(frames.HEADERS)
 	header.StreamID = s.streamID
-	header.Header = make(http.Header)
+	header.Header = changes
 
-	// Clear the headers that have been sent.
-	for name, values := range s.header {
-		for _, value := range values {
-			header.Header.Add(name, value)
-		}
-		s.header.Del(name)
+	// Any data written already is sent first.
+	if s.flow == nil {
+		s.out() <- header
+	} else if err := s.flow.Queue(header, s.out()); err != nil {
+		debug.Println(err)
+	}
+}
+
+// unlockHeader releases headerLock, then submits any
+// frames queued while it was held, so that the lock is
+// never held while waiting for the connection's output.
+func (s *RequestStream) unlockHeader() {
+	s.headerLock.Unlock()
+	if s.flow != nil {
+		s.flow.submit()
 	}
+}
 
-	s.output <- header
+// receiver returns the stream's Receiver and Request,
+// or a nil Receiver once the stream has closed and its
+// queued frames have been processed.
+func (s *RequestStream) receiver() (common.Receiver, *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	return s.Receiver, s.Request
 }
 
+// processFrames passes received frames to the Receiver
+// in order. Frames queued before the stream closes, such
+// as a response followed by a RST_STREAM, are still
+// delivered.
 func (s *RequestStream) processFrames() {
+	defer func() {
+		s.Lock()
+		s.Request = nil
+		s.Receiver = nil
+		s.Unlock()
+		close(s.drained)
+	}()
 	defer common.Recover()
-	for f := range s.headerChan {
-		f()
+
+	for {
+		select {
+		case f := <-s.headerChan:
+			f()
+		case <-s.finished:
+			// Deliver anything queued already.
+			for {
+				select {
+				case f := <-s.headerChan:
+					f()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// queue adds f to the frames to be processed, unless
+// the stream has finished.
+func (s *RequestStream) queue(f func()) {
+	select {
+	case s.headerChan <- f:
+	case <-s.finished:
 	}
 }
@@ -11,37 +11,136 @@ import (
 	"github.com/SlyMarbo/spdy/spdy3/frames"
 )
 
-// Request is used to make a client request.
+// Request is used to make a client request. If the request's
+// context ends before the whole response has been received,
+// the stream is cancelled with RST_STREAM CANCEL, and the
+// context's error is returned by RequestResponse.
 func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority common.Priority) (common.Stream, error) {
+	if err := request.Context().Err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRequest(priority); err != nil {
+		return nil, err
+	}
+
+	syn, err := newRequestSyn(request, priority)
+	if err != nil {
+		c.requestStreamLimit.Close()
+		return nil, err
+	}
+
+	// Any length given for the body must match it.
+	declared, err := common.ContentLength(syn.Header)
+	if err != nil {
+		c.requestStreamLimit.Close()
+		return nil, err
+	}
+	if declared < 0 && request.ContentLength > 0 {
+		declared = request.ContentLength
+	}
+
+	// Prepare the request body, if any.
+	body := make([]*frames.DATA, 0, 1)
+	total := 0
+	if request.Body != nil {
+		size := 32 * 1024
+		if size > c.dataChunkSize {
+			size = c.dataChunkSize
+		}
+		buf := make([]byte, size)
+		n, err := request.Body.Read(buf)
+		if err != nil && err != io.EOF {
+			c.requestStreamLimit.Close()
+			return nil, err
+		}
+		total = n
+		for n > 0 {
+			data := new(frames.DATA)
+			data.Data = make([]byte, n)
+			copy(data.Data, buf[:n])
+			body = append(body, data)
+			n, err = request.Body.Read(buf)
+			if err != nil && err != io.EOF {
+				c.requestStreamLimit.Close()
+				return nil, err
+			}
+			total += n
+		}
+
+		// Half-close the stream.
+		if len(body) == 0 {
+			syn.Flags = common.FLAG_FIN
+		} else {
+			syn.Header.Set("Content-Length", fmt.Sprint(total))
+			body[len(body)-1].Flags = common.FLAG_FIN
+		}
+		request.Body.Close()
+	} else {
+		syn.Flags = common.FLAG_FIN
+	}
+	if declared >= 0 && int64(total) != declared {
+		c.requestStreamLimit.Close()
+		return nil, common.ErrContentLength
+	}
+
+	// A body sent with Expect: 100-continue is
+	// held until the server asks for it.
+	var held []*frames.DATA
+	if len(body) > 0 && expectsContinue(request.Header) {
+		held, body = body, nil
+	}
+
+	stream, err := c.sendRequest(syn, body, request, receiver)
+	if err != nil {
+		return nil, err
+	}
+	stream.watchContext(request.Context())
+	if held != nil {
+		stream.heldBody.Add(1)
+		go stream.sendHeldBody(held, c.ExpectContinueTimeout)
+	}
+
+	return stream, nil
+}
+
+// checkRequest determines whether a new request can be
+// made. If so, the new stream is added to the stream
+// limit, and must be removed if the request fails.
+func (c *Conn) checkRequest(priority common.Priority) error {
 	if c.Closed() {
-		return nil, common.ErrConnClosed
+		return common.ErrConnClosed
 	}
 	c.goawayLock.Lock()
 	goaway := c.goawayReceived || c.goawaySent
 	c.goawayLock.Unlock()
 	if goaway {
-		return nil, common.ErrGoaway
+		return common.ErrGoaway
 	}
 
 	if c.server != nil {
-		return nil, errors.New("Error: Only clients can send requests.")
+		return errors.New("Error: Only clients can send requests.")
+	}
+
+	if !priority.Valid(3) {
+		return errors.New("Error: Priority must be in the range 0 - 7.")
 	}
 
 	// Check stream limit would allow the new stream.
 	if !c.requestStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return errors.New("Error: Max concurrent streams limit exceeded.")
 	}
 
-	if !priority.Valid(3) {
-		return nil, errors.New("Error: Priority must be in the range 0 - 7.")
-	}
+	return nil
+}
 
+// newRequestSyn returns the SYN_STREAM for the given
+// request, without any flags or stream ID.
+func newRequestSyn(request *http.Request, priority common.Priority) (*frames.SYN_STREAM, error) {
 	url := request.URL
 	if url == nil || url.Scheme == "" || url.Host == "" {
 		return nil, errors.New("Error: Incomplete path provided to resource.")
 	}
 
-	// Prepare the SYN_STREAM.
 	path := url.Path
 	if url.RawQuery != "" {
 		path += "?" + url.RawQuery
@@ -60,46 +159,23 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 	syn := new(frames.SYN_STREAM)
 	syn.Priority = priority
 	syn.Header = request.Header
+	if syn.Header == nil {
+		syn.Header = make(http.Header)
+	}
 	syn.Header.Set(":method", request.Method)
 	syn.Header.Set(":path", path)
 	syn.Header.Set(":version", "HTTP/1.1")
 	syn.Header.Set(":host", host)
 	syn.Header.Set(":scheme", url.Scheme)
 
-	// Prepare the request body, if any.
-	body := make([]*frames.DATA, 0, 1)
-	if request.Body != nil {
-		buf := make([]byte, 32*1024)
-		n, err := request.Body.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		total := n
-		for n > 0 {
-			data := new(frames.DATA)
-			data.Data = make([]byte, n)
-			copy(data.Data, buf[:n])
-			body = append(body, data)
-			n, err = request.Body.Read(buf)
-			if err != nil && err != io.EOF {
-				return nil, err
-			}
-			total += n
-		}
-
-		// Half-close the stream.
-		if len(body) == 0 {
-			syn.Flags = common.FLAG_FIN
-		} else {
-			syn.Header.Set("Content-Length", fmt.Sprint(total))
-			body[len(body)-1].Flags = common.FLAG_FIN
-		}
-		request.Body.Close()
-	} else {
-		syn.Flags = common.FLAG_FIN
-	}
+	return syn, nil
+}
 
-	// Send.
+// sendRequest assigns the request's stream ID, then sends
+// the SYN_STREAM and any body, and creates the new stream.
+// Unless the SYN_STREAM or body has FLAG_FIN set, the stream
+// remains open for writing.
+func (c *Conn) sendRequest(syn *frames.SYN_STREAM, body []*frames.DATA, request *http.Request, receiver common.Receiver) (*RequestStream, error) {
 	c.streamCreation.Lock()
 	defer c.streamCreation.Unlock()
 
@@ -112,22 +188,33 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 	syn.StreamID = c.lastRequestStreamID
 	c.lastRequestStreamIDLock.Unlock()
 	if syn.StreamID > common.MAX_STREAM_ID {
+		c.requestStreamLimit.Close()
 		return nil, errors.New("Error: All client streams exhausted.")
 	}
-	c.output[0] <- syn
-	for _, frame := range body {
-		frame.StreamID = syn.StreamID
-		c.output[0] <- frame
-	}
 
 	// Create the request stream.
-	out := NewRequestStream(c, syn.StreamID, c.output[0])
+	out := NewRequestStream(c, syn.StreamID, c.output[syn.Priority])
+	out.priority = syn.Priority
 	out.Request = request
 	out.Receiver = receiver
 	out.AddFlowControl(c.flowControl)
-	c.streamsLock.Lock()
-	c.streams[syn.StreamID] = out // Store in the connection map.
-	c.streamsLock.Unlock()
+	if !syn.Flags.FIN() && len(body) == 0 {
+		out.state = new(common.StreamState)
+	}
+	c.streams.add(syn.StreamID, out) // Store in the connection map.
+	c.updateState()
+
+	select {
+	case c.output[0] <- syn:
+	case <-c.stop:
+	}
+	for _, frame := range body {
+		frame.StreamID = syn.StreamID
+		select {
+		case c.output[0] <- frame:
+		case <-c.stop:
+		}
+	}
 
 	return out, nil
 }
@@ -144,5 +231,14 @@ func (c *Conn) RequestResponse(request *http.Request, receiver common.Receiver,
 	// Let the request run its course.
 	stream.Run()
 
+	if stream, ok := stream.(*RequestStream); ok {
+		stream.Lock()
+		err := stream.err
+		stream.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return res.Response(), c.shutdownError
 }
@@ -5,10 +5,12 @@
 package spdy3
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"runtime"
 	"strconv"
 	"sync"
 
@@ -26,18 +28,36 @@ type ResponseStream struct {
 	conn           *Conn
 	streamID       common.StreamID
 	flow           *flowControl
-	requestBody    *bytes.Buffer
+	requestBody    *common.SpillBuffer
+	body           *dataPipe // streamed request body, if any.
 	state          *common.StreamState
 	output         chan<- common.Frame
+	outputLock     sync.Mutex // protects output and priority.
 	request        *http.Request
+	cancel         context.CancelCauseFunc // cancels the request's context.
 	handler        http.Handler
-	header         http.Header
+	header         http.Header // the handler's header, only modified to add Server-Timing.
+	sentHeader     common.HeaderSnapshot
 	priority       common.Priority
 	unidirectional bool
 	responseCode   int
 	stop           chan bool
 	ready          chan struct{}
 	wroteHeader    bool
+	sentInterim    bool       // an interim 1xx response has been sent.
+	headerLock     sync.Mutex // protects sentHeader, wroteHeader and sentInterim.
+	flushHeaders   bool       // send headers ahead of other frames.
+	headerSize     int64      // charged to the connection's memory budget.
+	resetErr       error      // set if the stream was reset.
+	readClosed     bool       // further request data is discarded.
+	head           bool       // the request is HEAD, so the response has no body.
+	declared       int64      // the response's Content-Length, or -1.
+	written        int64      // response body written by the handler.
+	bodyReceived   int64      // request body received.
+	acceptEncoding string     // the request's Accept-Encoding.
+	encoding       string     // the response's content coding, if compressed.
+	encoder        bodyEncoder
+	stats          common.StreamCounter
 }
 
 func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- common.Frame, handler http.Handler, request *http.Request) *ResponseStream {
@@ -53,17 +73,39 @@ func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- commo
 	out.priority = frame.Priority
 	out.stop = conn.stop
 	out.unidirectional = frame.Flags.UNIDIRECTIONAL()
-	out.requestBody = new(bytes.Buffer)
+	out.requestBody = conn.newRequestBody()
+	out.headerSize = common.HeaderSize(request.Header)
+	out.stats.Open()
+	out.stats.Received(false, 0, int(common.HeaderSize(frame.Header)))
+	conn.memory.Add(out.headerSize)
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
 	out.responseCode = 0
+	out.head = request.Method == "HEAD"
+	out.declared = -1
+	if conn.CompressResponses {
+		out.acceptEncoding = request.Header.Get("Accept-Encoding")
+	}
 	out.ready = make(chan struct{})
 	out.wroteHeader = false
 	if frame.Flags.FIN() {
 		close(out.ready)
 		out.state.CloseThere()
+	} else if conn.handlesEarly(request) {
+		// The body is streamed to the handler, which is
+		// called immediately.
+		out.body = newDataPipe()
+		out.body.account = conn.memory
+		out.body.consumed = out.consumed
+		close(out.ready)
+	}
+	if out.body != nil && expectsContinue(request.Header) {
+		out.request.Body = &continueReader{stream: out, body: out.body}
+	} else if out.body != nil {
+		out.request.Body = out.body
+	} else {
+		out.request.Body = out.requestBody
 	}
-	out.request.Body = &common.ReadCloser{out.requestBody}
 	return out
 }
 
@@ -77,82 +119,244 @@ func (s *ResponseStream) Header() http.Header {
 
 // Write is the main method with which data is sent.
 func (s *ResponseStream) Write(inputData []byte) (int, error) {
+	return s.write(inputData, false)
+}
+
+// write sends data as the response body. If owned is
+// true, data belongs to the stream and is not copied.
+func (s *ResponseStream) write(inputData []byte, owned bool) (int, error) {
 	if s.unidirectional {
 		return 0, errors.New("Error: Stream is unidirectional.")
 	}
 
+	if err := s.resetError(); err != nil {
+		return 0, err
+	}
+
 	if s.closed() || s.state.ClosedHere() {
 		return 0, errors.New("Error: Stream already closed.")
 	}
 
-	// Copy the data locally to avoid any pointer issues.
-	data := make([]byte, len(inputData))
-	copy(data, inputData)
+	// Default to 200 response, and
+	// send any new headers.
+	s.sendHeaders(inputData)
 
-	// Default to 200 response.
-	if !s.wroteHeader {
-		s.WriteHeader(http.StatusOK)
+	// A compressed body is sent as the encoder
+	// produces it.
+	if s.encoder != nil {
+		n, err := s.encoder.Write(inputData)
+		return n, s.writeError(err)
 	}
 
-	// Send any new headers.
-	s.writeHeader()
+	return s.writeData(inputData, owned)
+}
+
+// writeData sends data on the stream, subject to flow
+// control, as written or as produced by the encoder.
+func (s *ResponseStream) writeData(inputData []byte, owned bool) (int, error) {
+	// Copy the data locally to avoid any pointer issues.
+	data := inputData
+	if !owned {
+		data = make([]byte, len(inputData))
+		copy(data, inputData)
+	}
+
+	// The body may not exceed its Content-Length.
+	if s.declared >= 0 && s.written+int64(len(data)) > s.declared {
+		return 0, http.ErrContentLength
+	}
 
 	// Chunk the response if necessary.
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
-		n, err := s.flow.Write(data[:common.MAX_DATA_SIZE])
+	chunk := s.conn.dataChunkSize
+	for len(data) > chunk {
+		n, err := s.flow.Write(data[:chunk])
 		if err != nil {
-			return written, err
+			s.written += int64(written)
+			return written, s.writeError(err)
 		}
 		written += n
-		data = data[common.MAX_DATA_SIZE:]
+		data = data[chunk:]
 	}
 
 	n, err := s.flow.Write(data)
 	written += n
+	s.written += int64(written)
 
-	return written, err
+	return written, s.writeError(err)
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy to the
+// stream, such as from an *os.File, reads the body directly
+// into DATA frames, rather than through an intermediate buffer.
+// Each read is sized to the stream's send window, up to the
+// connection's DATA chunk size, and waits for the window to
+// grow, so that no data is held by flow control.
+func (s *ResponseStream) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	for {
+		window, err := s.flow.sendWindow()
+		if err != nil {
+			return n, s.writeError(err)
+		}
+
+		size := int64(s.conn.dataChunkSize)
+		if window < size {
+			size = window
+		}
+		buf := make([]byte, size)
+		read, rerr := r.Read(buf)
+		if read > 0 {
+			written, err := s.write(buf[:read], true)
+			n += int64(written)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
 }
 
 // WriteHeader is used to set the HTTP status code.
+// As in net/http, a 1xx code other than 101 sends an
+// interim response with the headers set so far, and
+// WriteHeader may be called again with the final
+// status.
 func (s *ResponseStream) WriteHeader(code int) {
 	if s.unidirectional {
 		log.Println("Error: Stream is unidirectional.")
 		return
 	}
 
+	s.headerLock.Lock()
+	defer s.unlockHeader()
+
 	if s.wroteHeader {
 		log.Println("Error: Multiple calls to ResponseWriter.WriteHeader.")
 		return
 	}
 
+	if isInterim(code) {
+		s.writeInterim(code, common.CloneHeader(s.header))
+		return
+	}
+
+	s.writeReply(code, nil)
+}
+
+// writeReply sends the SYN_REPLY. The start of the
+// body, if known, is used to decide whether it is
+// compressed. The caller must hold headerLock.
+func (s *ResponseStream) writeReply(code int, body []byte) {
+	// These responses have no body, so close the stream now.
+	fin := code == 204 || code == 304 || code/100 == 1
+	if fin {
+		s.state.CloseHere()
+	} else {
+		s.startEncoding(code, body)
+	}
+
+	s.queue(s.newReply(code, fin), s.headerOutput())
+}
+
+// newReply returns the frame which sends the response's
+// status, with a snapshot of the headers set so far. This
+// is a SYN_REPLY, or a HEADERS frame if an interim response
+// has been sent already. The caller must hold headerLock.
+func (s *ResponseStream) newReply(code int, fin bool) common.Frame {
 	s.wroteHeader = true
 	s.responseCode = code
-	s.header.Set(":status", strconv.Itoa(code))
-	s.header.Set(":version", "HTTP/1.1")
+	if !fin && !s.head {
+		s.declared, _ = common.ContentLength(s.header)
+	}
+
+	header := s.sentHeader.Changes(s.header)
+	if s.encoder != nil && !fin {
+		// The length of the compressed body is unknown.
+		s.declared = -1
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", s.encoding)
+		header.Add("Vary", "Accept-Encoding")
+	}
+	header.Set(":status", strconv.Itoa(code))
+	header.Set(":version", "HTTP/1.1")
+
+	var flags common.Flags
+	if fin {
+		flags = common.FLAG_FIN
+	}
+
+	if s.sentInterim {
+		headers := new(frames.HEADERS)
+		headers.Flags = flags
+		headers.StreamID = s.streamID
+		headers.Header = header
+		return headers
+	}
 
-	// Create the response SYN_REPLY.
 	synReply := new(frames.SYN_REPLY)
+	synReply.Flags = flags
 	synReply.StreamID = s.streamID
-	synReply.Header = make(http.Header)
+	synReply.Header = header
+	return synReply
+}
+
+// Flush sends any response headers which have not yet
+// been sent. Data is not buffered by the stream, so any
+// data written has already been queued for sending,
+// subject to flow control, except that held by the
+// encoder of a compressed body, which is flushed.
+func (s *ResponseStream) Flush() {
+	if s.unidirectional || s.closed() || s.state.ClosedHere() {
+		return
+	}
 
-	// Clear the headers that have been sent.
-	for name, values := range s.header {
-		for _, value := range values {
-			synReply.Header.Add(name, value)
+	s.sendHeaders(nil)
+	if s.encoder != nil {
+		if err := s.encoder.Flush(); err != nil {
+			debug.Println(err)
 		}
-		s.header.Del(name)
 	}
+}
 
-	// These responses have no body, so close the stream now.
-	if code == 204 || code == 304 || code/100 == 1 {
-		synReply.Flags = common.FLAG_FIN
-		s.state.CloseHere()
+// sendHeaders sends a 200 SYN_REPLY if no
+// reply has been sent, then any new headers.
+func (s *ResponseStream) sendHeaders(body []byte) {
+	s.headerLock.Lock()
+	defer s.unlockHeader()
+
+	if !s.wroteHeader {
+		s.writeReply(http.StatusOK, body)
 	}
+	s.writeHeader()
+}
+
+// SetFlushHeaders determines whether the stream's response
+// headers are sent ahead of all other pending frames, rather
+// than at the stream's priority. This ensures that headers
+// reach the wire promptly after WriteHeader or Flush, even
+// when the connection is busy, which is important for
+// streaming responses where clients time out waiting for
+// headers. SetFlushHeaders should be called before
+// WriteHeader.
+func (s *ResponseStream) SetFlushHeaders(flush bool) {
+	s.flushHeaders = flush
+}
 
-	s.output <- synReply
+// headerOutput returns the channel on which the
+// stream's headers are sent.
+func (s *ResponseStream) headerOutput() chan<- common.Frame {
+	if s.flushHeaders {
+		return s.conn.output[0]
+	}
+	return s.out()
 }
 
 /*****************
@@ -167,8 +371,133 @@ func (s *ResponseStream) Close() error {
 	return nil
 }
 
+// Reset ends the stream abruptly, sending a RST_STREAM
+// with the given status code. The request's context is
+// cancelled with a *common.StreamResetError as its cause.
+func (s *ResponseStream) Reset(status common.StatusCode) error {
+	if !validResetStatus(status) {
+		return errors.New("Error: Invalid RST_STREAM status code.")
+	}
+
+	s.Lock()
+	if s.closed() {
+		s.Unlock()
+		return common.ErrStreamClosed
+	}
+	s.conn._RST_STREAM(s.streamID, status)
+	s.state.Close()
+	s.Unlock()
+
+	s.abort(&common.StreamResetError{StreamID: s.streamID, Status: status})
+	return s.Close()
+}
+
+// CloseWrite half-closes the stream, ending the response
+// with an empty DATA frame carrying FLAG_FIN, once any data
+// buffered by flow control has been sent, or with a SYN_REPLY
+// if none has been sent. The request body can still be read,
+// but further writes fail.
+func (s *ResponseStream) CloseWrite() error {
+	s.Lock()
+	closed := s.closed()
+	s.Unlock()
+	if closed {
+		return common.ErrStreamClosed
+	}
+
+	s.finishEncoding()
+
+	s.headerLock.Lock()
+	defer s.unlockHeader()
+	if s.unidirectional || s.state.ClosedHere() {
+		return nil
+	}
+
+	if !s.wroteHeader {
+		s.queue(s.newReply(http.StatusOK, true), s.out())
+	} else {
+		// Send any headers set since the last write.
+		s.writeHeader()
+
+		data := new(frames.DATA)
+		data.StreamID = s.streamID
+		data.Flags = common.FLAG_FIN
+		data.Data = []byte{}
+		s.queue(data, s.out())
+	}
+	s.state.CloseHere()
+	return nil
+}
+
+// CloseRead stops reading the request body. Any data
+// received since, or not yet read, is discarded, and
+// reads of the body fail. If refuse is true and the
+// client is still sending, the stream is reset with
+// RST_STREAM CANCEL instead, which also ends the response,
+// since SPDY cannot refuse one direction alone.
+func (s *ResponseStream) CloseRead(refuse bool) error {
+	s.Lock()
+	if s.closed() {
+		s.Unlock()
+		return common.ErrStreamClosed
+	}
+	if refuse && s.state.OpenThere() {
+		s.Unlock()
+		return s.Reset(common.RST_STREAM_CANCEL)
+	}
+	s.readClosed = true
+	body := s.body
+	s.Unlock()
+
+	if body != nil {
+		body.Close()
+	}
+	return nil
+}
+
+// abort cancels the request's context and fails any
+// reads of the request body and writes of the response
+// with err, when the stream has been reset. Nothing more
+// is sent on the stream.
+func (s *ResponseStream) abort(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.resetErr == nil {
+		s.resetErr = err
+	}
+	if s.state != nil {
+		s.state.Close()
+	}
+	if s.body != nil {
+		s.body.closeWithError(err)
+	}
+	if s.cancel != nil {
+		s.cancel(err)
+	}
+}
+
+// resetError returns the error with which the
+// stream was reset, if any.
+func (s *ResponseStream) resetError() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.resetErr
+}
+
+// writeError returns the error for a failed write,
+// which is the reset error if the write failed
+// because the stream was reset.
+func (s *ResponseStream) writeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if reset := s.resetError(); reset != nil {
+		return reset
+	}
+	return err
+}
+
 func (s *ResponseStream) shutdown() {
-	s.writeHeader()
 	if s.state != nil {
 		s.state.Close()
 	}
@@ -179,14 +508,26 @@ func (s *ResponseStream) shutdown() {
 		s.requestBody.Reset()
 		s.requestBody = nil
 	}
+	if s.body != nil {
+		s.body.closeWithError(common.ErrStreamClosed)
+		s.body.release()
+	}
+	s.conn.memory.Release(s.headerSize)
+	s.headerSize = 0
+	if s.cancel != nil {
+		if s.conn.Closed() {
+			s.cancel(common.ErrConnClosed)
+		} else {
+			s.cancel(common.ErrStreamClosed)
+		}
+	}
 	s.conn.requestStreamLimit.Close()
 	s.request = nil
 	s.handler = nil
 	s.stop = nil
 
-	s.conn.streamsLock.Lock()
-	delete(s.conn.streams, s.streamID)
-	s.conn.streamsLock.Unlock()
+	s.conn.streams.remove(s.streamID)
+	s.conn.updateState()
 }
 
 /**********
@@ -208,7 +549,12 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
-		s.requestBody.Write(frame.Data)
+		if s.body != nil {
+			s.flow.Hold(len(frame.Data))
+			s.body.write(frame.Data)
+		} else if !s.readClosed {
+			s.requestBody.Write(frame.Data)
+		}
 		s.flow.Receive(frame.Data)
 		if frame.Flags.FIN() {
 			select {
@@ -217,6 +563,9 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 				close(s.ready)
 			}
 			s.state.CloseThere()
+			if s.body != nil {
+				s.body.closeWithError(io.EOF)
+			}
 		}
 
 	case *frames.SYN_REPLY:
@@ -233,12 +582,7 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 		return errors.New("Received unexpected HEADERS frame")
 
 	case *frames.WINDOW_UPDATE:
-		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
-		if err != nil {
-			reply := new(frames.RST_STREAM)
-			reply.StreamID = s.streamID
-			reply.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-			s.output <- reply
+		if err := s.flow.UpdateWindow(frame.DeltaWindowSize); err != nil {
 			return err
 		}
 
@@ -249,6 +593,40 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	return nil
 }
 
+// receiveBody counts n bytes of request body received,
+// returning false if the body now exceeds the connection's
+// MaxRequestBodyBytes.
+func (s *ResponseStream) receiveBody(n int) bool {
+	limit := s.conn.MaxRequestBodyBytes
+	if limit <= 0 {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.bodyReceived += int64(n)
+	return s.bodyReceived <= limit
+}
+
+// refuseBody ends the stream once its request body has
+// exceeded the connection's MaxRequestBodyBytes. The client
+// is sent 413 Request Entity Too Large if the handler has not
+// yet responded, and the handler's reads and writes fail with
+// an *http.MaxBytesError.
+func (s *ResponseStream) refuseBody() {
+	s.headerLock.Lock()
+	reply := !s.unidirectional && !s.wroteHeader && !s.sentInterim && s.state.OpenHere()
+	if reply {
+		s.wroteHeader = true
+		s.responseCode = http.StatusRequestEntityTooLarge
+	}
+	s.state.Close()
+	s.headerLock.Unlock()
+
+	s.abort(&http.MaxBytesError{Limit: s.conn.MaxRequestBodyBytes})
+	s.conn.refuseBody(s.streamID, reply)
+	go s.Close()
+}
+
 func (s *ResponseStream) CloseNotify() <-chan bool {
 	return s.stop
 }
@@ -268,24 +646,44 @@ func (s *ResponseStream) Run() error {
 		}
 	}()
 
-	// Make sure Request is prepared.
-	if s.requestBody == nil || s.request.Body == nil {
-		s.requestBody = new(bytes.Buffer)
-		s.request.Body = &common.ReadCloser{s.requestBody}
+	// Make sure Request is prepared. The stream
+	// may have been closed with the connection.
+	s.Lock()
+	handler, request := s.handler, s.request
+	if handler == nil || request == nil {
+		s.Unlock()
+		return nil
+	}
+	if s.body == nil && (s.requestBody == nil || request.Body == nil) {
+		s.requestBody = s.conn.newRequestBody()
+		request.Body = s.requestBody
 	}
+	s.Unlock()
 
 	// Wait until the full request has been received.
 	<-s.ready
 
+	// Start any automatic pushes.
+	pushes := s.conn.autoPush(s)
+
 	/***************
 	 *** HANDLER ***
 	 ***************/
-	s.handler.ServeHTTP(s, s.request)
+	s.stats.HandlerStarted()
+	s.serve(handler, request)
+	s.stats.HandlerFinished()
+
+	// The pushes must finish before the stream closes.
+	pushes.Wait()
+
+	// Send the end of any compressed body.
+	s.finishEncoding()
 
 	// Make sure any queued data has been sent.
 	if err := s.flow.Wait(); err != nil {
 		log.Println(err)
 	}
+	s.stats.Flushed()
 
 	// Close the stream with a SYN_REPLY if
 	// none has been sent, or an empty DATA
@@ -293,39 +691,53 @@ func (s *ResponseStream) Run() error {
 	// already.
 	// If the stream is already closed at
 	// this end, then nothing happens.
+	// A response shorter than its Content-Length is
+	// reset, rather than ended, so that the client
+	// does not take it to be complete.
+	s.headerLock.Lock()
+	s.reportTiming(request)
+	short := false
 	if !s.unidirectional {
 		if s.state.OpenHere() && !s.wroteHeader {
-			h := s.header
-			if h == nil {
-				h = make(http.Header)
-			}
-
-			h.Set(":status", "200")
-			h.Set(":version", "HTTP/1.1")
-
 			// Create the response SYN_REPLY.
-			synReply := new(frames.SYN_REPLY)
-			synReply.Flags = common.FLAG_FIN
-			synReply.StreamID = s.streamID
-			synReply.Header = make(http.Header)
-
-			for name, values := range h {
-				for _, value := range values {
-					synReply.Header.Add(name, value)
-				}
-				h.Del(name)
+			length, _ := common.ContentLength(s.header)
+			short = length > 0 && !s.head
+			s.queue(s.newReply(http.StatusOK, !short), s.out())
+		} else if s.state.OpenHere() {
+			// Send any headers set since the
+			// last write before ending the stream.
+			s.writeHeader()
+
+			short = s.declared >= 0 && s.written < s.declared
+			if !short {
+				// Create the DATA.
+				data := new(frames.DATA)
+				data.StreamID = s.streamID
+				data.Flags = common.FLAG_FIN
+				data.Data = []byte{}
+
+				s.queue(data, s.out())
 			}
+		}
+	}
+	s.unlockHeader()
 
-			s.output <- synReply
-		} else if s.state.OpenHere() {
-			// Create the DATA.
-			data := new(frames.DATA)
-			data.StreamID = s.streamID
-			data.Flags = common.FLAG_FIN
-			data.Data = []byte{}
+	if short {
+		log.Printf("Resetting stream %d, as the handler wrote %d bytes of a %d-byte Content-Length.\n", s.streamID, s.written, s.declared)
+		s.Reset(common.RST_STREAM_INTERNAL_ERROR)
+	}
 
-			s.output <- data
+	// The handler has finished, so any further
+	// request data is unwanted.
+	if s.body != nil && s.state.OpenThere() {
+		rst := new(frames.RST_STREAM)
+		rst.StreamID = s.streamID
+		rst.Status = common.RST_STREAM_CANCEL
+		select {
+		case s.out() <- rst:
+		case <-s.conn.stop:
 		}
+		s.state.CloseThere()
 	}
 
 	// Clean up state.
@@ -338,6 +750,67 @@ func (s *ResponseStream) Run() error {
 	return nil
 }
 
+// reportTiming reports the stream's timings once the handler
+// has returned and its DATA has been released, as set by the
+// connection's ServerTiming. A Server-Timing header is only
+// added if the stream is still open, to be sent with its final
+// frame. The caller must hold headerLock.
+func (s *ResponseStream) reportTiming(request *http.Request) {
+	switch s.conn.ServerTiming {
+	case common.ServerTimingHeader:
+		if !s.unidirectional && s.state.OpenHere() {
+			stats := s.Stats()
+			s.header.Add("Server-Timing", stats.ServerTimingValue())
+		}
+	case common.ServerTimingLog:
+		stats := s.Stats()
+		log.Printf("Stream %d (%s %s) timing: %s\n", s.streamID, request.Method, request.URL, stats.ServerTimingValue())
+	}
+}
+
+// serve calls the handler, recovering from any panic. The
+// stream is then ended with a 500 response if the handler
+// had not sent its headers, or a RST_STREAM with
+// INTERNAL_ERROR otherwise, so that the client is not left
+// waiting, and the panic is reported. A panic with
+// http.ErrAbortHandler resets the stream with CANCEL, and
+// is not reported.
+func (s *ResponseStream) serve(handler http.Handler, request *http.Request) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		const size = 64 << 10
+		stack := make([]byte, size)
+		stack = stack[:runtime.Stack(stack, false)]
+
+		if v == http.ErrAbortHandler {
+			s.Reset(common.RST_STREAM_CANCEL)
+			return
+		}
+
+		s.headerLock.Lock()
+		if !s.unidirectional && !s.wroteHeader && s.state.OpenHere() {
+			s.queue(s.newReply(http.StatusInternalServerError, true), s.out())
+			s.state.CloseHere()
+			s.unlockHeader()
+		} else {
+			s.headerLock.Unlock()
+			s.Reset(common.RST_STREAM_INTERNAL_ERROR)
+		}
+
+		if s.conn.PanicHandler != nil {
+			s.conn.PanicHandler(request, v, stack)
+		} else {
+			log.Printf("Panic serving stream %d from %s: %v\n%s", s.streamID, s.conn.remoteAddr, v, stack)
+		}
+	}()
+
+	handler.ServeHTTP(s, request)
+}
+
 func (s *ResponseStream) State() *common.StreamState {
 	return s.state
 }
@@ -346,6 +819,24 @@ func (s *ResponseStream) StreamID() common.StreamID {
 	return s.streamID
 }
 
+// Stats returns the stream's statistics, including
+// its current throughput.
+func (s *ResponseStream) Stats() common.StreamStats {
+	if s.flow == nil {
+		return s.stats.Snapshot()
+	}
+	return s.flow.Stats()
+}
+
+// consumed is called as the handler reads the streamed
+// request body, so that the receive window only grows
+// as the body is consumed.
+func (s *ResponseStream) consumed(n int) {
+	if s.flow != nil {
+		s.flow.Consumed(n)
+	}
+}
+
 func (s *ResponseStream) closed() bool {
 	if s.conn == nil || s.state == nil || s.handler == nil {
 		return true
@@ -358,32 +849,54 @@ func (s *ResponseStream) closed() bool {
 	}
 }
 
-// writeHeader is used to flush HTTP headers.
+// writeHeader is used to flush any HTTP headers which
+// have changed since they were last sent. Nothing is
+// sent before the SYN_REPLY, or once the stream is
+// closed. The caller must hold headerLock.
 func (s *ResponseStream) writeHeader() {
-	if len(s.header) == 0 || s.unidirectional {
+	if s.unidirectional || !s.wroteHeader {
+		return
+	}
+	if s.state == nil || s.state.ClosedHere() {
+		return
+	}
+
+	changes := s.sentHeader.Changes(s.header)
+	if len(changes) == 0 {
 		return
 	}
 
 	// Create the HEADERS frame.
 	header := new(frames.HEADERS)
 	header.StreamID = s.streamID
-	header.Header = make(http.Header)
+	header.Header = changes
 
-	// Clear the headers that have been sent.
-	for name, values := range s.header {
-		for _, value := range values {
-			header.Header.Add(name, value)
+	s.queue(header, s.headerOutput())
+}
+
+// queue is used to send a frame on the stream, behind
+// any DATA buffered by flow control. The frame is sent
+// once the flow control's queue is submitted, which
+// unlockHeader does.
+func (s *ResponseStream) queue(frame common.Frame, output chan<- common.Frame) {
+	if s.flow == nil {
+		select {
+		case output <- frame:
+		case <-s.conn.stop:
 		}
-		s.header.Del(name)
+		return
+	}
+	if err := s.flow.Queue(frame, output); err != nil {
+		debug.Println(err)
 	}
-
-	s.output <- header
 }
 
-/******************
- * PriorityStream *
- ******************/
-
-func (s *ResponseStream) Priority() common.Priority {
-	return s.priority
+// unlockHeader releases headerLock, then submits any
+// frames queued while it was held, so that the lock is
+// never held while waiting for the connection's output.
+func (s *ResponseStream) unlockHeader() {
+	s.headerLock.Unlock()
+	if s.flow != nil {
+		s.flow.submit()
+	}
 }
@@ -0,0 +1,347 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// maxFairHeld is the maximum number of frames the fair
+// scheduler will hold back in each priority class while
+// looking for a frame from a stream which has not used its
+// share of the window.
+const maxFairHeld = 4
+
+// fairScheduler is used by the send loop to share bandwidth
+// approximately equally between the streams in each priority
+// class. The bytes of DATA sent by each stream are counted
+// over a short window, and a stream which has sent more than
+// its share in the current window has its frames held back
+// while other streams in the same class have data waiting.
+//
+// Alternatively, if the quantum is positive, DATA is sent
+// by deficit round robin. All DATA is held, and the streams
+// in each class with frames held take turns, each sending
+// up to the quantum's worth of bytes per turn. Bytes unused
+// in a turn are carried over to the stream's next turn,
+// while it has frames waiting.
+//
+// The fairScheduler is only used by the send goroutine, so
+// has no locking, except for the counts of held frames,
+// which are read by SchedulerState.
+type fairScheduler struct {
+	window time.Duration
+	start  time.Time
+	sent   [8]map[common.StreamID]int
+	total  [8]int
+	held   [8][]common.Frame
+	counts [8]int32 // len(held), accessed atomically.
+
+	// Deficit round robin.
+	quantum  int
+	turns    [8][]common.StreamID // streams with frames held, in turn order.
+	deficit  [8]map[common.StreamID]int
+	credited [8]bool // whether the first stream in turns has had its quantum.
+}
+
+func newFairScheduler(window time.Duration) *fairScheduler {
+	out := new(fairScheduler)
+	out.window = window
+	out.start = time.Now()
+	for i := range out.sent {
+		out.sent[i] = make(map[common.StreamID]int)
+	}
+	return out
+}
+
+func newRoundRobinScheduler(quantum int) *fairScheduler {
+	out := new(fairScheduler)
+	out.quantum = quantum
+	for i := range out.deficit {
+		out.deficit[i] = make(map[common.StreamID]int)
+	}
+	return out
+}
+
+// full reports whether no more frames should be held for
+// the given priority.
+func (f *fairScheduler) full(priority int) bool {
+	return len(f.held[priority]) >= maxFairHeld
+}
+
+// admit is called with each frame taken from the output
+// channel for the given priority. It returns true if the
+// frame should be sent now, or false if it has been held.
+func (f *fairScheduler) admit(priority int, frame common.Frame) bool {
+	id, ok := scheduledStreamID(frame)
+	if !ok {
+		return true
+	}
+
+	f.tick()
+
+	// Frames must not be reordered within a stream,
+	// including when its priority has changed.
+	if held := f.holding(id); held >= 0 {
+		f.hold(held, frame)
+		return false
+	}
+
+	if f.quantum > 0 {
+		if _, ok := frame.(*frames.DATA); ok {
+			f.hold(priority, frame)
+			return false
+		}
+		return true
+	}
+
+	if data, ok := frame.(*frames.DATA); ok {
+		if f.overShare(priority, id) {
+			f.hold(priority, frame)
+			return false
+		}
+		f.record(priority, id, len(data.Data))
+	}
+
+	return true
+}
+
+// release returns the next held frame for the given
+// priority, or nil if there are none. Frames from the
+// stream which has sent least in the current window are
+// preferred.
+func (f *fairScheduler) release(priority int) common.Frame {
+	held := f.held[priority]
+	if len(held) == 0 {
+		return nil
+	}
+	if f.quantum > 0 {
+		return f.releaseTurn(priority)
+	}
+
+	f.tick()
+
+	sent := f.sent[priority]
+	best := 0
+	bestID, _ := scheduledStreamID(held[0])
+	for i, frame := range held[1:] {
+		id, _ := scheduledStreamID(frame)
+		if sent[id] < sent[bestID] {
+			best, bestID = i+1, id
+		}
+	}
+
+	frame := held[best]
+	f.held[priority] = append(held[:best], held[best+1:]...)
+	atomic.StoreInt32(&f.counts[priority], int32(len(f.held[priority])))
+	if data, ok := frame.(*frames.DATA); ok {
+		f.record(priority, bestID, len(data.Data))
+	}
+
+	return frame
+}
+
+// releaseTurn returns the next held frame for the given
+// priority by deficit round robin. There must be frames
+// held.
+func (f *fairScheduler) releaseTurn(priority int) common.Frame {
+	deficit := f.deficit[priority]
+	for {
+		id := f.turns[priority][0]
+		if !f.credited[priority] {
+			deficit[id] += f.quantum
+			f.credited[priority] = true
+		}
+
+		// The stream's first held frame.
+		held := f.held[priority]
+		i := 0
+		for ; i < len(held); i++ {
+			if heldID, _ := scheduledStreamID(held[i]); heldID == id {
+				break
+			}
+		}
+
+		frame := held[i]
+		n := 0
+		if data, ok := frame.(*frames.DATA); ok {
+			n = len(data.Data)
+		}
+
+		if n > deficit[id] {
+			// Next stream's turn.
+			f.turns[priority] = append(f.turns[priority][1:], id)
+			f.credited[priority] = false
+			continue
+		}
+
+		deficit[id] -= n
+		f.held[priority] = append(held[:i], held[i+1:]...)
+		atomic.StoreInt32(&f.counts[priority], int32(len(f.held[priority])))
+		if f.holding(id) != priority {
+			// The stream's turn ends once it has nothing
+			// waiting, and it loses any unused bytes.
+			delete(deficit, id)
+			f.turns[priority] = f.turns[priority][1:]
+			f.credited[priority] = false
+		}
+
+		return frame
+	}
+}
+
+// releaseAny returns the highest-priority held frame and
+// its priority, or nil if there are none.
+func (f *fairScheduler) releaseAny() (common.Frame, int) {
+	for i := range f.held {
+		if frame := f.release(i); frame != nil {
+			return frame, i
+		}
+	}
+	return nil, -1
+}
+
+// tick starts a new window if the current one has expired.
+func (f *fairScheduler) tick() {
+	if f.quantum > 0 || time.Since(f.start) < f.window {
+		return
+	}
+	f.start = time.Now()
+	for i := range f.sent {
+		f.sent[i] = make(map[common.StreamID]int)
+		f.total[i] = 0
+	}
+}
+
+func (f *fairScheduler) record(priority int, id common.StreamID, n int) {
+	f.sent[priority][id] += n
+	f.total[priority] += n
+}
+
+// overShare reports whether the stream has sent more than
+// an equal share of the data sent in its priority class
+// during the current window.
+func (f *fairScheduler) overShare(priority int, id common.StreamID) bool {
+	sent := f.sent[priority]
+	if len(sent) < 2 {
+		return false
+	}
+	return sent[id] > f.total[priority]/len(sent)
+}
+
+// hold adds a frame to those held for the given priority.
+func (f *fairScheduler) hold(priority int, frame common.Frame) {
+	if f.quantum > 0 {
+		id, _ := scheduledStreamID(frame)
+		if f.holding(id) != priority {
+			f.turns[priority] = append(f.turns[priority], id)
+		}
+	}
+	f.held[priority] = append(f.held[priority], frame)
+	atomic.StoreInt32(&f.counts[priority], int32(len(f.held[priority])))
+}
+
+// heldCounts returns the number of frames held
+// for each priority. It is safe to call from any
+// goroutine.
+func (f *fairScheduler) heldCounts() (out [8]int) {
+	for i := range f.counts {
+		out[i] = int(atomic.LoadInt32(&f.counts[i]))
+	}
+	return out
+}
+
+// holding returns the priority class in which frames
+// are held for the given stream, or -1 if there are none.
+func (f *fairScheduler) holding(id common.StreamID) int {
+	for priority := range f.held {
+		for _, frame := range f.held[priority] {
+			if held, _ := scheduledStreamID(frame); held == id {
+				return priority
+			}
+		}
+	}
+	return -1
+}
+
+// scheduledStreamID returns the stream ID of frames which
+// are subject to fair scheduling.
+func scheduledStreamID(frame common.Frame) (common.StreamID, bool) {
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		return frame.StreamID, true
+	case *frames.HEADERS:
+		return frame.StreamID, true
+	case *frames.RST_STREAM:
+		return frame.StreamID, true
+	default:
+		return 0, false
+	}
+}
+
+// starvationWatchdog is used by the send loop to detect
+// priority classes which are being starved by the strict
+// priority scheduling. Each class's progress is recorded
+// whenever one of its frames is sent, or it is found to
+// have nothing waiting. A class which has made no progress
+// for longer than the bound, while frames from a higher
+// priority class have been sent, is starving.
+//
+// The starvationWatchdog is only used by the send goroutine,
+// so has no locking.
+type starvationWatchdog struct {
+	bound time.Duration
+	last  [8]time.Time // last progress in each class.
+	sent  [8]time.Time // last frame sent from each class.
+}
+
+func newStarvationWatchdog(bound time.Duration) *starvationWatchdog {
+	out := new(starvationWatchdog)
+	out.bound = bound
+	now := time.Now()
+	for i := range out.last {
+		out.last[i] = now
+	}
+	return out
+}
+
+// progress records that a frame from the given
+// priority class has been sent.
+func (w *starvationWatchdog) progress(priority int) {
+	now := time.Now()
+	w.last[priority] = now
+	w.sent[priority] = now
+}
+
+// idle records that the given priority class
+// has no frames waiting.
+func (w *starvationWatchdog) idle(priority int, now time.Time) {
+	w.last[priority] = now
+}
+
+// stalled returns the time since the given priority
+// class last made progress.
+func (w *starvationWatchdog) stalled(priority int, now time.Time) time.Duration {
+	return now.Sub(w.last[priority])
+}
+
+// starving reports whether the given priority class may be
+// starving, and should be checked for waiting frames.
+func (w *starvationWatchdog) starving(priority int, now time.Time) bool {
+	last := w.last[priority]
+	if now.Sub(last) <= w.bound {
+		return false
+	}
+	for i := 0; i < priority; i++ {
+		if w.sent[i].After(last) {
+			return true
+		}
+	}
+	return false
+}
@@ -25,10 +25,67 @@ func (c *Conn) Closed() bool {
 	}
 }
 
+// Drain begins a graceful shutdown of the connection. A GOAWAY
+// is sent, so that no new streams are accepted, and the connection
+// is closed once its existing streams have finished. Drain does
+// not block; use CloseNotify to wait for the connection to end.
+func (c *Conn) Drain() {
+	if c.Closed() {
+		return
+	}
+
+	c.goawayLock.Lock()
+	sent := c.goawaySent
+	c.goawaySent = true
+	c.goawayLock.Unlock()
+	if !sent {
+		select {
+		case c.output[0] <- c.newGoaway():
+		case <-c.stop:
+			return
+		}
+		c.reportGoaway()
+	}
+
+	go func() {
+		ticker := time.NewTicker(drainInterval)
+		defer ticker.Stop()
+		for !c.Idle() {
+			select {
+			case <-ticker.C:
+			case <-c.stop:
+				return
+			}
+		}
+		c.Close()
+	}()
+}
+
+// drainInterval is the interval at which a draining
+// connection checks whether it has become idle.
+const drainInterval = 50 * time.Millisecond
+
+// newGoaway returns a GOAWAY frame giving the last
+// stream processed from the other endpoint.
+func (c *Conn) newGoaway() *frames.GOAWAY {
+	goaway := new(frames.GOAWAY)
+	if c.server != nil {
+		c.lastRequestStreamIDLock.Lock()
+		goaway.LastGoodStreamID = c.lastRequestStreamID
+		c.lastRequestStreamIDLock.Unlock()
+	} else {
+		c.lastPushStreamIDLock.Lock()
+		goaway.LastGoodStreamID = c.lastPushStreamID
+		c.lastPushStreamIDLock.Unlock()
+	}
+	return goaway
+}
+
 func (c *Conn) shutdown() {
 	if c.Closed() {
 		return
 	}
+	c.endStates()
 
 	// Try to inform the other endpoint that the connection is closing.
 	c.sendingLock.Lock()
@@ -39,18 +96,8 @@ func (c *Conn) shutdown() {
 	c.goawayReceived = true
 	c.goawayLock.Unlock()
 	if !sent && !isSending {
-		goaway := new(frames.GOAWAY)
-		if c.server != nil {
-			c.lastRequestStreamIDLock.Lock()
-			goaway.LastGoodStreamID = c.lastRequestStreamID
-			c.lastRequestStreamIDLock.Unlock()
-		} else {
-			c.lastPushStreamIDLock.Lock()
-			goaway.LastGoodStreamID = c.lastPushStreamID
-			c.lastPushStreamIDLock.Unlock()
-		}
 		select {
-		case c.output[0] <- goaway:
+		case c.output[0] <- c.newGoaway():
 			c.goawayLock.Lock()
 			c.goawaySent = true
 			c.goawayLock.Unlock()
@@ -59,18 +106,18 @@ func (c *Conn) shutdown() {
 		}
 	}
 
-	// Close all streams. Make a copy so close() can modify the map.
-	var streams []common.Stream
-	c.streamsLock.Lock()
-	for key, stream := range c.streams {
-		streams = append(streams, stream)
-		delete(c.streams, key)
+	// Close all streams.
+	for _, stream := range c.streams.clear() {
+		stream.Close()
 	}
-	c.streamsLock.Unlock()
 
-	for _, stream := range streams {
-		stream.Close()
+	// End any pushes in progress.
+	c.pushResponsesLock.Lock()
+	for key, push := range c.pushResponses {
+		push.Reset(common.ErrConnClosed)
+		delete(c.pushResponses, key)
 	}
+	c.pushResponsesLock.Unlock()
 
 	// Ensure any pending frames are sent.
 	c.sendingLock.Lock()
@@ -108,14 +155,7 @@ func (c *Conn) shutdown() {
 
 	c.pushedResources = nil
 
-	for _, stream := range c.output {
-		select {
-		case _, ok := <-stream:
-			if ok {
-				close(stream)
-			}
-		default:
-			close(stream)
-		}
-	}
+	// The output channels are not closed, as streams may
+	// still send on them. Every sender also waits on stop,
+	// so none are left blocked.
 }
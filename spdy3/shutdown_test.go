@@ -0,0 +1,39 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+func TestSendAfterClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, &http.Server{Handler: http.NotFoundHandler()}, 1)
+	go conn.Run()
+	conn.Close()
+	<-conn.CloseNotify()
+
+	// Frames sent once the connection has closed are
+	// dropped, rather than blocking or panicking.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn._RST_STREAM(1, common.RST_STREAM_CANCEL)
+		conn.reject(3, http.StatusBadRequest, "closed", common.RST_STREAM_PROTOCOL_ERROR)
+		conn.sendSettings(new(frames.SETTINGS))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sending on a closed connection blocked.")
+	}
+}
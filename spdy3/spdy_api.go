@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -32,7 +33,10 @@ func (c *Conn) Ping() (<-chan bool, error) {
 	c.nextPingIDLock.Unlock()
 
 	ping.PingID = pid
-	c.output[0] <- ping
+	select {
+	case c.output[0] <- ping:
+	case <-c.stop:
+	}
 	ch := make(chan bool, 1)
 	c.pingsLock.Lock()
 	c.pings[pid] = ch
@@ -110,22 +114,110 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 		return nil, errors.New("Error: All server streams exhausted.")
 	}
 	push.StreamID = newID
-	c.output[0] <- push
+	select {
+	case c.output[0] <- push:
+	case <-c.stop:
+	}
 
 	// Create the pushStream.
 	out := NewPushStream(c, newID, origin, c.output[7])
+	out.path = path
+	if stream, ok := origin.(*ResponseStream); ok {
+		stream.Lock()
+		out.request = stream.request
+		stream.Unlock()
+	}
 	out.AddFlowControl(c.flowControl)
 
 	// Store in the connection map.
-	c.streamsLock.Lock()
-	c.streams[newID] = out
-	c.streamsLock.Unlock()
+	c.streams.add(newID, out)
+	c.updateState()
+
+	// Track the association, so the push can be
+	// reset with its associated stream.
+	assocID := origin.StreamID()
+	c.pushedStreamsLock.Lock()
+	if c.pushedStreams[assocID] == nil {
+		c.pushedStreams[assocID] = make(map[common.StreamID]struct{})
+	}
+	c.pushedStreams[assocID][newID] = struct{}{}
+	c.pushedStreamsLock.Unlock()
 
 	return out, nil
 }
 
+// PushedStreams returns the IDs of the open push streams
+// associated with the given stream, in ascending order.
+func (c *Conn) PushedStreams(streamID common.StreamID) []common.StreamID {
+	c.pushedStreamsLock.Lock()
+	defer c.pushedStreamsLock.Unlock()
+
+	out := make([]common.StreamID, 0, len(c.pushedStreams[streamID]))
+	for id := range c.pushedStreams[streamID] {
+		out = append(out, id)
+	}
+	sort.Sort(streamIDs(out))
+	return out
+}
+
+// resetPushedStreams sends a RST_STREAM with CANCEL for each
+// open push stream associated with the given stream, and
+// closes them. This is used when the associated stream is
+// reset, as the pushes are no longer wanted.
+func (c *Conn) resetPushedStreams(streamID common.StreamID) {
+	c.pushedStreamsLock.Lock()
+	children := c.pushedStreams[streamID]
+	delete(c.pushedStreams, streamID)
+	c.pushedStreamsLock.Unlock()
+
+	for id := range children {
+		stream := c.streams.get(id)
+		if stream == nil {
+			continue
+		}
+
+		debug.Printf("Resetting push stream %d, as stream %d was reset.\n", id, streamID)
+		c._RST_STREAM(id, common.RST_STREAM_CANCEL)
+		go stream.Close()
+	}
+}
+
+// removePushedStream stops tracking a push stream once it
+// has closed.
+func (c *Conn) removePushedStream(assocID, streamID common.StreamID) {
+	c.pushedStreamsLock.Lock()
+	if children := c.pushedStreams[assocID]; children != nil {
+		delete(children, streamID)
+		if len(children) == 0 {
+			delete(c.pushedStreams, assocID)
+		}
+	}
+	c.pushedStreamsLock.Unlock()
+}
+
 func (c *Conn) SetFlowControl(f common.FlowControl) {
 	c.flowControlLock.Lock()
 	c.flowControl = f
 	c.flowControlLock.Unlock()
 }
+
+// pushResponse returns the push given to the PushHandler
+// on the given stream, if there is one.
+func (c *Conn) pushResponse(streamID common.StreamID) *common.PushedResponse {
+	c.pushResponsesLock.Lock()
+	push := c.pushResponses[streamID]
+	c.pushResponsesLock.Unlock()
+	return push
+}
+
+// removePushResponse stops tracking a push once it has
+// ended, freeing up its slot in the stream limit.
+func (c *Conn) removePushResponse(streamID common.StreamID) {
+	c.pushResponsesLock.Lock()
+	_, ok := c.pushResponses[streamID]
+	delete(c.pushResponses, streamID)
+	c.pushResponsesLock.Unlock()
+	if ok {
+		c.pushStreamLimit.Close()
+	}
+}
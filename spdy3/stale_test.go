@@ -0,0 +1,139 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+func TestStaleFrames(t *testing.T) {
+	for _, subversion := range []int{0, 1} {
+		testStaleFrames(t, subversion)
+	}
+}
+
+func testStaleFrames(t *testing.T, subversion int) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream := w.(*ResponseStream)
+		push, err := stream.Conn().(*Conn).Push("https://"+r.Host+"/pushed", stream)
+		if err != nil {
+			t.Error(err)
+		} else {
+			push.Write([]byte("pushed"))
+			push.Finish()
+		}
+		w.Write([]byte("hello"))
+	})
+
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := NewConn(server, &http.Server{Handler: handler}, subversion)
+	go conn.Run()
+	defer conn.Close()
+
+	received := make(chan common.Frame, 64)
+	go func() {
+		buf := bufio.NewReader(client)
+		decom := common.NewDecompressor(3)
+		for {
+			frame, err := frames.ReadFrame(buf, subversion)
+			if err != nil {
+				close(received)
+				return
+			}
+			if err = frame.Decompress(decom); err != nil {
+				t.Error(err)
+			}
+			received <- frame
+		}
+	}()
+
+	syn := new(frames.SYN_STREAM)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = make(http.Header)
+	syn.Header.Set(":method", "GET")
+	syn.Header.Set(":scheme", "https")
+	syn.Header.Set(":host", "example.com")
+	syn.Header.Set(":path", "/")
+	syn.Header.Set(":version", "HTTP/1.1")
+	if err := syn.Compress(common.NewCompressor(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syn.WriteTo(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// The response and the push are sent as normal.
+	pushed := false
+	finished := make(map[common.StreamID]bool)
+	for !finished[1] || !finished[2] {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatalf("SPDY/3.%d: Connection closed before the response was received.", subversion)
+		case *frames.SYN_STREAM:
+			pushed = frame.StreamID == 2
+		case *frames.DATA:
+			if frame.Flags.FIN() {
+				finished[frame.StreamID] = true
+			}
+		case *frames.RST_STREAM:
+			t.Fatalf("SPDY/3.%d: Stream %d was reset with %s.", subversion, frame.StreamID, frame.Status)
+		}
+	}
+	if !pushed {
+		t.Errorf("SPDY/3.%d: Expected push stream 2 to be opened.", subversion)
+	}
+	if n := conn.Stats().StaleFrames; n != 0 {
+		t.Errorf("SPDY/3.%d: Expected no stale frames, got %d.", subversion, n)
+	}
+
+	// Frames for streams this endpoint never opened are
+	// dropped, but a reset of a stream which the client
+	// never opened is a reply, so is sent.
+	data := new(frames.DATA)
+	data.StreamID = 4
+	data.Data = []byte("stale")
+	headers := new(frames.HEADERS)
+	headers.StreamID = 6
+	headers.Header = http.Header{"X-Stale": {"yes"}}
+	rst := new(frames.RST_STREAM)
+	rst.StreamID = 3
+	rst.Status = common.RST_STREAM_INVALID_STREAM
+	ping := new(frames.PING)
+	ping.PingID = 2
+	for _, frame := range []common.Frame{data, headers, rst, ping} {
+		conn.output[0] <- frame
+	}
+
+	reset := false
+	for pinged := false; !pinged; {
+		switch frame := (<-received).(type) {
+		case nil:
+			t.Fatalf("SPDY/3.%d: Connection closed before the PING was received.", subversion)
+		case *frames.DATA:
+			t.Errorf("SPDY/3.%d: Sent stale DATA for stream %d.", subversion, frame.StreamID)
+		case *frames.HEADERS:
+			t.Errorf("SPDY/3.%d: Sent stale HEADERS for stream %d.", subversion, frame.StreamID)
+		case *frames.RST_STREAM:
+			reset = reset || frame.StreamID == 3
+		case *frames.PING:
+			pinged = frame.PingID == ping.PingID
+		}
+	}
+	if !reset {
+		t.Errorf("SPDY/3.%d: Expected RST_STREAM for stream 3 to be sent.", subversion)
+	}
+	if n := conn.Stats().StaleFrames; n != 2 {
+		t.Errorf("SPDY/3.%d: Expected 2 stale frames, got %d.", subversion, n)
+	}
+}
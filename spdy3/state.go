@@ -0,0 +1,234 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// State returns a snapshot of the connection's state.
+func (c *Conn) State() common.ConnState {
+	state := common.ConnState{
+		Version: "spdy/3",
+		Server:  c.server != nil,
+		Closed:  c.Closed(),
+	}
+	if c.Subversion > 0 {
+		state.Version = "spdy/3.1"
+	}
+
+	state.Streams = c.streams.ids()
+
+	c.lastRequestStreamIDLock.Lock()
+	requests := c.lastRequestStreamID
+	c.lastRequestStreamIDLock.Unlock()
+	c.lastPushStreamIDLock.Lock()
+	pushes := c.lastPushStreamID
+	c.lastPushStreamIDLock.Unlock()
+	if state.Server {
+		state.LastPeerStreamID, state.LastOwnStreamID = requests, pushes
+	} else {
+		state.LastPeerStreamID, state.LastOwnStreamID = pushes, requests
+	}
+
+	if c.Subversion > 0 {
+		c.connectionWindowLock.Lock()
+		state.SendWindow = c.connectionWindowSize
+		state.ReceiveWindow = c.connectionWindowSizeThere
+		state.HeldFrames = len(c.dataBuffer)
+		c.connectionWindowLock.Unlock()
+	}
+	c.initialWindowSizeLock.Lock()
+	state.InitialSendWindow = c.initialWindowSize
+	c.initialWindowSizeLock.Unlock()
+	c.flowControlLock.Lock()
+	if c.flowControl != nil {
+		state.InitialReceiveWindow = c.flowControl.InitialWindowSize()
+	}
+	c.flowControlLock.Unlock()
+
+	state.HeadersSent, state.HeadersReceived = c.HeaderCompression()
+
+	c.settingsLock.Lock()
+	state.SentSettings = c.sentSettings.Clone()
+	state.ReceivedSettings = c.receivedSettings.Clone()
+	c.settingsLock.Unlock()
+
+	stats := c.stats.Snapshot()
+	state.BytesSent = stats.BytesSent
+	state.BytesReceived = stats.BytesReceived
+	state.MemoryUsed, _ = c.memory.Used()
+
+	c.goawayLock.Lock()
+	state.GoawaySent = c.goawaySent
+	state.GoawayReceived = c.goawayReceived
+	c.goawayLock.Unlock()
+
+	return state
+}
+
+// Streams returns a snapshot of the state of each
+// active stream, in ascending order of stream ID.
+func (c *Conn) Streams() []common.StreamInfo {
+	streams := c.streams.list(nil)
+	out := make([]common.StreamInfo, 0, len(streams))
+	for _, stream := range streams {
+		info := common.StreamInfo{ID: stream.StreamID()}
+		var flow *flowControl
+		switch stream := stream.(type) {
+		case *RequestStream:
+			info.Kind = "request"
+			info.Priority = stream.Priority()
+			flow = stream.flow
+		case *ResponseStream:
+			info.Kind = "response"
+			info.Priority = stream.Priority()
+			flow = stream.flow
+		case *PushStream:
+			info.Kind = "push"
+			info.Priority = stream.Priority()
+			flow = stream.flow
+		}
+		if state := stream.State(); state != nil {
+			info.State = state.String()
+		}
+		if flow != nil {
+			info.SendWindow, info.ReceiveWindow, info.Buffered = flow.windows()
+			info.Stats = flow.Stats()
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// StreamInfo returns the same snapshot as Streams.
+//
+// Deprecated: Use Streams.
+func (c *Conn) StreamInfo() []common.StreamInfo {
+	return c.Streams()
+}
+
+// Stream returns the active stream with the given ID, or
+// nil if there is none, such as to reset a misbehaving
+// stream. The stream is a *RequestStream, *ResponseStream
+// or *PushStream.
+func (c *Conn) Stream(id common.StreamID) common.Stream {
+	return c.streams.get(id)
+}
+
+// HeaderCompression returns the totals for the header
+// blocks sent and received on the connection.
+func (c *Conn) HeaderCompression() (sent, received common.CompressionStats) {
+	type reporter interface {
+		Stats() common.CompressionStats
+	}
+	if r, ok := c.compressor.(reporter); ok {
+		sent = r.Stats()
+	}
+	if r, ok := c.decompressor.(reporter); ok {
+		received = r.Stats()
+	}
+	return sent, received
+}
+
+// SetHeaderDictionary sets the zlib dictionary used to compress
+// the header blocks sent and received on the connection, in place
+// of the SPDY/3 dictionary, for experimentation with peers using
+// the same dictionary. A nil dictionary restores the default.
+// SetHeaderDictionary must be called before Run.
+func (c *Conn) SetHeaderDictionary(dict []byte) error {
+	return c.setCompression(c.compressionLevel, dict)
+}
+
+// SetCompressionLevel sets the zlib compression level used for
+// the header blocks sent on the connection, such as zlib.BestSpeed
+// or zlib.NoCompression, in place of common.CompressionLevel. The
+// compression state is only allocated once the first header block
+// is sent. SetCompressionLevel must be called before Run.
+func (c *Conn) SetCompressionLevel(level int) error {
+	return c.setCompression(level, c.headerDictionary)
+}
+
+// setCompression replaces the connection's compression
+// state with one using the given level and dictionary.
+func (c *Conn) setCompression(level int, dict []byte) error {
+	compressor, err := common.NewCompressorLevel(3, level, dict)
+	if err != nil {
+		return err
+	}
+	c.compressor = compressor
+	c.decompressor = common.NewDecompressorDict(3, dict)
+	c.compressionLevel = level
+	c.headerDictionary = dict
+	return nil
+}
+
+// logHeaderBlock logs the header block of frame, if it has
+// one whose names and values exceed LogHeaderBlockSize.
+func (c *Conn) logHeaderBlock(direction string, frame common.Frame) {
+	if c.LogHeaderBlockSize <= 0 {
+		return
+	}
+	sid, header, ok := frameHeader(frame)
+	if !ok {
+		return
+	}
+	if size := common.HeaderSize(header); size > int64(c.LogHeaderBlockSize) {
+		log.Printf("%s %d-byte header block in %s on stream %d.\n", direction, size, frame.Name(), sid)
+	}
+}
+
+// sendSettings sends a SETTINGS frame, recording
+// the settings sent for State.
+func (c *Conn) sendSettings(settings *frames.SETTINGS) {
+	c.settingsLock.Lock()
+	for id, setting := range settings.Settings {
+		c.sentSettings[id] = setting
+	}
+	c.settingsLock.Unlock()
+	select {
+	case c.output[0] <- settings:
+	case <-c.stop:
+	}
+}
+
+// sendPersistedSettings applies the settings persisted from
+// an earlier session, and returns them to the server. They
+// are sent in their own frame, as they may share IDs with
+// the client's settings, and are not recorded as sent, as
+// they are the server's.
+func (c *Conn) sendPersistedSettings() {
+	if len(c.PersistedSettings) == 0 {
+		return
+	}
+
+	persisted := new(frames.SETTINGS)
+	persisted.Settings = make(common.Settings, len(c.PersistedSettings))
+	for id, setting := range c.PersistedSettings {
+		persisted.Add(common.FLAG_SETTINGS_PERSISTED, id, setting.Value)
+		c.applySetting(&common.Setting{ID: id, Value: setting.Value})
+	}
+	select {
+	case c.output[0] <- persisted:
+	case <-c.stop:
+	}
+}
+
+// persistSettings passes the settings which the server
+// asked to be persisted, or cleared, to the PersistSettings
+// hook.
+func (c *Conn) persistSettings(frame *frames.SETTINGS) {
+	persist := make(common.Settings)
+	for id, setting := range frame.Settings {
+		if setting.Flags.PERSIST_VALUE() {
+			persist[id] = &common.Setting{ID: id, Value: setting.Value}
+		}
+	}
+	clearing := frame.Flags.CLEAR_SETTINGS()
+	if clearing || len(persist) > 0 {
+		c.PersistSettings(clearing, persist)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// Stats returns the connection's counters since it
+// started, or since they were last reset.
+func (c *Conn) Stats() common.Stats {
+	return c.stats.Snapshot()
+}
+
+// ResetStats returns the connection's counters, as Stats,
+// and resets them to zero.
+func (c *Conn) ResetStats() common.Stats {
+	return c.stats.Reset()
+}
+
+// StatsDelta returns the change in the connection's
+// counters since the last call to StatsDelta or ResetStats.
+func (c *Conn) StatsDelta() common.Stats {
+	return c.stats.Delta()
+}
+
+// recordSent updates the stats with a frame
+// which has been written to the network.
+func (c *Conn) recordSent(frame common.Frame, n int64) {
+	delta := common.Stats{FramesSent: 1, BytesSent: uint64(n)}
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		delta.DataBytesSent = uint64(len(frame.Data))
+	case *frames.SYN_STREAM:
+		delta.StreamsOpened = 1
+	case *frames.RST_STREAM:
+		delta.ResetsSent = 1
+	}
+	c.stats.Add(delta)
+	if counter := c.streamCounter(frame); counter != nil {
+		counter.Sent(frame, frameHeaderSize(frame))
+	}
+	if c.events != nil {
+		c.events.Add(newEvent(frame, true))
+	}
+}
+
+// recordReceived updates the stats with a frame
+// which has been read from the network.
+func (c *Conn) recordReceived(frame common.Frame, n int64) {
+	delta := common.Stats{FramesReceived: 1, BytesReceived: uint64(n)}
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		delta.DataBytesReceived = uint64(len(frame.Data))
+	case *frames.SYN_STREAM:
+		delta.StreamsOpened = 1
+	case *frames.RST_STREAM:
+		delta.ResetsReceived = 1
+	}
+	c.stats.Add(delta)
+	if counter := c.streamCounter(frame); counter != nil {
+		data, isData := frame.(*frames.DATA)
+		dataBytes := 0
+		if isData {
+			dataBytes = len(data.Data)
+		}
+		counter.Received(isData, dataBytes, 0)
+	}
+	if c.events != nil {
+		c.events.Add(newEvent(frame, false))
+	}
+}
+
+// recordReceivedHeaders updates the stats of a frame's
+// stream with its headers, once they are decompressed.
+func (c *Conn) recordReceivedHeaders(frame common.Frame) {
+	if n := frameHeaderSize(frame); n > 0 {
+		if counter := c.streamCounter(frame); counter != nil {
+			counter.Received(false, 0, n)
+		}
+	}
+}
+
+// streamCounter returns the statistics of the stream
+// to which the frame belongs, or nil if there is none.
+func (c *Conn) streamCounter(frame common.Frame) *common.StreamCounter {
+	sid, ok := frameStreamID(frame)
+	if !ok {
+		return nil
+	}
+	switch stream := c.streams.get(sid).(type) {
+	case *RequestStream:
+		return &stream.stats
+	case *ResponseStream:
+		return &stream.stats
+	case *PushStream:
+		return &stream.stats
+	}
+	return nil
+}
+
+// frameHeaderSize returns the size of the frame's
+// headers, as common.HeaderSize, if it has any.
+func frameHeaderSize(frame common.Frame) int {
+	switch frame := frame.(type) {
+	case *frames.SYN_STREAM:
+		return int(common.HeaderSize(frame.Header))
+	case *frames.SYN_REPLY:
+		return int(common.HeaderSize(frame.Header))
+	case *frames.HEADERS:
+		return int(common.HeaderSize(frame.Header))
+	}
+	return 0
+}
@@ -0,0 +1,497 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// StreamConn is a net.Conn carried by a single SPDY stream,
+// which allows the stream to be used as a generic tunnel.
+// Data written is sent in DATA frames, subject to flow
+// control, and reads return the data received from the
+// peer. CloseWrite half-closes the stream with FLAG_FIN,
+// after which reads continue until the peer does the same.
+//
+// Writes block while the stream's transfer window is full.
+// Deadlines apply to reads and to this waiting, and expire
+// with os.ErrDeadlineExceeded.
+type StreamConn struct {
+	stream     common.Stream
+	flow       *flowControl
+	body       io.ReadCloser
+	pipe       *dataPipe // nil if the body is already buffered.
+	closeWrite func() error
+	reset      func(common.StatusCode) error
+	release    func()
+	local      net.Addr
+	remote     net.Addr
+
+	writeLock     sync.Mutex
+	writeDeadline pipeDeadline
+	wroteFin      bool
+	closeOnce     sync.Once
+	closed        chan struct{}
+}
+
+func newStreamConn(stream common.Stream, flow *flowControl, body io.ReadCloser) *StreamConn {
+	out := new(StreamConn)
+	out.stream = stream
+	out.flow = flow
+	out.body = body
+	out.pipe, _ = body.(*dataPipe)
+	out.writeDeadline = makePipeDeadline()
+	out.closed = make(chan struct{})
+	if conn := stream.Conn().Conn(); conn != nil {
+		out.local = conn.LocalAddr()
+		out.remote = conn.RemoteAddr()
+	}
+	return out
+}
+
+// StreamID returns the ID of the underlying stream.
+func (c *StreamConn) StreamID() common.StreamID {
+	return c.stream.StreamID()
+}
+
+func (c *StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *StreamConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.wroteFin || c.isClosed() {
+		return 0, common.ErrStreamClosed
+	}
+
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	n, err := c.stream.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.waitForWindow()
+}
+
+// waitForWindow blocks until any data buffered by
+// flow control has been sent.
+func (c *StreamConn) waitForWindow() error {
+	updates := c.flow.windowUpdates()
+	for {
+		c.flow.Lock()
+		paused := c.flow.Paused()
+		c.flow.Unlock()
+		if !paused {
+			return nil
+		}
+
+		select {
+		case <-updates:
+		case <-c.writeDeadline.wait():
+			return os.ErrDeadlineExceeded
+		case <-c.closed:
+			return common.ErrStreamClosed
+		case <-c.stream.CloseNotify():
+			return common.ErrStreamClosed
+		}
+	}
+}
+
+// CloseWrite half-closes the stream, once any data
+// buffered by flow control has been sent. Further
+// writes will fail, but reads are unaffected.
+func (c *StreamConn) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.wroteFin {
+		return nil
+	}
+	if c.isClosed() {
+		return common.ErrStreamClosed
+	}
+	if err := c.waitForWindow(); err != nil {
+		return err
+	}
+
+	c.wroteFin = true
+	return c.closeWrite()
+}
+
+// Close half-closes the stream, as CloseWrite, and
+// stops reading. If the peer has not yet half-closed
+// the stream, it is reset.
+func (c *StreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.CloseWrite()
+		close(c.closed)
+		c.body.Close()
+		c.release()
+	})
+	return nil
+}
+
+// Reset ends the stream abruptly, sending a RST_STREAM
+// with the given status code, rather than half-closing
+// it. The other endpoint's reads fail with a
+// *common.StreamResetError.
+func (c *StreamConn) Reset(status common.StatusCode) error {
+	err := c.reset(status)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.body.Close()
+		c.release()
+	})
+	return err
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for reads. This
+// has no effect if the stream's data was received in
+// full before the StreamConn was created.
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	if c.pipe != nil {
+		c.pipe.deadline.set(t)
+	}
+	return nil
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *StreamConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+/*************
+ * Streams *
+ *************/
+
+// NetConn returns a net.Conn carried by the stream, for use
+// as a tunnel. Reads return the request body and writes send
+// the response body. The response headers are sent at once,
+// with a 200 status if WriteHeader has not been called.
+//
+// The request body is only streamed if the request was sent
+// without FLAG_FIN or a Content-Length, in which case the
+// handler is called as soon as the request headers arrive.
+// Otherwise, reads return the complete request body.
+func (s *ResponseStream) NetConn() net.Conn {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	// The stream may have been reset already.
+	s.Lock()
+	var body io.ReadCloser = http.NoBody
+	if s.request != nil {
+		body, _ = s.request.Body.(io.ReadCloser)
+	}
+	s.Unlock()
+
+	out := newStreamConn(s, s.flow, body)
+	out.closeWrite = s.CloseWrite
+	out.reset = s.Reset
+	out.release = func() {} // Run cleans up once the handler returns.
+	return out
+}
+
+// Dial opens a stream with the given request and returns a
+// net.Conn carrying the stream's data in both directions, once
+// the server has replied. The stream is not half-closed with
+// the request, so the request's body is not used; write to the
+// returned net.Conn instead. The server's response is returned
+// for its headers, and has an empty body.
+//
+// If the server replies with a status other than 2xx, the
+// stream is reset and an error returned with the response.
+func (c *Conn) Dial(request *http.Request, priority common.Priority) (net.Conn, *http.Response, error) {
+	if err := c.checkRequest(priority); err != nil {
+		return nil, nil, err
+	}
+
+	syn, err := newRequestSyn(request, priority)
+	if err != nil {
+		c.requestStreamLimit.Close()
+		return nil, nil, err
+	}
+
+	tunnel := &tunnelReceiver{
+		pipe:  newDataPipe(),
+		reply: make(chan struct{}, 1),
+	}
+	res := common.NewResponse(request, tunnel)
+	stream, err := c.sendRequest(syn, nil, request, res)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Reads fail if the stream ends early.
+	stream.Lock()
+	stream.onReset = func(err error) {
+		tunnel.pipe.closeWithError(err)
+	}
+	stream.Unlock()
+	go func() {
+		<-stream.finished
+		tunnel.pipe.closeWithError(common.ErrStreamClosed)
+	}()
+
+	select {
+	case <-tunnel.reply:
+	case <-stream.finished:
+		return nil, nil, common.ErrStreamClosed
+	case <-c.stop:
+		return nil, nil, common.ErrConnClosed
+	}
+
+	response := res.Response()
+	response.Request = request
+	if response.StatusCode/100 != 2 {
+		stream.Close()
+		return nil, response, errors.New(fmt.Sprintf("Error: Stream refused with status %d.", response.StatusCode))
+	}
+
+	out := newStreamConn(stream, stream.flow, tunnel.pipe)
+	out.closeWrite = stream.CloseWrite
+	out.reset = stream.Reset
+	out.release = func() {
+		if stream.state.OpenThere() {
+			stream.Close()
+		}
+	}
+	return out, response, nil
+}
+
+// tunnelReceiver receives the response to a request
+// made with Dial, passing its data to a dataPipe.
+type tunnelReceiver struct {
+	pipe  *dataPipe
+	reply chan struct{}
+}
+
+func (r *tunnelReceiver) ReceiveData(_ *http.Request, data []byte, final bool) {
+	r.pipe.write(data)
+	if final {
+		r.pipe.closeWithError(io.EOF)
+	}
+}
+
+func (r *tunnelReceiver) ReceiveHeader(_ *http.Request, _ http.Header) {
+	select {
+	case r.reply <- struct{}{}:
+	default:
+	}
+}
+
+func (r *tunnelReceiver) ReceiveRequest(_ *http.Request) bool {
+	return false
+}
+
+/************
+ * Pipes *
+ ************/
+
+// dataPipe buffers the data received on a stream
+// until it is read.
+type dataPipe struct {
+	lock     sync.Mutex
+	buf      bytes.Buffer
+	err      error         // returned once buf is empty.
+	signal   chan struct{} // signalled on each write or close.
+	deadline pipeDeadline
+	account  *common.MemoryAccount // optional, charged for buf.
+	consumed func(n int)           // optional, called as data is read or discarded.
+}
+
+func newDataPipe() *dataPipe {
+	out := new(dataPipe)
+	out.signal = make(chan struct{}, 1)
+	out.deadline = makePipeDeadline()
+	return out
+}
+
+func (p *dataPipe) Read(b []byte) (int, error) {
+	for {
+		p.lock.Lock()
+		if p.buf.Len() > 0 {
+			n, _ := p.buf.Read(b)
+			p.account.Release(int64(n))
+			p.lock.Unlock()
+			p.consume(n)
+			return n, nil
+		}
+		err := p.err
+		p.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-p.signal:
+		case <-p.deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Close stops reading. Any further data is discarded.
+func (p *dataPipe) Close() error {
+	p.lock.Lock()
+	discarded := p.buf.Len()
+	p.account.Release(int64(discarded))
+	p.buf.Reset()
+	p.err = common.ErrStreamClosed
+	p.lock.Unlock()
+	p.consume(discarded)
+	p.notify()
+	return nil
+}
+
+// write adds data to the pipe, unless it has been closed.
+func (p *dataPipe) write(data []byte) {
+	p.lock.Lock()
+	discarded := p.err != nil
+	if !discarded {
+		p.account.Add(int64(len(data)))
+		p.buf.Write(data)
+	}
+	p.lock.Unlock()
+	if discarded {
+		p.consume(len(data))
+	}
+	p.notify()
+}
+
+// closeWithError ends the pipe. Reads return err once
+// any buffered data has been read.
+func (p *dataPipe) closeWithError(err error) {
+	p.lock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.lock.Unlock()
+	p.notify()
+}
+
+// release returns the memory charged for any unread
+// data, which can still be read, and stops charging
+// for the pipe.
+func (p *dataPipe) release() {
+	p.lock.Lock()
+	p.account.Release(int64(p.buf.Len()))
+	p.account = nil
+	p.lock.Unlock()
+}
+
+func (p *dataPipe) consume(n int) {
+	if p.consumed != nil && n > 0 {
+		p.consumed(n)
+	}
+}
+
+func (p *dataPipe) notify() {
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pipeDeadline is a deadline which can be waited on
+// with a channel, and which can be changed at any time.
+type pipeDeadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline expires.
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. A zero time clears it.
+func (d *pipeDeadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer's function to finish.
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the
+// deadline expires.
+func (d *pipeDeadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// streamRegistry holds a connection's active streams,
+// by stream ID. Streams which have closed are remembered
+// for a grace period, so that frames which were in flight
+// when they closed can be recognised. It is safe for
+// concurrent use.
+type streamRegistry struct {
+	lock    sync.Mutex
+	streams map[common.StreamID]common.Stream
+	highest [2]common.StreamID // highest stream ID added, by parity.
+	grace   time.Duration      // how long closed streams are remembered.
+	closed  map[common.StreamID]time.Time
+	closing []closedStream // closed streams, in the order they closed.
+	lengths map[common.StreamID]*bodyLength
+}
+
+// bodyLength tracks the DATA received on a stream against
+// the length given by its Content-Length header.
+type bodyLength struct {
+	declared int64
+	received int64
+}
+
+// closedStream records when a stream closed.
+type closedStream struct {
+	id common.StreamID
+	at time.Time
+}
+
+// get returns the stream with the given ID,
+// or nil if it is not active.
+func (r *streamRegistry) get(id common.StreamID) common.Stream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.streams[id]
+}
+
+// add registers stream under the given ID.
+func (r *streamRegistry) add(id common.StreamID, stream common.Stream) {
+	r.lock.Lock()
+	if r.streams == nil {
+		r.streams = make(map[common.StreamID]common.Stream)
+	}
+	r.streams[id] = stream
+	if id > r.highest[id&1] {
+		r.highest[id&1] = id
+	}
+	r.lock.Unlock()
+}
+
+// remove removes the stream with the given ID,
+// which is remembered as recently closed.
+func (r *streamRegistry) remove(id common.StreamID) {
+	r.lock.Lock()
+	delete(r.streams, id)
+	delete(r.lengths, id)
+	r.markClosed(id)
+	r.lock.Unlock()
+}
+
+// reset remembers the stream with the given ID as
+// recently closed, once a RST_STREAM has been sent.
+func (r *streamRegistry) reset(id common.StreamID) {
+	r.lock.Lock()
+	r.markClosed(id)
+	r.lock.Unlock()
+}
+
+// markClosed records that the stream with the given ID
+// has closed, and forgets any streams which closed more
+// than the grace period ago. The caller must hold lock.
+func (r *streamRegistry) markClosed(id common.StreamID) {
+	if r.grace <= 0 {
+		return
+	}
+
+	now := time.Now()
+	expired := 0
+	for _, closed := range r.closing {
+		if now.Sub(closed.at) < r.grace {
+			break
+		}
+		if r.closed[closed.id] == closed.at {
+			delete(r.closed, closed.id)
+		}
+		expired++
+	}
+	r.closing = r.closing[expired:]
+
+	if r.closed == nil {
+		r.closed = make(map[common.StreamID]time.Time)
+	}
+	r.closed[id] = now
+	r.closing = append(r.closing, closedStream{id: id, at: now})
+}
+
+// recentlyClosed indicates whether the stream with the
+// given ID closed within the grace period.
+func (r *streamRegistry) recentlyClosed(id common.StreamID) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	at, ok := r.closed[id]
+	return ok && time.Since(at) < r.grace
+}
+
+// added indicates whether a stream with the given ID, or
+// a later one with the same parity, has been added.
+func (r *streamRegistry) added(id common.StreamID) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return id <= r.highest[id&1]
+}
+
+// len returns the number of active streams.
+func (r *streamRegistry) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.streams)
+}
+
+// list returns the active streams for which keep returns
+// true, or all of them if keep is nil, in ascending order
+// of stream ID.
+func (r *streamRegistry) list(keep func(id common.StreamID) bool) []common.Stream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sorted(keep)
+}
+
+// ids returns the IDs of the active streams,
+// in ascending order.
+func (r *streamRegistry) ids() []common.StreamID {
+	streams := r.list(nil)
+	out := make([]common.StreamID, len(streams))
+	for i, stream := range streams {
+		out[i] = stream.StreamID()
+	}
+	return out
+}
+
+// clear removes every stream, returning them
+// in ascending order of stream ID.
+func (r *streamRegistry) clear() []common.Stream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	out := r.sorted(nil)
+	r.streams = nil
+	r.lengths = nil
+	return out
+}
+
+// expectLength records that the body received on the stream
+// with the given ID should be length bytes long, as given by
+// its Content-Length header.
+func (r *streamRegistry) expectLength(id common.StreamID, length int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.lengths == nil {
+		r.lengths = make(map[common.StreamID]*bodyLength)
+	}
+	r.lengths[id] = &bodyLength{declared: length}
+}
+
+// expectsLength indicates whether the length of the body
+// received on the stream with the given ID is being checked.
+func (r *streamRegistry) expectsLength(id common.StreamID) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.lengths[id]
+	return ok
+}
+
+// receiveData charges n bytes of DATA received on the stream
+// with the given ID to its declared length, if any, and ends
+// the check if fin is set. It returns false if the body is now
+// longer than declared, or ends shorter.
+func (r *streamRegistry) receiveData(id common.StreamID, n int, fin bool) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	length, ok := r.lengths[id]
+	if !ok {
+		return true
+	}
+	length.received += int64(n)
+	ok = length.received <= length.declared
+	if fin {
+		ok = length.received == length.declared
+	}
+	if fin || !ok {
+		delete(r.lengths, id)
+	}
+	return ok
+}
+
+// sorted implements list. The caller must hold lock.
+func (r *streamRegistry) sorted(keep func(id common.StreamID) bool) []common.Stream {
+	ids := make([]common.StreamID, 0, len(r.streams))
+	for id := range r.streams {
+		if keep == nil || keep(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	out := make([]common.Stream, len(ids))
+	for i, id := range ids {
+		out[i] = r.streams[id]
+	}
+	return out
+}
@@ -5,7 +5,12 @@
 package spdy3
 
 import (
+	"net/http"
+	"net/url"
+	"strings"
+
 	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
 )
 
 // defaultServerSettings are used in initialising the connection.
@@ -39,3 +44,224 @@ func defaultClientSettings(m uint32) common.Settings {
 		},
 	}
 }
+
+// streamIDs implements sort.Interface.
+type streamIDs []common.StreamID
+
+func (s streamIDs) Len() int           { return len(s) }
+func (s streamIDs) Less(i, j int) bool { return s[i] < s[j] }
+func (s streamIDs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// frameStreamID returns the stream ID of frames
+// which belong to a stream.
+func frameStreamID(frame common.Frame) (common.StreamID, bool) {
+	switch frame := frame.(type) {
+	case *frames.SYN_STREAM:
+		return frame.StreamID, true
+	case *frames.SYN_REPLY:
+		return frame.StreamID, true
+	case *frames.HEADERS:
+		return frame.StreamID, true
+	case *frames.DATA:
+		return frame.StreamID, true
+	case *frames.RST_STREAM:
+		return frame.StreamID, true
+	default:
+		return 0, false
+	}
+}
+
+// frameHeader returns the stream ID and header
+// of frames which carry a header block.
+func frameHeader(frame common.Frame) (common.StreamID, http.Header, bool) {
+	switch frame := frame.(type) {
+	case *frames.SYN_STREAM:
+		return frame.StreamID, frame.Header, true
+	case *frames.SYN_REPLY:
+		return frame.StreamID, frame.Header, true
+	case *frames.HEADERS:
+		return frame.StreamID, frame.Header, true
+	default:
+		return 0, nil, false
+	}
+}
+
+// checkPeerStream enforces the rules for the stream IDs of
+// SYN_STREAMs received from the other endpoint. Its streams
+// must have its own parity, and each must have a higher
+// stream ID than the last, which is recorded for stale. In
+// strict mode, a stream with the wrong parity or a repeated
+// stream ID is reset with PROTOCOL_ERROR, and a decreasing
+// stream ID ends the connection with a GOAWAY. Otherwise,
+// the violation is logged, and the stream is reset with
+// PROTOCOL_ERROR. checkPeerStream reports whether the frame
+// must be dropped.
+func (c *Conn) checkPeerStream(frame common.Frame) bool {
+	syn, ok := frame.(*frames.SYN_STREAM)
+	if !ok {
+		return false
+	}
+
+	sid := syn.StreamID
+	misused := sid&1 == c.oddity
+	c.peerStreamIDLock.Lock()
+	last := c.peerStreamID
+	if misused && sid > c.misusedStreamID {
+		c.misusedStreamID = sid
+	} else if !misused && sid > last {
+		c.peerStreamID = sid
+	}
+	c.peerStreamIDLock.Unlock()
+
+	switch {
+	case misused && c.server != nil:
+		return c.streamIDCheck(sid, false, "Received SYN_STREAM with even Stream ID %d", sid)
+	case misused:
+		return c.streamIDCheck(sid, false, "Received SYN_STREAM with odd Stream ID %d", sid)
+	case sid == last:
+		return c.streamIDCheck(sid, false, "Received SYN_STREAM with repeated Stream ID %d", sid)
+	case sid < last:
+		return c.streamIDCheck(sid, true, "Received SYN_STREAM with Stream ID %d, less than %d", sid, last)
+	}
+	return false
+}
+
+// pushAllowed indicates whether a push of the resource at u
+// may be associated with the stream with the given ID. The
+// stream must be an open request to the same scheme and host,
+// so that a server cannot push resources for other origins.
+func (c *Conn) pushAllowed(assoc common.StreamID, u *url.URL) bool {
+	stream, ok := c.streams.get(assoc).(*RequestStream)
+	if !ok || stream.Request == nil || stream.Request.URL == nil {
+		return false
+	}
+	req := stream.Request
+	host := req.URL.Host
+	if req.Host != "" {
+		host = req.Host
+	}
+	return strings.EqualFold(req.URL.Scheme, u.Scheme) &&
+		strings.EqualFold(originHost(req.URL.Scheme, host), originHost(u.Scheme, u.Host))
+}
+
+// originHost removes the default port for scheme from host.
+func originHost(scheme, host string) string {
+	switch strings.ToLower(scheme) {
+	case "https":
+		return strings.TrimSuffix(host, ":443")
+	case "http":
+		return strings.TrimSuffix(host, ":80")
+	}
+	return host
+}
+
+// opened indicates whether the stream with the given
+// ID has been opened by either endpoint, even if it was
+// refused.
+func (c *Conn) opened(sid common.StreamID) bool {
+	if c.streams.added(sid) {
+		return true
+	}
+	if sid&1 == c.oddity {
+		return false
+	}
+	c.peerStreamIDLock.Lock()
+	defer c.peerStreamIDLock.Unlock()
+	return sid <= c.peerStreamID
+}
+
+// stale indicates whether frame belongs to a stream which
+// was never opened on this connection, given the highest
+// stream ID opened by this endpoint so far. Such frames
+// can only have been queued for another session, so must
+// not be sent. A RST_STREAM for a stream the other endpoint
+// never opened is not stale, as it replies to a frame which
+// the other endpoint sent, as is one for a stream ID which
+// the other endpoint misused.
+func (c *Conn) stale(frame common.Frame, ownStreamID common.StreamID) bool {
+	var id common.StreamID
+	switch frame := frame.(type) {
+	case *frames.SYN_STREAM:
+		// Streams are opened in order, so this is a replay.
+		return frame.StreamID <= ownStreamID
+	case *frames.WINDOW_UPDATE:
+		id = frame.StreamID
+	default:
+		id, _ = frameStreamID(frame)
+	}
+
+	if id == 0 {
+		return false
+	}
+	_, rst := frame.(*frames.RST_STREAM)
+	if id&1 == c.oddity {
+		if rst && id > ownStreamID {
+			// The other endpoint may have misused the ID.
+			c.peerStreamIDLock.Lock()
+			defer c.peerStreamIDLock.Unlock()
+			return id > c.misusedStreamID
+		}
+		return id > ownStreamID
+	}
+	if rst {
+		return false
+	}
+
+	c.peerStreamIDLock.Lock()
+	defer c.peerStreamIDLock.Unlock()
+	return id > c.peerStreamID
+}
+
+// wrapFrameError annotates err with the context of
+// the stream to which frame belongs, if any.
+func (c *Conn) wrapFrameError(err error, frame common.Frame) error {
+	streamID, ok := frameStreamID(frame)
+	if !ok {
+		return err
+	}
+
+	path := ""
+	stream := c.streams.get(streamID)
+	switch stream := stream.(type) {
+	case *ResponseStream:
+		path = stream.flow.path
+	case *RequestStream:
+		path = stream.flow.path
+	case *PushStream:
+		path = stream.path
+	}
+
+	return common.WrapStreamError(err, streamID, path, c.remoteAddr)
+}
+
+// checksumsNegotiated indicates whether both endpoints
+// have agreed to use the DATA checksum extension.
+func (c *Conn) checksumsNegotiated() bool {
+	c.checksumsLock.Lock()
+	defer c.checksumsLock.Unlock()
+	return c.checksums
+}
+
+// handlesEarly reports whether the handler for request,
+// which has a body, is called as soon as its headers
+// arrive, with the body streamed to it, rather than once
+// the request is complete. Tunnels and requests whose
+// clients wait to be asked for the body are always handled
+// early, as they would otherwise never complete.
+func (c *Conn) handlesEarly(request *http.Request) bool {
+	if request.Method == "CONNECT" || expectsContinue(request.Header) {
+		return true
+	}
+	if c.HandleEarly != nil {
+		return c.HandleEarly(request)
+	}
+	return !c.BufferRequestBodies || request.Header.Get("Content-Length") == ""
+}
+
+// newRequestBody returns a buffer for a request
+// body which is received before the handler runs.
+func (c *Conn) newRequestBody() *common.SpillBuffer {
+	out := common.NewSpillBuffer(c.BodySpillThreshold, c.BodySpillDir)
+	out.Account = c.memory
+	return out
+}
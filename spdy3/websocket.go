@@ -0,0 +1,95 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// WebSockets are opened over a single stream, using an
+// extended CONNECT, adapted from RFC 8441 for HTTP/2. The
+// client sends a SYN_STREAM with the CONNECT method and a
+// ":protocol" header of "websocket", and the server replies
+// with a 2xx status. There is no Sec-WebSocket-Key, as the
+// stream is not shared with HTTP. The stream then carries
+// the WebSocket frames in both directions.
+
+// webSocketVersion is the only WebSocket version supported,
+// as in RFC 6455.
+const webSocketVersion = "13"
+
+// IsWebSocketRequest indicates whether the request is an
+// extended CONNECT, opening a WebSocket over its stream.
+func IsWebSocketRequest(r *http.Request) bool {
+	return r.Method == "CONNECT" && strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// AcceptWebSocket accepts a WebSocket request, replying with
+// a 200 status and any headers already set, such as the
+// Sec-WebSocket-Protocol chosen. The returned net.Conn carries
+// the WebSocket's frames, and can be given to a WebSocket
+// library in place of a hijacked connection.
+//
+// If the request is not a WebSocket request, common.ErrNotWebSocket
+// is returned, and nothing is sent. If it uses an unsupported
+// WebSocket version, it is refused with a 400 status.
+func (s *ResponseStream) AcceptWebSocket() (net.Conn, error) {
+	if s.closed() || s.wroteHeader {
+		return nil, errors.New("Error: Response headers already written.")
+	}
+
+	if !IsWebSocketRequest(s.request) {
+		return nil, common.ErrNotWebSocket
+	}
+
+	if s.request.Header.Get("Sec-WebSocket-Version") != webSocketVersion {
+		s.Header().Set("Sec-WebSocket-Version", webSocketVersion)
+		s.WriteHeader(http.StatusBadRequest)
+		return nil, errors.New("Error: Unsupported WebSocket version.")
+	}
+
+	return s.NetConn(), nil
+}
+
+// DialWebSocket opens a WebSocket to the given URL, sending the
+// given headers, such as Sec-WebSocket-Protocol, with the request.
+// URLs with the ws and wss schemes are mapped to http and https.
+// The returned net.Conn carries the WebSocket's frames, and the
+// server's response is returned for its headers.
+//
+// If the server refuses the WebSocket, an error is returned with
+// the response.
+func (c *Conn) DialWebSocket(rawurl string, header http.Header) (net.Conn, *http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    u,
+		Host:   u.Host,
+		Header: make(http.Header),
+	}
+	for name, values := range header {
+		request.Header[name] = append([]string(nil), values...)
+	}
+	request.Header.Set(":protocol", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", webSocketVersion)
+
+	return c.Dial(request, 0)
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"net"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// copyThreshold is the size below which writes to a
+// batchWriter are copied, rather than referenced.
+const copyThreshold = 1024
+
+// batchWriter coalesces the frames written by the send loop,
+// so that several frames can be sent with each system call.
+// The send loop flushes the batch whenever the scheduler has
+// no frame ready to send, so frames are only delayed while
+// more are waiting to join them. The batch is also flushed
+// once it reaches the maximum size.
+//
+// On TCP and Unix connections, the batch is written with
+// net.Buffers, which uses writev. Small writes, such as frame
+// headers, are copied into a shared buffer, but larger writes,
+// such as DATA payloads, are held by reference until they are
+// flushed, which is safe because each frame's WriteTo passes
+// data which is not modified once the frame has been sent. On
+// other connections, such as TLS, each batch is copied into a
+// single buffer, so that it is written as few records.
+//
+// If the maximum size is 0, writes are passed straight to the
+// connection.
+//
+// If the connection's traffic is being captured, each batch is
+// recorded as it is written.
+//
+// The batchWriter is only used by the send goroutine, so has
+// no locking.
+type batchWriter struct {
+	conn    net.Conn
+	max     int
+	copyAll bool        // whether all writes are copied.
+	buffers net.Buffers // the batch.
+	scratch []byte      // backing store for copied writes.
+	open    bool        // whether the last buffer is in scratch.
+	size    int         // total length of buffers.
+	capture *common.CaptureConn
+}
+
+func newBatchWriter(conn net.Conn, max int) *batchWriter {
+	out := new(batchWriter)
+	out.conn = conn
+	out.max = max
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		out.copyAll = true
+	}
+	return out
+}
+
+// Write adds p to the batch, flushing it if it has reached
+// the maximum size.
+func (w *batchWriter) Write(p []byte) (int, error) {
+	if w.max <= 0 {
+		n, err := w.conn.Write(p)
+		w.capture.Sent(p[:n])
+		return n, err
+	}
+
+	if w.copyAll || len(p) < copyThreshold {
+		start := len(w.scratch)
+		if w.open {
+			start -= len(w.buffers[len(w.buffers)-1])
+		}
+		w.scratch = append(w.scratch, p...)
+		if w.open {
+			w.buffers[len(w.buffers)-1] = w.scratch[start:]
+		} else {
+			w.buffers = append(w.buffers, w.scratch[start:])
+			w.open = true
+		}
+	} else {
+		w.buffers = append(w.buffers, p)
+		w.open = false
+	}
+
+	w.size += len(p)
+	if w.size >= w.max {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Buffered returns the number of bytes waiting to be
+// flushed.
+func (w *batchWriter) Buffered() int {
+	return w.size
+}
+
+// Flush writes the batch to the connection.
+func (w *batchWriter) Flush() error {
+	if w.size == 0 {
+		return nil
+	}
+
+	// The buffers are recorded before they are written,
+	// as writev consumes them.
+	if w.capture != nil {
+		for _, buf := range w.buffers {
+			w.capture.Sent(buf)
+		}
+	}
+
+	// A batch of one buffer, which is common when only
+	// small frames are sent, needs no writev.
+	var err error
+	if len(w.buffers) == 1 {
+		_, err = w.conn.Write(w.buffers[0])
+	} else {
+		buffers := w.buffers
+		_, err = buffers.WriteTo(w.conn)
+	}
+
+	for i := range w.buffers {
+		w.buffers[i] = nil
+	}
+	w.buffers = w.buffers[:0]
+	w.scratch = w.scratch[:0]
+	w.open = false
+	w.size = 0
+	return err
+}
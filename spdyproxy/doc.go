@@ -0,0 +1,14 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spdyproxy contains a SPDY-aware reverse proxy, which
+// accepts SPDY on the front and forwards requests to HTTP/1.1
+// or SPDY backends. Headers are filtered as they are translated
+// between the two, and a HeaderFilter can be set for each
+// direction to restrict them further.
+//
+// NewHTTP2Bridge returns a proxy which bridges SPDY clients to
+// HTTP/2 backends, translating stream priorities and push hints
+// between the protocols.
+package spdyproxy
@@ -0,0 +1,87 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdyproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderFilter controls the headers passed through the
+// proxy in one direction. SPDY pseudo-headers, hop-by-hop
+// headers and any headers named in the Connection header
+// are always removed, since they describe a single hop and
+// cannot be copied safely between SPDY and HTTP/1.1.
+//
+// Header names are matched case-insensitively.
+type HeaderFilter struct {
+	// Allow, if not empty, lists the only headers which
+	// are passed on.
+	Allow []string
+
+	// Deny lists headers which are removed, such as
+	// those carrying internal credentials.
+	Deny []string
+
+	// Require lists headers which must be present once
+	// the others have been removed.
+	Require []string
+}
+
+// clean returns a copy of h without the headers removed by
+// the filter, which may be nil. This is used in both
+// directions.
+func (f *HeaderFilter) clean(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vv := range h {
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		out[k] = append([]string(nil), vv...)
+	}
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		out.Del(name)
+	}
+	if f == nil {
+		return out
+	}
+
+	if len(f.Allow) > 0 {
+		allowed := make(map[string]bool, len(f.Allow))
+		for _, name := range f.Allow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for k := range out {
+			if !allowed[http.CanonicalHeaderKey(k)] {
+				delete(out, k)
+			}
+		}
+	}
+	for _, name := range f.Deny {
+		out.Del(name)
+	}
+	return out
+}
+
+// missing returns the name of the first header required
+// by the filter, which may be nil, that h does not have.
+func (f *HeaderFilter) missing(h http.Header) string {
+	if f == nil {
+		return ""
+	}
+	for _, name := range f.Require {
+		if len(h[http.CanonicalHeaderKey(name)]) == 0 {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdyproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// NewHTTP2Transport returns a Transport which speaks only HTTP/2
+// to backends, using the implementation in net/http. Backends
+// with https URLs are reached over TLS, configured by tlsConfig,
+// which may be nil, and those with http URLs with unencrypted
+// HTTP/2, also known as h2c with prior knowledge.
+//
+// Each backend request is a stream on a shared connection, with
+// its own HTTP/2 flow control, so a client slow to read its
+// response holds back only the corresponding backend stream.
+func NewHTTP2Transport(tlsConfig *tls.Config) *http.Transport {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig.Clone(),
+		ForceAttemptHTTP2: true,
+		Protocols:         protocols,
+	}
+}
+
+// NewHTTP2Bridge returns a ReverseProxy, as NewReverseProxy, which
+// forwards requests from SPDY clients to HTTP/2 backends. Stream
+// priorities are carried in the Priority header, and the backends'
+// push hints are turned into SPDY pushes, as described for
+// PriorityHeader and EnablePush.
+//
+// The same proxy serves the reverse direction, from HTTP/2 clients
+// to SPDY backends, if its Transport is set to a spdy.Transport and
+// it is served with HTTP/2 enabled, such as by spdy.DualStack.
+func NewHTTP2Bridge(target *url.URL) *ReverseProxy {
+	p := NewReverseProxy(target)
+	p.Transport = NewHTTP2Transport(nil)
+	p.PriorityHeader = true
+	p.EnablePush = true
+	return p
+}
+
+// priorityHeader returns the value of the Priority header, as
+// defined by RFC 9218, for the given SPDY/3 priority. Both
+// range from 0, the most urgent, to 7.
+func priorityHeader(priority common.Priority) string {
+	return "u=" + strconv.Itoa(int(priority))
+}
+
+// parsePriorityHeader returns the SPDY/3 priority given by the
+// urgency in a Priority header, as defined by RFC 9218. Other
+// parameters, such as incremental, have no SPDY equivalent and
+// are ignored.
+func parsePriorityHeader(value string) (common.Priority, bool) {
+	for _, param := range strings.Split(value, ",") {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "u=") {
+			continue
+		}
+		urgency, err := strconv.Atoi(param[2:])
+		if err != nil || urgency < 0 || urgency > 7 {
+			return 0, false
+		}
+		return common.Priority(urgency), true
+	}
+	return 0, false
+}
@@ -0,0 +1,11 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdyproxy
+
+import (
+	"github.com/SlyMarbo/spdy/common"
+)
+
+var log = common.GetLogger()
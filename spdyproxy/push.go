@@ -0,0 +1,169 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdyproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// PushHints returns the resources hinted for push in the
+// given response headers. Two forms of hint are supported:
+//
+//	X-Associated-Content: "/style.css":1, "/script.js"
+//	Link: </style.css>; rel=preload; as=style
+//
+// Link headers with the "nopush" parameter are ignored. The
+// returned references may be relative.
+func PushHints(header http.Header) []string {
+	var out []string
+
+	for _, value := range header["X-Associated-Content"] {
+		for _, hint := range strings.Split(value, ",") {
+			hint = strings.TrimSpace(hint)
+
+			// Remove any priority suffix.
+			if i := strings.LastIndex(hint, ":"); i > 0 && strings.HasPrefix(hint, "\"") && hint[i-1] == '"' {
+				hint = hint[:i]
+			}
+			hint = strings.Trim(hint, "\"")
+			if hint != "" {
+				out = append(out, hint)
+			}
+		}
+	}
+
+	for _, value := range header["Link"] {
+		for _, link := range strings.Split(value, ",") {
+			params := strings.Split(link, ";")
+			ref := strings.TrimSpace(params[0])
+			if !strings.HasPrefix(ref, "<") || !strings.HasSuffix(ref, ">") {
+				continue
+			}
+
+			preload, nopush := false, false
+			for _, param := range params[1:] {
+				param = strings.ToLower(strings.TrimSpace(param))
+				switch {
+				case param == "nopush":
+					nopush = true
+				case strings.HasPrefix(param, "rel="):
+					for _, rel := range strings.Fields(strings.Trim(param[4:], "\"")) {
+						if rel == "preload" {
+							preload = true
+						}
+					}
+				}
+			}
+
+			if preload && !nopush {
+				out = append(out, ref[1:len(ref)-1])
+			}
+		}
+	}
+
+	return out
+}
+
+// push starts a push on w for each resource hinted in the
+// backend's response header. Only resources on the same
+// origin as the inbound request are pushed. Each resource
+// is then fetched through the proxy in its own goroutine,
+// which is tracked with wg. Clients using HTTP/2 are sent
+// the pushes with http.Pusher instead, in which case the
+// resources are requested from the proxy by net/http.
+func (p *ReverseProxy) push(w http.ResponseWriter, req *http.Request, header http.Header, transport http.RoundTripper, wg *sync.WaitGroup) {
+	pusher, isPusher := w.(http.Pusher)
+	if !spdy.UsingSPDY(w) && !isPusher {
+		return
+	}
+
+	base := &url.URL{
+		Scheme: "https",
+		Host:   req.Host,
+		Path:   req.URL.Path,
+	}
+	if req.TLS == nil {
+		base.Scheme = "http"
+	}
+
+	for _, hint := range PushHints(header) {
+		ref, err := url.Parse(hint)
+		if err != nil {
+			continue
+		}
+		u := base.ResolveReference(ref)
+		if u.Scheme != base.Scheme || u.Host != base.Host {
+			continue
+		}
+
+		if !spdy.UsingSPDY(w) {
+			if err := pusher.Push(u.RequestURI(), nil); err != nil && err != http.ErrNotSupported {
+				p.logf("Error: proxy failed to push %q: %v", u, err)
+			}
+			continue
+		}
+
+		stream, err := spdy.Push(w, u.String())
+		if err != nil {
+			p.logf("Error: proxy failed to push %q: %v", u, err)
+			continue
+		}
+
+		wg.Add(1)
+		go p.fetchPush(stream, spdy.SPDYversion(w), req, u, transport, wg)
+	}
+}
+
+// fetchPush fetches the resource u from the backend, as
+// though it had been requested alongside req, and sends
+// the response on the push stream.
+func (p *ReverseProxy) fetchPush(stream common.PushStream, version float64, req *http.Request, u *url.URL, transport http.RoundTripper, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer stream.Finish()
+
+	pushReq := new(http.Request)
+	*pushReq = *req
+	pushReq.Method = "GET"
+	pushReq.URL = &url.URL{Path: u.Path, RawQuery: u.RawQuery}
+	pushReq.Body = nil
+	pushReq.ContentLength = 0
+
+	outreq := p.outboundRequest(pushReq)
+	outreq.Header.Del("Content-Length")
+	outreq.Header.Del("Content-Type")
+	outreq = spdy.WithPriority(outreq, 7)
+
+	status := ":status"
+	if version < 3 {
+		status = "status"
+	}
+
+	res, err := transport.RoundTrip(outreq)
+	if err != nil {
+		p.logf("Error: proxy failed to fetch push %q: %v", u, err)
+		stream.Header().Set(status, strconv.Itoa(http.StatusBadGateway))
+		return
+	}
+	defer res.Body.Close()
+
+	header := p.ResponseHeaders.clean(res.Header)
+	if name := p.ResponseHeaders.missing(header); name != "" {
+		p.logf("Error: backend response for push %q had no %s header.", u, name)
+		stream.Header().Set(status, strconv.Itoa(http.StatusBadGateway))
+		return
+	}
+	copyHeader(stream.Header(), header)
+	stream.Header().Set(status, strconv.Itoa(res.StatusCode))
+
+	stream.WriteHeader(res.StatusCode)
+	p.copyResponse(stream, res.Body)
+}
@@ -0,0 +1,263 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdyproxy
+
+import (
+	"io"
+	logging "log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// Hop-by-hop headers. These are removed when sent to the backend
+// or the client. SPDY forbids most of them on the wire anyway.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ReverseProxy is an HTTP Handler that takes an incoming request,
+// which may have arrived over SPDY, and sends it to another server,
+// proxying the response back to the client. Backends may speak
+// either HTTP/1.1 or SPDY; this is negotiated by the Transport.
+//
+// When the inbound request arrived over SPDY, its stream priority
+// is carried over to the backend request, and SPDY pseudo-headers
+// are translated to and from their HTTP/1.1 equivalents. Pushes
+// sent by SPDY backends are refused, since they cannot be tied back
+// to the inbound stream; the proxy is the origin of any pushes sent
+// to the client, as directed by EnablePush.
+type ReverseProxy struct {
+	// Director must be a function which modifies the request
+	// into a new request to be sent using Transport. Its
+	// response is then copied back to the original client
+	// unmodified.
+	Director func(*http.Request)
+
+	// Transport is used to perform proxy requests. If nil,
+	// a spdy.Transport is used, which will use SPDY to talk
+	// to backends that support it.
+	Transport http.RoundTripper
+
+	// BufferSize is the size of the chunks in which response
+	// bodies are copied to the client. Smaller chunks let the
+	// client's flow control window regulate the proxy sooner.
+	// If zero, DefaultBufferSize is used.
+	BufferSize int
+
+	// ErrorLog specifies an optional logger for errors that
+	// occur when attempting to proxy the request. If nil,
+	// the package's error logger is used.
+	ErrorLog *logging.Logger
+
+	// EnablePush, if true, causes push hints in backend
+	// responses to be translated into SPDY pushes to the
+	// client. The hinted resources are fetched through the
+	// proxy itself. See PushHints for the supported hints.
+	EnablePush bool
+
+	// RequestHeaders and ResponseHeaders, if set, filter the
+	// headers passed to the backend and to the client. A
+	// request missing a required header is refused with 400
+	// Bad Request, and a response with 502 Bad Gateway.
+	RequestHeaders  *HeaderFilter
+	ResponseHeaders *HeaderFilter
+
+	// PriorityHeader, if true, translates stream priorities
+	// to and from the Priority header defined by RFC 9218, as
+	// used by HTTP/2 and HTTP/3. The priority of a request
+	// received over SPDY is sent to the backend as its
+	// urgency, and the urgency of a request received over
+	// another protocol sets the priority used for SPDY
+	// backends. A Priority header from a SPDY client is
+	// replaced.
+	PriorityHeader bool
+}
+
+// DefaultBufferSize is the default size of the chunks in which
+// response bodies are copied.
+const DefaultBufferSize = 32 * 1024
+
+// NewReverseProxy returns a new ReverseProxy that rewrites URLs
+// to the scheme, host, and base path provided in target. If the
+// target's path is "/base" and the incoming request was for "/dir",
+// the target request will be for /base/dir.
+func NewReverseProxy(target *url.URL) *ReverseProxy {
+	targetQuery := target.RawQuery
+	director := func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if targetQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+		}
+	}
+	return &ReverseProxy{Director: director}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	transport := p.Transport
+	if transport == nil {
+		transport = defaultTransport
+	}
+
+	outreq := p.outboundRequest(req)
+	if name := p.RequestHeaders.missing(outreq.Header); name != "" {
+		p.logf("Error: proxy refused request without %s header.", name)
+		http.Error(w, "Missing required header "+name+".", http.StatusBadRequest)
+		return
+	}
+
+	// Carry the stream's priority over to SPDY backends.
+	if priority, err := spdy.GetPriority(w); err == nil {
+		outreq = spdy.WithPriority(outreq, common.Priority(priority))
+		if p.PriorityHeader {
+			urgency := priority
+			if spdy.SPDYversion(w) < 3 {
+				urgency *= 2 // SPDY/2 has only 4 priorities.
+			}
+			outreq.Header.Set("Priority", priorityHeader(common.Priority(urgency)))
+		}
+	} else if p.PriorityHeader {
+		if priority, ok := parsePriorityHeader(outreq.Header.Get("Priority")); ok {
+			outreq = spdy.WithPriority(outreq, priority)
+		}
+	}
+
+	res, err := transport.RoundTrip(outreq)
+	if err != nil {
+		p.logf("Error: proxy failed to reach backend: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	// Start any pushes before the response, so that the
+	// client knows not to request the resources itself.
+	var pushes sync.WaitGroup
+	if p.EnablePush {
+		p.push(w, req, res.Header, transport, &pushes)
+	}
+	res.Header.Del("X-Associated-Content")
+
+	header := p.ResponseHeaders.clean(res.Header)
+	if name := p.ResponseHeaders.missing(header); name != "" {
+		p.logf("Error: backend response had no %s header.", name)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	copyHeader(w.Header(), header)
+
+	w.WriteHeader(res.StatusCode)
+	p.copyResponse(w, res.Body)
+
+	// The inbound stream must stay open until the pushes
+	// have completed.
+	pushes.Wait()
+}
+
+// outboundRequest returns the request to be sent to the
+// backend for the inbound request req.
+func (p *ReverseProxy) outboundRequest(req *http.Request) *http.Request {
+	outreq := new(http.Request)
+	*outreq = *req // includes shallow copies of maps, but okay
+	outreq.URL = new(url.URL)
+	*outreq.URL = *req.URL
+
+	p.Director(outreq)
+	outreq.Proto = "HTTP/1.1"
+	outreq.ProtoMajor = 1
+	outreq.ProtoMinor = 1
+	outreq.Close = false
+	outreq.RequestURI = ""
+
+	// Translate the inbound SPDY headers, removing any
+	// pseudo-headers, hop-by-hop headers and filtered headers.
+	outreq.Header = p.RequestHeaders.clean(req.Header)
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior, ok := outreq.Header["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	return outreq
+}
+
+// copyResponse copies the response body in chunks, so that the
+// data is written as it is received and each write is subject to
+// the client's flow control window.
+func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
+	size := p.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	buf := make([]byte, size)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				p.logf("Error: proxy failed to write response: %v", werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.logf("Error: proxy failed to read response: %v", err)
+			return
+		}
+	}
+}
+
+func (p *ReverseProxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// defaultTransport is shared between proxies with no Transport
+// set, so that backend connections are reused.
+var defaultTransport = spdy.NewTransport(false)
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdyproxy_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/spdyproxy"
+)
+
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.Header {
+			if name[0] == ':' {
+				t.Errorf("Backend received pseudo-header %q", name)
+			}
+		}
+		w.Header().Set("X-Backend", "yes")
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	target, err := url.Parse(backend.URL + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := httptest.NewUnstartedServer(spdyproxy.NewReverseProxy(target))
+	spdy.AddSPDY(frontend.Config)
+	frontend.TLS = frontend.Config.TLSConfig
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	client := &http.Client{Transport: &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+	}}
+
+	res, err := client.Get(frontend.URL + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := string(body), "path=/base/file"; got != want {
+		t.Errorf("Got body %q, expected %q", got, want)
+	}
+	if res.Header.Get("X-Backend") != "yes" {
+		t.Error("Backend header was not proxied.")
+	}
+}
+
+type pushRecorder struct {
+	sync.Mutex
+	paths []string
+	done  chan string
+}
+
+func (p *pushRecorder) ReceiveData(req *http.Request, data []byte, final bool) {
+	if final {
+		p.done <- req.URL.Path
+	}
+}
+
+func (p *pushRecorder) ReceiveHeader(req *http.Request, header http.Header) {}
+
+func (p *pushRecorder) ReceiveRequest(req *http.Request) bool {
+	p.Lock()
+	p.paths = append(p.paths, req.URL.Path)
+	p.Unlock()
+	return true
+}
+
+func TestReverseProxyPush(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("X-Associated-Content", `"/a.css":1`)
+			w.Header().Add("Link", "</b.js>; rel=preload; as=script")
+			w.Header().Add("Link", "</c.js>; rel=preload; nopush")
+			fmt.Fprint(w, "index")
+		default:
+			fmt.Fprintf(w, "path=%s", r.URL.Path)
+		}
+	}))
+	defer backend.Close()
+
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := spdyproxy.NewReverseProxy(target)
+	proxy.EnablePush = true
+	frontend := httptest.NewUnstartedServer(proxy)
+	spdy.AddSPDY(frontend.Config)
+	frontend.TLS = frontend.Config.TLSConfig
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	pushes := &pushRecorder{done: make(chan string, 4)}
+	client := &http.Client{Transport: &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+		PushReceiver: pushes,
+	}}
+
+	res, err := client.Get(frontend.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.Header.Get("X-Associated-Content") != "" {
+		t.Error("Push hint was passed to the client.")
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-pushes.done:
+			got[path] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for pushes; got %v", got)
+		}
+	}
+	if !got["/a.css"] || !got["/b.js"] {
+		t.Errorf("Expected pushes of /a.css and /b.js, got %v", got)
+	}
+
+	pushes.Lock()
+	defer pushes.Unlock()
+	if len(pushes.paths) != 2 {
+		t.Errorf("Expected 2 pushes, got %v", pushes.paths)
+	}
+}
+
+func TestPushHints(t *testing.T) {
+	header := make(http.Header)
+	header.Set("X-Associated-Content", `"https://example.com/a.css":1, "/b.js"`)
+	header.Add("Link", `</c.png>; rel="preload"; as=image, </d.html>; rel=next`)
+
+	got := spdyproxy.PushHints(header)
+	want := []string{"https://example.com/a.css", "/b.js", "/c.png"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Got hints %v, expected %v", got, want)
+	}
+}
+
+func TestReverseProxyHeaderFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "" {
+			t.Error("Backend received denied Cookie header.")
+		}
+		if r.Header.Get("X-Tenant") != "a" {
+			t.Errorf("Backend received X-Tenant %q, expected %q", r.Header.Get("X-Tenant"), "a")
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "yes")
+		w.Header().Set("X-Internal-Token", "secret")
+		w.Header().Set("X-Backend", "yes")
+		if r.URL.Path == "/partial" {
+			w.Header().Del("X-Backend")
+		}
+	}))
+	defer backend.Close()
+
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := spdyproxy.NewReverseProxy(target)
+	proxy.RequestHeaders = &spdyproxy.HeaderFilter{
+		Deny:    []string{"cookie"},
+		Require: []string{"X-Tenant"},
+	}
+	proxy.ResponseHeaders = &spdyproxy.HeaderFilter{
+		Deny:    []string{"X-Internal-Token"},
+		Require: []string{"X-Backend"},
+	}
+	frontend := httptest.NewUnstartedServer(proxy)
+	spdy.AddSPDY(frontend.Config)
+	frontend.TLS = frontend.Config.TLSConfig
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	client := &http.Client{Transport: &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+	}}
+
+	get := func(path string, header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", frontend.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	res := get("/", http.Header{"X-Tenant": {"a"}, "Cookie": {"session=1"}})
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	for _, name := range []string{"X-Internal-Token", "X-Hop"} {
+		if res.Header.Get(name) != "" {
+			t.Errorf("Filtered header %s was passed to the client.", name)
+		}
+	}
+	if res.Header.Get("X-Backend") != "yes" {
+		t.Error("Backend header was not proxied.")
+	}
+
+	if res = get("/", http.Header{}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a required request header, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+	if res = get("/partial", http.Header{"X-Tenant": {"a"}}); res.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status %d without a required response header, got %d", http.StatusBadGateway, res.StatusCode)
+	}
+}
+
+func TestHTTP2Bridge(t *testing.T) {
+	// SPDY clients to an HTTP/2 backend.
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.Header.Get("Priority"))
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := httptest.NewUnstartedServer(spdyproxy.NewHTTP2Bridge(target))
+	spdy.AddSPDY(frontend.Config)
+	frontend.TLS = frontend.Config.TLSConfig
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	client := &http.Client{Transport: &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+	}}
+	req, err := http.NewRequest("GET", frontend.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(t, client, spdy.WithPriority(req, 2)), "HTTP/2.0 u=2"; got != want {
+		t.Errorf("Got body %q, expected %q", got, want)
+	}
+
+	// HTTP/2 clients to a SPDY backend.
+	spdyBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority, err := spdy.GetPriority(w)
+		if err != nil {
+			t.Error(err)
+		}
+		fmt.Fprint(w, priority)
+	}))
+	spdy.AddSPDY(spdyBackend.Config)
+	spdyBackend.TLS = spdyBackend.Config.TLSConfig
+	spdyBackend.StartTLS()
+	defer spdyBackend.Close()
+
+	target, err = url.Parse(spdyBackend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := spdyproxy.NewReverseProxy(target)
+	proxy.Transport = spdy.NewTransport(true)
+	proxy.PriorityHeader = true
+
+	h2Frontend := httptest.NewUnstartedServer(proxy)
+	spdy.NewDualStack(h2Frontend.Config)
+	h2Frontend.TLS = h2Frontend.Config.TLSConfig
+	h2Frontend.StartTLS()
+	defer h2Frontend.Close()
+
+	h2 := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	req, err = http.NewRequest("GET", h2Frontend.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Priority", "u=5, i")
+	if got, want := get(t, h2, req), "5"; got != want {
+		t.Errorf("Got body %q, expected %q", got, want)
+	}
+}
+
+func get(t *testing.T, client *http.Client, req *http.Request) string {
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
@@ -0,0 +1,32 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stream multiplexes raw byte streams over a single SPDY/3.1
+// connection, independently of net/http. Each stream is a net.Conn with
+// its own flow control and half-close, and carries a set of headers as
+// metadata from the endpoint which opened it.
+//
+// As in SPDY, the roles are asymmetric: the client side of a session
+// opens streams, and the server side accepts them.
+//
+// A simple example is:
+//
+//	// Server.
+//	session := stream.Server(conn)
+//	for {
+//		s, err := session.Accept()
+//		if err != nil {
+//			break
+//		}
+//		go handle(s.Header().Get("Service"), s)
+//	}
+//
+//	// Client.
+//	session := stream.Client(conn)
+//	s, err := session.Open(http.Header{"Service": {"echo"}})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Close()
+package stream
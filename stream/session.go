@@ -0,0 +1,161 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3"
+)
+
+// ErrNotClient is returned when a server session
+// is used to open a stream.
+var ErrNotClient = errors.New("Error: Only client sessions can open streams.")
+
+// Session is a SPDY/3.1 connection carrying multiplexed
+// byte streams.
+type Session struct {
+	conn   *spdy3.Conn
+	client bool
+	accept chan *Stream
+}
+
+// Client returns a session using conn, which opens
+// streams with Open.
+func Client(conn net.Conn) *Session {
+	s := &Session{client: true}
+	s.conn = spdy3.NewConn(conn, nil, 1)
+	go s.conn.Run()
+	return s
+}
+
+// Server returns a session using conn, which accepts
+// streams with Accept.
+func Server(conn net.Conn) *Session {
+	s := &Session{accept: make(chan *Stream)}
+	s.conn = spdy3.NewConn(conn, &http.Server{Handler: http.HandlerFunc(s.serve)}, 1)
+	go s.conn.Run()
+	return s
+}
+
+// Open opens a new stream, sending header as its metadata,
+// and returns once the other endpoint has received it.
+func (s *Session) Open(header http.Header) (*Stream, error) {
+	if !s.client {
+		return nil, ErrNotClient
+	}
+
+	metadata := cloneHeader(header)
+	request := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Scheme: "https", Host: "stream", Path: "/"},
+		Header: cloneHeader(header),
+	}
+
+	conn, _, err := s.conn.Dial(request, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream{StreamConn: conn.(*spdy3.StreamConn), header: metadata}, nil
+}
+
+// Accept waits for and returns the next stream opened by
+// the other endpoint. Only server sessions accept streams.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.conn.CloseNotify():
+		return nil, common.ErrConnClosed
+	}
+}
+
+// Close ends the session, and all of its streams.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// Closed indicates whether the session has ended.
+func (s *Session) Closed() bool {
+	return s.conn.Closed()
+}
+
+// Conn returns the underlying SPDY connection.
+func (s *Session) Conn() *spdy3.Conn {
+	return s.conn
+}
+
+// serve passes each stream to Accept, then keeps its
+// handler running until the stream is closed.
+func (s *Session) serve(w http.ResponseWriter, r *http.Request) {
+	rs, ok := w.(*spdy3.ResponseStream)
+	if !ok {
+		return
+	}
+
+	stream := &Stream{
+		StreamConn: rs.NetConn().(*spdy3.StreamConn),
+		header:     cloneHeader(r.Header),
+		done:       make(chan struct{}),
+	}
+
+	select {
+	case s.accept <- stream:
+	case <-s.conn.CloseNotify():
+		stream.Close()
+		return
+	}
+
+	select {
+	case <-stream.done:
+	case <-s.conn.CloseNotify():
+	}
+}
+
+// Stream is a single byte stream in a session.
+type Stream struct {
+	*spdy3.StreamConn
+	header    http.Header
+	done      chan struct{} // nil on client sessions.
+	closeOnce sync.Once
+}
+
+// Header returns the metadata sent when the stream was
+// opened.
+func (s *Stream) Header() http.Header {
+	return s.header
+}
+
+// Close half-closes the stream and stops reading. If the
+// other endpoint is still writing, the stream is reset.
+func (s *Stream) Close() error {
+	err := s.StreamConn.Close()
+	if s.done != nil {
+		s.closeOnce.Do(func() {
+			close(s.done)
+		})
+	}
+	return err
+}
+
+// cloneHeader returns a copy of h without any SPDY
+// pseudo-headers.
+func cloneHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/stream"
+)
+
+func TestSession(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := stream.Client(c)
+	server := stream.Server(s)
+	defer client.Close()
+
+	// Echo each stream, prefixed with its metadata.
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.WriteString(st, st.Header().Get("Name")+":")
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	if _, err := server.Open(nil); err != stream.ErrNotClient {
+		t.Fatalf("Expected ErrNotClient from server, got %v.", err)
+	}
+
+	const n = 4
+	done := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			name := fmt.Sprintf("stream-%d", i)
+			st, err := client.Open(http.Header{"Name": {name}})
+			if err != nil {
+				done <- err
+				return
+			}
+			defer st.Close()
+
+			data := bytes.Repeat([]byte(name), 20000)
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+
+			got, err := io.ReadAll(st)
+			if err != nil {
+				done <- err
+				return
+			}
+			if want := append([]byte(name+":"), data...); !bytes.Equal(got, want) {
+				done <- fmt.Errorf("%s: got %d bytes, expected %d.", name, len(got), len(want))
+				return
+			}
+			done <- nil
+		}(i)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.Close()
+	if _, err := server.Accept(); err == nil {
+		t.Fatal("Expected Accept to fail once the session closed.")
+	}
+}
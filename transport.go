@@ -5,9 +5,11 @@
 package spdy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -17,6 +19,8 @@ import (
 	"time"
 
 	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	"github.com/SlyMarbo/spdy/spdy3"
 )
 
 // A Transport is an HTTP/SPDY http.RoundTripper.
@@ -27,17 +31,69 @@ type Transport struct {
 	// Request. If the function returns a non-nil error, the
 	// request is aborted with the provided error.
 	// If Proxy is nil or returns a nil *URL, no proxy is used.
+	//
+	// Each new connection is tunnelled through the proxy, over
+	// which the TLS session, and so SPDY, is negotiated with the
+	// server as usual. The proxy's URL gives its type: "http" and
+	// "https" proxies are sent a CONNECT request, and "socks5"
+	// and "socks5h" proxies are used as SOCKS5, with the host
+	// resolved by the proxy for "socks5h". Any username and
+	// password in the URL are sent to the proxy, with Basic
+	// authentication for HTTP. Proxy may be set to
+	// http.ProxyFromEnvironment to use the HTTPS_PROXY and
+	// NO_PROXY environment variables.
 	Proxy func(*http.Request) (*url.URL, error)
 
+	// ProxyConnectHeader optionally specifies headers to send
+	// to HTTP proxies with each CONNECT request.
+	ProxyConnectHeader http.Header
+
+	// DialContext specifies the dial function for creating TCP
+	// connections. If DialContext is nil, Dial is used, and if
+	// both are nil, a net.Dialer is used, which tries each of
+	// the host's addresses in turn and, if the host has both
+	// IPv4 and IPv6 addresses, races the two families with
+	// Happy Eyeballs (RFC 6555).
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// Dial specifies the dial function for creating TCP
-	// connections.
-	// If Dial is nil, net.Dial is used.
-	Dial func(network, addr string) (net.Conn, error) // TODO: use
+	// connections, if DialContext is nil.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// DialTimeout, if non-zero, limits the time taken to make
+	// each connection, including any TLS handshake. When the
+	// default dialer tries several addresses, the time is
+	// shared between them.
+	DialTimeout time.Duration
+
+	// FallbackDelay is the time the default dialer waits for
+	// a connection to the host's preferred address family
+	// before also trying the other. If zero, a delay of 300ms
+	// is used, and if negative, the families are not raced.
+	FallbackDelay time.Duration
+
+	// UnixSockets maps host names to the paths of the Unix
+	// domain sockets serving them, for requests to URLs with
+	// the "unix" scheme. For example, with {"app": "/run/app.sock"},
+	// unix://app/status is requested over /run/app.sock. These
+	// requests are made with SPDY/3.1 directly over the socket,
+	// without TLS or a proxy, so the server must serve SPDY/3.1
+	// in plaintext, as with Server.ServePlaintext. The socket is
+	// dialled with DialContext or Dial, if set.
+	UnixSockets map[string]string
 
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
 
+	// KeyLogWriter, if set, is given the TLS session keys of
+	// each connection in the NSS key log format, so that
+	// captures of the traffic can be decrypted for debugging.
+	// It is used unless TLSClientConfig has a KeyLogWriter of
+	// its own. KeyLogFromEnv gives a writer to the file named
+	// by SSLKEYLOGFILE.
+	KeyLogWriter io.Writer
+
 	// DisableKeepAlives, if true, prevents re-use of TCP connections
 	// between different HTTP requests.
 	DisableKeepAlives bool
@@ -63,6 +119,44 @@ type Transport struct {
 	// time does not include the time to read the response body.
 	ResponseHeaderTimeout time.Duration
 
+	// ExpectContinueTimeout, if non-zero, specifies the amount of
+	// time to wait for a server's first response headers after
+	// sending the request headers, if the request has an
+	// "Expect: 100-continue" header, before sending the body
+	// anyway. If zero, common.ExpectContinueTimeout is used. This
+	// only applies to SPDY/3 and SPDY/3.1 sessions.
+	ExpectContinueTimeout time.Duration
+
+	// Timeout, if non-zero, limits the time taken by each SPDY
+	// request, from sending it to receiving the whole response.
+	// If it expires, the stream is cancelled with RST_STREAM
+	// CANCEL and context.DeadlineExceeded is returned. Each
+	// request's context is honoured in the same way, whether
+	// or not Timeout is set. This only applies to SPDY/3 and
+	// SPDY/3.1 sessions.
+	Timeout time.Duration
+
+	// RetryUnprocessed, if true, causes any request which a
+	// server refuses with GOAWAY before processing it to be
+	// retried on a new connection. Otherwise, only requests
+	// with idempotent methods are retried. Requests with a
+	// body are only retried if they have GetBody. This only
+	// applies to SPDY/3 and SPDY/3.1 sessions.
+	RetryUnprocessed bool
+
+	// RefusedRetries is the number of times a request which a
+	// server refuses with RST_STREAM REFUSED_STREAM is retried.
+	// The server guarantees that such a request was not
+	// processed, so it is retried whatever its method, provided
+	// any body has GetBody. If zero, common.RefusedStreamRetries
+	// is used, and if negative, refused requests are not retried.
+	// RefusedRetryBackoff is the delay before the first retry,
+	// which doubles with each further retry, and if zero,
+	// common.RefusedStreamBackoff is used. This only applies to
+	// SPDY/3 and SPDY/3.1 sessions.
+	RefusedRetries      int
+	RefusedRetryBackoff time.Duration
+
 	spdyConns map[string]common.Conn   // SPDY connections mapped to host:port.
 	tcpConns  map[string]chan net.Conn // Non-SPDY connections mapped to host:port.
 	connLimit map[string]chan struct{} // Used to enforce the TCP conn limit.
@@ -81,6 +175,53 @@ type Transport struct {
 	// sent with the server push. See Receiver for more detail on
 	// its methods.
 	PushReceiver common.Receiver
+
+	// PushHandler is used to receive server pushes on SPDY/3
+	// and SPDY/3.1 connections as PushedResponses, which can
+	// be accepted, read or cancelled. If set, it takes
+	// precedence over PushReceiver.
+	PushHandler common.PushHandler
+
+	// PushCache, if set, stores accepted pushes and serves
+	// later requests for the same URLs without a round trip.
+	// PushCache is only used if PushHandler is nil.
+	PushCache *PushCache
+
+	// OnSettings, if set, is called whenever a SPDY/3 or
+	// SPDY/3.1 session receives SETTINGS from a server, with
+	// the server's host:port and the settings received. This
+	// can be used to log changes in server behaviour, or to
+	// adjust concurrency to SETTINGS_MAX_CONCURRENT_STREAMS.
+	// OnSettings is called from the session's read loop, so
+	// it must not block.
+	OnSettings func(origin string, settings common.Settings)
+
+	// OnGoaway, if set, is called whenever a SPDY/3 or
+	// SPDY/3.1 session receives a GOAWAY from a server, with
+	// the server's host:port, the last stream the server
+	// processed, and the status given. OnGoaway is called
+	// from the session's read loop, so it must not block.
+	OnGoaway func(origin string, lastGoodStreamID common.StreamID, status common.GoawayStatus)
+
+	// Hints, if set, stores what is learnt about each origin,
+	// so that it is remembered across connections and, with a
+	// store such as FileHintStore, process restarts. This is
+	// the protocol negotiated, and the SPDY settings which
+	// the server asked to be persisted. The settings are
+	// returned to the server as each new session starts, and
+	// are discarded if it sends FLAG_SETTINGS_CLEAR_SETTINGS.
+	Hints     HintStore
+	hintsLock sync.Mutex // serialises updates to Hints.
+}
+
+// priorityKey is the context key used by WithPriority.
+type priorityKey struct{}
+
+// WithPriority returns a shallow copy of req which will be
+// sent with the given priority if it is made over SPDY. This
+// takes precedence over Transport.Priority.
+func WithPriority(req *http.Request, priority common.Priority) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), priorityKey{}, priority))
 }
 
 // NewTransport gives a simple initialised Transport.
@@ -93,25 +234,56 @@ func NewTransport(insecureSkipVerify bool) *Transport {
 	}
 }
 
-// dial makes the connection to an endpoint.
-func (t *Transport) dial(u *url.URL) (conn net.Conn, err error) {
+// dialContext returns the function used to make TCP
+// and Unix domain socket connections.
+func (t *Transport) dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.DialContext != nil {
+		return t.DialContext
+	}
+	if t.Dial != nil {
+		return func(_ context.Context, network, addr string) (net.Conn, error) {
+			return t.Dial(network, addr)
+		}
+	}
+	dialer := &net.Dialer{FallbackDelay: t.FallbackDelay}
+	return dialer.DialContext
+}
+
+// dial makes the connection to the endpoint of req.
+func (t *Transport) dial(req *http.Request) (conn net.Conn, err error) {
+	ctx, u := req.Context(), req.URL
 
 	if t.TLSClientConfig == nil {
-		t.TLSClientConfig = &tls.Config{
-			NextProtos: npn(),
-		}
-	} else if t.TLSClientConfig.NextProtos == nil {
-		t.TLSClientConfig.NextProtos = npn()
+		t.TLSClientConfig = new(tls.Config)
+	}
+	if t.TLSClientConfig.NextProtos == nil {
+		ConfigureTLS(t.TLSClientConfig)
+	}
+	if t.KeyLogWriter != nil && t.TLSClientConfig.KeyLogWriter == nil {
+		t.TLSClientConfig.KeyLogWriter = t.KeyLogWriter
 	}
 
 	// Wait for a connection slot to become available.
 	<-t.connLimit[u.Host]
 
+	if t.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.DialTimeout)
+		defer cancel()
+	}
+
 	switch u.Scheme {
 	case "http":
-		conn, err = net.Dial("tcp", u.Host)
+		conn, err = t.dialTCP(ctx, req, u.Host)
 	case "https":
-		conn, err = tls.Dial("tcp", u.Host, t.TLSClientConfig)
+		conn, err = t.dialTLS(ctx, req, u.Host)
+	case "unix":
+		path, ok := t.UnixSockets[u.Host]
+		if !ok {
+			err = errors.New(fmt.Sprintf("Error: No Unix domain socket for host %q.", u.Host))
+			break
+		}
+		conn, err = t.dialContext()(ctx, "unix", path)
 	default:
 		err = errors.New(fmt.Sprintf("Error: URL has invalid scheme %q.", u.Scheme))
 	}
@@ -124,6 +296,32 @@ func (t *Transport) dial(u *url.URL) (conn net.Conn, err error) {
 	return conn, err
 }
 
+// dialTLS connects to addr and completes the TLS handshake,
+// as tls.Dial.
+func (t *Transport) dialTLS(ctx context.Context, req *http.Request, addr string) (net.Conn, error) {
+	raw, err := t.dialTCP(ctx, req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := t.TLSClientConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // doHTTP is used to process an HTTP(S) request, using the TCP connection pool.
 func (t *Transport) doHTTP(conn net.Conn, req *http.Request) (*http.Response, error) {
 	debug.Printf("Requesting %q over HTTP.\n", req.URL.String())
@@ -167,35 +365,151 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
-	conn, tcpConn, err := t.process(req)
-	if err != nil {
-		return nil, err
+	// Serve pushed responses from the cache.
+	if t.PushCache != nil && t.PushHandler == nil {
+		if res, ok := t.PushCache.Response(req); ok {
+			debug.Printf("Serving %q from the push cache.\n", u.String())
+			return res, nil
+		}
 	}
-	if tcpConn != nil {
-		return t.doHTTP(tcpConn, req)
+
+	refused := 0
+	for retries := 0; ; retries++ {
+		conn, tcpConn, err := t.process(req)
+		if err != nil {
+			return nil, err
+		}
+		if tcpConn != nil {
+			return t.doHTTP(tcpConn, req)
+		}
+
+		// The connection has now been established.
+
+		debug.Printf("Requesting %q over SPDY.\n", u.String())
+
+		// Determine the request priority.
+		var priority common.Priority
+		if p, ok := req.Context().Value(priorityKey{}).(common.Priority); ok {
+			priority = p
+		} else if t.Priority != nil {
+			priority = t.Priority(req.URL)
+		} else {
+			priority = common.DefaultPriority(req.URL)
+		}
+
+		res, err := t.requestResponse(conn, req, priority)
+		if conn.Closed() {
+			t.releaseConn(u.Host)
+		}
+		if err == common.ErrUnprocessed && retries < maxUnprocessedRetries && t.canRetry(req) {
+			if retry, err := rewindBody(req); err == nil {
+				debug.Printf("Retrying %q after GOAWAY.\n", u.String())
+				req = retry
+				continue
+			}
+		}
+		if t.canRetryRefused(req, err, refused) {
+			if retry, err := rewindBody(req); err == nil {
+				debug.Printf("Retrying %q after REFUSED_STREAM.\n", u.String())
+				if err := t.refusedBackoff(req, refused); err != nil {
+					return nil, err
+				}
+				refused++
+				req = retry
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+}
+
+// requestResponse makes the request on conn, within
+// the Transport's Timeout, if any.
+func (t *Transport) requestResponse(conn common.Conn, req *http.Request, priority common.Priority) (*http.Response, error) {
+	if t.Timeout <= 0 {
+		return conn.RequestResponse(req, t.Receiver, priority)
 	}
 
-	// The connection has now been established.
+	ctx, cancel := context.WithTimeout(req.Context(), t.Timeout)
+	defer cancel()
+	return conn.RequestResponse(req.WithContext(ctx), t.Receiver, priority)
+}
 
-	debug.Printf("Requesting %q over SPDY.\n", u.String())
+// maxUnprocessedRetries is the number of times a request
+// refused by GOAWAY is retried before its error is returned.
+const maxUnprocessedRetries = 3
 
-	// Determine the request priority.
-	var priority common.Priority
-	if t.Priority != nil {
-		priority = t.Priority(req.URL)
-	} else {
-		priority = common.DefaultPriority(req.URL)
+// canRetry indicates whether a request refused by GOAWAY
+// before it was processed can be sent again.
+func (t *Transport) canRetry(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if t.RetryUnprocessed {
+		return true
 	}
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
 
-	res, err := conn.RequestResponse(req, t.Receiver, priority)
-	if conn.Closed() {
-		t.connLimit[u.Host] <- struct{}{}
+// canRetryRefused indicates whether req, which failed with
+// err, having already been refused the given number of times,
+// was refused with REFUSED_STREAM and can be retried. As with
+// GOAWAY, requests with a body are only retried if they have
+// GetBody.
+func (t *Transport) canRetryRefused(req *http.Request, err error, refused int) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	var reset *common.StreamResetError
+	if !errors.As(err, &reset) || !reset.Retryable() {
+		return false
+	}
+	limit := t.RefusedRetries
+	if limit == 0 {
+		limit = common.RefusedStreamRetries
+	}
+	return refused < limit
+}
+
+// refusedBackoff waits before retrying a request refused the
+// given number of times, returning early with the request
+// context's error if it is cancelled.
+func (t *Transport) refusedBackoff(req *http.Request, refused int) error {
+	backoff := t.RefusedRetryBackoff
+	if backoff == 0 {
+		backoff = common.RefusedStreamBackoff
+	}
+	timer := time.NewTimer(backoff << uint(refused))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// rewindBody returns a copy of req with a fresh body,
+// so that it can be sent again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
 	}
+	body, err := req.GetBody()
 	if err != nil {
 		return nil, err
 	}
-
-	return res, nil
+	out := *req
+	out.Body = body
+	return &out, nil
 }
 
 func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
@@ -239,12 +553,35 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 
 	// Check the SPDY connection pool.
 	conn, ok := t.spdyConns[u.Host]
+	if conn != nil && !conn.Closed() {
+		if g, isReporter := conn.(GoawayReporter); isReporter && g.GoingAway() {
+			// Leave the session to finish its streams,
+			// but send new requests elsewhere.
+			t.retireConn(u.Host, conn)
+			delete(t.spdyConns, u.Host)
+			ok, conn = false, nil
+		}
+	}
 	if !ok || u.Scheme == "http" || (conn != nil && conn.Closed()) {
-		tcpConn, err := t.dial(req.URL)
+		tcpConn, err := t.dial(req)
 		if err != nil {
 			return nil, nil, err
 		}
 
+		if u.Scheme == "unix" {
+			// Unix domain sockets serve SPDY/3.1 in plaintext.
+			newConn, err := NewClientConn(tcpConn, t.PushReceiver, 3, 1)
+			if err != nil {
+				tcpConn.Close()
+				t.connLimit[u.Host] <- struct{}{}
+				return nil, nil, err
+			}
+			t.configureConn(newConn, u.Host)
+			go newConn.Run()
+			t.spdyConns[u.Host] = newConn
+			return newConn, nil, nil
+		}
+
 		if tlsConn, ok := tcpConn.(*tls.Conn); !ok {
 			// Handle HTTP requests.
 			return nil, tcpConn, nil
@@ -258,6 +595,7 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 				if err != nil {
 					return nil, nil, err
 				}
+				state = tlsConn.ConnectionState()
 			}
 
 			// Verify hostname, unless requested not to.
@@ -274,28 +612,30 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 			}
 
 			// If a protocol could not be negotiated, assume HTTPS.
-			if !state.NegotiatedProtocolIsMutual {
+			proto := negotiatedProtocol(&state)
+			if proto == "" {
 				return nil, tcpConn, nil
 			}
 
 			// Scan the list of supported NPN strings.
 			supported := false
-			for _, proto := range npn() {
-				if state.NegotiatedProtocol == proto {
+			for _, p := range npn() {
+				if proto == p {
 					supported = true
 					break
 				}
 			}
 
 			// Ensure the negotiated protocol is supported.
-			if !supported && state.NegotiatedProtocol != "" {
-				msg := fmt.Sprintf("Error: Unsupported negotiated protocol %q.", state.NegotiatedProtocol)
+			if !supported {
+				msg := fmt.Sprintf("Error: Unsupported negotiated protocol %q.", proto)
 				return nil, nil, errors.New(msg)
 			}
+			t.rememberProtocol(u.Host, proto)
 
 			// Handle the protocol.
-			switch state.NegotiatedProtocol {
-			case "http/1.1", "":
+			switch proto {
+			case "http/1.1":
 				return nil, tcpConn, nil
 
 			case "spdy/3.1":
@@ -303,6 +643,7 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 				if err != nil {
 					return nil, nil, err
 				}
+				t.configureConn(newConn, u.Host)
 				go newConn.Run()
 				t.spdyConns[u.Host] = newConn
 				conn = newConn
@@ -312,6 +653,7 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 				if err != nil {
 					return nil, nil, err
 				}
+				t.configureConn(newConn, u.Host)
 				go newConn.Run()
 				t.spdyConns[u.Host] = newConn
 				conn = newConn
@@ -321,6 +663,7 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 				if err != nil {
 					return nil, nil, err
 				}
+				t.configureConn(newConn, u.Host)
 				go newConn.Run()
 				t.spdyConns[u.Host] = newConn
 				conn = newConn
@@ -330,3 +673,231 @@ func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
 
 	return conn, nil, nil
 }
+
+// DialViaProxy opens a tunnel to address through the SPDY
+// forward proxy at the given URL, with a CONNECT request. The
+// SPDY session to the proxy is shared with other requests, and
+// each tunnel uses its own stream. The returned net.Conn carries
+// the tunnelled bytes, and supports CloseWrite. The proxy must
+// negotiate SPDY/3 or SPDY/3.1.
+func (t *Transport) DialViaProxy(proxy *url.URL, address string) (net.Conn, error) {
+	if proxy == nil || proxy.Host == "" {
+		return nil, errors.New("Error: Incomplete proxy URL.")
+	}
+
+	conn, tcpConn, err := t.process(&http.Request{URL: proxy})
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn != nil {
+		tcpConn.Close()
+		t.releaseConn(proxy.Host)
+		return nil, errors.New("Error: Proxy does not support SPDY.")
+	}
+
+	dialer, ok := conn.(StreamDialer)
+	if !ok {
+		return nil, errors.New("Error: Proxy does not support SPDY/3.")
+	}
+
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Scheme: proxy.Scheme, Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	priority := common.DefaultPriority(request.URL)
+	if t.Priority != nil {
+		priority = t.Priority(request.URL)
+	}
+
+	tunnel, res, err := dialer.Dial(request, priority)
+	if err != nil {
+		if res != nil {
+			return nil, errors.New(fmt.Sprintf("Error: Proxy refused CONNECT with status %d.", res.StatusCode))
+		}
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// configureConn applies the Transport's settings to a new
+// SPDY connection to origin, before it starts running.
+func (t *Transport) configureConn(conn common.Conn, origin string) {
+	if conn, ok := conn.(*spdy3.Conn); ok {
+		conn.PushHandler = t.PushHandler
+		if t.ExpectContinueTimeout > 0 {
+			conn.ExpectContinueTimeout = t.ExpectContinueTimeout
+		}
+		if conn.PushHandler == nil && t.PushCache != nil {
+			conn.PushHandler = t.PushCache
+		}
+		if onSettings := t.OnSettings; onSettings != nil {
+			conn.SettingsHandler = func(settings common.Settings) {
+				onSettings(origin, settings)
+			}
+		}
+		if onGoaway := t.OnGoaway; onGoaway != nil {
+			conn.GoawayHandler = func(lastGoodStreamID common.StreamID, status common.GoawayStatus) {
+				onGoaway(origin, lastGoodStreamID, status)
+			}
+		}
+	}
+	if t.Hints != nil {
+		t.configureHints(conn, origin)
+	}
+}
+
+// configureHints has a new SPDY connection to origin
+// return the settings persisted in the Transport's Hints,
+// and persist any more that the server sends.
+func (t *Transport) configureHints(conn common.Conn, origin string) {
+	var persisted common.Settings
+	if hints, ok := t.Hints.Load(origin); ok {
+		persisted = hints.Settings
+	}
+	persist := func(clearing bool, settings common.Settings) {
+		t.persistSettings(origin, clearing, settings)
+	}
+
+	switch conn := conn.(type) {
+	case *spdy3.Conn:
+		conn.PersistedSettings = persisted
+		conn.PersistSettings = persist
+	case *spdy2.Conn:
+		conn.PersistedSettings = persisted
+		conn.PersistSettings = persist
+	}
+}
+
+// rememberProtocol records the protocol negotiated
+// with origin in the Transport's Hints.
+func (t *Transport) rememberProtocol(origin, proto string) {
+	if t.Hints == nil {
+		return
+	}
+
+	t.hintsLock.Lock()
+	defer t.hintsLock.Unlock()
+	hints, _ := t.Hints.Load(origin)
+	if hints.Protocol == proto {
+		return
+	}
+	hints.Protocol = proto
+	if err := t.Hints.Save(origin, hints); err != nil {
+		log.Printf("Error: Failed to save hints for %s: %v", origin, err)
+	}
+}
+
+// persistSettings updates the settings persisted for
+// origin in the Transport's Hints.
+func (t *Transport) persistSettings(origin string, clearing bool, persist common.Settings) {
+	t.hintsLock.Lock()
+	defer t.hintsLock.Unlock()
+	hints, _ := t.Hints.Load(origin)
+	if clearing || hints.Settings == nil {
+		hints.Settings = make(common.Settings, len(persist))
+	}
+	for id, setting := range persist {
+		hints.Settings[id] = setting
+	}
+	if err := t.Hints.Save(origin, hints); err != nil {
+		log.Printf("Error: Failed to save hints for %s: %v", origin, err)
+	}
+}
+
+// IdleSessions returns the SPDY sessions which currently
+// have no active streams.
+func (t *Transport) IdleSessions() []common.Conn {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	out := make([]common.Conn, 0, len(t.spdyConns))
+	for _, conn := range t.spdyConns {
+		if conn == nil || conn.Closed() {
+			continue
+		}
+		if idler, ok := conn.(Idler); ok && idler.Idle() {
+			out = append(out, conn)
+		}
+	}
+	return out
+}
+
+// CloseIdleConnections closes any connections which were
+// previously connected from previous requests but are now
+// sitting idle. This includes SPDY sessions with no active
+// streams, which are sent a GOAWAY. It does not interrupt
+// any connections currently in use.
+func (t *Transport) CloseIdleConnections() {
+	t.closeConnections(false)
+}
+
+// CloseAll closes every connection held by the Transport,
+// sending a GOAWAY on each SPDY session. Any requests in
+// progress on those sessions will fail.
+func (t *Transport) CloseAll() {
+	t.closeConnections(true)
+}
+
+func (t *Transport) closeConnections(all bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for host, conn := range t.spdyConns {
+		if conn == nil {
+			continue
+		}
+		if !all {
+			if idler, ok := conn.(Idler); !ok || !idler.Idle() {
+				continue
+			}
+		}
+		closed := conn.Closed()
+		conn.Close()
+		delete(t.spdyConns, host)
+		if !closed {
+			t.releaseConn(host)
+		}
+	}
+
+	// Connections in the HTTP pool are idle by definition.
+	for host, connChan := range t.tcpConns {
+	Drain:
+		for {
+			select {
+			case conn := <-connChan:
+				conn.Close()
+				t.releaseConn(host)
+			default:
+				break Drain
+			}
+		}
+	}
+}
+
+// retireConn closes a SPDY session no longer used
+// for new requests once its streams have finished,
+// then frees up its connection slot.
+func (t *Transport) retireConn(host string, conn common.Conn) {
+	if drainer, ok := conn.(Drainer); ok {
+		drainer.Drain()
+	}
+	limit := t.connLimit[host]
+	go func() {
+		<-conn.CloseNotify()
+		select {
+		case limit <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// releaseConn frees up a connection slot for the given
+// host, if one is held.
+func (t *Transport) releaseConn(host string) {
+	select {
+	case t.connLimit[host] <- struct{}{}:
+	default:
+	}
+}
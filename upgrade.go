@@ -0,0 +1,100 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/SlyMarbo/spdy/spdy3"
+)
+
+// Upgrade serves SPDY on conn, an already-accepted connection,
+// using srv to configure the request serving, and returns once
+// the session has ended. Any bytes already read from conn, such
+// as those sniffed to tell SPDY from HTTP/1.1 on a cleartext port,
+// are given in buffered, and are read before the rest of conn.
+// If conn is a TLS connection, its handshake must be complete.
+// conn is closed when Upgrade returns.
+//
+// For example, a front door serving both protocols might use:
+//
+//	start := make([]byte, 1)
+//	if _, err := io.ReadFull(conn, start); err != nil {
+//		// handle error
+//	}
+//	if start[0] == 0x80 { // SPDY control frame.
+//		err = spdy.Upgrade(conn, start, srv, 3, 1)
+//	}
+func Upgrade(conn net.Conn, buffered []byte, srv *http.Server, version, subversion int) error {
+	if conn == nil {
+		return errors.New("Error: Connection initialised with nil net.conn.")
+	}
+	if srv == nil {
+		return errors.New("Error: Connection initialised with nil server.")
+	}
+
+	setState(srv, conn, http.StateNew)
+	defer setState(srv, conn, http.StateClosed)
+	defer conn.Close()
+
+	serverConn, err := NewServerConn(newPrefixedConn(conn, buffered), srv, version, subversion)
+	if err != nil {
+		return err
+	}
+
+	// Report the connection's states against conn, rather
+	// than the wrapper given to the session.
+	if c, ok := serverConn.(*spdy3.Conn); ok && c.ConnState != nil {
+		hook := c.ConnState
+		c.ConnState = func(_ net.Conn, state http.ConnState) {
+			hook(conn, state)
+		}
+	}
+
+	return serverConn.Run()
+}
+
+// prefixedConn is a net.Conn whose reads return buffered
+// before reading from the underlying connection.
+type prefixedConn struct {
+	net.Conn
+	buffered []byte
+}
+
+// tlsPrefixedConn is a prefixedConn over a TLS connection,
+// which keeps the connection state available to the session.
+type tlsPrefixedConn struct {
+	*prefixedConn
+	tlsConn *tls.Conn
+}
+
+func (t *tlsPrefixedConn) ConnectionState() tls.ConnectionState {
+	return t.tlsConn.ConnectionState()
+}
+
+func newPrefixedConn(conn net.Conn, buffered []byte) net.Conn {
+	if len(buffered) == 0 {
+		return conn
+	}
+
+	// Copy the buffer, as the caller may reuse it.
+	p := &prefixedConn{Conn: conn, buffered: append([]byte(nil), buffered...)}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return &tlsPrefixedConn{prefixedConn: p, tlsConn: tlsConn}
+	}
+	return p
+}
+
+func (p *prefixedConn) Read(b []byte) (int, error) {
+	if len(p.buffered) == 0 {
+		return p.Conn.Read(b)
+	}
+	n := copy(b, p.buffered)
+	p.buffered = p.buffered[n:]
+	return n, nil
+}